@@ -136,6 +136,9 @@ func (q *AMQPJobQueue) Jobs(ctx gocontext.Context) (outChan <-chan Job, err erro
 
 				buildJob.startAttributes = startAttrs.Config
 				buildJob.startAttributes.VMType = buildJob.payload.VMType
+				buildJob.startAttributes.Repository = buildJob.payload.Repository.Slug
+				buildJob.startAttributes.Branch = buildJob.payload.Job.Branch
+				buildJob.startAttributes.Commit = buildJob.payload.Job.Commit
 				buildJob.startAttributes.SetDefaults(q.DefaultLanguage, q.DefaultDist, q.DefaultGroup, q.DefaultOS, VMTypeDefault)
 				buildJob.conn = q.conn
 				buildJob.delivery = delivery
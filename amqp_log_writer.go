@@ -90,6 +90,11 @@ func (w *amqpLogWriter) Write(p []byte) (int, error) {
 		return 0, fmt.Errorf("attempted write to closed log")
 	}
 
+	// Empty writes, e.g. keepalives of quiet execs, aren't log activity.
+	if len(p) == 0 {
+		return 0, nil
+	}
+
 	logger := context.LoggerFromContext(w.ctx).WithFields(logrus.Fields{
 		"self": "amqp_log_writer",
 		"inst": fmt.Sprintf("%p", w),
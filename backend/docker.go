@@ -3,17 +3,31 @@ package backend
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	gocontext "context"
 
+	"github.com/cenk/backoff"
 	"github.com/dustin/go-humanize"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/pborman/uuid"
@@ -27,29 +41,223 @@ import (
 )
 
 const (
-	defaultDockerImageSelectorType = "tag"
+	defaultDockerImageSelectorType   = "tag"
+	defaultDockerImageSelectorInfra  = "docker"
+	defaultDockerScriptViaEnvMaxSize = uint64(32 * 1024)
+	defaultDockerTmpTmpfsSize        = uint64(512 * 1024 * 1024)
+	defaultDockerJobTmpfsMaxSize     = uint64(1024 * 1024 * 1024)
+	defaultDockerTmpfsExecPaths      = "/tmp"
+	dockerScriptEnvVar               = "TRAVIS_WORKER_BUILD_SCRIPT"
+	dockerBootstrapScriptPath        = "/usr/local/bin/travis-bootstrap"
+	dockerCgroupRoot                 = "/sys/fs/cgroup"
+	dockerExecCgroupPath             = "/sys/fs/cgroup/travis-build"
+	dockerExecCgroupInitPath         = "/sys/fs/cgroup/init"
+	dockerOutputFifoPath             = "/tmp/travis-build-output"
+	dockerOutputLogsLabel            = "travis-build-output: "
+	dockerMemoryPeakPath             = "/sys/fs/cgroup/memory.peak"
+	dockerSockPath                   = "/var/run/docker.sock"
+	defaultDockerSockMode            = "ro"
+	dockerWorkerVersionLabel         = "travis.worker_version"
+	dockerImageMemoryLabel           = "travis.memory"
+	dockerImageCPUsLabel             = "travis.cpus"
+	dockerStartTimeLabel             = "travis.start_time"
+	dockerCPUSetLabel                = "travis.cpuset"
+	dockerImageLabel                 = "travis.image"
+	dockerMemoryLimitLabel           = "travis.memory_limit"
+	dockerRepositoryLabel            = "travis.repository"
+	dockerBranchLabel                = "travis.branch"
+	dockerCommitLabel                = "travis.commit"
+	defaultDockerSecretsPath         = "/run/travis-secrets"
+	defaultDockerBuildHome           = "/home/travis"
+	defaultDockerSecretsOwner        = "2000:2000"
+	dockerNetworkMTUOption           = "com.docker.network.driver.mtu"
+	defaultDockerSSHAddressTemplate  = "{{.IP}}:22"
 )
 
 var (
-	defaultDockerNumCPUer       dockerNumCPUer = &stdlibNumCPUer{}
-	defaultDockerSSHDialTimeout                = 5 * time.Second
-	defaultExecCmd                             = "bash /home/travis/build.sh"
-	defaultTmpfsMap                            = map[string]string{"/run": "rw,nosuid,nodev,exec,noatime,size=65536k"}
-	dockerHelp                                 = map[string]string{
-		"ENDPOINT / HOST":     "[REQUIRED] tcp or unix address for connecting to Docker",
-		"CERT_PATH":           "directory where ca.pem, cert.pem, and key.pem are located (default \"\")",
-		"CMD":                 "command (CMD) to run when creating containers (default \"/sbin/init\")",
-		"EXEC_CMD":            fmt.Sprintf("command to run via exec/ssh (default %q)", defaultExecCmd),
-		"TMPFS_MAP":           fmt.Sprintf("space-delimited key:value map of tmpfs mounts (default %q)", defaultTmpfsMap),
-		"MEMORY":              "memory to allocate to each container (0 disables allocation, default \"4G\")",
-		"SHM":                 "/dev/shm to allocate to each container (0 disables allocation, default \"64MiB\")",
-		"CPUS":                "cpu count to allocate to each container (0 disables allocation, default 2)",
-		"CPU_SET_SIZE":        "size of available cpu set (default detected locally via runtime.NumCPU)",
-		"NATIVE":              "upload and run build script via docker API instead of over ssh (default false)",
-		"PRIVILEGED":          "run containers in privileged mode (default false)",
-		"SSH_DIAL_TIMEOUT":    fmt.Sprintf("connection timeout for ssh connections (default %v)", defaultDockerSSHDialTimeout),
-		"IMAGE_SELECTOR_TYPE": fmt.Sprintf("image selector type (\"tag\" or \"api\", default %q)", defaultDockerImageSelectorType),
-		"IMAGE_SELECTOR_URL":  "URL for image selector API, used only when image selector is \"api\"",
+	errDockerNoFreeCPUSets = fmt.Errorf("not enough free cpu sets")
+	errDockerJobTmpfs      = fmt.Errorf("invalid tmpfs requested by job")
+	errDockerMacAddress    = fmt.Errorf("invalid mac address")
+	errDockerUploadTimeout = fmt.Errorf("timed out uploading build script")
+	errDockerMemoryBudget  = fmt.Errorf("host memory budget exceeded")
+
+	// ErrPullRateLimited is returned from Start if pulling a missing image
+	// was rate limited by the registry, or still cools down from that.
+	ErrPullRateLimited = fmt.Errorf("image pull rate limited")
+
+	// dockerWorkerVersion is the worker version set at build time, used to
+	// label created containers
+	dockerWorkerVersion = "?"
+
+	defaultDockerNumCPUer                dockerNumCPUer    = &stdlibNumCPUer{}
+	defaultDockerCPUTopology             dockerCPUTopology = &sysfsCPUTopology{}
+	defaultDockerSSHDialTimeout                            = 5 * time.Second
+	defaultDockerIPRetries                                 = uint64(5)
+	defaultDockerIPRetrySleep                              = time.Second
+	defaultDockerSSHAuthGrace                              = 30 * time.Second
+	defaultDockerSSHAuthRetries                            = uint64(5)
+	defaultDockerSSHAuthRetrySleep                         = 2 * time.Second
+	defaultDockerSSHDRestartRetries                        = uint64(2)
+	defaultDockerSSHDRestartSleep                          = time.Second
+	defaultDockerLogsDrainTimeout                          = 2 * time.Second
+	defaultDockerStopPollSleep                             = 500 * time.Millisecond
+	defaultDockerInspectExecRetries                        = uint64(3)
+	defaultDockerInspectExecRetrySleep                     = 500 * time.Millisecond
+	defaultDockerRemoveRetries                             = uint64(3)
+	defaultDockerAuditLogBufferSize                        = 1000
+	defaultDockerRemoveRetrySleep                          = 500 * time.Millisecond
+	defaultDockerCreateFDCooldown                          = 10 * time.Second
+	defaultDockerCreateFDRetries                           = uint64(2)
+	defaultDockerPullRateLimitCooldown                     = 10 * time.Minute
+	defaultDockerPostExecTimeout                           = 10 * time.Second
+	defaultDockerCPUSetSweepInterval                       = time.Minute
+	defaultDockerReadyProbeSleep                           = time.Second
+	defaultDockerBootPollSleep                             = 100 * time.Millisecond
+	defaultDockerEarlyExitWindow                           = 10 * time.Second
+	defaultDockerWarmPoolBootTimeout                       = 5 * time.Minute
+	defaultDockerSelectorURLCheckTimeout                   = 5 * time.Second
+	defaultExecCmd                                         = "bash /home/travis/build.sh"
+	defaultTmpfsMap                                        = map[string]string{"/run": "rw,nosuid,nodev,exec,noatime,size=65536k"}
+
+	// dockerTmpfsOptions maps the recognized tmpfs mount options to whether
+	// they take a value, e.g. "size=64m"
+	dockerTmpfsOptions = map[string]bool{
+		"rw": false, "ro": false,
+		"exec": false, "noexec": false,
+		"suid": false, "nosuid": false,
+		"dev": false, "nodev": false,
+		"sync": false, "async": false, "dirsync": false,
+		"atime": false, "noatime": false,
+		"diratime": false, "nodiratime": false,
+		"relatime": false, "norelatime": false,
+		"strictatime": false, "nostrictatime": false,
+		"mand": false, "nomand": false,
+		"size": true, "mode": true, "uid": true, "gid": true,
+		"nr_inodes": true, "nr_blocks": true, "mpol": true,
+	}
+
+	// dockerDNSOptions maps the recognized resolv.conf options to whether they
+	// take a numeric value, e.g. "ndots:2"
+	dockerDNSOptions = map[string]bool{
+		"ndots": true, "timeout": true, "attempts": true,
+		"debug": false, "rotate": false, "no-check-names": false,
+		"inet6": false, "ip6-bytestring": false, "ip6-dotint": false,
+		"no-ip6-dotint": false, "edns0": false, "single-request": false,
+		"single-request-reopen": false, "no-tld-query": false, "use-vc": false,
+		"no-reload": false, "trust-ad": false,
+	}
+
+	dockerHelp = map[string]string{
+		"CREATE_FD_COOLDOWN":        fmt.Sprintf("time to wait before retrying to create a container after the daemon ran out of file descriptors, doubled for every further retry (default %v)", defaultDockerCreateFDCooldown),
+		"CREATE_FD_RETRIES":         fmt.Sprintf("number of times to retry creating a container after the daemon ran out of file descriptors (default %d)", defaultDockerCreateFDRetries),
+		"PULL_MISSING_IMAGES":       "pull images that creating a container reports as missing from the endpoint and retry, instead of trying the next endpoint (default false)",
+		"PULL_RATE_LIMIT_COOLDOWN":  fmt.Sprintf("time during which missing images aren't pulled after the registry rate limited a pull, failing starts that need one right away (default %v)", defaultDockerPullRateLimitCooldown),
+		"ENDPOINTS":                 "comma-delimited tcp or unix addresses of several docker hosts to spread containers across round-robin, failing over on create errors or when a host has no room, with cpu sets and memory accounted per host (overrides ENDPOINT / HOST)",
+		"ENDPOINT / HOST":           "[REQUIRED] tcp or unix address for connecting to Docker",
+		"ENV_FILE":                  "path of a dotenv-style file of KEY=VALUE lines, with # comments and quoted values, whose variables are set in created containers (default \"\")",
+		"CONTAINER_ENV":             "space-delimited KEY=VALUE variables set in created containers, taking precedence over ENV_FILE (default \"\")",
+		"PROPAGATE_PROXY_ENV":       "set the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables of the worker, in upper or lower case, in created containers unless ENV_FILE or CONTAINER_ENV set them (default false)",
+		"ANNOTATIONS":               "space-delimited key=value annotations attached to created containers as labels, best-effort for daemons such as CRI shims that honor them (default \"\")",
+		"AUDIT_LOG_PATH":            "file to append a JSON line to for every container started and stopped, with its image, cpu set, resources, labels and environment with secret-like values redacted (default \"\", disabled)",
+		"CERT_PATH":                 "directory where ca.pem, cert.pem, and key.pem are located (default \"\")",
+		"BOOTSTRAP_SCRIPT":          fmt.Sprintf("script written to %s in created containers before they are started, inline or read from a file when prefixed with @; the default CMD then runs it before /sbin/init, a custom CMD has to run it itself (default \"\")", dockerBootstrapScriptPath),
+		"CMD":                       "command (CMD) to run when creating containers (default \"/sbin/init\", or running BOOTSTRAP_SCRIPT first when set)",
+		"CMD_BY_IMAGE":              "semicolon-delimited glob=command list of CMDs for images whose name matches the glob, where * doesn't match \"/\", the first match taking precedence over CMD (default \"\")",
+		"CMD_MODE":                  "whether CMD \"replace\"s the CMD of the image or is \"append\"ed to it as extra arguments, in which case it defaults to none (default \"replace\")",
+		"DNS_OPTIONS":               "space-delimited resolv.conf options for containers, e.g. \"ndots:2 timeout:1\" (default \"\")",
+		"EARLY_EXIT_WINDOW":         fmt.Sprintf("window after start in which a container exiting fails the boot with a CMD hint instead of timing out, 0 disables (default %v)", defaultDockerEarlyExitWindow),
+		"WARM_POOL_SIZE":            "number of idle containers of WARM_POOL_IMAGE kept booted to hand out instantly, replenished as they are used (default 0, disabled)",
+		"WARM_POOL_IMAGE":           "image of the warm pool containers, starts for other images, with secrets or a platform, or whose containers LABEL_SOURCE labels, as labels can't be added to existing containers, boot a container as usual (required if WARM_POOL_SIZE is set)",
+		"WAIT_FOR_HEALTHY":          "consider containers of images with a HEALTHCHECK ready once they report healthy instead of once they are running, bounded by the boot timeout (default false)",
+		"READY_PROBE_CMD":           "command exec'd without a tty in booted containers until it exits 0, e.g. \"systemctl is-system-running\", before they are considered ready, bounded by the boot timeout (default \"\", disabled)",
+		"EXEC_RAW_TERMINAL":         "allocate a tty for native execs and copy its raw output, disable for clean LF-only output (default true)",
+		"EXEC_KEEPALIVE_INTERVAL":   "TCP keepalive interval of the connections to the docker daemons and interval at which empty writes, which aren't log activity, are sent down the build output while native execs are quiet, so that proxies with idle timeouts don't drop their streams (default 0, disabled)",
+		"EXEC_CMD":                  fmt.Sprintf("command to run via exec/ssh (default %q, with the build script in BUILD_HOME)", defaultExecCmd),
+		"BUILD_HOME":                fmt.Sprintf("home directory of the build user in the image, which the build script is uploaded to (default %q)", defaultDockerBuildHome),
+		"BUILD_HOME_WORKDIR":        "use BUILD_HOME as the working directory of created containers instead of the image's (default false)",
+		"LOG_EXEC_COMMAND":          "log the command run via exec/ssh at info level, with secret-like values redacted, to debug EXEC_CMD and EXEC_SHELL (default false)",
+		"EXEC_SHELL":                "shell to run EXEC_CMD with as a single quoted argument, e.g. \"bash -lc\" to load the login environment (default \"\", run EXEC_CMD directly)",
+		"EXEC_CGROUP_LIMITS":        fmt.Sprintf("comma-delimited memory, cpus and pids limits, e.g. \"memory=3GiB,cpus=1.5\", of a %s cgroup v2 sub-cgroup the exec'd build is moved into to leave headroom for the rest of the container, with the other processes of the container moved into %s; best-effort, as it needs a writable cgroup filesystem, e.g. with PRIVILEGED, and otherwise runs the build unlimited with a warning (default \"\", disabled)", dockerExecCgroupPath, dockerExecCgroupInitPath),
+		"TMP_TMPFS_SIZE":            fmt.Sprintf("size of the writable tmpfs mounted on /tmp in addition to TMPFS_MAP unless it contains /tmp, 0 disables the mount (default %q)", humanize.IBytes(defaultDockerTmpTmpfsSize)),
+		"TMPFS_MAP":                 fmt.Sprintf("space-delimited key:value map of tmpfs mounts (default %q)", defaultTmpfsMap),
+		"TMPFS_ALLOWED_PATHS":       "space-delimited glob patterns of mount points jobs may request extra tmpfs mounts on, merged over TMPFS_MAP (default none)",
+		"TMPFS_HARDEN":              "mount all tmpfs mounts, including those requested by jobs, nosuid and nodev, and noexec unless they are on TMPFS_EXEC_PATHS (default false)",
+		"TMPFS_EXEC_PATHS":          fmt.Sprintf("space-delimited glob patterns of mount points that keep exec with TMPFS_HARDEN, as builds run binaries from them (default %q)", defaultDockerTmpfsExecPaths),
+		"TMPFS_MAX_SIZE":            fmt.Sprintf("size that tmpfs mounts requested by jobs are capped at (default %q)", humanize.IBytes(defaultDockerJobTmpfsMaxSize)),
+		"MEMORY":                    "memory to allocate to each container (0 disables allocation, default \"4G\")",
+		"SECRETS_PATH":              fmt.Sprintf("path of the tmpfs mount build secrets are written to (default %q)", defaultDockerSecretsPath),
+		"SECRETS_OWNER":             fmt.Sprintf("numeric uid:gid owning build secret files, which are only readable by this owner (default %q)", defaultDockerSecretsOwner),
+		"SHM":                       "/dev/shm to allocate to each container (0 disables allocation, default \"64MiB\")",
+		"SHM_HUGE":                  "back /dev/shm with a tmpfs of SHM bytes using transparent huge pages, \"always\", \"within_size\" or \"advise\", which requires kernel 4.7 or later on the docker host as checked at setup (default \"\", disabled)",
+		"HUGETLBFS_BIND":            "host:container path to bind-mount a hugetlbfs into containers, e.g. \"/dev/hugepages:/dev/hugepages\", where the host path must already be a hugetlbfs mount with pages reserved, which the daemon can't check (default \"\", disabled)",
+		"KERNEL_MEMORY":             "kernel memory limit for each container, only applied on cgroup v1 hosts as cgroup v2 counts kernel memory towards MEMORY (default 0, unset)",
+		"CPUS":                      "cpu count to allocate to each container (0 disables allocation, default 2)",
+		"CPU_RT_RUNTIME":            "microseconds of each CPU_RT_PERIOD that containers may run realtime tasks, which requires a daemon on cgroup v1 started with --cpu-rt-runtime, as checked at setup (default 0, unset)",
+		"CPU_RT_PERIOD":             "realtime scheduling period in microseconds, only used with CPU_RT_RUNTIME (default 0, the daemon's default)",
+		"CPU_SHARES":                "relative cpu weight (shares) to give each container, applied alongside cpu sets (default 0, unset)",
+		"CPU_SET_GRANULARITY":       "unit in which cpu sets are reserved, \"thread\" or \"core\" to reserve sibling threads of whole physical cores together, in which case CPUS counts cores (default \"thread\")",
+		"CPU_SET_LEASE_GRACE":       fmt.Sprintf("time after which cpu sets checked out for containers that neither boot nor are owned by an instance anymore are reclaimed by a background sweeper, as a safety net against leaks, counted from the boot timeout for containers still booting (default 0, disabled)"),
+		"CPU_SET_SIZE":              "size of available cpu set (default detected locally via runtime.NumCPU)",
+		"CPU_SET_ALLOWED":           "cpu list in the kernel's format, e.g. \"2-7,10\", restricting the cpus of the cpu set that are allocated to containers, leaving the others for the host (default all cpus of the cpu set)",
+		"CPU_SET_STRATEGY":          "\"default\" or \"numa-aware\" to also pin the memory of containers to the numa nodes of their cpus via cpuset.mems (default \"default\")",
+		"CPU_SET_ISOLATED_ONLY":     "only allocate cpus the kernel isolates from the scheduler or runs tickless (isolcpus or nohz_full), within CPU_SET_ALLOWED if set, falling back to all cpus with a warning if there are none (default false)",
+		"MOUNT_DOCKER_SOCK":         "bind-mount the host docker socket into containers for docker-in-docker builds, which grants control of the host daemon (default false)",
+		"MOUNT_DOCKER_SOCK_MODE":    fmt.Sprintf("mount mode of the docker socket bind (\"ro\" or \"rw\", default %q)", defaultDockerSockMode),
+		"NETWORK":                   "user-defined bridge network to attach containers to, created on startup if missing (default \"\", the default bridge)",
+		"NETWORK_MTU":               "MTU of the NETWORK bridge, e.g. to match an overlay with reduced MTU, only applied when the worker creates the network, existing networks are left as is (default 0, daemon default)",
+		"NATIVE":                    "upload and run build script via docker API instead of over ssh (default false)",
+		"REMOVE_RETRIES":            fmt.Sprintf("number of times to retry removing a stopped container while the daemon reports it as busy (default %d)", defaultDockerRemoveRetries),
+		"INSPECT_EXEC_RETRIES":      fmt.Sprintf("number of times to retry inspecting a native exec after transient errors (default %d)", defaultDockerInspectExecRetries),
+		"LABEL_WORKER_VERSION":      fmt.Sprintf("label created containers with the worker version as %q (default true)", dockerWorkerVersionLabel),
+		"LABEL_SOURCE":              fmt.Sprintf("label created containers with the repository, branch and commit of the job, if known, as %q, %q and %q (default true)", dockerRepositoryLabel, dockerBranchLabel, dockerCommitLabel),
+		"MAX_CPUS":                  "upper bound for cpus requested via image labels (default CPUS)",
+		"HOST_MEMORY_BUDGET":        "total memory that may be committed to the containers of each docker host, further starts are refused so that the job is rescheduled (default 0, unlimited)",
+		"MEMORY_OVERCOMMIT_RATIO":   "ratio by which HOST_MEMORY_BUDGET is scaled when accounting for committed memory, e.g. 1.5 to pack containers that rarely use all of their memory, without changing their limits (default 1)",
+		"MAX_MEMORY":                "upper bound for memory requested via image labels (default MEMORY)",
+		"METRICS_LABELS":            fmt.Sprintf("label created containers with %q, %q and %q so that cAdvisor/Prometheus metrics can be joined with build metadata (default false)", dockerStartTimeLabel, dockerCPUSetLabel, dockerImageLabel),
+		"METRICS_LABELS_MEMORY":     fmt.Sprintf("additionally label created containers with the allocated memory in bytes as %q, only takes effect if METRICS_LABELS is true (default false)", dockerMemoryLimitLabel),
+		"MAX_CONCURRENT_STARTS":     "maximum number of containers being created and booted at the same time, further starts wait for a slot until their boot timeout (default 0, unlimited)",
+		"MAX_INSTANCE_LIFETIME":     "maximum age of an instance, counted from when it started booting, also in the warm pool, after which it is stopped and removed automatically; warm containers are only handed out with at least half of it left (default 0, disabled)",
+		"OUTPUT_TIMESTAMPS":         "prefix each line of build output with an RFC3339 timestamp (default false)",
+		"OUTPUT_VIA_LOGS":           "stream build output by following container logs instead of the exec stream, relayed into them through a fifo by a root exec and labelled to tell it apart from the output of the main process, only takes effect if NATIVE is true (default false)",
+		"POST_EXEC_CMD":             fmt.Sprintf("cleanup command to run via exec before stopping containers, failing or exceeding %v doesn't block teardown (default \"\", disabled)", defaultDockerPostExecTimeout),
+		"PRIVILEGED":                "run containers in privileged mode (default false)",
+		"REMOVE_VOLUMES":            "remove the anonymous volumes of containers along with them, disable to keep e.g. caches declared as image VOLUMEs for inspection or reuse, named volumes are never removed (default true)",
+		"RESOURCE_PROFILES":         "space-delimited language:key=value,... map overriding MEMORY, CPUS and SHM for jobs of a language via the memory, cpus and shm keys, e.g. \"jvm:memory=6GiB,cpus=3 shell:memory=2GiB\" (default \"\")",
+		"RESPECT_IMAGE_LABELS":      fmt.Sprintf("override MEMORY and CPUS from the %q and %q image labels, bounded by MAX_MEMORY and MAX_CPUS (default false)", dockerImageMemoryLabel, dockerImageCPUsLabel),
+		"RUN_SUMMARY_STATS":         "sample container stats after running the build script to report peak memory in the run summary (default false)",
+		"SCRIPT_VIA_ENV":            "pass small build scripts to the exec via a base64 environment variable instead of uploading them, only takes effect if NATIVE is true (default false)",
+		"ALLOW_SCRIPT_OVERWRITE":    "overwrite an existing build script instead of failing the upload as a stale vm, for setups that reuse containers on purpose (default false)",
+		"SCRIPT_VIA_STDIN":          "write build scripts to the container from the stdin of the exec running them instead of uploading them separately, saving a round-trip to remote docker hosts, only takes effect if NATIVE is true, implies no exec tty (default false)",
+		"SCRIPT_VIA_ENV_MAX_SIZE":   fmt.Sprintf("maximum size of a build script passed via SCRIPT_VIA_ENV, larger scripts are uploaded (default %q)", humanize.IBytes(defaultDockerScriptViaEnvMaxSize)),
+		"UPLOAD_COMPRESS":           "gzip the tar stream of native build script uploads to save bandwidth to remote docker hosts, only takes effect if NATIVE is true (default false)",
+		"UPLOAD_TIMEOUT":            "maximum time to upload the build script via either native or ssh before giving up with an upload timeout, within the worker's own upload timeout (default 0, disabled)",
+		"UPLOAD_PROGRESS_INTERVAL":  "report the progress of native build script uploads as the worker.vm.provider.docker.upload.bytes gauge every so many bytes, to spot stalled uploads (default 0, disabled)",
+		"STOP_REMOVE_WAIT":          "maximum time to wait for a stopped container to exit before removing it (default 0, disabled)",
+		"STOP_MODE":                 "how containers are stopped, \"graceful\"ly with a timeout or by sending STOP_SIGNAL right away with \"kill\", for images whose shutdown hangs (default \"graceful\")",
+		"STOP_SIGNAL":               "signal name or number sent to containers when STOP_MODE is \"kill\" (default \"KILL\")",
+		"SSH_CIPHERS":               "comma-delimited list of ciphers to offer for ssh connections (default library defaults)",
+		"SSH_DIAL_ADDRESS_TEMPLATE": fmt.Sprintf("template of the tcp address ssh connections dial, with the container's .IP and .ID, e.g. to go through a proxy (default %q)", defaultDockerSSHAddressTemplate),
+		"SSH_DIAL_TIMEOUT":          fmt.Sprintf("connection timeout for ssh connections (default %v)", defaultDockerSSHDialTimeout),
+		"SSH_AUTH_GRACE":            fmt.Sprintf("time after a container started within which failing ssh authentication is retried, as its users may still be set up (default %v)", defaultDockerSSHAuthGrace),
+		"SSH_AUTH_RETRIES":          fmt.Sprintf("number of times to retry failing ssh authentication within SSH_AUTH_GRACE (default %d)", defaultDockerSSHAuthRetries),
+		"SSH_IP_RETRIES":            fmt.Sprintf("number of times to re-inspect a container without an IP address before giving up on ssh connections, for network modes that assign it late (default %d)", defaultDockerIPRetries),
+		"SSHD_RESTART_CMD":          "command exec'd without a tty as the build user, e.g. \"sudo service ssh restart\", to restart sshd when ssh connections are refused, in case it died mid-build (default \"\", disabled)",
+		"SSHD_RESTART_RETRIES":      fmt.Sprintf("number of times sshd is restarted via SSHD_RESTART_CMD before a refused ssh connection fails (default %d)", defaultDockerSSHDRestartRetries),
+		"SSH_KEX":                   "comma-delimited list of key exchange algorithms to offer for ssh connections (default library defaults)",
+		"SSH_MACS":                  "comma-delimited list of MAC algorithms to offer for ssh connections (default library defaults)",
+		"IMAGE_CACHE_TTL":           "time for which images found on a docker host are remembered instead of listing images for every container, invalidated when creating a container reports the image as missing (default 0, disabled)",
+		"IMAGE_SELECTOR_MISS_TTL":   "time for which a language the image selector returned no image for fails without querying the selector again (default 0, disabled)",
+		"IMAGE_SELECTOR_TYPE":       fmt.Sprintf("image selector type (\"tag\" or \"api\", default %q)", defaultDockerImageSelectorType),
+		"IMAGE_SELECTOR_INFRA":      fmt.Sprintf("infra passed to the image selector, e.g. to tell docker variants apart in a shared selector API (default %q)", defaultDockerImageSelectorInfra),
+		"PRELOAD_IMAGE":             "image used for every container instead of selecting one, resolved to its id once at setup and again only when creating a container reports it as missing",
+		"IMAGE_SELECTION_FORMAT":    "order of a selection of both image id and name separated by \";\", \"id-name\" or \"name-id\" (default \"id-name\")",
+		"IMAGE_SELECTOR_URL":        "URL for image selector API, used only when image selector is \"api\"",
+		"VALIDATE_SELECTOR_URL":     fmt.Sprintf("check at setup that IMAGE_SELECTOR_URL answers within %v, to fail early on misconfiguration (default false)", defaultDockerSelectorURLCheckTimeout),
+		"CGROUPNS_MODE":             "cgroup namespace mode of containers, \"host\" or \"private\", which some systemd-based images need (default \"\", daemon default)",
+		"PLATFORM":                  "platform (os/arch[/variant]) to request when creating containers, overridable per job (default host platform)",
+		"MAC_ADDRESS":               "mac address of created containers, e.g. for license-bound test suites, overridable per job with MAC_ADDRESS_ALLOWED (default assigned by the daemon)",
+		"MAC_ADDRESS_ALLOWED":       "space-delimited mac addresses jobs may request for their containers (default none, jobs can't set one)",
 	}
 )
 
@@ -67,44 +275,372 @@ func (nc *stdlibNumCPUer) NumCPU() int {
 	return runtime.NumCPU()
 }
 
+type dockerCPUTopology interface {
+	// ThreadSiblings returns the cpus sharing a physical core with the given
+	// cpu, including the cpu itself.
+	ThreadSiblings(cpu int) ([]int, error)
+
+	// IsolatedCPUs returns the cpus isolated from the scheduler or running
+	// tickless, which may be none.
+	IsolatedCPUs() ([]int, error)
+
+	// NUMANode returns the numa node the given cpu belongs to.
+	NUMANode(cpu int) (int, error)
+}
+
+type sysfsCPUTopology struct{}
+
+func (t *sysfsCPUTopology) ThreadSiblings(cpu int) ([]int, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/topology/thread_siblings_list", cpu))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCPUList(strings.TrimSpace(string(b)))
+}
+
+// IsolatedCPUs reads the isolated and nohz_full cpus from sysfs, falling back
+// to the kernel command line on kernels without the sysfs files.
+func (t *sysfsCPUTopology) IsolatedCPUs() ([]int, error) {
+	cpus := []int{}
+
+	for _, name := range []string{"isolated", "nohz_full"} {
+		b, err := ioutil.ReadFile("/sys/devices/system/cpu/" + name)
+		if os.IsNotExist(err) {
+			cmdline, err := ioutil.ReadFile("/proc/cmdline")
+			if err != nil {
+				return nil, err
+			}
+			return parseIsolatedCPUsFromCmdline(string(cmdline))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// nohz_full reads "(null)" if no cpus are tickless
+		list := strings.TrimSpace(string(b))
+		if list == "" || list == "(null)" {
+			continue
+		}
+
+		listCPUs, err := parseCPUList(list)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cpu list in %s", name)
+		}
+		cpus = append(cpus, listCPUs...)
+	}
+
+	return cpus, nil
+}
+
+// NUMANode finds the node the cpu is linked to in sysfs, assuming node 0 on
+// kernels built without numa support.
+func (t *sysfsCPUTopology) NUMANode(cpu int) (int, error) {
+	matches, err := filepath.Glob(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/node[0-9]*", cpu))
+	if err != nil {
+		return 0, err
+	}
+	if len(matches) == 0 {
+		return 0, nil
+	}
+
+	node, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(matches[0]), "node"), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid numa node of cpu %d", cpu)
+	}
+
+	return int(node), nil
+}
+
+// parseIsolatedCPUsFromCmdline parses the cpu lists of the isolcpus and
+// nohz_full kernel parameters, skipping the flags isolcpus may start with,
+// e.g. "isolcpus=domain,managed_irq,2-5".
+func parseIsolatedCPUsFromCmdline(cmdline string) ([]int, error) {
+	cpus := []int{}
+
+	for _, param := range strings.Fields(cmdline) {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 || (parts[0] != "isolcpus" && parts[0] != "nohz_full") {
+			continue
+		}
+
+		list := []string{}
+		for _, item := range strings.Split(parts[1], ",") {
+			if item != "" && item[0] >= '0' && item[0] <= '9' {
+				list = append(list, item)
+			}
+		}
+		if len(list) == 0 {
+			continue
+		}
+
+		listCPUs, err := parseCPUList(strings.Join(list, ","))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cpu list in %s", param)
+		}
+		cpus = append(cpus, listCPUs...)
+	}
+
+	return cpus, nil
+}
+
+// parseCPUList parses a cpu list in the kernel's format, e.g. "0,4" or "0-1"
+func parseCPUList(s string) ([]int, error) {
+	cpus := []int{}
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+
+		first, err := strconv.ParseUint(bounds[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if last < first {
+			return nil, fmt.Errorf("invalid cpu range %q", part)
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, int(cpu))
+		}
+	}
+
+	return cpus, nil
+}
+
 type dockerProvider struct {
-	client         *docker.Client
+	client         dockerClient
+	clients        []dockerClient
+	clientIndex    uint64
 	sshDialer      ssh.Dialer
 	sshDialTimeout time.Duration
+	sshAddress     *template.Template
+	sshNeedsIP     bool
+	sshAuthGrace   time.Duration
+	sshAuthRetries uint64
+	sshdRestartCmd []string
+	sshdRestarts   uint64
+	ipRetries      uint64
+
+	runPrivileged  bool
+	runCmd         []string
+	runCmdAppend   bool
+	runCmdByImage  []dockerImageCmd
+	runBootstrap   []byte
+	runMemory      uint64
+	runShm         uint64
+	runProfiles    map[string]dockerResourceProfile
+	runKernelMem   uint64
+	runCPUs        int
+	runCPUShares   int64
+	cpuRTRuntime   int64
+	cpuRTPeriod    int64
+	maxMemory      uint64
+	memoryBudget   uint64
+	maxCPUs        int
+	annotations    map[string]string
+	dockerSockBind string
+	runNative      bool
+	runPlatform    string
+	runMacAddress  string
+	macAllowed     map[string]bool
+	outputViaLogs  bool
+	maxLifetime    time.Duration
+	stopWait       time.Duration
+	execCmd        []string
+	buildHome      string
+	buildWorkdir   bool
+	execShell      []string
+	execCgroup     dockerExecCgroupLimits
+	postExecCmd    []string
+	tmpFs          map[string]string
+	tmpFsAllowed   []string
+	tmpFsMaxSize   uint64
+	tmpFsHarden    bool
+	tmpFsExec      []string
+	containerEnv   []string
+	dnsOptions     []string
+	cgroupnsMode   string
+	networkName    string
+	networkMTU     int
+	hugetlbfsBind  string
+	shmHuge        string
+	labelVersion   bool
+	labelSource    bool
+	labelMetrics   bool
+	labelMemory    bool
+	secretsPath    string
+	secretsUID     int
+	secretsGID     int
+	imageSelector  image.Selector
+	imageInfra     string
+	selectorURL    string
+	imageNameFirst bool
+
+	imageCacheTTL   time.Duration
+	imageCacheMutex sync.Mutex
+	imageCache      map[string]dockerImageCacheEntry
+	imageMissTTL    time.Duration
+	imageMisses     map[string]time.Time
+
+	preloadImage      string
+	preloadImageMutex sync.Mutex
+	preloadImageIDs   map[string]string
 
-	runPrivileged bool
-	runCmd        []string
-	runMemory     uint64
-	runShm        uint64
-	runCPUs       int
-	runNative     bool
-	execCmd       []string
-	tmpFs         map[string]string
-	imageSelector image.Selector
+	respectImageLabels bool
 
-	cpuSetsMutex sync.Mutex
-	cpuSets      []bool
+	execRawTerminal     bool
+	logExecCommand      bool
+	outputTimestamps    bool
+	runSummaryStats     bool
+	scriptViaEnv        bool
+	scriptViaEnvMaxSize uint64
+	scriptViaStdin      bool
+	scriptOverwrite     bool
+	uploadCompress      bool
+	uploadProgressEvery uint64
+	uploadTimeout       time.Duration
+	inspectExecRetries  uint64
+	execKeepalive       time.Duration
+	earlyExitWindow     time.Duration
+	waitForHealthy      bool
+	readyProbeCmd       []string
+	stopKill            bool
+	stopSignal          docker.Signal
+	removeVolumes       bool
+	removeRetries       uint64
+	createFDCooldown    time.Duration
+	createFDRetries     uint64
+	auditLog            *dockerAuditLog
+
+	pullMissingImages     bool
+	pullRateLimitCooldown time.Duration
+	pullMutex             sync.Mutex
+	pullLimitedUntil      map[string]time.Time
+
+	cgroupVersionsMutex sync.Mutex
+	cgroupVersions      map[string]int
+
+	daemonVersionsMutex sync.Mutex
+	daemonVersions      map[string]string
+
+	startSlots chan struct{}
+
+	warmPoolSize    int
+	warmPoolImage   string
+	warmPoolMutex   sync.Mutex
+	warmPool        []*dockerInstance
+	warmPoolBooting int
+
+	// The cpu sets and memory handed out are accounted for per endpoint, as
+	// each endpoint is a host of its own.
+	memoryMutex     sync.Mutex
+	memoryCommitted map[string]uint64
+
+	cpuSetsMutex  sync.Mutex
+	cpuSetSize    int
+	cpuSets       map[string][]bool
+	cpuBooting    map[string][]time.Time
+	cpuLeases     map[string][]time.Time
+	cpuLeaseGrace time.Duration
+	cpuAllowed    []bool
+	cpuCores      [][]int
+	cpuNodes      []int
+
+	instancesMutex sync.Mutex
+	instances      map[string]*dockerInstance
+	starting       int
+	draining       bool
+	drained        chan struct{}
 }
 
 type dockerInstance struct {
-	client       *docker.Client
+	client       dockerClient
 	provider     *dockerProvider
 	container    *docker.Container
 	startBooting time.Time
 
 	imageName string
 	runNative bool
+
+	// cpuSet is set once at boot, as the cpu set sweep reads it
+	// concurrently with the instance running its job.
+	cpuSet string
+
+	// stateMutex guards the State and NetworkSettings of container, which
+	// Refresh updates while Stop, DebugInfo and WatchEvents may be using
+	// the container. The container itself is never replaced.
+	stateMutex sync.Mutex
+
+	memory        uint64
+	scriptEnv     string
+	scriptStdin   []byte
+	lifetimeTimer *time.Timer
+	stopMutex     sync.Mutex
+	paused        bool
+
+	// A Stop that fails leaves the instance to be stopped again, but only
+	// stops the container and releases its resources once.
+	halted   bool
+	released bool
+	stopped  bool
+}
+
+type dockerImageCacheEntry struct {
+	id      string
+	expires time.Time
+}
+
+// dockerClient is the part of *docker.Client used by the provider and its
+// instances, so that tests can use a fake instead of a daemon.
+type dockerClient interface {
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error)
+	CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error)
+	CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error)
+	DownloadFromContainer(id string, opts docker.DownloadFromContainerOptions) error
+	Endpoint() string
+	Info() (*docker.DockerInfo, error)
+	InspectContainer(id string) (*docker.Container, error)
+	InspectExec(id string) (*docker.ExecInspect, error)
+	InspectImage(name string) (*docker.Image, error)
+	KillContainer(opts docker.KillContainerOptions) error
+	ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error)
+	PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error
+	Logs(opts docker.LogsOptions) error
+	NetworkInfo(id string) (*docker.Network, error)
+	PauseContainer(id string) error
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
+	RenameContainer(opts docker.RenameContainerOptions) error
+	StartContainer(id string, hostConfig *docker.HostConfig) error
+	StartExec(id string, opts docker.StartExecOptions) error
+	Stats(opts docker.StatsOptions) error
+	StopContainer(id string, timeout uint) error
+	UnpauseContainer(id string) error
+	UploadToContainer(id string, opts docker.UploadToContainerOptions) error
+	Version() (*docker.Env, error)
+	WaitContainerWithContext(id string, ctx gocontext.Context) (int, error)
 }
 
 type dockerTagImageSelector struct {
-	client *docker.Client
+	clients []dockerClient
 }
 
 func newDockerProvider(cfg *config.ProviderConfig) (Provider, error) {
-	client, err := buildDockerClient(cfg)
+	clients, err := buildDockerClients(cfg)
 	if err != nil {
 		return nil, err
 	}
+	client := clients[0]
 
 	runNative := false
 	if cfg.IsSet("NATIVE") {
@@ -116,510 +652,5439 @@ func newDockerProvider(cfg *config.ProviderConfig) (Provider, error) {
 		runNative = v
 	}
 
-	cpuSetSize := 0
+	execRawTerminal := true
+	if cfg.IsSet("EXEC_RAW_TERMINAL") {
+		v, err := strconv.ParseBool(cfg.Get("EXEC_RAW_TERMINAL"))
+		if err != nil {
+			return nil, err
+		}
 
-	if defaultDockerNumCPUer != nil {
-		cpuSetSize = defaultDockerNumCPUer.NumCPU()
+		execRawTerminal = v
 	}
 
-	if cfg.IsSet("CPU_SET_SIZE") {
-		v, err := strconv.ParseInt(cfg.Get("CPU_SET_SIZE"), 10, 64)
+	logExecCommand := false
+	if cfg.IsSet("LOG_EXEC_COMMAND") {
+		logExecCommand, err = strconv.ParseBool(cfg.Get("LOG_EXEC_COMMAND"))
 		if err != nil {
 			return nil, err
 		}
-		cpuSetSize = int(v)
 	}
 
-	if cpuSetSize < 2 {
-		cpuSetSize = 2
+	outputViaLogs := false
+	if cfg.IsSet("OUTPUT_VIA_LOGS") {
+		v, err := strconv.ParseBool(cfg.Get("OUTPUT_VIA_LOGS"))
+		if err != nil {
+			return nil, err
+		}
+
+		outputViaLogs = v
 	}
 
-	privileged := false
-	if cfg.IsSet("PRIVILEGED") {
-		v, err := strconv.ParseBool(cfg.Get("PRIVILEGED"))
+	outputTimestamps := false
+	if cfg.IsSet("OUTPUT_TIMESTAMPS") {
+		v, err := strconv.ParseBool(cfg.Get("OUTPUT_TIMESTAMPS"))
 		if err != nil {
 			return nil, err
 		}
-		privileged = v
-	}
 
-	cmd := []string{"/sbin/init"}
-	if cfg.IsSet("CMD") {
-		cmd = strings.Split(cfg.Get("CMD"), " ")
+		outputTimestamps = v
 	}
 
-	execCmd := strings.Split(defaultExecCmd, " ")
-	if cfg.IsSet("EXEC_CMD") {
-		execCmd = strings.Split(cfg.Get("EXEC_CMD"), " ")
+	runSummaryStats := false
+	if cfg.IsSet("RUN_SUMMARY_STATS") {
+		v, err := strconv.ParseBool(cfg.Get("RUN_SUMMARY_STATS"))
+		if err != nil {
+			return nil, err
+		}
+
+		runSummaryStats = v
 	}
 
-	tmpFs := str2map(cfg.Get("TMPFS_MAP"))
-	if len(tmpFs) == 0 {
-		tmpFs = defaultTmpfsMap
+	scriptViaEnv := false
+	if cfg.IsSet("SCRIPT_VIA_ENV") {
+		v, err := strconv.ParseBool(cfg.Get("SCRIPT_VIA_ENV"))
+		if err != nil {
+			return nil, err
+		}
+
+		scriptViaEnv = v
 	}
 
-	memory := uint64(1024 * 1024 * 1024 * 4)
-	if cfg.IsSet("MEMORY") {
-		if parsedMemory, err := humanize.ParseBytes(cfg.Get("MEMORY")); err == nil {
-			memory = parsedMemory
+	scriptViaStdin := false
+	if cfg.IsSet("SCRIPT_VIA_STDIN") {
+		scriptViaStdin, err = strconv.ParseBool(cfg.Get("SCRIPT_VIA_STDIN"))
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	shm := uint64(1024 * 1024 * 64)
-	if cfg.IsSet("SHM") {
-		if parsedShm, err := humanize.ParseBytes(cfg.Get("SHM")); err == nil {
-			shm = parsedShm
+	scriptOverwrite := false
+	if cfg.IsSet("ALLOW_SCRIPT_OVERWRITE") {
+		scriptOverwrite, err = strconv.ParseBool(cfg.Get("ALLOW_SCRIPT_OVERWRITE"))
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	cpus := uint64(2)
-	if cfg.IsSet("CPUS") {
-		if parsedCPUs, err := strconv.ParseUint(cfg.Get("CPUS"), 10, 64); err == nil {
-			cpus = parsedCPUs
+	scriptViaEnvMaxSize := defaultDockerScriptViaEnvMaxSize
+	if cfg.IsSet("SCRIPT_VIA_ENV_MAX_SIZE") {
+		scriptViaEnvMaxSize, err = humanize.ParseBytes(cfg.Get("SCRIPT_VIA_ENV_MAX_SIZE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid SCRIPT_VIA_ENV_MAX_SIZE")
 		}
 	}
 
-	sshDialTimeout := defaultDockerSSHDialTimeout
-	if cfg.IsSet("SSH_DIAL_TIMEOUT") {
-		sshDialTimeout, err = time.ParseDuration(cfg.Get("SSH_DIAL_TIMEOUT"))
+	uploadCompress := false
+	if cfg.IsSet("UPLOAD_COMPRESS") {
+		uploadCompress, err = strconv.ParseBool(cfg.Get("UPLOAD_COMPRESS"))
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	sshDialer, err := ssh.NewDialerWithPassword("travis")
-	if err != nil {
-		return nil, errors.Wrap(err, "couldn't create SSH dialer")
+	uploadProgressEvery := uint64(0)
+	if cfg.IsSet("UPLOAD_PROGRESS_INTERVAL") {
+		uploadProgressEvery, err = humanize.ParseBytes(cfg.Get("UPLOAD_PROGRESS_INTERVAL"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid UPLOAD_PROGRESS_INTERVAL")
+		}
 	}
 
-	imageSelectorType := defaultDockerImageSelectorType
-	if cfg.IsSet("IMAGE_SELECTOR_TYPE") {
-		imageSelectorType = cfg.Get("IMAGE_SELECTOR_TYPE")
+	uploadTimeout := time.Duration(0)
+	if cfg.IsSet("UPLOAD_TIMEOUT") {
+		uploadTimeout, err = time.ParseDuration(cfg.Get("UPLOAD_TIMEOUT"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid UPLOAD_TIMEOUT")
+		}
 	}
 
-	if imageSelectorType != "tag" && imageSelectorType != "api" {
-		return nil, fmt.Errorf("invalid image selector type %q", imageSelectorType)
+	inspectExecRetries := defaultDockerInspectExecRetries
+	if cfg.IsSet("INSPECT_EXEC_RETRIES") {
+		inspectExecRetries, err = strconv.ParseUint(cfg.Get("INSPECT_EXEC_RETRIES"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	imageSelector, err := buildDockerImageSelector(imageSelectorType, client, cfg)
-	if err != nil {
-		return nil, errors.Wrap(err, "couldn't build docker image selector")
+	execKeepalive := time.Duration(0)
+	if cfg.IsSet("EXEC_KEEPALIVE_INTERVAL") {
+		execKeepalive, err = time.ParseDuration(cfg.Get("EXEC_KEEPALIVE_INTERVAL"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid EXEC_KEEPALIVE_INTERVAL")
+		}
 	}
 
-	return &dockerProvider{
-		client:         client,
-		sshDialer:      sshDialer,
-		sshDialTimeout: sshDialTimeout,
+	if execKeepalive > 0 {
+		for _, client := range clients {
+			if dc, ok := client.(*docker.Client); ok {
+				setDockerClientKeepalive(dc, execKeepalive)
+			}
+		}
+	}
 
-		runPrivileged: privileged,
-		runCmd:        cmd,
-		runMemory:     memory,
-		runShm:        shm,
-		runCPUs:       int(cpus),
-		runNative:     runNative,
-		imageSelector: imageSelector,
+	cpuSetSize := 0
 
-		execCmd: execCmd,
-		tmpFs:   tmpFs,
+	if defaultDockerNumCPUer != nil {
+		cpuSetSize = defaultDockerNumCPUer.NumCPU()
+	}
 
-		cpuSets: make([]bool, cpuSetSize),
-	}, nil
-}
+	if cfg.IsSet("CPU_SET_SIZE") {
+		v, err := strconv.ParseInt(cfg.Get("CPU_SET_SIZE"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cpuSetSize = int(v)
+	}
 
-func buildDockerClient(cfg *config.ProviderConfig) (*docker.Client, error) {
-	// check for both DOCKER_ENDPOINT and DOCKER_HOST, the latter for
-	// compatibility with docker's own env vars.
-	if !cfg.IsSet("ENDPOINT") && !cfg.IsSet("HOST") {
-		return nil, ErrMissingEndpointConfig
+	if cpuSetSize < 2 {
+		cpuSetSize = 2
 	}
 
-	endpoint := cfg.Get("ENDPOINT")
-	if endpoint == "" {
-		endpoint = cfg.Get("HOST")
+	cpuLeaseGrace := time.Duration(0)
+	if cfg.IsSet("CPU_SET_LEASE_GRACE") {
+		cpuLeaseGrace, err = time.ParseDuration(cfg.Get("CPU_SET_LEASE_GRACE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CPU_SET_LEASE_GRACE")
+		}
 	}
 
-	if cfg.IsSet("CERT_PATH") {
-		path := cfg.Get("CERT_PATH")
-		ca := fmt.Sprintf("%s/ca.pem", path)
-		cert := fmt.Sprintf("%s/cert.pem", path)
-		key := fmt.Sprintf("%s/key.pem", path)
-		return docker.NewTLSClient(endpoint, cert, key, ca)
+	var cpuAllowed []bool
+	if cfg.IsSet("CPU_SET_ALLOWED") {
+		cpuAllowed, err = buildDockerCPUAllowed(cfg.Get("CPU_SET_ALLOWED"), cpuSetSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CPU_SET_ALLOWED")
+		}
 	}
 
-	return docker.NewClient(endpoint)
-}
+	if cfg.IsSet("CPU_SET_ISOLATED_ONLY") {
+		isolatedOnly, err := strconv.ParseBool(cfg.Get("CPU_SET_ISOLATED_ONLY"))
+		if err != nil {
+			return nil, err
+		}
 
-func buildDockerImageSelector(selectorType string, client *docker.Client, cfg *config.ProviderConfig) (image.Selector, error) {
-	switch selectorType {
-	case "tag":
-		return &dockerTagImageSelector{client: client}, nil
-	case "api":
-		baseURL, err := url.Parse(cfg.Get("IMAGE_SELECTOR_URL"))
+		if isolatedOnly {
+			cpuAllowed, err = restrictDockerCPUAllowedToIsolated(cpuAllowed, cpuSetSize)
+			if err != nil {
+				return nil, errors.Wrap(err, "couldn't read isolated cpus")
+			}
+		}
+	}
+
+	var cpuCores [][]int
+	switch cfg.Get("CPU_SET_GRANULARITY") {
+	case "", "thread":
+	case "core":
+		cpuCores, err = buildDockerCPUCores(cpuSetSize)
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to parse image selector URL")
+			return nil, errors.Wrap(err, "couldn't read cpu topology")
 		}
-		return image.NewAPISelector(baseURL), nil
 	default:
-		return nil, fmt.Errorf("invalid image selector type %q", selectorType)
+		return nil, fmt.Errorf("invalid cpu set granularity %q", cfg.Get("CPU_SET_GRANULARITY"))
 	}
-}
 
-func dockerImageIDNameFromSelection(selection string) (string, string) {
-	parts := strings.SplitN(strings.TrimSpace(selection), ";", 2)
-	if len(parts) == 2 {
-		return parts[0], parts[1]
+	var cpuNodes []int
+	switch cfg.Get("CPU_SET_STRATEGY") {
+	case "", "default":
+	case "numa-aware":
+		cpuNodes, err = buildDockerCPUNodes(cpuSetSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't read numa topology")
+		}
+	default:
+		return nil, fmt.Errorf("invalid cpu set strategy %q", cfg.Get("CPU_SET_STRATEGY"))
+	}
+
+	privileged := false
+	if cfg.IsSet("PRIVILEGED") {
+		v, err := strconv.ParseBool(cfg.Get("PRIVILEGED"))
+		if err != nil {
+			return nil, err
+		}
+		privileged = v
+	}
+
+	cmdAppend := false
+	switch cfg.Get("CMD_MODE") {
+	case "", "replace":
+	case "append":
+		cmdAppend = true
+	default:
+		return nil, fmt.Errorf("invalid cmd mode %q", cfg.Get("CMD_MODE"))
+	}
+
+	var bootstrapScript []byte
+	if cfg.IsSet("BOOTSTRAP_SCRIPT") {
+		bootstrapScript = []byte(cfg.Get("BOOTSTRAP_SCRIPT"))
+		if strings.HasPrefix(cfg.Get("BOOTSTRAP_SCRIPT"), "@") {
+			bootstrapScript, err = ioutil.ReadFile(strings.TrimPrefix(cfg.Get("BOOTSTRAP_SCRIPT"), "@"))
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid BOOTSTRAP_SCRIPT")
+			}
+		}
+	}
+
+	cmd := []string{"/sbin/init"}
+	if len(bootstrapScript) > 0 {
+		cmd = []string{"/bin/sh", "-c", fmt.Sprintf("/bin/sh %s && exec /sbin/init", dockerBootstrapScriptPath)}
+	}
+	if cmdAppend {
+		cmd = []string{}
+	}
+	if cfg.IsSet("CMD") {
+		cmd = strings.Split(cfg.Get("CMD"), " ")
+	}
+
+	cmdByImage, err := parseDockerCmdByImage(cfg.Get("CMD_BY_IMAGE"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid CMD_BY_IMAGE")
+	}
+
+	buildHome := defaultDockerBuildHome
+	if cfg.IsSet("BUILD_HOME") {
+		buildHome = path.Clean(cfg.Get("BUILD_HOME"))
+		if !path.IsAbs(buildHome) {
+			return nil, fmt.Errorf("invalid BUILD_HOME %q: not an absolute path", cfg.Get("BUILD_HOME"))
+		}
+	}
+
+	buildWorkdir := false
+	if cfg.IsSet("BUILD_HOME_WORKDIR") {
+		buildWorkdir, err = strconv.ParseBool(cfg.Get("BUILD_HOME_WORKDIR"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	execCmd := strings.Split(defaultExecCmd, " ")
+	if buildHome != defaultDockerBuildHome {
+		execCmd = []string{"bash", path.Join(buildHome, "build.sh")}
+	}
+	if cfg.IsSet("EXEC_CMD") {
+		execCmd = strings.Split(cfg.Get("EXEC_CMD"), " ")
+	}
+
+	execShell := strings.Fields(cfg.Get("EXEC_SHELL"))
+
+	execCgroup, err := parseDockerExecCgroupLimits(cfg.Get("EXEC_CGROUP_LIMITS"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid EXEC_CGROUP_LIMITS")
+	}
+
+	var postExecCmd []string
+	if cfg.IsSet("POST_EXEC_CMD") {
+		postExecCmd = strings.Split(cfg.Get("POST_EXEC_CMD"), " ")
+	}
+
+	tmpFs, err := normalizeDockerTmpfsMap(str2map(cfg.Get("TMPFS_MAP")))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid TMPFS_MAP")
+	}
+	if len(tmpFs) == 0 {
+		tmpFs = map[string]string{}
+		for mountPoint, opts := range defaultTmpfsMap {
+			tmpFs[mountPoint] = opts
+		}
+	}
+
+	tmpTmpfsSize := defaultDockerTmpTmpfsSize
+	if cfg.IsSet("TMP_TMPFS_SIZE") {
+		tmpTmpfsSize, err = humanize.ParseBytes(cfg.Get("TMP_TMPFS_SIZE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid TMP_TMPFS_SIZE")
+		}
+	}
+
+	tmpFsAllowed := strings.Fields(cfg.Get("TMPFS_ALLOWED_PATHS"))
+	for _, pattern := range tmpFsAllowed {
+		if !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("invalid TMPFS_ALLOWED_PATHS: %q is not an absolute path", pattern)
+		}
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, errors.Wrapf(err, "invalid TMPFS_ALLOWED_PATHS pattern %q", pattern)
+		}
+	}
+
+	tmpFsMaxSize := defaultDockerJobTmpfsMaxSize
+	if cfg.IsSet("TMPFS_MAX_SIZE") {
+		tmpFsMaxSize, err = humanize.ParseBytes(cfg.Get("TMPFS_MAX_SIZE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid TMPFS_MAX_SIZE")
+		}
+		if tmpFsMaxSize == 0 {
+			return nil, fmt.Errorf("invalid TMPFS_MAX_SIZE: must be greater than 0")
+		}
+	}
+
+	// An explicit /tmp in TMPFS_MAP takes precedence. The size is rounded up
+	// to whole KiB, as a size of 0 would make the tmpfs unlimited.
+	if _, ok := tmpFs["/tmp"]; !ok && tmpTmpfsSize > 0 {
+		tmpFs["/tmp"] = fmt.Sprintf("rw,nosuid,nodev,exec,mode=1777,size=%dk", (tmpTmpfsSize+1023)/1024)
+	}
+
+	memory := uint64(1024 * 1024 * 1024 * 4)
+	if cfg.IsSet("MEMORY") {
+		memory, err = humanize.ParseBytes(cfg.Get("MEMORY"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid MEMORY")
+		}
+	}
+
+	shm := uint64(1024 * 1024 * 64)
+	if cfg.IsSet("SHM") {
+		shm, err = humanize.ParseBytes(cfg.Get("SHM"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid SHM")
+		}
+	}
+
+	// A mount at /dev/shm replaces the one docker would create with ShmSize.
+	shmHuge := cfg.Get("SHM_HUGE")
+	switch shmHuge {
+	case "":
+	case "always", "within_size", "advise":
+		if shm == 0 {
+			return nil, fmt.Errorf("SHM_HUGE requires a SHM size")
+		}
+		if _, ok := tmpFs["/dev/shm"]; ok {
+			return nil, fmt.Errorf("SHM_HUGE conflicts with /dev/shm in TMPFS_MAP")
+		}
+
+		tmpFs["/dev/shm"] = fmt.Sprintf("rw,nosuid,nodev,noexec,size=%dk,huge=%s", (shm+1023)/1024, shmHuge)
+		shm = 0
+	default:
+		return nil, fmt.Errorf("invalid SHM_HUGE %q", shmHuge)
+	}
+
+	tmpFsHarden := false
+	if cfg.IsSet("TMPFS_HARDEN") {
+		tmpFsHarden, err = strconv.ParseBool(cfg.Get("TMPFS_HARDEN"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tmpFsExec := strings.Fields(defaultDockerTmpfsExecPaths)
+	if cfg.IsSet("TMPFS_EXEC_PATHS") {
+		tmpFsExec = strings.Fields(cfg.Get("TMPFS_EXEC_PATHS"))
+	}
+	for _, pattern := range tmpFsExec {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, errors.Wrapf(err, "invalid TMPFS_EXEC_PATHS pattern %q", pattern)
+		}
+	}
+
+	if tmpFsHarden {
+		for mountPoint, opts := range tmpFs {
+			tmpFs[mountPoint] = hardenDockerTmpfsOpts(opts, dockerPathMatchesAny(tmpFsExec, mountPoint))
+		}
+	}
+
+	hugetlbfsBind := ""
+	if cfg.IsSet("HUGETLBFS_BIND") {
+		parts := strings.Split(cfg.Get("HUGETLBFS_BIND"), ":")
+		if len(parts) != 2 || !path.IsAbs(parts[0]) || !path.IsAbs(parts[1]) {
+			return nil, fmt.Errorf("invalid HUGETLBFS_BIND %q, expected absolute host:container paths", cfg.Get("HUGETLBFS_BIND"))
+		}
+
+		hugetlbfsBind = fmt.Sprintf("%s:%s:rw", parts[0], parts[1])
+	}
+
+	kernelMemory := uint64(0)
+	if cfg.IsSet("KERNEL_MEMORY") {
+		kernelMemory, err = humanize.ParseBytes(cfg.Get("KERNEL_MEMORY"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid KERNEL_MEMORY")
+		}
+	}
+
+	cpus := uint64(2)
+	if cfg.IsSet("CPUS") {
+		cpus, err = strconv.ParseUint(cfg.Get("CPUS"), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CPUS")
+		}
+	}
+
+	respectImageLabels := false
+	if cfg.IsSet("RESPECT_IMAGE_LABELS") {
+		respectImageLabels, err = strconv.ParseBool(cfg.Get("RESPECT_IMAGE_LABELS"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxMemory := memory
+	if cfg.IsSet("MAX_MEMORY") {
+		maxMemory, err = humanize.ParseBytes(cfg.Get("MAX_MEMORY"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid MAX_MEMORY")
+		}
+	}
+
+	memoryBudget := uint64(0)
+	if cfg.IsSet("HOST_MEMORY_BUDGET") {
+		memoryBudget, err = humanize.ParseBytes(cfg.Get("HOST_MEMORY_BUDGET"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid HOST_MEMORY_BUDGET")
+		}
+	}
+
+	// The overcommit ratio only scales the budget accounted against, the
+	// memory limits of the containers stay as they are.
+	if cfg.IsSet("MEMORY_OVERCOMMIT_RATIO") {
+		ratio, err := strconv.ParseFloat(cfg.Get("MEMORY_OVERCOMMIT_RATIO"), 64)
+		if err != nil || ratio <= 0 {
+			return nil, fmt.Errorf("invalid MEMORY_OVERCOMMIT_RATIO %q", cfg.Get("MEMORY_OVERCOMMIT_RATIO"))
+		}
+		if memoryBudget == 0 {
+			return nil, fmt.Errorf("MEMORY_OVERCOMMIT_RATIO requires HOST_MEMORY_BUDGET")
+		}
+		memoryBudget = uint64(float64(memoryBudget) * ratio)
+	}
+
+	maxCPUs := cpus
+	if cfg.IsSet("MAX_CPUS") {
+		maxCPUs, err = strconv.ParseUint(cfg.Get("MAX_CPUS"), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid MAX_CPUS")
+		}
+	}
+
+	runProfiles, err := parseDockerResourceProfiles(cfg.Get("RESOURCE_PROFILES"), dockerResourceProfile{
+		memory: memory,
+		cpus:   int(cpus),
+		shm:    shm,
+	}, cpuSetSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid RESOURCE_PROFILES")
+	}
+	for language, profile := range runProfiles {
+		if shmHuge != "" && profile.shm != shm {
+			return nil, fmt.Errorf("SHM_HUGE conflicts with the shm of the %q resource profile", language)
+		}
+	}
+
+	cpuShares := int64(0)
+	if cfg.IsSet("CPU_SHARES") {
+		cpuShares, err = strconv.ParseInt(cfg.Get("CPU_SHARES"), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CPU_SHARES")
+		}
+		if cpuShares <= 0 {
+			return nil, fmt.Errorf("CPU_SHARES must be positive, got %d", cpuShares)
+		}
+	}
+
+	cpuRTRuntime := int64(0)
+	if cfg.IsSet("CPU_RT_RUNTIME") {
+		cpuRTRuntime, err = strconv.ParseInt(cfg.Get("CPU_RT_RUNTIME"), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CPU_RT_RUNTIME")
+		}
+		if cpuRTRuntime <= 0 {
+			return nil, fmt.Errorf("CPU_RT_RUNTIME must be positive, got %d", cpuRTRuntime)
+		}
+	}
+
+	cpuRTPeriod := int64(0)
+	if cfg.IsSet("CPU_RT_PERIOD") {
+		if cpuRTRuntime == 0 {
+			return nil, fmt.Errorf("CPU_RT_PERIOD requires CPU_RT_RUNTIME")
+		}
+
+		cpuRTPeriod, err = strconv.ParseInt(cfg.Get("CPU_RT_PERIOD"), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CPU_RT_PERIOD")
+		}
+		if cpuRTPeriod < cpuRTRuntime {
+			return nil, fmt.Errorf("CPU_RT_PERIOD must be at least CPU_RT_RUNTIME, got %d < %d", cpuRTPeriod, cpuRTRuntime)
+		}
+	}
+
+	sshDialTimeout := defaultDockerSSHDialTimeout
+	if cfg.IsSet("SSH_DIAL_TIMEOUT") {
+		sshDialTimeout, err = time.ParseDuration(cfg.Get("SSH_DIAL_TIMEOUT"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sshAuthGrace := defaultDockerSSHAuthGrace
+	if cfg.IsSet("SSH_AUTH_GRACE") {
+		sshAuthGrace, err = time.ParseDuration(cfg.Get("SSH_AUTH_GRACE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid SSH_AUTH_GRACE")
+		}
+	}
+
+	sshAuthRetries := defaultDockerSSHAuthRetries
+	if cfg.IsSet("SSH_AUTH_RETRIES") {
+		sshAuthRetries, err = strconv.ParseUint(cfg.Get("SSH_AUTH_RETRIES"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var sshdRestartCmd []string
+	if cfg.IsSet("SSHD_RESTART_CMD") {
+		sshdRestartCmd = strings.Split(cfg.Get("SSHD_RESTART_CMD"), " ")
+	}
+
+	sshdRestarts := defaultDockerSSHDRestartRetries
+	if cfg.IsSet("SSHD_RESTART_RETRIES") {
+		sshdRestarts, err = strconv.ParseUint(cfg.Get("SSHD_RESTART_RETRIES"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ipRetries := defaultDockerIPRetries
+	if cfg.IsSet("SSH_IP_RETRIES") {
+		ipRetries, err = strconv.ParseUint(cfg.Get("SSH_IP_RETRIES"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cgroupnsMode := cfg.Get("CGROUPNS_MODE")
+	switch cgroupnsMode {
+	case "", "host", "private":
+	default:
+		return nil, fmt.Errorf("invalid cgroup namespace mode %q", cgroupnsMode)
+	}
+
+	platform := ""
+	if cfg.IsSet("PLATFORM") {
+		platform = cfg.Get("PLATFORM")
+	}
+
+	macAddress := ""
+	if cfg.IsSet("MAC_ADDRESS") {
+		macAddress, err = normalizeDockerMacAddress(cfg.Get("MAC_ADDRESS"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid MAC_ADDRESS")
+		}
+	}
+
+	macAllowed := map[string]bool{}
+	for _, allowed := range strings.Fields(cfg.Get("MAC_ADDRESS_ALLOWED")) {
+		normalized, err := normalizeDockerMacAddress(allowed)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid MAC_ADDRESS_ALLOWED")
+		}
+		macAllowed[normalized] = true
+	}
+
+	earlyExitWindow := defaultDockerEarlyExitWindow
+	if cfg.IsSet("EARLY_EXIT_WINDOW") {
+		earlyExitWindow, err = time.ParseDuration(cfg.Get("EARLY_EXIT_WINDOW"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	waitForHealthy := false
+	if cfg.IsSet("WAIT_FOR_HEALTHY") {
+		waitForHealthy, err = strconv.ParseBool(cfg.Get("WAIT_FOR_HEALTHY"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var readyProbeCmd []string
+	if cfg.IsSet("READY_PROBE_CMD") {
+		readyProbeCmd = strings.Split(cfg.Get("READY_PROBE_CMD"), " ")
+	}
+
+	var startSlots chan struct{}
+	if cfg.IsSet("MAX_CONCURRENT_STARTS") {
+		maxStarts, err := strconv.ParseUint(cfg.Get("MAX_CONCURRENT_STARTS"), 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid MAX_CONCURRENT_STARTS")
+		}
+		if maxStarts > 0 {
+			startSlots = make(chan struct{}, maxStarts)
+		}
+	}
+
+	warmPoolSize := 0
+	if cfg.IsSet("WARM_POOL_SIZE") {
+		warmPoolSize, err = strconv.Atoi(cfg.Get("WARM_POOL_SIZE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid WARM_POOL_SIZE")
+		}
+	}
+
+	warmPoolImage := cfg.Get("WARM_POOL_IMAGE")
+	if warmPoolSize > 0 && warmPoolImage == "" {
+		return nil, fmt.Errorf("WARM_POOL_SIZE requires WARM_POOL_IMAGE")
+	}
+
+	maxLifetime := time.Duration(0)
+	if cfg.IsSet("MAX_INSTANCE_LIFETIME") {
+		maxLifetime, err = time.ParseDuration(cfg.Get("MAX_INSTANCE_LIFETIME"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stopWait := time.Duration(0)
+	if cfg.IsSet("STOP_REMOVE_WAIT") {
+		stopWait, err = time.ParseDuration(cfg.Get("STOP_REMOVE_WAIT"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stopKill := false
+	switch cfg.Get("STOP_MODE") {
+	case "", "graceful":
+	case "kill":
+		stopKill = true
+	default:
+		return nil, fmt.Errorf("invalid stop mode %q", cfg.Get("STOP_MODE"))
+	}
+
+	stopSignal := docker.SIGKILL
+	if cfg.IsSet("STOP_SIGNAL") {
+		stopSignal, err = parseDockerSignal(cfg.Get("STOP_SIGNAL"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid STOP_SIGNAL")
+		}
+	}
+
+	removeVolumes := true
+	if cfg.IsSet("REMOVE_VOLUMES") {
+		removeVolumes, err = strconv.ParseBool(cfg.Get("REMOVE_VOLUMES"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	removeRetries := defaultDockerRemoveRetries
+	if cfg.IsSet("REMOVE_RETRIES") {
+		removeRetries, err = strconv.ParseUint(cfg.Get("REMOVE_RETRIES"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	createFDCooldown := defaultDockerCreateFDCooldown
+	if cfg.IsSet("CREATE_FD_COOLDOWN") {
+		createFDCooldown, err = time.ParseDuration(cfg.Get("CREATE_FD_COOLDOWN"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CREATE_FD_COOLDOWN")
+		}
+	}
+
+	createFDRetries := defaultDockerCreateFDRetries
+	if cfg.IsSet("CREATE_FD_RETRIES") {
+		createFDRetries, err = strconv.ParseUint(cfg.Get("CREATE_FD_RETRIES"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pullMissingImages := false
+	if cfg.IsSet("PULL_MISSING_IMAGES") {
+		pullMissingImages, err = strconv.ParseBool(cfg.Get("PULL_MISSING_IMAGES"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid PULL_MISSING_IMAGES")
+		}
+	}
+
+	pullRateLimitCooldown := defaultDockerPullRateLimitCooldown
+	if cfg.IsSet("PULL_RATE_LIMIT_COOLDOWN") {
+		pullRateLimitCooldown, err = time.ParseDuration(cfg.Get("PULL_RATE_LIMIT_COOLDOWN"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid PULL_RATE_LIMIT_COOLDOWN")
+		}
+	}
+
+	var auditLog *dockerAuditLog
+	if cfg.Get("AUDIT_LOG_PATH") != "" {
+		auditLog, err = newDockerAuditLog(cfg.Get("AUDIT_LOG_PATH"), defaultDockerAuditLogBufferSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid AUDIT_LOG_PATH")
+		}
+	}
+
+	annotations, err := parseDockerAnnotations(cfg.Get("ANNOTATIONS"))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ANNOTATIONS")
+	}
+
+	env := map[string]string{}
+	if cfg.IsSet("ENV_FILE") {
+		b, err := ioutil.ReadFile(cfg.Get("ENV_FILE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid ENV_FILE")
+		}
+
+		env, err = parseDockerEnvFile(string(b))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid ENV_FILE")
+		}
+	}
+
+	if cfg.IsSet("PROPAGATE_PROXY_ENV") {
+		propagateProxyEnv, err := strconv.ParseBool(cfg.Get("PROPAGATE_PROXY_ENV"))
+		if err != nil {
+			return nil, err
+		}
+
+		if propagateProxyEnv {
+			for _, key := range dockerProxyEnvVars {
+				if _, ok := env[key]; ok {
+					continue
+				}
+				if value := os.Getenv(key); value != "" {
+					env[key] = value
+				}
+			}
+		}
+	}
+
+	for _, kv := range strings.Fields(cfg.Get("CONTAINER_ENV")) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !dockerEnvKeyRegexp.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid CONTAINER_ENV: malformed variable %q, expected KEY=VALUE", kv)
+		}
+		env[parts[0]] = parts[1]
+	}
+
+	containerEnv := []string{}
+	for key, value := range env {
+		containerEnv = append(containerEnv, key+"="+value)
+	}
+	sort.Strings(containerEnv)
+
+	dnsOptions := strings.Fields(cfg.Get("DNS_OPTIONS"))
+	err = validateDockerDNSOptions(dnsOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid DNS_OPTIONS")
+	}
+
+	networkName := cfg.Get("NETWORK")
+
+	networkMTU := 0
+	if cfg.IsSet("NETWORK_MTU") {
+		networkMTU, err = strconv.Atoi(cfg.Get("NETWORK_MTU"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid NETWORK_MTU")
+		}
+		if networkMTU <= 0 {
+			return nil, fmt.Errorf("NETWORK_MTU must be positive, got %d", networkMTU)
+		}
+		if networkName == "" {
+			return nil, fmt.Errorf("NETWORK_MTU requires NETWORK, as the default bridge can't be reconfigured")
+		}
+	}
+
+	dockerSockBind := ""
+	if cfg.IsSet("MOUNT_DOCKER_SOCK") {
+		v, err := strconv.ParseBool(cfg.Get("MOUNT_DOCKER_SOCK"))
+		if err != nil {
+			return nil, err
+		}
+
+		if v {
+			mode := defaultDockerSockMode
+			if cfg.IsSet("MOUNT_DOCKER_SOCK_MODE") {
+				mode = cfg.Get("MOUNT_DOCKER_SOCK_MODE")
+			}
+
+			if mode != "ro" && mode != "rw" {
+				return nil, fmt.Errorf("invalid docker socket mount mode %q", mode)
+			}
+
+			dockerSockBind = fmt.Sprintf("%s:%s:%s", dockerSockPath, dockerSockPath, mode)
+		}
+	}
+
+	labelVersion := true
+	if cfg.IsSet("LABEL_WORKER_VERSION") {
+		labelVersion, err = strconv.ParseBool(cfg.Get("LABEL_WORKER_VERSION"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	labelSource := true
+	if cfg.IsSet("LABEL_SOURCE") {
+		labelSource, err = strconv.ParseBool(cfg.Get("LABEL_SOURCE"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	labelMetrics := false
+	if cfg.IsSet("METRICS_LABELS") {
+		labelMetrics, err = strconv.ParseBool(cfg.Get("METRICS_LABELS"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	labelMemory := false
+	if cfg.IsSet("METRICS_LABELS_MEMORY") {
+		labelMemory, err = strconv.ParseBool(cfg.Get("METRICS_LABELS_MEMORY"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	secretsPath := defaultDockerSecretsPath
+	if cfg.IsSet("SECRETS_PATH") {
+		secretsPath = path.Clean(cfg.Get("SECRETS_PATH"))
+		if !strings.HasPrefix(secretsPath, "/") {
+			return nil, fmt.Errorf("secrets path %q is not an absolute path", secretsPath)
+		}
+	}
+
+	secretsOwner := defaultDockerSecretsOwner
+	if cfg.IsSet("SECRETS_OWNER") {
+		secretsOwner = cfg.Get("SECRETS_OWNER")
+	}
+
+	secretsUID, secretsGID, err := parseDockerOwner(secretsOwner)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid SECRETS_OWNER")
+	}
+
+	sshAddressTemplate := defaultDockerSSHAddressTemplate
+	if cfg.IsSet("SSH_DIAL_ADDRESS_TEMPLATE") {
+		sshAddressTemplate = cfg.Get("SSH_DIAL_ADDRESS_TEMPLATE")
+	}
+
+	sshAddress, err := template.New("ssh-address").Option("missingkey=error").Parse(sshAddressTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid SSH_DIAL_ADDRESS_TEMPLATE")
+	}
+
+	sshDialer, err := ssh.NewDialerWithPasswordAndAlgorithms("travis", ssh.Algorithms{
+		Ciphers:      dockerConfigList(cfg, "SSH_CIPHERS"),
+		KeyExchanges: dockerConfigList(cfg, "SSH_KEX"),
+		MACs:         dockerConfigList(cfg, "SSH_MACS"),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create SSH dialer")
+	}
+
+	imageCacheTTL := time.Duration(0)
+	if cfg.IsSet("IMAGE_CACHE_TTL") {
+		imageCacheTTL, err = time.ParseDuration(cfg.Get("IMAGE_CACHE_TTL"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid IMAGE_CACHE_TTL")
+		}
+	}
+
+	imageMissTTL := time.Duration(0)
+	if cfg.IsSet("IMAGE_SELECTOR_MISS_TTL") {
+		imageMissTTL, err = time.ParseDuration(cfg.Get("IMAGE_SELECTOR_MISS_TTL"))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid IMAGE_SELECTOR_MISS_TTL")
+		}
+	}
+
+	imageSelectorType := defaultDockerImageSelectorType
+	if cfg.IsSet("IMAGE_SELECTOR_TYPE") {
+		imageSelectorType = cfg.Get("IMAGE_SELECTOR_TYPE")
+	}
+
+	if imageSelectorType != "tag" && imageSelectorType != "api" {
+		return nil, fmt.Errorf("invalid image selector type %q", imageSelectorType)
+	}
+
+	imageSelector, err := buildDockerImageSelector(imageSelectorType, clients, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't build docker image selector")
+	}
+
+	selectorURL := ""
+	if cfg.IsSet("VALIDATE_SELECTOR_URL") {
+		v, err := strconv.ParseBool(cfg.Get("VALIDATE_SELECTOR_URL"))
+		if err != nil {
+			return nil, err
+		}
+
+		if v && imageSelectorType == "api" {
+			selectorURL = cfg.Get("IMAGE_SELECTOR_URL")
+		}
+	}
+
+	imageInfra := defaultDockerImageSelectorInfra
+	if cfg.IsSet("IMAGE_SELECTOR_INFRA") {
+		imageInfra = cfg.Get("IMAGE_SELECTOR_INFRA")
+	}
+
+	imageNameFirst := false
+	switch cfg.Get("IMAGE_SELECTION_FORMAT") {
+	case "", "id-name":
+	case "name-id":
+		imageNameFirst = true
+	default:
+		return nil, fmt.Errorf("invalid image selection format %q", cfg.Get("IMAGE_SELECTION_FORMAT"))
+	}
+
+	return &dockerProvider{
+		client:         client,
+		clients:        clients,
+		sshDialer:      sshDialer,
+		sshDialTimeout: sshDialTimeout,
+		sshAddress:     sshAddress,
+		sshNeedsIP:     strings.Contains(sshAddressTemplate, ".IP"),
+		sshAuthGrace:   sshAuthGrace,
+		sshAuthRetries: sshAuthRetries,
+		sshdRestartCmd: sshdRestartCmd,
+		sshdRestarts:   sshdRestarts,
+		ipRetries:      ipRetries,
+
+		runPrivileged:  privileged,
+		runCmd:         cmd,
+		runCmdAppend:   cmdAppend,
+		runCmdByImage:  cmdByImage,
+		runBootstrap:   bootstrapScript,
+		runMemory:      memory,
+		runShm:         shm,
+		runProfiles:    runProfiles,
+		runKernelMem:   kernelMemory,
+		runCPUs:        int(cpus),
+		runCPUShares:   cpuShares,
+		cpuRTRuntime:   cpuRTRuntime,
+		cpuRTPeriod:    cpuRTPeriod,
+		maxMemory:      maxMemory,
+		memoryBudget:   memoryBudget,
+		maxCPUs:        int(maxCPUs),
+		annotations:    annotations,
+		dockerSockBind: dockerSockBind,
+		runNative:      runNative,
+		runPlatform:    platform,
+		runMacAddress:  macAddress,
+		macAllowed:     macAllowed,
+		outputViaLogs:  outputViaLogs,
+		maxLifetime:    maxLifetime,
+		stopWait:       stopWait,
+		execCmd:        execCmd,
+		buildHome:      buildHome,
+		buildWorkdir:   buildWorkdir,
+		execShell:      execShell,
+		execCgroup:     execCgroup,
+		postExecCmd:    postExecCmd,
+		tmpFs:          tmpFs,
+		tmpFsAllowed:   tmpFsAllowed,
+		tmpFsMaxSize:   tmpFsMaxSize,
+		tmpFsHarden:    tmpFsHarden,
+		tmpFsExec:      tmpFsExec,
+		containerEnv:   containerEnv,
+		dnsOptions:     dnsOptions,
+		cgroupnsMode:   cgroupnsMode,
+		networkName:    networkName,
+		networkMTU:     networkMTU,
+		hugetlbfsBind:  hugetlbfsBind,
+		shmHuge:        shmHuge,
+		labelVersion:   labelVersion,
+		labelSource:    labelSource,
+		labelMetrics:   labelMetrics,
+		labelMemory:    labelMemory,
+		secretsPath:    secretsPath,
+		secretsUID:     secretsUID,
+		secretsGID:     secretsGID,
+		imageSelector:  imageSelector,
+		imageInfra:     imageInfra,
+		selectorURL:    selectorURL,
+		imageNameFirst: imageNameFirst,
+
+		imageCacheTTL: imageCacheTTL,
+		imageCache:    map[string]dockerImageCacheEntry{},
+		imageMissTTL:  imageMissTTL,
+		imageMisses:   map[string]time.Time{},
+
+		cgroupVersions: map[string]int{},
+		daemonVersions: map[string]string{},
+
+		preloadImage:    cfg.Get("PRELOAD_IMAGE"),
+		preloadImageIDs: map[string]string{},
+
+		respectImageLabels: respectImageLabels,
+
+		execRawTerminal:     execRawTerminal,
+		logExecCommand:      logExecCommand,
+		outputTimestamps:    outputTimestamps,
+		runSummaryStats:     runSummaryStats,
+		scriptViaEnv:        scriptViaEnv,
+		scriptViaEnvMaxSize: scriptViaEnvMaxSize,
+		scriptViaStdin:      scriptViaStdin,
+		scriptOverwrite:     scriptOverwrite,
+		uploadCompress:      uploadCompress,
+		uploadProgressEvery: uploadProgressEvery,
+		uploadTimeout:       uploadTimeout,
+		inspectExecRetries:  inspectExecRetries,
+		execKeepalive:       execKeepalive,
+		earlyExitWindow:     earlyExitWindow,
+		waitForHealthy:      waitForHealthy,
+		readyProbeCmd:       readyProbeCmd,
+		stopKill:            stopKill,
+		stopSignal:          stopSignal,
+		removeVolumes:       removeVolumes,
+		removeRetries:       removeRetries,
+		createFDCooldown:    createFDCooldown,
+		createFDRetries:     createFDRetries,
+
+		pullMissingImages:     pullMissingImages,
+		pullRateLimitCooldown: pullRateLimitCooldown,
+		pullLimitedUntil:      map[string]time.Time{},
+		auditLog:              auditLog,
+
+		startSlots: startSlots,
+
+		warmPoolSize:  warmPoolSize,
+		warmPoolImage: warmPoolImage,
+
+		memoryCommitted: map[string]uint64{},
+
+		cpuSetSize:    cpuSetSize,
+		cpuSets:       map[string][]bool{},
+		cpuBooting:    map[string][]time.Time{},
+		cpuLeases:     map[string][]time.Time{},
+		cpuLeaseGrace: cpuLeaseGrace,
+		cpuAllowed:    cpuAllowed,
+		cpuCores:      cpuCores,
+		cpuNodes:      cpuNodes,
+		instances:     map[string]*dockerInstance{},
+	}, nil
+}
+
+// buildDockerCPUAllowed marks the cpus of the given cpu list as allowed to be
+// allocated, checking that they are part of the cpu set.
+func buildDockerCPUAllowed(cpuList string, cpuSetSize int) ([]bool, error) {
+	cpus, err := parseCPUList(strings.TrimSpace(cpuList))
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make([]bool, cpuSetSize)
+	for _, cpu := range cpus {
+		if cpu >= cpuSetSize {
+			return nil, fmt.Errorf("cpu %d is outside of the cpu set of size %d", cpu, cpuSetSize)
+		}
+		allowed[cpu] = true
+	}
+
+	return allowed, nil
+}
+
+// restrictDockerCPUAllowedToIsolated restricts the allowed cpus, all cpus of
+// the cpu set if nil, to the isolated ones. If none of them are isolated, the
+// allowed cpus are returned as is, as refusing to start would be worse than
+// running on the shared cpus.
+func restrictDockerCPUAllowedToIsolated(allowed []bool, cpuSetSize int) ([]bool, error) {
+	isolated, err := defaultDockerCPUTopology.IsolatedCPUs()
+	if err != nil {
+		return nil, err
+	}
+
+	restricted := make([]bool, cpuSetSize)
+	count := 0
+	for _, cpu := range isolated {
+		if cpu < cpuSetSize && (allowed == nil || allowed[cpu]) && !restricted[cpu] {
+			restricted[cpu] = true
+			count++
+		}
+	}
+
+	if count == 0 {
+		context.LoggerFromContext(gocontext.Background()).WithFields(logrus.Fields{
+			"self":     "backend/docker_provider",
+			"isolated": isolated,
+		}).Warn("no isolated cpus in the cpu set; allocating from all allowed cpus")
+		return allowed, nil
+	}
+
+	return restricted, nil
+}
+
+// buildDockerCPUCores groups the cpus of the cpu set into physical cores
+// using the thread siblings reported by the cpu topology.
+func buildDockerCPUCores(cpuSetSize int) ([][]int, error) {
+	cores := [][]int{}
+	seen := map[int]bool{}
+
+	for cpu := 0; cpu < cpuSetSize; cpu++ {
+		if seen[cpu] {
+			continue
+		}
+
+		siblings, err := defaultDockerCPUTopology.ThreadSiblings(cpu)
+		if err != nil {
+			return nil, err
+		}
+
+		core := []int{}
+		for _, sibling := range siblings {
+			if sibling < cpuSetSize && !seen[sibling] {
+				seen[sibling] = true
+				core = append(core, sibling)
+			}
+		}
+		cores = append(cores, core)
+	}
+
+	return cores, nil
+}
+
+// buildDockerCPUNodes maps each cpu of the cpu set to its numa node using the
+// cpu topology.
+func buildDockerCPUNodes(cpuSetSize int) ([]int, error) {
+	nodes := make([]int, cpuSetSize)
+
+	for cpu := 0; cpu < cpuSetSize; cpu++ {
+		node, err := defaultDockerCPUTopology.NUMANode(cpu)
+		if err != nil {
+			return nil, err
+		}
+		nodes[cpu] = node
+	}
+
+	return nodes, nil
+}
+
+// normalizeDockerTmpfsMap checks that each tmpfs mount point is an absolute
+// path and that each set of mount options only contains recognized options,
+// returning a copy with cleaned paths and options.
+func normalizeDockerTmpfsMap(tmpFs map[string]string) (map[string]string, error) {
+	normalized := map[string]string{}
+
+	for mountPoint, opts := range tmpFs {
+		if !strings.HasPrefix(mountPoint, "/") {
+			return nil, fmt.Errorf("tmpfs mount point %q is not an absolute path", mountPoint)
+		}
+
+		cleanOpts := []string{}
+		for _, opt := range strings.Split(opts, ",") {
+			opt = strings.TrimSpace(opt)
+			if opt == "" {
+				continue
+			}
+
+			name := strings.SplitN(opt, "=", 2)[0]
+			takesValue, ok := dockerTmpfsOptions[name]
+			if !ok {
+				return nil, fmt.Errorf("unrecognized tmpfs option %q for %q", name, mountPoint)
+			}
+			if takesValue != strings.Contains(opt, "=") {
+				return nil, fmt.Errorf("malformed tmpfs option %q for %q", opt, mountPoint)
+			}
+
+			cleanOpts = append(cleanOpts, opt)
+		}
+
+		normalized[path.Clean(mountPoint)] = strings.Join(cleanOpts, ",")
+	}
+
+	return normalized, nil
+}
+
+// jobTmpfs validates the tmpfs mounts requested by a job, which must be on
+// mount points matching TMPFS_ALLOWED_PATHS, and caps their size at
+// TMPFS_MAX_SIZE. Mounts without a size get TMPFS_MAX_SIZE, as a tmpfs
+// without one may grow to half of the host's memory.
+func (p *dockerProvider) jobTmpfs(logger *logrus.Entry, requested map[string]string) (map[string]string, error) {
+	if len(requested) == 0 {
+		return nil, nil
+	}
+
+	normalized, err := normalizeDockerTmpfsMap(requested)
+	if err != nil {
+		return nil, errors.Wrap(errDockerJobTmpfs, err.Error())
+	}
+
+	tmpFs := map[string]string{}
+	for mountPoint, opts := range normalized {
+		if mountPoint == p.secretsPath || !p.tmpfsAllowed(mountPoint) {
+			return nil, errors.Wrapf(errDockerJobTmpfs, "tmpfs mount point %q is not allowed", mountPoint)
+		}
+
+		size := p.tmpFsMaxSize
+		cleanOpts := []string{}
+		for _, opt := range strings.Split(opts, ",") {
+			if !strings.HasPrefix(opt, "size=") {
+				if opt != "" {
+					cleanOpts = append(cleanOpts, opt)
+				}
+				continue
+			}
+
+			requestedSize, err := parseDockerTmpfsSize(strings.TrimPrefix(opt, "size="))
+			if err != nil {
+				return nil, errors.Wrapf(errDockerJobTmpfs, "invalid size for %q: %v", mountPoint, err)
+			}
+			if requestedSize > p.tmpFsMaxSize {
+				logger.WithFields(logrus.Fields{
+					"mount_point": mountPoint,
+					"size":        requestedSize,
+					"max_size":    p.tmpFsMaxSize,
+				}).Warn("capping size of tmpfs requested by job")
+			} else {
+				size = requestedSize
+			}
+		}
+
+		tmpFs[mountPoint] = strings.Join(append(cleanOpts, fmt.Sprintf("size=%dk", (size+1023)/1024)), ",")
+		if p.tmpFsHarden {
+			tmpFs[mountPoint] = hardenDockerTmpfsOpts(tmpFs[mountPoint], dockerPathMatchesAny(p.tmpFsExec, mountPoint))
+		}
+	}
+
+	return tmpFs, nil
+}
+
+// tmpfsAllowed reports whether jobs may request a tmpfs on the mount point.
+func (p *dockerProvider) tmpfsAllowed(mountPoint string) bool {
+	return dockerPathMatchesAny(p.tmpFsAllowed, mountPoint)
+}
+
+// dockerPathMatchesAny reports whether the path matches any of the glob
+// patterns.
+func dockerPathMatchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hardenDockerTmpfsOpts replaces the exec, suid and dev options of a set of
+// tmpfs mount options with nosuid and nodev, and noexec unless keepExec.
+func hardenDockerTmpfsOpts(opts string, keepExec bool) string {
+	hardened := []string{}
+	for _, opt := range strings.Split(opts, ",") {
+		switch opt {
+		case "", "exec", "noexec", "suid", "nosuid", "dev", "nodev":
+			continue
+		}
+		hardened = append(hardened, opt)
+	}
+
+	hardened = append(hardened, "nosuid", "nodev")
+	if keepExec {
+		return strings.Join(append(hardened, "exec"), ",")
+	}
+	return strings.Join(append(hardened, "noexec"), ",")
+}
+
+// parseDockerTmpfsSize parses a tmpfs size option in bytes, with an optional
+// k, m or g suffix as understood by mount. Sizes relative to the host's
+// memory aren't supported, as they can't be capped.
+func parseDockerTmpfsSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	multiplier := uint64(1)
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		multiplier = 1024
+	case "m":
+		multiplier = 1024 * 1024
+	case "g":
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("unsupported size %q", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// normalizeDockerMacAddress checks that the mac address is a 48-bit address
+// as the daemon expects, returning it in lower-case colon notation.
+func normalizeDockerMacAddress(s string) (string, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return "", errors.Wrapf(errDockerMacAddress, "%q is not a 48-bit mac address", s)
+	}
+	return mac.String(), nil
+}
+
+// jobMacAddress validates the mac address requested by a job, which must be
+// one of MAC_ADDRESS_ALLOWED, as it could otherwise take over the address of
+// any host on the network of the container.
+func (p *dockerProvider) jobMacAddress(requested string) (string, error) {
+	macAddress, err := normalizeDockerMacAddress(requested)
+	if err != nil {
+		return "", err
+	}
+	if !p.macAllowed[macAddress] {
+		return "", errors.Wrapf(errDockerMacAddress, "mac address %q is not allowed", macAddress)
+	}
+	return macAddress, nil
+}
+
+// validateDockerDNSOptions checks that each option is a recognized
+// resolv.conf option with a numeric value if it takes one.
+func validateDockerDNSOptions(opts []string) error {
+	for _, opt := range opts {
+		parts := strings.SplitN(opt, ":", 2)
+		takesValue, ok := dockerDNSOptions[parts[0]]
+		if !ok {
+			return fmt.Errorf("unrecognized dns option %q", parts[0])
+		}
+
+		if !takesValue {
+			if len(parts) == 2 {
+				return fmt.Errorf("dns option %q does not take a value", parts[0])
+			}
+			continue
+		}
+
+		if len(parts) != 2 {
+			return fmt.Errorf("dns option %q requires a value", parts[0])
+		}
+		if _, err := strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return fmt.Errorf("dns option %q has non-numeric value %q", parts[0], parts[1])
+		}
+	}
+
+	return nil
+}
+
+// parseDockerOwner parses a numeric uid:gid pair
+func parseDockerOwner(s string) (int, int, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected uid:gid, got %q", s)
+	}
+
+	uid, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	gid, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(uid), int(gid), nil
+}
+
+// parseDockerAnnotations parses a space-delimited list of key=value pairs
+func parseDockerAnnotations(s string) (map[string]string, error) {
+	annotations := map[string]string{}
+
+	for _, kv := range strings.Fields(s) {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("malformed annotation %q, expected key=value", kv)
+		}
+
+		annotations[parts[0]] = parts[1]
+	}
+
+	return annotations, nil
+}
+
+// dockerResourceProfile holds the resources of containers for jobs of a
+// language set via RESOURCE_PROFILES.
+type dockerResourceProfile struct {
+	memory uint64
+	cpus   int
+	shm    uint64
+}
+
+// parseDockerResourceProfiles parses a space-delimited map of languages to
+// comma-delimited key=value resources, filling in the defaults for resources
+// a profile doesn't set. Profiles can't allocate more cpus than the cpu set
+// has.
+func parseDockerResourceProfiles(s string, defaults dockerResourceProfile, cpuSetSize int) (map[string]dockerResourceProfile, error) {
+	profiles := map[string]dockerResourceProfile{}
+
+	for language, resources := range str2map(s) {
+		profile := defaults
+		for _, kv := range strings.Split(resources, ",") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 || parts[1] == "" {
+				return nil, fmt.Errorf("malformed resource %q for %q, expected key=value", kv, language)
+			}
+
+			var err error
+			switch parts[0] {
+			case "memory":
+				profile.memory, err = humanize.ParseBytes(parts[1])
+				if err == nil && profile.memory == 0 {
+					err = fmt.Errorf("must be greater than 0")
+				}
+			case "cpus":
+				var cpus uint64
+				cpus, err = strconv.ParseUint(parts[1], 10, 64)
+				if err == nil && int(cpus) > cpuSetSize {
+					err = fmt.Errorf("exceeds the cpu set of size %d", cpuSetSize)
+				}
+				profile.cpus = int(cpus)
+			case "shm":
+				profile.shm, err = humanize.ParseBytes(parts[1])
+			default:
+				return nil, fmt.Errorf("unknown resource %q for %q", parts[0], language)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %s for %q", parts[0], language)
+			}
+		}
+
+		profiles[language] = profile
+	}
+
+	return profiles, nil
+}
+
+// dockerExecCgroupLimits are the limits of the sub-cgroup exec'd builds run
+// in, zero values meaning unlimited.
+type dockerExecCgroupLimits struct {
+	memory uint64
+	cpus   float64
+	pids   uint64
+}
+
+func parseDockerExecCgroupLimits(s string) (dockerExecCgroupLimits, error) {
+	limits := dockerExecCgroupLimits{}
+	if strings.TrimSpace(s) == "" {
+		return limits, nil
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return limits, fmt.Errorf("malformed limit %q, expected key=value", kv)
+		}
+
+		var err error
+		switch parts[0] {
+		case "memory":
+			limits.memory, err = humanize.ParseBytes(parts[1])
+		case "cpus":
+			limits.cpus, err = strconv.ParseFloat(parts[1], 64)
+			if err == nil && limits.cpus < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "pids":
+			limits.pids, err = strconv.ParseUint(parts[1], 10, 64)
+		default:
+			return limits, fmt.Errorf("unknown limit %q", parts[0])
+		}
+		if err != nil {
+			return limits, errors.Wrapf(err, "invalid %s", parts[0])
+		}
+	}
+
+	return limits, nil
+}
+
+// files returns the cgroup v2 interface files and values that set the
+// limits.
+func (l dockerExecCgroupLimits) files() [][2]string {
+	files := [][2]string{}
+	if l.memory > 0 {
+		files = append(files, [2]string{"memory.max", strconv.FormatUint(l.memory, 10)})
+	}
+	if l.cpus > 0 {
+		files = append(files, [2]string{"cpu.max", fmt.Sprintf("%d 100000", int64(l.cpus*100000))})
+	}
+	if l.pids > 0 {
+		files = append(files, [2]string{"pids.max", strconv.FormatUint(l.pids, 10)})
+	}
+	return files
+}
+
+// dockerImageCmd is the CMD for images whose name matches glob.
+type dockerImageCmd struct {
+	glob string
+	cmd  []string
+}
+
+func parseDockerCmdByImage(s string) ([]dockerImageCmd, error) {
+	imageCmds := []dockerImageCmd{}
+
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("malformed entry %q, expected glob=command", entry)
+		}
+
+		glob := strings.TrimSpace(parts[0])
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid glob %q", glob)
+		}
+
+		imageCmds = append(imageCmds, dockerImageCmd{
+			glob: glob,
+			cmd:  strings.Fields(parts[1]),
+		})
+	}
+
+	return imageCmds, nil
+}
+
+// cmdForImage returns the CMD of the first CMD_BY_IMAGE glob matching the
+// image name, falling back to CMD.
+func (p *dockerProvider) cmdForImage(imageName string) []string {
+	for _, imageCmd := range p.runCmdByImage {
+		if matched, _ := path.Match(imageCmd.glob, imageName); matched {
+			return imageCmd.cmd
+		}
+	}
+
+	return p.runCmd
+}
+
+// dockerProxyEnvVars are the proxy variables set by PROPAGATE_PROXY_ENV,
+// which tools disagree on the case of.
+var dockerProxyEnvVars = []string{
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY",
+	"http_proxy", "https_proxy", "no_proxy",
+}
+
+var dockerEnvKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseDockerEnvFile parses dotenv-style KEY=VALUE lines. Blank lines and
+// lines starting with # are skipped, as is an "export " prefix. Values may be
+// double-quoted with backslash escapes, single-quoted literally, or unquoted,
+// in which case a # after whitespace starts a comment.
+func parseDockerEnvFile(s string) (map[string]string, error) {
+	env := map[string]string{}
+
+	for idx, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !dockerEnvKeyRegexp.MatchString(key) {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", idx+1)
+		}
+
+		value, err := parseDockerEnvValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", idx+1)
+		}
+
+		env[key] = value
+	}
+
+	return env, nil
+}
+
+func parseDockerEnvValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		value := &bytes.Buffer{}
+		for idx := 1; idx < len(s); idx++ {
+			switch s[idx] {
+			case '"':
+				if rest := strings.TrimSpace(s[idx+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+					return "", fmt.Errorf("unexpected %q after quoted value", rest)
+				}
+				return value.String(), nil
+			case '\\':
+				idx++
+				if idx == len(s) {
+					return "", fmt.Errorf("unterminated quoted value")
+				}
+				if s[idx] == 'n' {
+					value.WriteByte('\n')
+				} else {
+					value.WriteByte(s[idx])
+				}
+			default:
+				value.WriteByte(s[idx])
+			}
+		}
+		return "", fmt.Errorf("unterminated quoted value")
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end == -1 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		if rest := strings.TrimSpace(s[end+2:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after quoted value", rest)
+		}
+		return s[1 : end+1], nil
+	default:
+		if idx := strings.Index(s, " #"); idx != -1 {
+			s = s[:idx]
+		}
+		if idx := strings.Index(s, "\t#"); idx != -1 {
+			s = s[:idx]
+		}
+		return strings.TrimSpace(s), nil
+	}
+}
+
+func buildDockerClients(cfg *config.ProviderConfig) ([]dockerClient, error) {
+	if !cfg.IsSet("ENDPOINTS") {
+		client, err := buildDockerClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return []dockerClient{client}, nil
+	}
+
+	clients := []dockerClient{}
+	for _, endpoint := range strings.Split(cfg.Get("ENDPOINTS"), ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+
+		client, err := buildDockerClientForEndpoint(endpoint, cfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't build docker client for %q", endpoint)
+		}
+		clients = append(clients, client)
+	}
+
+	if len(clients) == 0 {
+		return nil, ErrMissingEndpointConfig
+	}
+
+	return clients, nil
+}
+
+func buildDockerClient(cfg *config.ProviderConfig) (*docker.Client, error) {
+	// check for both DOCKER_ENDPOINT and DOCKER_HOST, the latter for
+	// compatibility with docker's own env vars.
+	if !cfg.IsSet("ENDPOINT") && !cfg.IsSet("HOST") {
+		return nil, ErrMissingEndpointConfig
+	}
+
+	endpoint := cfg.Get("ENDPOINT")
+	if endpoint == "" {
+		endpoint = cfg.Get("HOST")
+	}
+
+	return buildDockerClientForEndpoint(endpoint, cfg)
+}
+
+func buildDockerClientForEndpoint(endpoint string, cfg *config.ProviderConfig) (*docker.Client, error) {
+	if cfg.IsSet("CERT_PATH") {
+		path := cfg.Get("CERT_PATH")
+		ca := fmt.Sprintf("%s/ca.pem", path)
+		cert := fmt.Sprintf("%s/cert.pem", path)
+		key := fmt.Sprintf("%s/key.pem", path)
+		return docker.NewTLSClient(endpoint, cert, key, ca)
+	}
+
+	return docker.NewClient(endpoint)
+}
+
+// setDockerClientKeepalive sets the TCP keepalive interval of the
+// connections of the client, both the hijacked ones of execs and those of
+// its http transport. Unix sockets are left alone, as no proxy sits in
+// between.
+func setDockerClientKeepalive(client *docker.Client, interval time.Duration) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: interval,
+	}
+	client.Dialer = dialer
+
+	if strings.HasPrefix(client.Endpoint(), "unix://") {
+		return
+	}
+	if tr, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+		tr.DialContext = dialer.DialContext
+	}
+}
+
+func buildDockerImageSelector(selectorType string, clients []dockerClient, cfg *config.ProviderConfig) (image.Selector, error) {
+	switch selectorType {
+	case "tag":
+		return &dockerTagImageSelector{clients: clients}, nil
+	case "api":
+		baseURL, err := url.Parse(cfg.Get("IMAGE_SELECTOR_URL"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse image selector URL")
+		}
+		return image.NewAPISelector(baseURL), nil
+	default:
+		return nil, fmt.Errorf("invalid image selector type %q", selectorType)
+	}
+}
+
+// dockerImageIDNameFromSelection splits a selection of "id;name", or
+// "name;id" if nameFirst, into the image id and name.
+func dockerImageIDNameFromSelection(selection string, nameFirst bool) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(selection), ";", 2)
+	if len(parts) == 2 {
+		if nameFirst {
+			return parts[1], parts[0]
+		}
+		return parts[0], parts[1]
+	}
+	return parts[0], parts[0]
+}
+
+// nextClient returns the client for the next docker endpoint in round-robin
+// order.
+func (p *dockerProvider) nextClient() dockerClient {
+	n := atomic.AddUint64(&p.clientIndex, 1) - 1
+	return p.clients[n%uint64(len(p.clients))]
+}
+
+// isDockerFullImageRef reports whether the image name is a fully-qualified
+// reference with a registry or repository path or a digest, e.g.
+// "quay.io/travisci/ci-garnet:latest" or "ci-garnet@sha256:...", which the
+// daemon resolves by itself without looking up its id first.
+func isDockerFullImageRef(imageName string) bool {
+	return strings.ContainsAny(imageName, "/@")
+}
+
+func (p *dockerProvider) dockerImageIDFromName(client dockerClient, imageName string) string {
+	if imageID, ok := p.cachedImageID(client, imageName); ok {
+		return imageID
+	}
+
+	images, err := client.ListImages(docker.ListImagesOptions{All: true})
+	if err != nil {
+		return imageName
+	}
+
+	imageID, _, err := findDockerImageByTag([]string{imageName}, images)
+	if err != nil {
+		return imageName
+	}
+
+	p.cacheImageID(client, imageName, imageID)
+	return imageID
+}
+
+func (p *dockerProvider) cachedImageID(client dockerClient, imageName string) (string, bool) {
+	p.imageCacheMutex.Lock()
+	defer p.imageCacheMutex.Unlock()
+
+	entry, ok := p.imageCache[client.Endpoint()+" "+imageName]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+
+	return entry.id, true
+}
+
+// cacheImageID remembers that the image exists on the client's host for
+// IMAGE_CACHE_TTL. Only found images are cached, so a missing image is
+// looked up again on the next start.
+func (p *dockerProvider) cacheImageID(client dockerClient, imageName, imageID string) {
+	if p.imageCacheTTL <= 0 {
+		return
+	}
+
+	p.imageCacheMutex.Lock()
+	defer p.imageCacheMutex.Unlock()
+
+	p.imageCache[client.Endpoint()+" "+imageName] = dockerImageCacheEntry{
+		id:      imageID,
+		expires: time.Now().Add(p.imageCacheTTL),
+	}
+}
+
+// imageSelectionMissed reports whether the image selector returned no image
+// for the language within the last IMAGE_SELECTOR_MISS_TTL.
+func (p *dockerProvider) imageSelectionMissed(language string) bool {
+	p.imageCacheMutex.Lock()
+	defer p.imageCacheMutex.Unlock()
+
+	expires, ok := p.imageMisses[language]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(p.imageMisses, language)
+		return false
+	}
+
+	return true
+}
+
+// cacheImageSelectionMiss remembers that the image selector returned no image
+// for the language, so that a flood of jobs for an unsupported language
+// doesn't query the selector for every one of them.
+func (p *dockerProvider) cacheImageSelectionMiss(language string) {
+	if p.imageMissTTL <= 0 {
+		return
+	}
+
+	p.imageCacheMutex.Lock()
+	defer p.imageCacheMutex.Unlock()
+
+	p.imageMisses[language] = time.Now().Add(p.imageMissTTL)
+}
+
+// invalidateImageCache forgets the cached image, e.g. after it was pruned.
+func (p *dockerProvider) invalidateImageCache(client dockerClient, imageName string) {
+	p.imageCacheMutex.Lock()
+	delete(p.imageCache, client.Endpoint()+" "+imageName)
+	p.imageCacheMutex.Unlock()
+
+	if imageName == p.preloadImage {
+		p.preloadImageMutex.Lock()
+		delete(p.preloadImageIDs, client.Endpoint())
+		p.preloadImageMutex.Unlock()
+	}
+}
+
+// pullImage pulls the image onto the endpoint of the client. After a
+// registry rate limited a pull, pulls from it onto the endpoint fail with
+// ErrPullRateLimited without reaching it until PULL_RATE_LIMIT_COOLDOWN
+// passed, as retrying right away only uses up the limit further. Other
+// registries and endpoints, which have limits of their own, are still pulled
+// from.
+func (p *dockerProvider) pullImage(ctx gocontext.Context, client dockerClient, imageName string) error {
+	key := client.Endpoint() + " " + dockerImageRegistry(imageName)
+
+	p.pullMutex.Lock()
+	limitedUntil := p.pullLimitedUntil[key]
+	p.pullMutex.Unlock()
+
+	if time.Now().Before(limitedUntil) {
+		return errors.Wrapf(ErrPullRateLimited, "not pulling %q until %s", imageName, limitedUntil.Format(time.RFC3339))
+	}
+
+	err := client.PullImage(docker.PullImageOptions{
+		Repository: imageName,
+		Context:    ctx,
+	}, docker.AuthConfiguration{})
+	if isDockerPullRateLimitError(err) {
+		metrics.Mark("worker.vm.provider.docker.pull.ratelimited")
+
+		p.pullMutex.Lock()
+		p.pullLimitedUntil[key] = time.Now().Add(p.pullRateLimitCooldown)
+		p.pullMutex.Unlock()
+
+		return errors.Wrapf(ErrPullRateLimited, "couldn't pull %q: %v", imageName, err)
+	}
+
+	return errors.Wrapf(err, "couldn't pull %q", imageName)
+}
+
+// dockerImageRegistry returns the registry the image is pulled from, which
+// is the first component of its name if that is a host, e.g. "quay.io" for
+// "quay.io/travisci/ci-garnet:latest", and Docker Hub otherwise.
+func dockerImageRegistry(imageName string) string {
+	parts := strings.SplitN(imageName, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+	return "docker.io"
+}
+
+// preloadedImageID returns the id of PRELOAD_IMAGE on the endpoint of the
+// client, resolving it if it isn't known yet or was invalidated.
+func (p *dockerProvider) preloadedImageID(client dockerClient) (string, error) {
+	p.preloadImageMutex.Lock()
+	imageID := p.preloadImageIDs[client.Endpoint()]
+	p.preloadImageMutex.Unlock()
+
+	if imageID != "" {
+		return imageID, nil
+	}
+
+	return p.refreshPreloadedImage(client)
+}
+
+// refreshPreloadedImage resolves PRELOAD_IMAGE to its id on the endpoint of
+// the client, replacing the cached one.
+func (p *dockerProvider) refreshPreloadedImage(client dockerClient) (string, error) {
+	images, err := client.ListImages(docker.ListImagesOptions{All: true})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list docker images")
+	}
+
+	imageID, _, err := findDockerImageByTag([]string{p.preloadImage}, images)
+	if err != nil {
+		return "", errors.Wrapf(ErrImageNotFound, "couldn't find preloaded image %q on %s", p.preloadImage, client.Endpoint())
+	}
+
+	p.preloadImageMutex.Lock()
+	defer p.preloadImageMutex.Unlock()
+
+	p.preloadImageIDs[client.Endpoint()] = imageID
+	return imageID, nil
+}
+
+// resolveImage returns the reference to create the container of the
+// selected image from on the endpoint of the client, i.e. its id there
+// unless the selection already is one or a full reference.
+func (p *dockerProvider) resolveImage(client dockerClient, startAttributes *StartAttributes, imageID, imageName string) (string, error) {
+	switch {
+	case imageID != "":
+		return imageID, nil
+	case p.preloadImage != "" && imageName == p.preloadImage:
+		return p.preloadedImageID(client)
+	case imageName == startAttributes.ImageName && isDockerFullImageRef(imageName):
+		return imageName, nil
+	default:
+		return p.dockerImageIDFromName(client, imageName), nil
+	}
+}
+
+// listDockerImages lists the images of the first of the clients whose
+// endpoint answers, so that an endpoint that is down doesn't fail lookups
+// the others can answer.
+func listDockerImages(clients []dockerClient) ([]docker.APIImages, error) {
+	var err error
+	for _, client := range clients {
+		var images []docker.APIImages
+		images, err = client.ListImages(docker.ListImagesOptions{All: true})
+		if err == nil {
+			return images, nil
+		}
+		err = errors.Wrapf(err, "failed to list docker images on %s", client.Endpoint())
+	}
+
+	return nil, err
+}
+
+// Start starts a container, returning errors as a *StartError classified by
+// classifyDockerStartError.
+func (p *dockerProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
+	instance, err := p.start(ctx, startAttributes)
+	if err != nil {
+		return nil, &StartError{Class: classifyDockerStartError(err), Err: err}
+	}
+
+	return instance, nil
+}
+
+// classifyDockerStartError classifies the errors only this provider returns,
+// leaving the others to ClassifyStartError.
+func classifyDockerStartError(err error) FailureClass {
+	switch errors.Cause(err) {
+	case errDockerJobTmpfs, errDockerMacAddress:
+		return FailureFail
+	case errDockerNoFreeCPUSets, errDockerMemoryBudget, ErrPullRateLimited:
+		return FailureReschedule
+	}
+
+	return ClassifyStartError(err)
+}
+
+func (p *dockerProvider) start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_provider")
+
+	if !p.beginStart() {
+		logger.Warn("refusing to start instance while draining")
+		return nil, ErrProviderDraining
+	}
+	defer p.endStart()
+
+	imageID, imageName, err := p.selectImage(logger, startAttributes)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.warmPoolSize > 0 && imageName == p.warmPoolImage &&
+		len(startAttributes.Secrets) == 0 && len(startAttributes.Tmpfs) == 0 &&
+		startAttributes.Platform == "" && startAttributes.MacAddress == "" &&
+		!p.hasResourceProfile(startAttributes.Language) && !p.hasSourceLabels(startAttributes) {
+		instance := p.takeWarmInstance(logger)
+		if instance != nil {
+			go p.fillWarmPool(gocontext.Background())
+
+			err = p.nameWarmInstance(ctx, instance)
+			if err == nil {
+				metrics.Mark("worker.vm.provider.docker.warm_pool.hit")
+				logger.WithField("instance", instance.ID()).Info("using warm container")
+
+				p.activateInstance(logger, instance)
+				return instance, nil
+			}
+
+			// e.g. a container of an earlier attempt of the job holds
+			// the name, which the cold boot adopts or replaces
+			logger.WithField("err", err).Warn("couldn't name warm container after the job; booting another")
+			go func() {
+				err := instance.Stop(gocontext.Background())
+				if err != nil {
+					logger.WithField("err", err).Error("couldn't stop warm container")
+				}
+			}()
+		}
+
+		metrics.Mark("worker.vm.provider.docker.warm_pool.miss")
+	}
+
+	instance, err := p.boot(ctx, logger, startAttributes, imageID, imageName)
+	if err != nil {
+		return nil, err
+	}
+
+	p.activateInstance(logger, instance)
+	return instance, nil
+}
+
+// dockerContainerName returns the name of the container of the job in the
+// context, or "" to let the daemon pick one, e.g. for warm containers.
+func dockerContainerName(ctx gocontext.Context) string {
+	if jobID, ok := context.JobIDFromContext(ctx); ok {
+		return fmt.Sprintf("travis-job-%d", jobID)
+	}
+	return ""
+}
+
+// activateInstance hands out a booted instance, whose lifetime started when
+// it started booting, also for warm instances.
+func (p *dockerProvider) activateInstance(logger *logrus.Entry, instance *dockerInstance) {
+	if p.maxLifetime > 0 {
+		// The timer may fire right away, so its Stop waits for the timer to
+		// be set.
+		instance.stopMutex.Lock()
+		instance.lifetimeTimer = time.AfterFunc(p.maxLifetime-time.Since(instance.startBooting), func() {
+			logger.WithField("max_lifetime", p.maxLifetime).Warn("instance exceeded max lifetime; stopping")
+			metrics.Mark("worker.vm.provider.docker.lifetime.exceeded")
+
+			err := instance.Stop(gocontext.Background())
+			if err != nil {
+				logger.WithField("err", err).Error("couldn't stop instance after max lifetime")
+			}
+		})
+		instance.stopMutex.Unlock()
+	}
+
+	p.registerInstance(instance)
+	p.finishBootingCPUSets(instance.client, instance.CPUSet())
+	p.audit(instance, "start", nil)
+}
+
+// selectImage picks the image for the start attributes, returning its id if
+// the selection names one and its name. Ids of images found on an endpoint
+// are left to resolveImage, which looks them up on the endpoint the
+// container is created on.
+func (p *dockerProvider) selectImage(logger *logrus.Entry, startAttributes *StartAttributes) (string, string, error) {
+	var (
+		imageID   string
+		imageName string
+	)
+
+	if p.preloadImage != "" {
+		return "", p.preloadImage, nil
+	}
+
+	if startAttributes.ImageName != "" {
+		imageName = startAttributes.ImageName
+	} else if len(startAttributes.ImageTags) > 0 {
+		images, err := listDockerImages(p.clients)
+		if err != nil {
+			logger.WithField("err", err).Error("couldn't list images")
+			return "", "", err
+		}
+
+		_, imageName, err = findDockerImageByTag(startAttributes.ImageTags, images)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"err":        err,
+				"image_tags": startAttributes.ImageTags,
+			}).Error("couldn't find image by explicit tags")
+			return "", "", err
+		}
+	} else {
+		if p.imageSelectionMissed(startAttributes.Language) {
+			logger.WithField("language", startAttributes.Language).Error("image selector recently returned no image")
+			return "", "", errors.Wrapf(ErrImageNotFound, "image selector recently returned no image for language %q", startAttributes.Language)
+		}
+
+		imageIDName, err := p.imageSelector.Select(&image.Params{
+			Language: startAttributes.Language,
+			Infra:    p.imageInfra,
+		})
+		if err != nil {
+			logger.WithField("err", err).Error("couldn't select image")
+			return "", "", err
+		}
+
+		if strings.TrimSpace(imageIDName) == "" {
+			p.cacheImageSelectionMiss(startAttributes.Language)
+			logger.WithField("language", startAttributes.Language).Error("image selector returned no image")
+			return "", "", errors.Wrapf(ErrImageNotFound, "image selector returned no image for language %q", startAttributes.Language)
+		}
+
+		if strings.Contains(imageIDName, ";") {
+			imageID, imageName = dockerImageIDNameFromSelection(imageIDName, p.imageNameFirst)
+		} else {
+			imageName = imageIDName
+		}
+	}
+
+	return imageID, imageName, nil
+}
+
+// boot creates and starts a container of the given image, returning once it
+// is ready.
+func (p *dockerProvider) boot(ctx gocontext.Context, logger *logrus.Entry, startAttributes *StartAttributes, imageID, imageName string) (*dockerInstance, error) {
+	jobTmpfs, err := p.jobTmpfs(logger, startAttributes.Tmpfs)
+	if err != nil {
+		logger.WithField("err", err).Error("couldn't use tmpfs requested by job")
+		return nil, err
+	}
+
+	// The image and its labels and CMD are looked up on the endpoint the
+	// container is created on, so memory, cpus and cmd are only final once
+	// an endpoint was picked.
+	profileMemory, profileCPUs, shm := p.runMemory, p.runCPUs, p.runShm
+	if profile, ok := p.runProfiles[startAttributes.Language]; ok {
+		profileMemory, profileCPUs, shm = profile.memory, profile.cpus, profile.shm
+	}
+	var (
+		memory uint64
+		cpus   int
+		cmd    []string
+	)
+
+	platform := p.runPlatform
+	if startAttributes.Platform != "" {
+		platform = startAttributes.Platform
+	}
+
+	macAddress := p.runMacAddress
+	if startAttributes.MacAddress != "" {
+		macAddress, err = p.jobMacAddress(startAttributes.MacAddress)
+		if err != nil {
+			logger.WithField("err", err).Error("couldn't use mac address requested by job")
+			return nil, err
+		}
+	}
+
+	dockerConfig := &docker.Config{
+		Hostname:   fmt.Sprintf("testing-docker-%s", uuid.NewRandom()),
+		Labels:     map[string]string{},
+		MacAddress: macAddress,
+	}
+
+	if len(p.containerEnv) > 0 {
+		dockerConfig.Env = append([]string{}, p.containerEnv...)
+	}
+
+	if p.buildWorkdir {
+		dockerConfig.WorkingDir = p.buildHome
+	}
+
+	// Annotations are best-effort: the docker API only has labels, which
+	// CRI-compatible daemons expose as annotations.
+	for key, value := range p.annotations {
+		dockerConfig.Labels[key] = value
+	}
+
+	if p.labelVersion {
+		dockerConfig.Labels[dockerWorkerVersionLabel] = dockerLabelValue(dockerWorkerVersion)
+	}
+
+	if p.labelSource {
+		for label, value := range map[string]string{
+			dockerRepositoryLabel: startAttributes.Repository,
+			dockerBranchLabel:     startAttributes.Branch,
+			dockerCommitLabel:     startAttributes.Commit,
+		} {
+			if value != "" {
+				dockerConfig.Labels[label] = dockerLabelValue(value)
+			}
+		}
+	}
+
+	dockerHostConfig := &docker.HostConfig{
+		Privileged:         p.runPrivileged,
+		ShmSize:            int64(shm),
+		Tmpfs:              p.tmpFs,
+		CPUShares:          p.runCPUShares,
+		CPURealtimeRuntime: p.cpuRTRuntime,
+		CPURealtimePeriod:  p.cpuRTPeriod,
+		DNSOptions:         p.dnsOptions,
+		NetworkMode:        p.networkName,
+		CgroupnsMode:       p.cgroupnsMode,
+	}
+
+	if len(jobTmpfs) > 0 || len(startAttributes.Secrets) > 0 {
+		tmpFs := map[string]string{}
+		for mountPoint, opts := range p.tmpFs {
+			tmpFs[mountPoint] = opts
+		}
+		for mountPoint, opts := range jobTmpfs {
+			tmpFs[mountPoint] = opts
+		}
+		if len(startAttributes.Secrets) > 0 {
+			// The secrets live on a tmpfs that is only accessible by their
+			// owner, so they never touch disk and are gone once the container
+			// stops.
+			tmpFs[p.secretsPath] = fmt.Sprintf("rw,noexec,nosuid,nodev,mode=0700,uid=%d,gid=%d",
+				p.secretsUID, p.secretsGID)
+		}
+		dockerHostConfig.Tmpfs = tmpFs
+	}
+
+	if p.dockerSockBind != "" {
+		logger.WithField("bind", p.dockerSockBind).Warn("mounting host docker socket into container")
+		dockerHostConfig.Binds = append(dockerHostConfig.Binds, p.dockerSockBind)
+	}
+
+	if p.hugetlbfsBind != "" {
+		dockerHostConfig.Binds = append(dockerHostConfig.Binds, p.hugetlbfsBind)
+	}
+
+	booted := false
+
+	var (
+		client    dockerClient
+		container *docker.Container
+		cpuSets   string
+		reserved  bool
+		created   bool
+		adopted   bool
+		pulled    bool
+		fdRetries uint64
+	)
+
+	// Whatever stops the boot short, including a panic, removes the
+	// container if one was created and checks in its cpu sets and memory on
+	// the endpoint they were reserved on.
+	defer func() {
+		r := recover()
+		if booted {
+			return
+		}
+
+		if r != nil {
+			logger.WithField("cpu_sets", cpuSets).Error("panic during start; checking in cpu sets")
+		}
+
+		if created {
+			err := client.RemoveContainer(docker.RemoveContainerOptions{
+				ID:            container.ID,
+				RemoveVolumes: p.removeVolumes,
+				Force:         true,
+			})
+			if _, ok := err.(*docker.NoSuchContainer); err != nil && !ok {
+				logger.WithField("err", err).Error("couldn't remove container after boot failure")
+			}
+		}
+
+		if reserved {
+			p.checkinCPUSets(client, cpuSets)
+			p.releaseMemory(client, memory)
+		}
+
+		if r != nil {
+			panic(r)
+		}
+	}()
+
+	if p.labelMetrics {
+		dockerConfig.Labels[dockerStartTimeLabel] = time.Now().UTC().Format(time.RFC3339)
+		dockerConfig.Labels[dockerImageLabel] = dockerLabelValue(imageName)
+	}
+
+	if p.startSlots != nil {
+		select {
+		case p.startSlots <- struct{}{}:
+			defer func() { <-p.startSlots }()
+		case <-ctx.Done():
+			metrics.Mark("worker.vm.provider.docker.start_slot.timeout")
+			return nil, errors.Wrap(ctx.Err(), "timed out waiting for a start slot")
+		}
+	}
+
+	// Naming the container after the job makes retrying Start after an
+	// ambiguous create failure safe, as the retry conflicts with the
+	// container that was created and adopts it instead of creating another.
+	containerName := dockerContainerName(ctx)
+
+	// The cpus count as booting until the boot times out at most.
+	bootDeadline, _ := ctx.Deadline()
+
+	// Each endpoint is tried at most once, failing over to the next one in
+	// round-robin order when it has no room for the container or creating
+	// the container fails.
+	var pulledClient dockerClient
+	for attempt := 0; attempt < len(p.clients); attempt++ {
+		client = p.nextClient()
+		if pulledClient != nil {
+			client, pulledClient = pulledClient, nil
+		}
+
+		var imageRef string
+		imageRef, err = p.resolveImage(client, startAttributes, imageID, imageName)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"err":      err,
+				"endpoint": client.Endpoint(),
+				"image":    imageName,
+			}).Error("couldn't resolve image")
+			continue
+		}
+
+		memory, cpus = profileMemory, profileCPUs
+		if p.respectImageLabels {
+			memory, cpus = p.imageResources(logger, client, imageRef, memory, cpus)
+		}
+
+		cmd = p.cmdForImage(imageName)
+		if p.runCmdAppend {
+			cmd, err = p.appendImageCmd(client, imageRef, cmd)
+			if err != nil {
+				logger.WithFields(logrus.Fields{
+					"err":      err,
+					"endpoint": client.Endpoint(),
+				}).Error("couldn't inspect image for its CMD")
+				continue
+			}
+		}
+
+		dockerConfig.Image = imageRef
+		dockerConfig.Cmd = cmd
+		dockerConfig.Memory = int64(memory)
+		dockerHostConfig.Memory = int64(memory)
+		if p.labelMetrics && p.labelMemory {
+			dockerConfig.Labels[dockerMemoryLimitLabel] = strconv.FormatUint(memory, 10)
+		}
+
+		err = p.commitMemory(client, memory)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"err":      err,
+				"endpoint": client.Endpoint(),
+			}).Error("couldn't commit memory")
+			continue
+		}
+
+		cpuSets, err = p.checkoutCPUSets(client, cpus, bootDeadline)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"err":      err,
+				"endpoint": client.Endpoint(),
+			}).Error("couldn't checkout CPUSets")
+			p.releaseMemory(client, memory)
+			continue
+		}
+		reserved = true
+		logger.WithFields(logrus.Fields{
+			"cpu_sets": cpuSets,
+			"endpoint": client.Endpoint(),
+		}).Info("checked out")
+
+		dockerConfig.CPUSet = cpuSets
+		dockerHostConfig.CPUSet = cpuSets
+		dockerHostConfig.CPUSetMEMs = p.cpuSetMems(cpuSets)
+		if p.labelMetrics {
+			dockerConfig.Labels[dockerCPUSetLabel] = dockerLabelValue(cpuSets)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"config":      fmt.Sprintf("%#v", dockerConfig),
+			"host_config": fmt.Sprintf("%#v", dockerHostConfig),
+			"platform":    platform,
+		}).Debug("creating container")
+
+		dockerHostConfig.KernelMemory = 0
+		if p.runKernelMem > 0 && p.cgroupVersion(client) == 1 {
+			dockerHostConfig.KernelMemory = int64(p.runKernelMem)
+		}
+
+		// FIXME: This doesn't seem to create the container with the Config and HostConfig
+		createOpts := docker.CreateContainerOptions{
+			Name:       containerName,
+			Config:     dockerConfig,
+			HostConfig: dockerHostConfig,
+			Platform:   platform,
+		}
+		container, err = client.CreateContainer(createOpts)
+		adopted = false
+		if err == docker.ErrContainerAlreadyExists && containerName != "" {
+			container, err = p.adoptContainer(client, containerName)
+			if err == nil && p.swapCPUSets(client, cpuSets, container.HostConfig.CPUSet) {
+				logger.WithFields(logrus.Fields{
+					"name": containerName,
+					"id":   container.ID,
+				}).Warn("adopting container created by an earlier start attempt")
+
+				cpuSets = container.HostConfig.CPUSet
+				adopted = true
+			} else if err == nil {
+				// The cpus of the earlier attempt were checked in when
+				// it failed and may be another container's by now, so
+				// its container is replaced rather than adopted.
+				logger.WithFields(logrus.Fields{
+					"name":     containerName,
+					"id":       container.ID,
+					"cpu_sets": container.HostConfig.CPUSet,
+				}).Warn("removing container created by an earlier start attempt whose cpu sets were handed out since")
+
+				err = client.RemoveContainer(docker.RemoveContainerOptions{
+					ID:            container.ID,
+					RemoveVolumes: p.removeVolumes,
+					Force:         true,
+				})
+				if err == nil {
+					container, err = client.CreateContainer(createOpts)
+				}
+			}
+		}
+		if err == nil {
+			// An adopted container keeps the configs it was created with
+			// rather than claiming those of this attempt.
+			if !adopted {
+				container.Config = dockerConfig
+				container.HostConfig = dockerHostConfig
+			}
+			created = true
+			break
+		}
+
+		p.checkinCPUSets(client, cpuSets)
+		p.releaseMemory(client, memory)
+		reserved = false
+
+		logger.WithFields(logrus.Fields{
+			"err":      err,
+			"endpoint": client.Endpoint(),
+		}).Error("couldn't create container")
+
+		if err == docker.ErrNoSuchImage {
+			p.invalidateImageCache(client, imageName)
+
+			// The image is pulled once, and creating the container is
+			// retried on the same endpoint without counting as failing
+			// over.
+			if p.pullMissingImages && !pulled {
+				pulled = true
+
+				pullErr := p.pullImage(ctx, client, imageName)
+				if errors.Cause(pullErr) == ErrPullRateLimited {
+					logger.WithFields(logrus.Fields{
+						"err":   pullErr,
+						"image": imageName,
+					}).Error("image pull rate limited")
+					return nil, pullErr
+				}
+				if pullErr != nil {
+					logger.WithField("err", pullErr).Error("couldn't pull missing image")
+				} else {
+					pulledClient = client
+					attempt--
+					continue
+				}
+			}
+		}
+
+		if container != nil {
+			err := client.RemoveContainer(docker.RemoveContainerOptions{
+				ID:            container.ID,
+				RemoveVolumes: p.removeVolumes,
+				Force:         true,
+			})
+			if err != nil {
+				logger.WithField("err", err).Error("couldn't remove container after create failure")
+			}
+		}
+
+		// Retrying right away would only make a daemon that ran out of file
+		// descriptors worse, so it gets some time to recover first. These
+		// retries don't count as failing over to another endpoint.
+		if isDockerFDExhaustedError(err) {
+			metrics.Mark("worker.vm.provider.docker.fd_exhausted")
+
+			if fdRetries < p.createFDRetries {
+				cooldown := p.createFDCooldown << fdRetries
+				fdRetries++
+
+				logger.WithFields(logrus.Fields{
+					"endpoint": client.Endpoint(),
+					"cooldown": cooldown,
+				}).Warn("docker daemon ran out of file descriptors; cooling down before retrying")
+
+				select {
+				case <-time.After(cooldown):
+				case <-ctx.Done():
+					return nil, errors.Wrap(ctx.Err(), "timed out cooling down after the daemon ran out of file descriptors")
+				}
+
+				attempt--
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The bootstrap script has to be in place before the CMD referencing it
+	// runs, so unlike the build script, which UploadScript only writes into
+	// the running container after boot, it's uploaded into the created
+	// container. The build script isn't available to it.
+	if len(p.runBootstrap) > 0 {
+		err = p.uploadBootstrapScript(client, container.ID)
+		if err != nil {
+			logger.WithField("err", err).Error("couldn't upload bootstrap script")
+			return nil, err
+		}
+	}
+
+	startBooting := time.Now()
+
+	instanceConfig, instanceHostConfig := dockerConfig, dockerHostConfig
+	if adopted {
+		instanceConfig, instanceHostConfig = container.Config, container.HostConfig
+	}
+
+	err = client.StartContainer(container.ID, instanceHostConfig)
+	if _, ok := err.(*docker.ContainerAlreadyRunning); err != nil && !ok {
+		return nil, err
+	}
+
+	// Both channels are buffered so the goroutine never blocks on a boot
+	// that already gave up.
+	containerReady := make(chan *docker.Container, 1)
+	errChan := make(chan error, 1)
+	pollSleep := defaultDockerBootPollSleep
+	go func(id string) {
+		for {
+			container, err := client.InspectContainer(id)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			container.Config = instanceConfig
+			container.HostConfig = instanceHostConfig
+
+			if container.State.Running && p.containerIsReady(container) {
+				containerReady <- container
+				return
+			}
+
+			if p.earlyExitWindow > 0 && time.Since(startBooting) < p.earlyExitWindow &&
+				!container.State.StartedAt.IsZero() && !container.State.FinishedAt.IsZero() {
+				errChan <- fmt.Errorf("container exited immediately with exit code %d, check CMD %q",
+					container.State.ExitCode, strings.Join(cmd, " "))
+				return
+			}
+
+			select {
+			case <-time.After(pollSleep):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}(container.ID)
+
+	select {
+	case container := <-containerReady:
+		metrics.TimeSince("worker.vm.provider.docker.boot", startBooting)
+		instance := &dockerInstance{
+			client:       client,
+			provider:     p,
+			runNative:    p.runNative,
+			container:    container,
+			imageName:    imageName,
+			startBooting: startBooting,
+			cpuSet:       cpuSets,
+			memory:       memory,
+		}
+
+		if len(p.readyProbeCmd) > 0 {
+			err := instance.waitForReadyProbe(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if len(startAttributes.Secrets) > 0 {
+			err := p.uploadSecrets(client, container.ID, startAttributes.Secrets)
+			if err != nil {
+				logger.WithField("err", err).Error("couldn't upload secrets")
+				return nil, err
+			}
+		}
+
+		booted = true
+		return instance, nil
+	case err := <-errChan:
+		return nil, err
+	case <-ctx.Done():
+		if ctx.Err() == gocontext.DeadlineExceeded {
+			metrics.Mark("worker.vm.provider.docker.boot.timeout")
+			return nil, errors.Wrapf(ctx.Err(), "boot timed out, %s", p.bootDiagnostics(client, container.ID))
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// dockerLabelValue replaces characters that can't be used safely in metric
+// label values once scraped, keeping the value readable.
+func dockerLabelValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("-_.:/,@", r):
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// containerIsReady reports whether a running container is ready, which with
+// WAIT_FOR_HEALTHY means healthy if its image defines a healthcheck.
+func (p *dockerProvider) containerIsReady(container *docker.Container) bool {
+	if !p.waitForHealthy {
+		return true
+	}
+
+	switch container.State.Health.Status {
+	case "", "none", "healthy":
+		return true
+	default:
+		return false
+	}
+}
+
+// adoptContainer inspects the named container left behind by an earlier
+// attempt to start the same job, refusing containers of running instances.
+func (p *dockerProvider) adoptContainer(client dockerClient, name string) (*docker.Container, error) {
+	container, err := client.InspectContainer(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't inspect conflicting container %q", name)
+	}
+
+	p.instancesMutex.Lock()
+	_, inUse := p.instances[container.ID]
+	p.instancesMutex.Unlock()
+
+	if inUse {
+		return nil, fmt.Errorf("conflicting container %q belongs to a running instance", name)
+	}
+
+	if container.HostConfig == nil {
+		container.HostConfig = &docker.HostConfig{}
+	}
+	if container.HostConfig.CPUSet == "" {
+		container.HostConfig.CPUSet = container.HostConfig.CPUSetCPUs
+	}
+
+	return container, nil
+}
+
+// uploadSecrets writes the given secrets as files onto the secrets tmpfs of a
+// running container, readable only by the secrets owner.
+func (p *dockerProvider) uploadSecrets(client dockerClient, id string, secrets map[string]string) error {
+	names := []string{}
+	for name := range secrets {
+		if name == "" || strings.ContainsAny(name, "/\x00") || name == "." || name == ".." {
+			return fmt.Errorf("invalid secret name %q", name)
+		}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+	for _, name := range names {
+		err := tw.WriteHeader(&tar.Header{
+			Name: path.Join(p.secretsPath, name),
+			Mode: 0400,
+			Uid:  p.secretsUID,
+			Gid:  p.secretsGID,
+			Size: int64(len(secrets[name])),
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tw.Write([]byte(secrets[name]))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.UploadToContainer(id, docker.UploadToContainerOptions{
+		InputStream: tarBuf,
+		Path:        "/",
+	})
+}
+
+// bootDiagnostics describes the state of a container that failed to boot in
+// time, including a tail of its logs if available.
+func (p *dockerProvider) bootDiagnostics(client dockerClient, id string) string {
+	container, err := client.InspectContainer(id)
+	if err != nil {
+		return fmt.Sprintf("couldn't inspect container: %v", err)
+	}
+
+	diag := fmt.Sprintf("container state=%s", container.State.Status)
+	if container.State.Error != "" {
+		diag += fmt.Sprintf(", error=%s", container.State.Error)
+	}
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), defaultDockerLogsDrainTimeout)
+	defer cancel()
+
+	logsBuf := &bytes.Buffer{}
+	err = client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    id,
+		OutputStream: logsBuf,
+		ErrorStream:  logsBuf,
+		Stdout:       true,
+		Stderr:       true,
+		Tail:         "20",
+	})
+	if err == nil && logsBuf.Len() > 0 {
+		diag += fmt.Sprintf(", logs=%q", logsBuf.String())
+	}
+
+	return diag
+}
+
+// Setup creates the NETWORK on each docker host if it doesn't exist yet,
+// detects the version of each daemon and fills the warm pool.
+func (p *dockerProvider) Setup(ctx gocontext.Context) error {
+	if p.networkName != "" {
+		for _, client := range p.clients {
+			err := p.ensureNetwork(ctx, client)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.selectorURL != "" {
+		err := checkDockerSelectorURL(ctx, p.selectorURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, client := range p.clients {
+		p.detectDaemonVersion(ctx, client)
+	}
+
+	// Only KERNEL_MEMORY and CPU_RT_RUNTIME depend on the cgroup version so
+	// far, so there is no need to ask the daemons otherwise.
+	if p.runKernelMem > 0 || p.cpuRTRuntime > 0 {
+		for _, client := range p.clients {
+			p.detectCgroupVersion(ctx, client)
+		}
+	}
+
+	if p.cpuRTRuntime > 0 {
+		for _, client := range p.clients {
+			if p.cgroupVersion(client) != 1 {
+				return fmt.Errorf("CPU_RT_RUNTIME requires cgroup v1, but %s uses cgroup v2", client.Endpoint())
+			}
+		}
+	}
+
+	if p.shmHuge != "" {
+		for _, client := range p.clients {
+			err := checkDockerShmHugeSupport(client)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.preloadImage != "" {
+		for _, client := range p.clients {
+			_, err := p.refreshPreloadedImage(client)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// The pool fills in the background, so that the worker starts taking
+	// jobs right away, which boot as usual until it is filled.
+	if p.warmPoolSize > 0 {
+		go p.fillWarmPool(ctx)
+	}
+
+	if p.cpuLeaseGrace > 0 {
+		go p.sweepCPUSetLeases(ctx, defaultDockerCPUSetSweepInterval)
+	}
+
+	return nil
+}
+
+// detectCgroupVersion asks the daemon which cgroup version it manages
+// containers with. go-dockerclient doesn't decode the CgroupVersion field, but
+// daemons on the unified hierarchy also report the cgroupns security option,
+// which daemons that only support cgroup v1 never do.
+func (p *dockerProvider) detectCgroupVersion(ctx gocontext.Context, client dockerClient) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_provider")
+
+	info, err := client.Info()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"err":      err,
+			"endpoint": client.Endpoint(),
+		}).Warn("couldn't get daemon info; assuming cgroup v1")
+		return
+	}
+
+	version := 1
+	for _, opt := range info.SecurityOptions {
+		if opt == "name=cgroupns" {
+			version = 2
+			logger.WithField("endpoint", client.Endpoint()).Info("daemon uses cgroup v2; omitting kernel memory limits")
+			break
+		}
+	}
+
+	p.cgroupVersionsMutex.Lock()
+	defer p.cgroupVersionsMutex.Unlock()
+
+	p.cgroupVersions[client.Endpoint()] = version
+}
+
+// detectDaemonVersion asks the client's daemon for its version once, so that
+// it can be included in the debug info of instances for correlating
+// incidents without a request per Start.
+func (p *dockerProvider) detectDaemonVersion(ctx gocontext.Context, client dockerClient) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_provider")
+
+	env, err := client.Version()
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"err":      err,
+			"endpoint": client.Endpoint(),
+		}).Warn("couldn't get daemon version")
+		return
+	}
+
+	version := env.Get("Version")
+	logger.WithFields(logrus.Fields{
+		"endpoint":       client.Endpoint(),
+		"daemon_version": version,
+	}).Info("detected daemon version")
+
+	p.daemonVersionsMutex.Lock()
+	defer p.daemonVersionsMutex.Unlock()
+
+	p.daemonVersions[client.Endpoint()] = version
+}
+
+// daemonVersion returns the version detected for the client's daemon, or an
+// empty string if it couldn't be detected.
+func (p *dockerProvider) daemonVersion(client dockerClient) string {
+	p.daemonVersionsMutex.Lock()
+	defer p.daemonVersionsMutex.Unlock()
+
+	return p.daemonVersions[client.Endpoint()]
+}
+
+// checkDockerSelectorURL checks that the image selector API answers at all,
+// as any response, even an error status, means that it is reachable.
+func checkDockerSelectorURL(ctx gocontext.Context, selectorURL string) error {
+	ctx, cancel := gocontext.WithTimeout(ctx, defaultDockerSelectorURLCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", selectorURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "invalid IMAGE_SELECTOR_URL")
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "image selector URL %q is unreachable", req.URL.Host)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// checkDockerShmHugeSupport checks that the daemon's kernel supports the huge
+// option of tmpfs, which was added in linux 4.7.
+func checkDockerShmHugeSupport(client dockerClient) error {
+	info, err := client.Info()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't get daemon info of %s to check SHM_HUGE support", client.Endpoint())
+	}
+
+	var major, minor int
+	_, err = fmt.Sscanf(info.KernelVersion, "%d.%d", &major, &minor)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't parse kernel version %q of %s", info.KernelVersion, client.Endpoint())
+	}
+
+	if major < 4 || (major == 4 && minor < 7) {
+		return fmt.Errorf("SHM_HUGE requires linux 4.7 or later, but %s runs %s", client.Endpoint(), info.KernelVersion)
+	}
+
+	return nil
+}
+
+// cgroupVersion returns the cgroup version detected for the client's daemon,
+// defaulting to v1 if it couldn't be detected.
+func (p *dockerProvider) cgroupVersion(client dockerClient) int {
+	p.cgroupVersionsMutex.Lock()
+	defer p.cgroupVersionsMutex.Unlock()
+
+	if version, ok := p.cgroupVersions[client.Endpoint()]; ok {
+		return version
+	}
+	return 1
+}
+
+// hasSourceLabels returns whether LABEL_SOURCE labels the container of the
+// job, which only a cold boot can do, as labels can't be added to the
+// containers of the warm pool once they are created.
+func (p *dockerProvider) hasSourceLabels(startAttributes *StartAttributes) bool {
+	return p.labelSource &&
+		(startAttributes.Repository != "" || startAttributes.Branch != "" || startAttributes.Commit != "")
+}
+
+// nameWarmInstance renames a container taken from the warm pool after the
+// job, as cold boots name it, so that retries of the job find it.
+func (p *dockerProvider) nameWarmInstance(ctx gocontext.Context, instance *dockerInstance) error {
+	name := dockerContainerName(ctx)
+	if name == "" {
+		return nil
+	}
+
+	err := instance.client.RenameContainer(docker.RenameContainerOptions{
+		ID:      instance.container.ID,
+		Name:    name,
+		Context: ctx,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't rename warm container to %q", name)
+	}
+
+	instance.container.Name = "/" + name
+	return nil
+}
+
+// takeWarmInstance removes an instance from the warm pool, returning nil if
+// the pool is empty. Instances that already used up half of
+// MAX_INSTANCE_LIFETIME while waiting in the pool are stopped instead of
+// handed out, so that a job doesn't get a container that is stopped under it
+// shortly after.
+func (p *dockerProvider) takeWarmInstance(logger *logrus.Entry) *dockerInstance {
+	p.warmPoolMutex.Lock()
+	defer p.warmPoolMutex.Unlock()
+
+	for len(p.warmPool) > 0 {
+		instance := p.warmPool[0]
+		p.warmPool = p.warmPool[1:]
+
+		// Registering before the pool is unlocked, also for instances
+		// about to be stopped, keeps the cpu set sweep from seeing them in
+		// neither place.
+		p.registerInstance(instance)
+
+		if p.maxLifetime == 0 || time.Since(instance.startBooting) < p.maxLifetime/2 {
+			return instance
+		}
+
+		metrics.Mark("worker.vm.provider.docker.warm_pool.expired")
+		go func() {
+			err := instance.Stop(gocontext.Background())
+			if err != nil {
+				logger.WithField("err", err).Error("couldn't stop expired warm container")
+			}
+			p.fillWarmPool(gocontext.Background())
+		}()
+	}
+
+	return nil
+}
+
+// fillWarmPool boots containers of WARM_POOL_IMAGE until the pool is full,
+// counting those still booting so that concurrent fills don't overshoot. The
+// boots take a start slot like those of jobs, so refilling the pool counts
+// against MAX_CONCURRENT_STARTS.
+func (p *dockerProvider) fillWarmPool(ctx gocontext.Context) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_provider")
+
+	for {
+		// Warm boots count as starting, so that Drain waits for them.
+		if !p.beginStart() {
+			return
+		}
+
+		p.warmPoolMutex.Lock()
+		if len(p.warmPool)+p.warmPoolBooting >= p.warmPoolSize {
+			p.warmPoolMutex.Unlock()
+			p.endStart()
+			return
+		}
+		p.warmPoolBooting++
+		p.warmPoolMutex.Unlock()
+
+		bootCtx, cancel := gocontext.WithTimeout(ctx, defaultDockerWarmPoolBootTimeout)
+		instance, err := p.boot(bootCtx, logger, &StartAttributes{}, "", p.warmPoolImage)
+		cancel()
+
+		// Drain empties the pool after it started draining, so an instance
+		// that finished booting since is stopped rather than left in the
+		// pool.
+		pooled := false
+		p.warmPoolMutex.Lock()
+		p.warmPoolBooting--
+		if err == nil && !p.isDraining() {
+			p.warmPool = append(p.warmPool, instance)
+			pooled = true
+		}
+		p.warmPoolMutex.Unlock()
+
+		if pooled {
+			p.finishBootingCPUSets(instance.client, instance.CPUSet())
+		}
+
+		if err == nil && !pooled {
+			stopErr := instance.Stop(ctx)
+			if stopErr != nil {
+				logger.WithField("err", stopErr).Error("couldn't stop warm container booted while draining")
+			}
+		}
+
+		p.endStart()
+
+		if err != nil {
+			logger.WithField("err", err).Error("couldn't boot warm pool container")
+			return
+		}
+		if !pooled {
+			return
+		}
+	}
+}
+
+// ensureNetwork creates the NETWORK bridge with the configured MTU, leaving
+// an existing network as is.
+func (p *dockerProvider) ensureNetwork(ctx gocontext.Context, client dockerClient) error {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_provider")
+
+	network, err := client.NetworkInfo(p.networkName)
+	if err == nil {
+		if p.networkMTU > 0 && network.Options[dockerNetworkMTUOption] != strconv.Itoa(p.networkMTU) {
+			logger.WithFields(logrus.Fields{
+				"network": p.networkName,
+				"mtu":     network.Options[dockerNetworkMTUOption],
+			}).Warn("existing network has a different MTU than NETWORK_MTU")
+		}
+		return nil
+	}
+
+	if _, ok := err.(*docker.NoSuchNetwork); !ok {
+		return errors.Wrapf(err, "couldn't inspect network %q", p.networkName)
+	}
+
+	options := map[string]interface{}{}
+	if p.networkMTU > 0 {
+		options[dockerNetworkMTUOption] = strconv.Itoa(p.networkMTU)
+	}
+
+	_, err = client.CreateNetwork(docker.CreateNetworkOptions{
+		Name:           p.networkName,
+		Driver:         "bridge",
+		CheckDuplicate: true,
+		Options:        options,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create network %q", p.networkName)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"network": p.networkName,
+		"mtu":     p.networkMTU,
+	}).Info("created network")
+
+	return nil
+}
+
+// Instances returns the instances started by this provider that have not yet
+// been stopped, ordered by container ID.
+func (p *dockerProvider) Instances() []Instance {
+	p.instancesMutex.Lock()
+	defer p.instancesMutex.Unlock()
+
+	ids := []string{}
+	for id := range p.instances {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	instances := []Instance{}
+	for _, id := range ids {
+		instances = append(instances, p.instances[id])
+	}
+
+	return instances
+}
+
+func (p *dockerProvider) registerInstance(instance *dockerInstance) {
+	p.instancesMutex.Lock()
+	defer p.instancesMutex.Unlock()
+
+	p.instances[instance.container.ID] = instance
+	metrics.Gauge("worker.vm.provider.docker.active", int64(len(p.instances)))
+}
+
+func (p *dockerProvider) deregisterInstance(instance *dockerInstance) {
+	p.instancesMutex.Lock()
+	defer p.instancesMutex.Unlock()
+
+	delete(p.instances, instance.container.ID)
+	metrics.Gauge("worker.vm.provider.docker.active", int64(len(p.instances)))
+	p.checkDrained()
+}
+
+// Drain stops the provider from starting new instances, which fail with
+// ErrProviderDraining, stops the containers of the warm pool and waits until
+// all active instances have been stopped, or until ctx is done. It is meant
+// to be called before shutting down, so that rollouts don't leave containers
+// behind.
+func (p *dockerProvider) Drain(ctx gocontext.Context) error {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_provider")
+
+	p.instancesMutex.Lock()
+	p.draining = true
+	if p.drained == nil {
+		p.drained = make(chan struct{})
+	}
+	drained := p.drained
+	logger.WithFields(logrus.Fields{
+		"active":   len(p.instances),
+		"starting": p.starting,
+	}).Info("draining")
+	p.checkDrained()
+	p.instancesMutex.Unlock()
+
+	p.warmPoolMutex.Lock()
+	warmPool := p.warmPool
+	p.warmPool = nil
+	p.warmPoolMutex.Unlock()
+
+	for _, instance := range warmPool {
+		err := instance.Stop(ctx)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"err":      err,
+				"instance": instance.ID(),
+			}).Error("couldn't stop warm container")
+		}
+	}
+
+	select {
+	case <-drained:
+		logger.Info("drained")
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "couldn't drain provider")
+	}
+}
+
+func (p *dockerProvider) isDraining() bool {
+	p.instancesMutex.Lock()
+	defer p.instancesMutex.Unlock()
+
+	return p.draining
+}
+
+// beginStart counts a starting instance towards the ones Drain waits for,
+// returning false if the provider is draining.
+func (p *dockerProvider) beginStart() bool {
+	p.instancesMutex.Lock()
+	defer p.instancesMutex.Unlock()
+
+	if p.draining {
+		return false
+	}
+	p.starting++
+	return true
+}
+
+func (p *dockerProvider) endStart() {
+	p.instancesMutex.Lock()
+	defer p.instancesMutex.Unlock()
+
+	p.starting--
+	p.checkDrained()
+}
+
+// checkDrained signals Drain once no instances are active or starting. It
+// must be called with instancesMutex held.
+func (p *dockerProvider) checkDrained() {
+	if !p.draining || p.drained == nil || len(p.instances) > 0 || p.starting > 0 {
+		return
+	}
+
+	close(p.drained)
+	p.drained = nil
+}
+
+// dockerConfigList returns the comma-delimited values of the given config key,
+// or nil if it isn't set or empty.
+func dockerConfigList(cfg *config.ProviderConfig, key string) []string {
+	if !cfg.IsSet(key) {
+		return nil
+	}
+
+	var values []string
+	for _, value := range strings.Split(cfg.Get(key), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// hasResourceProfile reports whether jobs of the language get resources other
+// than the global ones, which warm pool containers were booted with.
+func (p *dockerProvider) hasResourceProfile(language string) bool {
+	_, ok := p.runProfiles[language]
+	return ok
+}
+
+// imageResources returns the memory and cpus to allocate for the given image
+// on the endpoint of the client, taken from its labels where present and
+// bounded by the configured maximums, or the given ones otherwise.
+func (p *dockerProvider) imageResources(logger *logrus.Entry, client dockerClient, imageRef string, memory uint64, cpus int) (uint64, int) {
+	img, err := client.InspectImage(imageRef)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't inspect image for resource labels")
+		return memory, cpus
+	}
+	if img.Config == nil {
+		return memory, cpus
+	}
+
+	if v, ok := img.Config.Labels[dockerImageMemoryLabel]; ok {
+		parsedMemory, err := humanize.ParseBytes(v)
+		if err != nil {
+			logger.WithField("err", err).Warn("ignoring invalid image memory label")
+		} else if parsedMemory > p.maxMemory {
+			memory = p.maxMemory
+		} else {
+			memory = parsedMemory
+		}
+	}
+
+	if v, ok := img.Config.Labels[dockerImageCPUsLabel]; ok {
+		parsedCPUs, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			logger.WithField("err", err).Warn("ignoring invalid image cpus label")
+		} else if int(parsedCPUs) > p.maxCPUs {
+			cpus = p.maxCPUs
+		} else {
+			cpus = int(parsedCPUs)
+		}
+	}
+
+	return memory, cpus
+}
+
+// appendImageCmd returns the CMD of the image on the endpoint of the client
+// followed by cmd, for CMD_MODE append.
+func (p *dockerProvider) appendImageCmd(client dockerClient, imageRef string, cmd []string) ([]string, error) {
+	img, err := client.InspectImage(imageRef)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't inspect image to append to its CMD")
+	}
+
+	appended := []string{}
+	if img.Config != nil {
+		appended = append(appended, img.Config.Cmd...)
+	}
+	return append(appended, cmd...), nil
+}
+
+// checkoutCPUSets checks out count cpus on the endpoint of the given client.
+// They count as booting until finishBootingCPUSets or checkinCPUSets, at
+// most until bootDeadline, or the warm pool boot timeout from now if zero.
+func (p *dockerProvider) checkoutCPUSets(client dockerClient, count int, bootDeadline time.Time) (string, error) {
+	if count == 0 {
+		return "", nil
+	}
+
+	p.cpuSetsMutex.Lock()
+	defer p.cpuSetsMutex.Unlock()
+
+	checkedOutSets, booting, leases := p.endpointCPUSets(client.Endpoint())
+	cpuSets := []int{}
+
+	if p.cpuCores != nil {
+		cores := 0
+
+		for _, core := range p.cpuCores {
+			free := true
+			for _, cpu := range core {
+				free = free && !checkedOutSets[cpu] && p.cpuIsAllowed(cpu)
+			}
+
+			if free {
+				cpuSets = append(cpuSets, core...)
+				cores++
+			}
+
+			if cores == count {
+				break
+			}
+		}
+
+		if cores != count {
+			return "", errors.Wrapf(errDockerNoFreeCPUSets, "couldn't reserve %d whole cores", count)
+		}
+	} else {
+		for i, checkedOut := range checkedOutSets {
+			if !checkedOut && p.cpuIsAllowed(i) {
+				cpuSets = append(cpuSets, i)
+			}
+
+			if len(cpuSets) == count {
+				break
+			}
+		}
+
+		if len(cpuSets) != count {
+			return "", errDockerNoFreeCPUSets
+		}
+	}
+
+	cpuSetsString := []string{}
+	now := time.Now()
+	if bootDeadline.IsZero() {
+		bootDeadline = now.Add(defaultDockerWarmPoolBootTimeout)
+	}
+
+	for _, cpuSet := range cpuSets {
+		checkedOutSets[cpuSet] = true
+		booting[cpuSet] = bootDeadline
+		leases[cpuSet] = now
+		cpuSetsString = append(cpuSetsString, fmt.Sprintf("%d", cpuSet))
+	}
+
+	return strings.Join(cpuSetsString, ","), nil
+}
+
+// endpointCPUSets returns which cpus of the given endpoint are checked out,
+// until when those held by a container still booting boot at most and since
+// when they are checked out, and must be called with cpuSetsMutex held.
+func (p *dockerProvider) endpointCPUSets(endpoint string) ([]bool, []time.Time, []time.Time) {
+	if _, ok := p.cpuSets[endpoint]; !ok {
+		p.cpuSets[endpoint] = make([]bool, p.cpuSetSize)
+		p.cpuBooting[endpoint] = make([]time.Time, p.cpuSetSize)
+		p.cpuLeases[endpoint] = make([]time.Time, p.cpuSetSize)
+	}
+	return p.cpuSets[endpoint], p.cpuBooting[endpoint], p.cpuLeases[endpoint]
+}
+
+// cpuIsAllowed reports whether the given cpu may be allocated, which is the
+// case for all cpus unless CPU_SET_ALLOWED is set.
+func (p *dockerProvider) cpuIsAllowed(cpu int) bool {
+	return p.cpuAllowed == nil || p.cpuAllowed[cpu]
+}
+
+// cpuSetMems returns the numa nodes of the given cpu sets in the kernel's cpu
+// list format, or an empty string unless CPU_SET_STRATEGY is numa-aware.
+func (p *dockerProvider) cpuSetMems(sets string) string {
+	if p.cpuNodes == nil {
+		return ""
+	}
+
+	seen := map[int]bool{}
+	nodes := []int{}
+	for _, cpuString := range strings.Split(sets, ",") {
+		cpu, err := strconv.ParseUint(cpuString, 10, 64)
+		if err != nil || int(cpu) >= len(p.cpuNodes) {
+			continue
+		}
+
+		node := p.cpuNodes[int(cpu)]
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Ints(nodes)
+
+	mems := []string{}
+	for _, node := range nodes {
+		mems = append(mems, strconv.Itoa(node))
+	}
+
+	return strings.Join(mems, ",")
+}
+
+// commitMemory accounts for the memory of a container about to be created on
+// the endpoint of the given client, refusing it with errDockerMemoryBudget if
+// that would exceed HOST_MEMORY_BUDGET there.
+func (p *dockerProvider) commitMemory(client dockerClient, memory uint64) error {
+	if p.memoryBudget == 0 {
+		return nil
+	}
+
+	p.memoryMutex.Lock()
+	defer p.memoryMutex.Unlock()
+
+	committed := p.memoryCommitted[client.Endpoint()]
+	if committed+memory > p.memoryBudget {
+		return errors.Wrapf(errDockerMemoryBudget, "%s committed on %s, %s requested, budget %s",
+			humanize.IBytes(committed), client.Endpoint(), humanize.IBytes(memory), humanize.IBytes(p.memoryBudget))
+	}
+
+	p.memoryCommitted[client.Endpoint()] = committed + memory
+	p.gaugeMemoryCommitted()
+	return nil
+}
+
+// releaseMemory accounts for the memory of a container on the endpoint of the
+// given client that was removed or couldn't be booted.
+func (p *dockerProvider) releaseMemory(client dockerClient, memory uint64) {
+	if p.memoryBudget == 0 {
+		return
+	}
+
+	p.memoryMutex.Lock()
+	defer p.memoryMutex.Unlock()
+
+	committed := p.memoryCommitted[client.Endpoint()]
+	if memory > committed {
+		memory = committed
+	}
+	p.memoryCommitted[client.Endpoint()] = committed - memory
+	p.gaugeMemoryCommitted()
+}
+
+// gaugeMemoryCommitted reports the memory committed on all endpoints, and
+// must be called with memoryMutex held.
+func (p *dockerProvider) gaugeMemoryCommitted() {
+	total := uint64(0)
+	for _, committed := range p.memoryCommitted {
+		total += committed
+	}
+	metrics.Gauge("worker.vm.provider.docker.memory.committed", int64(total))
+}
+
+func (p *dockerProvider) checkinCPUSets(client dockerClient, sets string) {
+	p.cpuSetsMutex.Lock()
+	defer p.cpuSetsMutex.Unlock()
+
+	cpuSets, booting, leases := p.endpointCPUSets(client.Endpoint())
+	for _, cpu := range parseDockerCPUSets(sets, len(cpuSets)) {
+		cpuSets[cpu] = false
+		booting[cpu] = time.Time{}
+		leases[cpu] = time.Time{}
+	}
+}
+
+// swapCPUSets checks in the cpu sets from and checks out the cpu sets to in
+// their place, e.g. those of an adopted container, unless any of them is
+// checked out otherwise, in which case from stays checked out and false is
+// returned.
+func (p *dockerProvider) swapCPUSets(client dockerClient, from, to string) bool {
+	p.cpuSetsMutex.Lock()
+	defer p.cpuSetsMutex.Unlock()
+
+	cpuSets, booting, leases := p.endpointCPUSets(client.Endpoint())
+	fromCPUs := map[int]bool{}
+	for _, cpu := range parseDockerCPUSets(from, len(cpuSets)) {
+		fromCPUs[cpu] = true
+	}
+
+	toCPUs := parseDockerCPUSets(to, len(cpuSets))
+	for _, cpu := range toCPUs {
+		if cpuSets[cpu] && !fromCPUs[cpu] {
+			return false
+		}
+	}
+
+	now := time.Now()
+	bootDeadline := time.Time{}
+	for cpu := range fromCPUs {
+		if booting[cpu].After(bootDeadline) {
+			bootDeadline = booting[cpu]
+		}
+		cpuSets[cpu] = false
+		booting[cpu] = time.Time{}
+		leases[cpu] = time.Time{}
+	}
+	if bootDeadline.IsZero() {
+		bootDeadline = now.Add(defaultDockerWarmPoolBootTimeout)
+	}
+	for _, cpu := range toCPUs {
+		cpuSets[cpu] = true
+		booting[cpu] = bootDeadline
+		leases[cpu] = now
+	}
+	return true
+}
+
+// finishBootingCPUSets hands the cpu sets of a booted container over to its
+// instance, which must already be registered or in the warm pool, so that
+// the sweep never sees the cpus owned by neither.
+func (p *dockerProvider) finishBootingCPUSets(client dockerClient, sets string) {
+	p.cpuSetsMutex.Lock()
+	defer p.cpuSetsMutex.Unlock()
+
+	_, booting, _ := p.endpointCPUSets(client.Endpoint())
+	for _, cpu := range parseDockerCPUSets(sets, len(booting)) {
+		booting[cpu] = time.Time{}
+	}
+}
+
+// parseDockerCPUSets returns the cpus of a comma-separated cpu set, skipping
+// those that aren't below size.
+func parseDockerCPUSets(sets string, size int) []int {
+	cpus := []int{}
+	for _, cpuString := range strings.Split(sets, ",") {
+		cpu, err := strconv.ParseUint(cpuString, 10, 64)
+		if err != nil || int(cpu) >= size {
+			continue
+		}
+		cpus = append(cpus, int(cpu))
+	}
+	return cpus
+}
+
+// sweepCPUSetLeases reclaims leaked cpu sets every interval until ctx is
+// done.
+func (p *dockerProvider) sweepCPUSetLeases(ctx gocontext.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.reclaimCPUSetLeases(ctx, time.Now())
+		}
+	}
+}
+
+// reclaimCPUSetLeases checks in the cpus whose lease is older than
+// CPU_SET_LEASE_GRACE and that neither a booting container, an active
+// instance nor a warm pool container owns, returning them. This is a safety
+// net over the checkin on Stop, for cpu sets leaked by error paths. A boot
+// that didn't hand its cpus over by its boot timeout plus the grace leaked
+// them, e.g. by hanging past its deadline.
+//
+// The owners are gathered with cpuSetsMutex held, which every hand-over
+// between them also takes: booting cpus are only finished once their instance
+// is registered or pooled, and Stop checks in before deregistering. Warm pool
+// containers are registered before they leave the pool, so the pool is
+// gathered before the instances.
+func (p *dockerProvider) reclaimCPUSetLeases(ctx gocontext.Context, now time.Time) []int {
+	p.cpuSetsMutex.Lock()
+	defer p.cpuSetsMutex.Unlock()
+
+	owned := map[string]map[int]bool{}
+	markOwned := func(instance *dockerInstance) {
+		endpoint := instance.client.Endpoint()
+		if owned[endpoint] == nil {
+			owned[endpoint] = map[int]bool{}
+		}
+		for _, cpu := range parseDockerCPUSets(instance.CPUSet(), p.cpuSetSize) {
+			owned[endpoint][cpu] = true
+		}
+	}
+
+	p.warmPoolMutex.Lock()
+	for _, instance := range p.warmPool {
+		markOwned(instance)
+	}
+	p.warmPoolMutex.Unlock()
+
+	p.instancesMutex.Lock()
+	for _, instance := range p.instances {
+		markOwned(instance)
+	}
+	p.instancesMutex.Unlock()
+
+	reclaimed := []int{}
+	for endpoint, cpuSets := range p.cpuSets {
+		booting := p.cpuBooting[endpoint]
+		leases := p.cpuLeases[endpoint]
+		for cpu, checkedOut := range cpuSets {
+			stillBooting := !booting[cpu].IsZero() && now.Before(booting[cpu].Add(p.cpuLeaseGrace))
+			if !checkedOut || stillBooting || owned[endpoint][cpu] || now.Sub(leases[cpu]) < p.cpuLeaseGrace {
+				continue
+			}
+
+			cpuSets[cpu] = false
+			booting[cpu] = time.Time{}
+			leases[cpu] = time.Time{}
+			reclaimed = append(reclaimed, cpu)
+		}
+	}
+
+	if len(reclaimed) > 0 {
+		metrics.Mark("worker.vm.provider.docker.cpuset.reclaimed")
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"self": "backend/docker_provider",
+			"cpus": reclaimed,
+		}).Warn("reclaimed leaked cpu sets")
+	}
+
+	return reclaimed
+}
+
+// Refresh re-inspects the container so that its state and network settings
+// are current, keeping the config the container was created with.
+func (i *dockerInstance) Refresh(ctx gocontext.Context) error {
+	container, err := i.client.InspectContainer(i.container.ID)
+	if err != nil {
+		return err
+	}
+
+	i.stateMutex.Lock()
+	defer i.stateMutex.Unlock()
+
+	i.container.State = container.State
+	i.container.NetworkSettings = container.NetworkSettings
+
+	return nil
+}
+
+// DebugInfo gathers the container id, image, cpu set, state, network,
+// timings and daemon version of the instance in one place for logging on
+// failure. The container is inspected once, and an inspect error is reported
+// under "inspect_error".
+func (i *dockerInstance) DebugInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		"container_id":     i.container.ID,
+		"image":            i.imageName,
+		"cpuset":           i.CPUSet(),
+		"daemon_version":   i.provider.daemonVersion(i.client),
+		"state":            "unknown",
+		"ip_address":       "",
+		"network_mode":     "",
+		"created":          i.container.Created,
+		"started_at":       time.Time{},
+		"finished_at":      time.Time{},
+		"startup_duration": i.StartupDuration(),
+	}
+
+	container, err := i.client.InspectContainer(i.container.ID)
+	if err != nil {
+		info["inspect_error"] = err.Error()
+		return info
+	}
+
+	info["state"] = container.State.StateString()
+	info["exit_code"] = container.State.ExitCode
+	info["oom_killed"] = container.State.OOMKilled
+	info["started_at"] = container.State.StartedAt
+	info["finished_at"] = container.State.FinishedAt
+	if container.NetworkSettings != nil {
+		info["ip_address"] = container.NetworkSettings.IPAddress
+	}
+	if container.HostConfig != nil {
+		info["network_mode"] = container.HostConfig.NetworkMode
+	}
+
+	return info
+}
+
+// WatchEvents streams the docker events of the container, such as oom, die
+// and health_status, until ctx is done, at which point the returned channel
+// is closed.
+func (i *dockerInstance) WatchEvents(ctx gocontext.Context) (<-chan docker.APIEvents, error) {
+	listener := make(chan *docker.APIEvents, 16)
+	err := i.client.AddEventListener(listener)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan docker.APIEvents)
+	go func() {
+		defer close(events)
+		defer i.removeEventListener(listener)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-listener:
+				if !ok {
+					return
+				}
+				if event.ID != i.container.ID && event.Actor.ID != i.container.ID {
+					continue
+				}
+
+				select {
+				case events <- *event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// removeEventListener removes the listener while draining it, as the client
+// blocks on sending events to its listeners.
+func (i *dockerInstance) removeEventListener(listener chan *docker.APIEvents) {
+	removed := make(chan struct{})
+	go func() {
+		_ = i.client.RemoveEventListener(listener)
+		close(removed)
+	}()
+
+	for {
+		select {
+		case <-listener:
+		case <-removed:
+			return
+		}
+	}
+}
+
+func (i *dockerInstance) sshConnection(ctx gocontext.Context) (ssh.Connection, error) {
+	err := i.waitForIPAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	address, err := i.sshAddress()
+	if err != nil {
+		return nil, err
+	}
+
+	time.Sleep(2 * time.Second)
+
+	return i.dialSSHWithRestart(ctx, address)
+}
+
+// dialSSHWithRestart dials the container via ssh, restarting sshd with
+// SSHD_RESTART_CMD up to SSHD_RESTART_RETRIES times if the connection is
+// refused, as sshd may have died while the build was running.
+func (i *dockerInstance) dialSSHWithRestart(ctx gocontext.Context, address string) (ssh.Connection, error) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
+
+	for restarts := uint64(0); ; restarts++ {
+		conn, err := i.dialSSH(ctx, address)
+		if err == nil || len(i.provider.sshdRestartCmd) == 0 || !isDockerSSHRefusedError(err) {
+			return conn, err
+		}
+		if restarts >= i.provider.sshdRestarts {
+			return nil, errors.Wrapf(err, "ssh connection still refused after restarting sshd %d times", restarts)
+		}
+
+		metrics.Mark("worker.vm.provider.docker.sshd.restart")
+		logger.WithFields(logrus.Fields{
+			"err":     err,
+			"restart": restarts + 1,
+		}).Warn("ssh connection refused; restarting sshd")
+
+		res, err := i.runExecTTY(ctx, i.provider.sshdRestartCmd, nil, nil, ioutil.Discard, false)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't restart sshd")
+		}
+		if res.ExitCode != 0 {
+			logger.WithField("exit_code", res.ExitCode).Warn("sshd restart command failed")
+		}
+
+		select {
+		case <-time.After(defaultDockerSSHDRestartSleep):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dialSSH connects to the container via ssh. Authentication failures within
+// SSH_AUTH_GRACE of the container starting are retried up to
+// SSH_AUTH_RETRIES times, as the build user or its password may not be set
+// up yet, while later ones are persistent and returned right away.
+func (i *dockerInstance) dialSSH(ctx gocontext.Context, address string) (ssh.Connection, error) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
+
+	startedAt := i.startBooting
+	i.stateMutex.Lock()
+	if i.container.State.StartedAt.After(startedAt) {
+		startedAt = i.container.State.StartedAt
+	}
+	i.stateMutex.Unlock()
+
+	for attempt := uint64(0); ; attempt++ {
+		conn, err := i.provider.sshDialer.Dial(address, "travis", i.provider.sshDialTimeout)
+		if err == nil || !isDockerSSHAuthError(err) {
+			return conn, err
+		}
+
+		if time.Since(startedAt) > i.provider.sshAuthGrace {
+			return nil, errors.Wrap(err, "ssh authentication failed after the boot grace period")
+		}
+		if attempt >= i.provider.sshAuthRetries {
+			return nil, errors.Wrapf(err, "ssh authentication still failed after %d retries", attempt)
+		}
+
+		metrics.Mark("worker.vm.provider.docker.ssh.auth.retry")
+		logger.WithFields(logrus.Fields{
+			"err":     err,
+			"attempt": attempt + 1,
+		}).Warn("ssh authentication failed during early boot; retrying")
+
+		select {
+		case <-time.After(defaultDockerSSHAuthRetrySleep):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// isDockerSSHAuthError reports whether the ssh connection was refused
+// because none of the authentication methods were accepted.
+func isDockerSSHAuthError(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// isDockerSSHRefusedError reports whether nothing was listening for the ssh
+// connection.
+func isDockerSSHRefusedError(err error) bool {
+	return strings.Contains(err.Error(), "connection refused")
+}
+
+// waitForIPAddress refreshes the container, re-inspecting it up to
+// SSH_IP_RETRIES times while it has no IP address, as some network modes
+// only assign one a while after the container started. Without an IP address
+// the ssh dial would fail with a confusing error about ":22", so the network
+// mode is reported instead.
+func (i *dockerInstance) waitForIPAddress(ctx gocontext.Context) error {
+	for attempt := uint64(0); ; attempt++ {
+		err := i.Refresh(ctx)
+		if err != nil {
+			return err
+		}
+
+		if !i.provider.sshNeedsIP || i.ipAddress() != "" {
+			return nil
+		}
+
+		if attempt >= i.provider.ipRetries {
+			break
+		}
+
+		select {
+		case <-time.After(defaultDockerIPRetrySleep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	networkMode := i.provider.networkName
+	if i.container.HostConfig != nil && i.container.HostConfig.NetworkMode != "" {
+		networkMode = i.container.HostConfig.NetworkMode
+	}
+	if networkMode == "" {
+		networkMode = "default"
+	}
+
+	return fmt.Errorf("container has no IP address to connect to via ssh on network mode %q", networkMode)
+}
+
+// sshAddress renders the SSH_DIAL_ADDRESS_TEMPLATE for the container.
+func (i *dockerInstance) sshAddress() (string, error) {
+	buf := &bytes.Buffer{}
+	err := i.provider.sshAddress.Execute(buf, struct {
+		IP string
+		ID string
+	}{
+		IP: i.ipAddress(),
+		ID: i.container.ID,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't render ssh dial address")
+	}
+
+	return buf.String(), nil
+}
+
+// ipAddress returns the address of the container on NETWORK, or on the
+// default bridge if no NETWORK is configured.
+func (i *dockerInstance) ipAddress() string {
+	i.stateMutex.Lock()
+	defer i.stateMutex.Unlock()
+
+	if i.container.NetworkSettings == nil {
+		return ""
+	}
+
+	if i.provider.networkName != "" {
+		if network, ok := i.container.NetworkSettings.Networks[i.provider.networkName]; ok {
+			return network.IPAddress
+		}
+	}
+
+	return i.container.NetworkSettings.IPAddress
+}
+
+// UploadScript uploads the build script natively or via ssh. With
+// UPLOAD_TIMEOUT set, the upload runs in the background and is cancelled
+// once the timeout is exceeded, which also closes its ssh connection.
+func (i *dockerInstance) UploadScript(ctx gocontext.Context, script []byte) error {
+	if i.provider.uploadTimeout == 0 {
+		upload, err := i.uploadScript(ctx, script)
+		if err != nil {
+			return err
+		}
+		i.setScriptUpload(upload)
+		return nil
+	}
+
+	uploadCtx, cancel := gocontext.WithTimeout(ctx, i.provider.uploadTimeout)
+	defer cancel()
+
+	// The upload only hands back how the script is passed to the exec, so
+	// an upload finishing after the timeout doesn't change the instance.
+	type uploadResult struct {
+		upload dockerScriptUpload
+		err    error
+	}
+
+	resultChan := make(chan uploadResult, 1)
+	go func() {
+		upload, err := i.uploadScript(uploadCtx, script)
+		resultChan <- uploadResult{upload: upload, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		if result.err != nil {
+			return result.err
+		}
+		i.setScriptUpload(result.upload)
+		return nil
+	case <-uploadCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		metrics.Mark("worker.vm.provider.docker.upload.timeout")
+		return errors.Wrapf(errDockerUploadTimeout, "upload exceeded %v", i.provider.uploadTimeout)
+	}
+}
+
+// dockerScriptUpload is how an uploaded build script is passed to the exec
+// running it, if not as a file in the container.
+type dockerScriptUpload struct {
+	env   string
+	stdin []byte
+}
+
+func (i *dockerInstance) setScriptUpload(upload dockerScriptUpload) {
+	i.scriptEnv = upload.env
+	i.scriptStdin = upload.stdin
+}
+
+func (i *dockerInstance) uploadScript(ctx gocontext.Context, script []byte) (dockerScriptUpload, error) {
+	if i.runNative {
+		return i.uploadScriptNative(ctx, script)
+	}
+	return dockerScriptUpload{}, i.uploadScriptSCP(ctx, script)
+}
+
+// buildScriptPath returns the path of the build script in BUILD_HOME.
+func (p *dockerProvider) buildScriptPath() string {
+	return path.Join(p.buildHome, "build.sh")
+}
+
+// writeDockerScriptTar writes script to tw as the build script at name, with
+// size as the size recorded in its header, and closes tw. Any mismatch
+// between size and the script would leave a truncated or padded build script
+// in the container, so it is reported as an error rather than uploaded.
+func writeDockerScriptTar(tw *tar.Writer, name string, size int64, script []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0755,
+		Size: size,
+	})
+	if err != nil {
+		return errors.Wrap(err, "couldn't write build script header")
+	}
+
+	n, err := tw.Write(script)
+	if n != len(script) {
+		return fmt.Errorf("short write of build script: wrote %d of %d bytes (header size %d)", n, len(script), size)
+	}
+	if err != nil {
+		return errors.Wrap(err, "couldn't write build script")
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't finish build script archive: wrote %d bytes (header size %d)", n, size)
+	}
+
+	return nil
+}
+
+// uploadBootstrapScript writes BOOTSTRAP_SCRIPT into the container with the
+// given id, which doesn't need to be running.
+func (p *dockerProvider) uploadBootstrapScript(client dockerClient, id string) error {
+	tarBuf := &bytes.Buffer{}
+	tw := tar.NewWriter(tarBuf)
+
+	err := writeDockerScriptTar(tw, dockerBootstrapScriptPath, int64(len(p.runBootstrap)), p.runBootstrap)
+	if err != nil {
+		return err
+	}
+
+	err = client.UploadToContainer(id, docker.UploadToContainerOptions{
+		InputStream: tarBuf,
+		Path:        "/",
+	})
+	return errors.Wrap(err, "couldn't upload bootstrap script")
+}
+
+func (i *dockerInstance) uploadScriptNative(ctx gocontext.Context, script []byte) (dockerScriptUpload, error) {
+	// Passing the script to the exec saves the archive round-trips, so
+	// neither mode looks for a stale script first.
+	if i.provider.scriptViaEnv && uint64(len(script)) <= i.provider.scriptViaEnvMaxSize {
+		return dockerScriptUpload{env: base64.StdEncoding.EncodeToString(script)}, nil
+	}
+
+	if i.provider.scriptViaStdin {
+		return dockerScriptUpload{stdin: script}, nil
+	}
+
+	// A build script already being present means that the container was
+	// used before, which is the equivalent of the scp "existed" check. The
+	// tar upload overwrites it anyway, so with ALLOW_SCRIPT_OVERWRITE there
+	// is nothing to check.
+	if !i.provider.scriptOverwrite {
+		err := i.client.DownloadFromContainer(i.container.ID, docker.DownloadFromContainerOptions{
+			Path:         i.provider.buildScriptPath(),
+			OutputStream: ioutil.Discard,
+			Context:      ctx,
+		})
+		if err == nil {
+			return dockerScriptUpload{}, ErrStaleVM
+		}
+		if dockerErr, ok := err.(*docker.Error); !ok || dockerErr.Status != http.StatusNotFound {
+			return dockerScriptUpload{}, errors.Wrap(err, "couldn't check for existing build script")
+		}
+	}
+
+	tarBuf := &bytes.Buffer{}
+
+	// The daemon detects and decompresses gzipped archives by itself.
+	var gzw *gzip.Writer
+	tw := tar.NewWriter(tarBuf)
+	if i.provider.uploadCompress {
+		gzw = gzip.NewWriter(tarBuf)
+		tw = tar.NewWriter(gzw)
+	}
+
+	err := writeDockerScriptTar(tw, i.provider.buildScriptPath(), int64(len(script)), script)
+	if err != nil {
+		return dockerScriptUpload{}, err
+	}
+	if gzw != nil {
+		err = gzw.Close()
+		if err != nil {
+			return dockerScriptUpload{}, err
+		}
+	}
+
+	var upload io.Reader = bytes.NewReader(tarBuf.Bytes())
+	if i.provider.uploadProgressEvery > 0 {
+		logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
+		size := tarBuf.Len()
+
+		upload = &dockerProgressReader{
+			r:           upload,
+			reportEvery: int64(i.provider.uploadProgressEvery),
+			report: func(n int64) {
+				metrics.Gauge("worker.vm.provider.docker.upload.bytes", n)
+				logger.WithFields(logrus.Fields{
+					"bytes": n,
+					"total": size,
+				}).Debug("uploading build script")
+			},
+		}
+	}
+
+	uploadOpts := docker.UploadToContainerOptions{
+		InputStream: upload,
+		Path:        "/",
+		Context:     ctx,
+	}
+
+	return dockerScriptUpload{}, i.client.UploadToContainer(i.container.ID, uploadOpts)
+}
+
+// dockerAuditRecord is a line of the AUDIT_LOG_PATH audit log.
+type dockerAuditRecord struct {
+	Time      time.Time         `json:"time"`
+	Event     string            `json:"event"`
+	Endpoint  string            `json:"endpoint"`
+	Container string            `json:"container"`
+	Image     string            `json:"image"`
+	ImageID   string            `json:"image_id"`
+	CPUSet    string            `json:"cpuset"`
+	Memory    int64             `json:"memory"`
+	CPUShares int64             `json:"cpu_shares,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Env       []string          `json:"env,omitempty"`
+	BootedAt  time.Time         `json:"booted_at"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// dockerAuditLog appends audit records to a file from a single goroutine, so
+// that Start and Stop never wait for the disk. Records are dropped if the
+// buffer is full, e.g. because the disk hangs.
+type dockerAuditLog struct {
+	records chan *dockerAuditRecord
+}
+
+func newDockerAuditLog(path string, bufferSize int) (*dockerAuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &dockerAuditLog{records: make(chan *dockerAuditRecord, bufferSize)}
+	go l.write(f)
+	return l, nil
+}
+
+func (l *dockerAuditLog) Record(record *dockerAuditRecord) {
+	select {
+	case l.records <- record:
+	default:
+		metrics.Mark("worker.vm.provider.docker.audit.dropped")
+	}
+}
+
+func (l *dockerAuditLog) write(w io.Writer) {
+	logger := context.LoggerFromContext(gocontext.Background()).WithField("self", "backend/docker_provider")
+	enc := json.NewEncoder(w)
+
+	for record := range l.records {
+		err := enc.Encode(record)
+		if err != nil {
+			metrics.Mark("worker.vm.provider.docker.audit.error")
+			logger.WithField("err", err).Error("couldn't write audit record")
+		}
+	}
+}
+
+// dockerSecretEnvKeyRegexp matches the keys of environment variables whose
+// values are redacted from the audit log.
+var dockerSecretEnvKeyRegexp = regexp.MustCompile(`(?i)(secret|token|passw(or)?d|credential|private|api_?key|access_?key|auth)`)
+
+// redactDockerEnv returns a copy of env with the values of secret-like
+// variables replaced.
+func redactDockerEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, entry := range env {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 && dockerSecretEnvKeyRegexp.MatchString(parts[0]) {
+			entry = parts[0] + "=[REDACTED]"
+		}
+		redacted = append(redacted, entry)
+	}
+	return redacted
+}
+
+// dockerSecretArgRegexp matches secret-like KEY=VALUE assignments and
+// --key=value flags within command arguments.
+var dockerSecretArgRegexp = regexp.MustCompile(`(?i)([A-Za-z0-9_-]*(secret|token|passw(or)?d|credential|private|api_?key|access_?key|auth)[A-Za-z0-9_-]*)=('[^']*'|"[^"]*"|[^\s'"]+)`)
+
+// redactDockerCommand returns a copy of cmd with the values of secret-like
+// assignments replaced, also within arguments that are shell scripts.
+func redactDockerCommand(cmd []string) []string {
+	redacted := make([]string, 0, len(cmd))
+	for _, arg := range cmd {
+		redacted = append(redacted, dockerSecretArgRegexp.ReplaceAllString(arg, "$1=[REDACTED]"))
+	}
+	return redacted
+}
+
+// audit records the instance event to the audit log, if configured.
+func (p *dockerProvider) audit(instance *dockerInstance, event string, err error) {
+	if p.auditLog == nil {
+		return
+	}
+
+	record := &dockerAuditRecord{
+		Time:      time.Now().UTC(),
+		Event:     event,
+		Endpoint:  instance.client.Endpoint(),
+		Container: instance.container.ID,
+		Image:     instance.imageName,
+		BootedAt:  instance.startBooting.UTC(),
+	}
+	if containerConfig := instance.container.Config; containerConfig != nil {
+		record.ImageID = containerConfig.Image
+		record.CPUSet = containerConfig.CPUSet
+		record.Labels = containerConfig.Labels
+		record.Env = redactDockerEnv(containerConfig.Env)
+	}
+	if hostConfig := instance.container.HostConfig; hostConfig != nil {
+		record.Memory = hostConfig.Memory
+		record.CPUShares = hostConfig.CPUShares
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	p.auditLog.Record(record)
+}
+
+// dockerProgressReader counts the bytes read through it, reporting the total
+// whenever another reportEvery bytes were read and once more at EOF.
+type dockerProgressReader struct {
+	r           io.Reader
+	n           int64
+	reported    int64
+	reportEvery int64
+	report      func(n int64)
+}
+
+func (pr *dockerProgressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.n += int64(n)
+
+	if pr.n-pr.reported >= pr.reportEvery || (err == io.EOF && pr.n > pr.reported) {
+		pr.reported = pr.n
+		pr.report(pr.n)
+	}
+
+	return n, err
+}
+
+func (i *dockerInstance) uploadScriptSCP(ctx gocontext.Context, script []byte) error {
+	conn, err := i.sshConnection(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return i.uploadScriptViaConn(ctx, conn, script)
+}
+
+// uploadScriptViaConn uploads the build script via sftp. As the upload
+// refuses to overwrite an existing file, with ALLOW_SCRIPT_OVERWRITE it is
+// removed and the upload retried instead of failing with ErrStaleVM.
+func (i *dockerInstance) uploadScriptViaConn(ctx gocontext.Context, conn ssh.Connection, script []byte) error {
+	// The upload path is relative to the home of the ssh user, which is the
+	// default BUILD_HOME.
+	scriptPath := "build.sh"
+	if i.provider.buildHome != defaultDockerBuildHome {
+		scriptPath = i.provider.buildScriptPath()
+	}
+
+	// The sftp upload doesn't take a context, so an upload stuck on the
+	// connection is stopped by closing it once ctx is done, e.g. after
+	// UPLOAD_TIMEOUT.
+	uploaded := make(chan struct{})
+	defer close(uploaded)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-uploaded:
+		}
+	}()
+
+	existed, err := conn.UploadFile(scriptPath, script)
+	if existed && i.provider.scriptOverwrite {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"self": "backend/docker_instance",
+			"path": scriptPath,
+		}).Info("overwriting existing build script")
+
+		_, err = conn.RunCommand(dockerShellJoin([]string{"rm", "-f", scriptPath}), ioutil.Discard)
+		if err != nil {
+			return errors.Wrap(err, "couldn't remove existing build script")
+		}
+
+		existed, err = conn.UploadFile(scriptPath, script)
+	}
+	if existed {
+		return ErrStaleVM
+	}
+	if err != nil {
+		return errors.Wrap(err, "couldn't upload build script")
+	}
+
+	return nil
+}
+
+func (i *dockerInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	var (
+		res *RunResult
+		err error
+	)
+
+	// Streaming is abandoned as soon as the output sink fails, rather than
+	// dropping the rest of the output while the script keeps running.
+	runCtx, cancelRun := gocontext.WithCancel(ctx)
+	defer cancelRun()
+
+	sink := &dockerSinkWriter{w: output, failed: make(chan struct{})}
+	go func() {
+		select {
+		case <-sink.failed:
+			cancelRun()
+		case <-runCtx.Done():
+		}
+	}()
+	output = sink
+
+	if i.provider.outputTimestamps {
+		output = &dockerTimestampWriter{w: output, now: time.Now}
+	}
+
+	counter := &dockerCountingWriter{w: output}
+	startedAt := time.Now()
+
+	if i.runNative {
+		res, err = i.runScriptExec(runCtx, counter)
+	} else {
+		res, err = i.runScriptSSH(runCtx, counter)
+	}
+
+	if sinkErr := sink.Err(); sinkErr != nil {
+		res, err = &RunResult{Completed: false}, errors.Wrap(sinkErr, "output sink failed")
+	}
+
+	if res != nil {
+		res.Summary = i.runSummary(ctx, startedAt, atomic.LoadInt64(&counter.n), res.ExitCode)
+	}
+
+	return res, err
+}
+
+func (i *dockerInstance) runSummary(ctx gocontext.Context, startedAt time.Time, bytesStreamed int64, exitCode uint8) *RunSummary {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
+
+	summary := &RunSummary{
+		StartedAt:     startedAt,
+		FinishedAt:    time.Now(),
+		ExitCode:      exitCode,
+		BytesStreamed: bytesStreamed,
+	}
+
+	container, err := i.client.InspectContainer(i.container.ID)
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't inspect container for run summary")
+	} else {
+		summary.OOMKilled = container.State.OOMKilled
+	}
+
+	if i.provider.runSummaryStats {
+		peak, err := i.peakMemory(ctx)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't sample container stats for run summary")
+		}
+		summary.PeakMemoryBytes = peak
+	}
+
+	return summary
+}
+
+// peakMemory takes a single stats sample and returns the maximum memory
+// usage recorded for the container, or 0 if it's unknown. The stats of
+// cgroup v2 don't record it, so there it's read from memory.peak inside the
+// container instead, which needs kernel 5.19 or later.
+func (i *dockerInstance) peakMemory(ctx gocontext.Context) (uint64, error) {
+	statsChan := make(chan *docker.Stats, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		errChan <- i.client.Stats(docker.StatsOptions{
+			ID:      i.container.ID,
+			Stats:   statsChan,
+			Stream:  false,
+			Timeout: defaultDockerLogsDrainTimeout,
+		})
+	}()
+
+	peak := uint64(0)
+	for stats := range statsChan {
+		if stats.MemoryStats.MaxUsage > peak {
+			peak = stats.MemoryStats.MaxUsage
+		}
+	}
+
+	err := <-errChan
+	if err != nil || peak > 0 || i.provider.cgroupVersion(i.client) != 2 {
+		return peak, err
+	}
+
+	// With the host cgroup namespace memory.peak would be the host's.
+	if i.provider.cgroupnsMode == "host" {
+		return 0, nil
+	}
+
+	buf := &bytes.Buffer{}
+	res, err := i.runExecAs(ctx, "root", []string{"cat", dockerMemoryPeakPath}, nil, nil, buf, false)
+	if err != nil {
+		return 0, err
+	}
+	if res.ExitCode != 0 {
+		return 0, fmt.Errorf("couldn't read %s: %s", dockerMemoryPeakPath, strings.TrimSpace(buf.String()))
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(buf.String()), 10, 64)
+}
+
+// dockerSinkWriter remembers the first error of the wrapped writer, closing
+// failed and refusing any further writes.
+type dockerSinkWriter struct {
+	w      io.Writer
+	once   sync.Once
+	err    error
+	failed chan struct{}
+}
+
+func (sw *dockerSinkWriter) Write(p []byte) (int, error) {
+	if err := sw.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := sw.w.Write(p)
+	if err != nil {
+		sw.once.Do(func() {
+			sw.err = err
+			close(sw.failed)
+		})
+	}
+	return n, err
+}
+
+// Err returns the error the wrapped writer failed with, if any.
+func (sw *dockerSinkWriter) Err() error {
+	select {
+	case <-sw.failed:
+		return sw.err
+	default:
+		return nil
+	}
+}
+
+type dockerCountingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *dockerCountingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(&cw.n, int64(n))
+	return n, err
+}
+
+// dockerTimestampWriter prefixes each line with the time its first byte was
+// written. Partial lines are passed through right away rather than buffered,
+// so that progress output still shows up live.
+type dockerTimestampWriter struct {
+	w           io.Writer
+	now         func() time.Time
+	midLine     bool
+	prefixMutex sync.Mutex
+}
+
+func (tw *dockerTimestampWriter) Write(p []byte) (int, error) {
+	tw.prefixMutex.Lock()
+	defer tw.prefixMutex.Unlock()
+
+	buf := &bytes.Buffer{}
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !tw.midLine {
+			buf.WriteString(tw.now().UTC().Format(time.RFC3339))
+			buf.WriteByte(' ')
+		}
+		buf.Write(line)
+		tw.midLine = line[len(line)-1] != '\n'
+	}
+
+	_, err := tw.w.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (i *dockerInstance) runScriptExec(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
+
+	cmd := i.provider.execArgs()
+	env := []string{}
+	var stdin io.Reader
+	if i.scriptEnv != "" {
+		cmd = dockerScriptEnvCmd(i.provider.buildScriptPath(), cmd)
+		env = append(env, fmt.Sprintf("%s=%s", dockerScriptEnvVar, i.scriptEnv))
+	} else if i.scriptStdin != nil {
+		cmd = dockerScriptStdinCmd(i.provider.buildScriptPath(), cmd)
+		stdin = bytes.NewReader(i.scriptStdin)
+	}
+	if len(i.provider.execCgroup.files()) > 0 {
+		err := i.setupExecCgroup(ctx)
+		if err != nil {
+			logger.WithField("err", err).Warn("couldn't set up exec cgroup; running the build without EXEC_CGROUP_LIMITS")
+		} else {
+			cmd = dockerExecCgroupCmd(dockerCgroupRoot, cmd)
+		}
+	}
+
+	// The keepalive wraps the build output itself, as the exec output is
+	// discarded with OUTPUT_VIA_LOGS, and is done before returning, so that
+	// it never writes to the output once the run is over.
+	if i.provider.execKeepalive > 0 {
+		keepaliveCtx, cancelKeepalive := gocontext.WithCancel(ctx)
+		keepaliveDone := make(chan struct{})
+		defer func() {
+			cancelKeepalive()
+			<-keepaliveDone
+		}()
+
+		keepaliveOutput := &dockerKeepaliveWriter{w: output, lastWrite: time.Now()}
+		go func() {
+			defer close(keepaliveDone)
+			keepaliveOutput.keepalive(keepaliveCtx, i.provider.execKeepalive)
+		}()
+		output = keepaliveOutput
+	}
+
+	execOutput := output
+	var (
+		relayDone  chan struct{}
+		logsDone   chan struct{}
+		stopRelay  = func() {}
+		stopFollow = func() {}
+	)
+	if i.provider.outputViaLogs {
+		// The exec output is relayed to the main process so that it ends up
+		// in the container logs, which are followed separately below. Only
+		// root may open the fds of PID 1, so the build writes into a fifo
+		// that a root exec copies from until the build closes it. Each
+		// relayed line is labelled so that the output of PID 1 itself is
+		// left out of the build output.
+		res, err := i.runExecAs(ctx, "root", []string{"sh", "-c",
+			fmt.Sprintf("rm -f %s && mkfifo -m 0622 %s", dockerOutputFifoPath, dockerOutputFifoPath)}, nil, nil, ioutil.Discard, false)
+		if err == nil && res.ExitCode != 0 {
+			err = fmt.Errorf("exited with code %d", res.ExitCode)
+		}
+		if err != nil {
+			return &RunResult{Completed: false}, errors.Wrap(err, "couldn't create output fifo")
+		}
+
+		cmd = []string{"bash", "-c", dockerShellJoin(cmd) + " >" + dockerOutputFifoPath + " 2>&1"}
+		execOutput = ioutil.Discard
+
+		var relayCtx, logsCtx gocontext.Context
+		relayCtx, stopRelay = gocontext.WithCancel(ctx)
+		defer stopRelay()
+		logsCtx, stopFollow = gocontext.WithCancel(ctx)
+		defer stopFollow()
+
+		relayDone = make(chan struct{})
+		go func() {
+			defer close(relayDone)
+			_, err := i.runExecAs(relayCtx, "root", []string{"sh", "-c",
+				fmt.Sprintf(`exec awk '{ print "%s" $0; fflush() }' %s >/proc/1/fd/1`, dockerOutputLogsLabel, dockerOutputFifoPath)}, nil, nil, ioutil.Discard, false)
+			if err != nil && relayCtx.Err() == nil {
+				logger.WithField("err", err).Warn("couldn't relay output to the container logs")
+			}
+		}()
+
+		logsDone = make(chan struct{})
+		go i.followLogs(logsCtx, logger, output, logsDone)
+	}
+
+	if i.provider.logExecCommand {
+		logger.WithField("cmd", redactDockerCommand(cmd)).Info("running script via exec")
+	}
+
+	res, err := i.runExec(ctx, cmd, env, stdin, execOutput)
+	if logsDone != nil {
+		// The relay exits as soon as the build closed the fifo. It only
+		// doesn't if the build never opened it, e.g. because it failed to
+		// start.
+		if err == nil {
+			select {
+			case <-relayDone:
+			case <-time.After(defaultDockerLogsDrainTimeout):
+				logger.Debug("timed out waiting for the output relay to exit")
+			}
+		}
+		stopRelay()
+		stopFollow()
+		<-logsDone
+	}
+
+	return res, err
+}
+
+// dockerKeepaliveWriter serializes writes to the wrapped writer so that
+// keepalives can be interleaved with the build output.
+type dockerKeepaliveWriter struct {
+	mutex     sync.Mutex
+	w         io.Writer
+	lastWrite time.Time
+}
+
+func (kw *dockerKeepaliveWriter) Write(p []byte) (int, error) {
+	kw.mutex.Lock()
+	defer kw.mutex.Unlock()
+
+	kw.lastWrite = time.Now()
+	return kw.w.Write(p)
+}
+
+// keepalive writes zero bytes whenever nothing has been written for the
+// given interval, until ctx is done. The log writers don't count empty
+// writes as log activity, so they neither add to the log nor reset its
+// timeout.
+func (kw *dockerKeepaliveWriter) keepalive(ctx gocontext.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			kw.mutex.Lock()
+			if time.Since(kw.lastWrite) >= interval {
+				kw.lastWrite = time.Now()
+				_, _ = kw.w.Write([]byte{})
+			}
+			kw.mutex.Unlock()
+		}
+	}
+}
+
+// Exec runs an ad-hoc command such as a diagnostic in the running container,
+// outside of the build script.
+func (i *dockerInstance) Exec(ctx gocontext.Context, cmd []string, output io.Writer) (*RunResult, error) {
+	return i.runExec(ctx, cmd, nil, nil, output)
+}
+
+// runExec runs the given command via the docker exec API, streaming its
+// output until it exits. If stdin is given, it is attached without a tty so
+// that it isn't echoed.
+func (i *dockerInstance) runExec(ctx gocontext.Context, cmd, env []string, stdin io.Reader, output io.Writer) (*RunResult, error) {
+	return i.runExecTTY(ctx, cmd, env, stdin, output, i.provider.execRawTerminal && stdin == nil)
+}
+
+// waitForReadyProbe execs READY_PROBE_CMD until it exits 0, giving up once
+// ctx is done.
+func (i *dockerInstance) waitForReadyProbe(ctx gocontext.Context) error {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
+
+	for attempt := 1; ; attempt++ {
+		res, err := i.runExecTTY(ctx, i.provider.readyProbeCmd, nil, nil, ioutil.Discard, false)
+		if err == nil && res.ExitCode == 0 {
+			logger.WithField("attempts", attempt).Debug("ready probe succeeded")
+			return nil
+		}
+
+		logger.WithFields(logrus.Fields{
+			"attempt": attempt,
+			"err":     err,
+			"exit":    res.ExitCode,
+		}).Debug("container not ready yet")
+
+		select {
+		case <-ctx.Done():
+			metrics.Mark("worker.vm.provider.docker.ready_probe.timeout")
+			return errors.Wrapf(ctx.Err(), "ready probe %q didn't succeed after %d attempts",
+				strings.Join(i.provider.readyProbeCmd, " "), attempt)
+		case <-time.After(defaultDockerReadyProbeSleep):
+		}
+	}
+}
+
+// runExecTTY is runExec with an explicit choice of whether to allocate a
+// tty.
+func (i *dockerInstance) runExecTTY(ctx gocontext.Context, cmd, env []string, stdin io.Reader, output io.Writer, tty bool) (*RunResult, error) {
+	return i.runExecAs(ctx, "travis", cmd, env, stdin, output, tty)
+}
+
+// runExecAs is runExecTTY as the given user, e.g. root for setup that the
+// build user isn't allowed to do.
+func (i *dockerInstance) runExecAs(ctx gocontext.Context, user string, cmd, env []string, stdin io.Reader, output io.Writer, tty bool) (*RunResult, error) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
+
+	createExecOpts := docker.CreateExecOptions{
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          tty,
+		Cmd:          cmd,
+		Env:          env,
+		User:         user,
+		Container:    i.container.ID,
+	}
+	exec, err := i.client.CreateExec(createExecOpts)
+	if err != nil {
+		return &RunResult{Completed: false}, err
+	}
+
+	successChan := make(chan struct{})
+
+	startExecOpts := docker.StartExecOptions{
+		Detach:       false,
+		Success:      successChan,
+		Tty:          tty,
+		InputStream:  stdin,
+		OutputStream: output,
+		ErrorStream:  output,
+		Context:      ctx,
+
+		// IMPORTANT!  If this is false, then
+		// github.com/docker/docker/pkg/stdcopy.StdCopy is used instead of io.Copy,
+		// which will result in busted behavior unless the exec was created
+		// without a tty, as the stream is only multiplexed then.
+		RawTerminal: tty,
+	}
+
+	// Buffered, so that StartExec returning after the exec was given up on
+	// doesn't block.
+	startErrChan := make(chan error, 1)
+	go func() {
+		err := i.client.StartExec(exec.ID, startExecOpts)
+		if err != nil {
+			logger.WithField("err", err).Error("start exec error")
+		}
+		startErrChan <- err
+	}()
+
+	select {
+	case <-successChan:
+		logger.Debug("exec success; returning control to hijacked streams")
+		successChan <- struct{}{}
+	case err := <-startErrChan:
+		// StartExec failed before hijacking the connection, or the exec
+		// never got to run.
+		if err == nil {
+			err = errors.New("exec ended before its streams were attached")
+		}
+		return &RunResult{Completed: false}, errors.Wrap(err, "couldn't start exec")
+	case <-ctx.Done():
+		// A hijack succeeding late still waits for the handshake, which is
+		// finished in the background so that StartExec returns.
+		go func() {
+			select {
+			case <-successChan:
+				successChan <- struct{}{}
+			case <-startErrChan:
+			}
+		}()
+		return &RunResult{Completed: false}, ctx.Err()
+	}
+
+	for {
+		inspect, err := i.inspectExec(ctx, exec.ID)
+		if err != nil {
+			return &RunResult{Completed: false}, err
+		}
+
+		if !inspect.Running {
+			return &RunResult{Completed: true, ExitCode: uint8(inspect.ExitCode)}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return &RunResult{Completed: false}, ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// inspectExec inspects the given exec, retrying with backoff after transient
+// errors such as dropped connections to the daemon, until ctx is done.
+func (i *dockerInstance) inspectExec(ctx gocontext.Context, id string) (*docker.ExecInspect, error) {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = defaultDockerInspectExecRetrySleep
+
+	for attempt := uint64(0); ; attempt++ {
+		inspect, err := i.client.InspectExec(id)
+		if err == nil || !isTransientDockerError(err) || attempt >= i.provider.inspectExecRetries {
+			return inspect, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(b.NextBackOff()):
+		}
+	}
+}
+
+// isTransientDockerError reports whether a request that failed with err may
+// succeed when retried, which is the case for server errors of the daemon
+// and dropped connections to it. Cancelled requests and unknown errors
+// aren't retried.
+func isTransientDockerError(err error) bool {
+	cause := errors.Cause(err)
+	if urlErr, ok := cause.(*url.Error); ok {
+		cause = urlErr.Err
+	}
+	if cause == gocontext.Canceled || cause == gocontext.DeadlineExceeded {
+		return false
+	}
+
+	switch e := cause.(type) {
+	case *docker.Error:
+		return e.Status >= http.StatusInternalServerError
+	case net.Error:
+		return true
+	}
+
+	return cause == io.EOF || cause == io.ErrUnexpectedEOF || cause == docker.ErrConnectionRefused
+}
+
+// execArgs returns EXEC_CMD, passed to EXEC_SHELL as a single argument if
+// one is configured.
+func (p *dockerProvider) execArgs() []string {
+	if len(p.execShell) == 0 {
+		return p.execCmd
+	}
+
+	args := append([]string{}, p.execShell...)
+	return append(args, strings.Join(p.execCmd, " "))
+}
+
+// dockerShellJoin joins the arguments into a command line, single-quoting
+// those that the shell would otherwise split or interpret.
+func dockerShellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for idx, arg := range args {
+		safe := arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+				strings.ContainsRune("_./=:@%+,-", r))
+		}) == -1
+		if safe {
+			quoted[idx] = arg
+			continue
+		}
+
+		quoted[idx] = "'" + strings.Replace(arg, "'", `'"'"'`, -1) + "'"
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// isDockerFDExhaustedError reports whether the daemon failed because it ran
+// out of file descriptors.
+func isDockerFDExhaustedError(err error) bool {
+	return strings.Contains(err.Error(), "too many open files")
+}
+
+// isDockerPullRateLimitError returns whether the registry refused a pull as
+// too many requests, which the daemon reports either as the status or in the
+// message of the error.
+func isDockerPullRateLimitError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if dockerErr, ok := errors.Cause(err).(*docker.Error); ok && dockerErr.Status == http.StatusTooManyRequests {
+		return true
+	}
+	return strings.Contains(err.Error(), "toomanyrequests")
+}
+
+func isBusyDockerError(err error) bool {
+	dockerErr, ok := err.(*docker.Error)
+	if !ok {
+		return isTransientDockerError(err)
+	}
+
+	return dockerErr.Status == http.StatusConflict || dockerErr.Status >= http.StatusInternalServerError ||
+		strings.Contains(dockerErr.Message, "already in progress") ||
+		strings.Contains(dockerErr.Message, "device or resource busy")
+}
+
+// dockerScriptEnvCmd wraps the exec command so that the build script is first
+// decoded from the environment into place at scriptPath.
+func dockerScriptEnvCmd(scriptPath string, execCmd []string) []string {
+	scriptPath = dockerShellJoin([]string{scriptPath})
+	return []string{
+		"bash", "-c",
+		fmt.Sprintf(`echo "$%s" | base64 -d >%s && chmod 0755 %s && exec %s`,
+			dockerScriptEnvVar, scriptPath, scriptPath, dockerShellJoin(execCmd)),
+	}
+}
+
+// setupExecCgroup creates the sub-cgroup of EXEC_CGROUP_LIMITS as root, as
+// the build user can neither create it nor enable its controllers.
+func (i *dockerInstance) setupExecCgroup(ctx gocontext.Context) error {
+	buf := &bytes.Buffer{}
+	res, err := i.runExecAs(ctx, "root", dockerExecCgroupSetupCmd(dockerCgroupRoot, i.provider.execCgroup, "travis"), nil, nil, buf, false)
+	if err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("exited with code %d: %s", res.ExitCode, strings.TrimSpace(buf.String()))
+	}
+	return nil
+}
+
+// dockerExecCgroupSetupCmd creates the sub-cgroup with the given limits below
+// the cgroup v2 root. Controllers can only be enabled for the children of a
+// cgroup without processes, so the processes of the container are first moved
+// into an init leaf, which docker execs also join from then on. Moving a
+// process needs write access to the cgroup.procs of the common ancestor, so
+// the user is given that as well as access to the sub-cgroup.
+func dockerExecCgroupSetupCmd(root string, limits dockerExecCgroupLimits, user string) []string {
+	initCgroup := path.Base(dockerExecCgroupInitPath)
+	cgroup := path.Base(dockerExecCgroupPath)
+
+	steps := []string{
+		"set -e",
+		fmt.Sprintf("cd %s", dockerShellJoin([]string{root})),
+		fmt.Sprintf("mkdir -p %s %s", initCgroup, cgroup),
+		// processes that exited meanwhile can't be moved
+		fmt.Sprintf("for pid in $(cat cgroup.procs); do echo $pid >%s/cgroup.procs || ! kill -0 $pid 2>/dev/null; done", initCgroup),
+		`echo "+cpu +memory +pids" >cgroup.subtree_control`,
+	}
+	for _, file := range limits.files() {
+		steps = append(steps, fmt.Sprintf("echo %s >%s/%s", dockerShellJoin([]string{file[1]}), cgroup, file[0]))
 	}
-	return parts[0], parts[0]
+	steps = append(steps, fmt.Sprintf("chown %s cgroup.procs %s/cgroup.procs", dockerShellJoin([]string{user}), cgroup))
+
+	return []string{"sh", "-c", strings.Join(steps, "\n")}
 }
 
-func (p *dockerProvider) dockerImageIDFromName(imageName string) string {
-	images, err := p.client.ListImages(docker.ListImagesOptions{All: true})
-	if err != nil {
-		return imageName
+// dockerExecCgroupCmd wraps the exec command so that it first moves itself
+// into the sub-cgroup set up by dockerExecCgroupSetupCmd below root. If that
+// fails, the build runs without the limits and says so in its output.
+func dockerExecCgroupCmd(root string, execCmd []string) []string {
+	procs := dockerShellJoin([]string{path.Join(root, path.Base(dockerExecCgroupPath), "cgroup.procs")})
+	return []string{
+		"bash", "-c",
+		fmt.Sprintf(`echo $$ >%s || echo "couldn't move the build into its cgroup, running it without EXEC_CGROUP_LIMITS" >&2; exec %s`,
+			procs, dockerShellJoin(execCmd)),
 	}
+}
 
-	imageID, _, err := findDockerImageByTag([]string{imageName}, images)
-	if err != nil {
-		return imageName
+// dockerScriptStdinCmd wraps the exec command so that the build script is
+// first written into place at scriptPath from stdin.
+func dockerScriptStdinCmd(scriptPath string, execCmd []string) []string {
+	scriptPath = dockerShellJoin([]string{scriptPath})
+	return []string{
+		"bash", "-c",
+		fmt.Sprintf(`cat >%s && chmod 0755 %s && exec %s </dev/null`,
+			scriptPath, scriptPath, dockerShellJoin(execCmd)),
 	}
-
-	return imageID
 }
 
-func (p *dockerProvider) Start(ctx gocontext.Context, startAttributes *StartAttributes) (Instance, error) {
-	var (
-		imageID   string
-		imageName string
-	)
+// followLogs follows the build output relayed into the container logs into
+// output, reconnecting if the stream drops, until ctx is done or the container
+// exits. The logs written up to then that weren't followed yet are fetched
+// once more without following.
+func (i *dockerInstance) followLogs(ctx gocontext.Context, logger *logrus.Entry, output io.Writer, done chan struct{}) {
+	defer close(done)
 
-	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_provider")
+	logsOutput := &dockerLogsWriter{w: output, last: time.Now(), label: []byte(dockerOutputLogsLabel)}
+	logsOpts := func(ctx gocontext.Context, follow bool) docker.LogsOptions {
+		return docker.LogsOptions{
+			Context:      ctx,
+			Container:    i.container.ID,
+			OutputStream: logsOutput,
+			Follow:       follow,
+			Stdout:       true,
+			Since:        logsOutput.last.Unix(),
+			Timestamps:   true,
+		}
+	}
 
-	if startAttributes.ImageName != "" {
-		imageName = startAttributes.ImageName
-	} else {
-		imageIDName, err := p.imageSelector.Select(&image.Params{
-			Language: startAttributes.Language,
-			Infra:    "docker",
-		})
+	for ctx.Err() == nil {
+		logsOutput.reset()
+		err := i.client.Logs(logsOpts(ctx, true))
+		if ctx.Err() != nil {
+			break
+		}
 		if err != nil {
-			logger.WithField("err", err).Error("couldn't select image")
-			return nil, err
+			logger.WithField("err", err).Warn("following container logs failed; reconnecting")
 		}
 
-		if strings.Contains(imageIDName, ";") {
-			imageID, imageName = dockerImageIDNameFromSelection(imageIDName)
-		} else {
-			imageName = imageIDName
+		container, err := i.client.InspectContainer(i.container.ID)
+		if err != nil || !container.State.Running {
+			break
 		}
-	}
 
-	if imageID == "" {
-		imageID = p.dockerImageIDFromName(imageName)
+		select {
+		case <-ctx.Done():
+		case <-time.After(500 * time.Millisecond):
+		}
 	}
 
-	dockerConfig := &docker.Config{
-		Cmd:      p.runCmd,
-		Image:    imageID,
-		Memory:   int64(p.runMemory),
-		Hostname: fmt.Sprintf("testing-docker-%s", uuid.NewRandom()),
-	}
+	drainCtx, cancel := gocontext.WithTimeout(gocontext.Background(), defaultDockerLogsDrainTimeout)
+	defer cancel()
 
-	dockerHostConfig := &docker.HostConfig{
-		Privileged: p.runPrivileged,
-		Memory:     int64(p.runMemory),
-		ShmSize:    int64(p.runShm),
-		Tmpfs:      p.tmpFs,
-		CPUSet:     strconv.Itoa(p.runCPUs),
+	logsOutput.reset()
+	err := i.client.Logs(logsOpts(drainCtx, false))
+	if err != nil {
+		logger.WithField("err", err).Warn("couldn't fetch the remaining container logs")
 	}
-
-	cpuSets, err := p.checkoutCPUSets()
+	err = logsOutput.flush()
 	if err != nil {
-		logger.WithField("err", err).Error("couldn't checkout CPUSets")
-		return nil, err
+		logger.WithField("err", err).Warn("couldn't write the remaining container logs")
 	}
-	logger.WithField("cpu_sets", cpuSets).Info("checked out")
+}
 
-	if cpuSets != "" {
-		dockerConfig.CPUSet = cpuSets
-		dockerHostConfig.CPUSet = cpuSets
+// dockerLogsWriter writes container log lines, which are prefixed with their
+// timestamp, to w without it. Lines that aren't newer than the last one
+// written are skipped, as Since only has a resolution of seconds and
+// reconnecting with it repeats lines. With a label, only the lines that have
+// it are written, without it.
+type dockerLogsWriter struct {
+	w     io.Writer
+	last  time.Time
+	label []byte
+	buf   []byte
+}
+
+func (lw *dockerLogsWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		idx := bytes.IndexByte(lw.buf, '\n')
+		if idx < 0 {
+			return len(p), nil
+		}
+
+		line := lw.buf[:idx+1]
+		lw.buf = lw.buf[idx+1:]
+		err := lw.writeLine(line)
+		if err != nil {
+			return len(p), err
+		}
 	}
+}
 
-	logger.WithFields(logrus.Fields{
-		"config":      fmt.Sprintf("%#v", dockerConfig),
-		"host_config": fmt.Sprintf("%#v", dockerHostConfig),
-	}).Debug("creating container")
-
-	// FIXME: This doesn't seem to create the container with the Config and HostConfig
-	container, err := p.client.CreateContainer(docker.CreateContainerOptions{
-		Config:     dockerConfig,
-		HostConfig: dockerHostConfig,
-	})
-	container.Config = dockerConfig
-	container.HostConfig = dockerHostConfig
+// reset drops a line that a dropped stream cut off, as fetching the logs
+// again repeats it in full.
+func (lw *dockerLogsWriter) reset() {
+	lw.buf = nil
+}
 
-	if err != nil {
-		logger.WithField("err", err).Error("couldn't create container")
+// flush writes a last line that didn't end in a newline.
+func (lw *dockerLogsWriter) flush() error {
+	if len(lw.buf) == 0 {
+		return nil
+	}
 
-		if container != nil {
-			err := p.client.RemoveContainer(docker.RemoveContainerOptions{
-				ID:            container.ID,
-				RemoveVolumes: true,
-				Force:         true,
-			})
-			if err != nil {
-				logger.WithField("err", err).Error("couldn't remove container after create failure")
-			}
+	line := lw.buf
+	lw.buf = nil
+	return lw.writeLine(line)
+}
+
+func (lw *dockerLogsWriter) writeLine(line []byte) error {
+	parts := bytes.SplitN(line, []byte(" "), 2)
+	ts, err := time.Parse(time.RFC3339Nano, string(parts[0]))
+	if err == nil && len(parts) == 2 {
+		if !ts.After(lw.last) {
+			return nil
 		}
+		lw.last = ts
+		line = parts[1]
+	}
 
-		return nil, err
+	if lw.label != nil {
+		if !bytes.HasPrefix(line, lw.label) {
+			return nil
+		}
+		line = line[len(lw.label):]
 	}
 
-	startBooting := time.Now()
+	_, err = lw.w.Write(line)
+	return err
+}
 
-	err = p.client.StartContainer(container.ID, dockerHostConfig)
+func (i *dockerInstance) runScriptSSH(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
+	conn, err := i.sshConnection(ctx)
 	if err != nil {
-		return nil, err
+		return &RunResult{Completed: false}, errors.Wrap(err, "couldn't connect to SSH server")
 	}
+	defer conn.Close()
 
-	containerReady := make(chan *docker.Container)
-	errChan := make(chan error)
-	go func(id string) {
-		for {
-			container, err := p.client.InspectContainer(id)
-			container.Config = dockerConfig
-			container.HostConfig = dockerHostConfig
-			if err != nil {
-				errChan <- err
-				return
-			}
+	cmd := dockerShellJoin(i.provider.execArgs())
+	if i.provider.logExecCommand {
+		context.LoggerFromContext(ctx).WithFields(logrus.Fields{
+			"self": "backend/docker_instance",
+			"cmd":  redactDockerCommand([]string{cmd})[0],
+		}).Info("running script via ssh")
+	}
 
-			if container.State.Running {
-				containerReady <- container
-				return
-			}
+	// The channel is buffered so the goroutine never blocks on a run that
+	// was cancelled.
+	resultChan := make(chan struct {
+		exitStatus uint8
+		err        error
+	}, 1)
+
+	go func() {
+		exitStatus, err := conn.RunCommand(cmd, output)
+		resultChan <- struct {
+			exitStatus uint8
+			err        error
+		}{
+			exitStatus,
+			err,
 		}
-	}(container.ID)
+	}()
 
 	select {
-	case container := <-containerReady:
-		metrics.TimeSince("worker.vm.provider.docker.boot", startBooting)
-		return &dockerInstance{
-			client:       p.client,
-			provider:     p,
-			runNative:    p.runNative,
-			container:    container,
-			imageName:    imageName,
-			startBooting: startBooting,
-		}, nil
-	case err := <-errChan:
-		return nil, err
+	case result := <-resultChan:
+		return &RunResult{Completed: result.err == nil, ExitCode: result.exitStatus}, errors.Wrap(result.err, "error running script")
 	case <-ctx.Done():
-		if ctx.Err() == gocontext.DeadlineExceeded {
-			metrics.Mark("worker.vm.provider.docker.boot.timeout")
-		}
-		return nil, ctx.Err()
+		// Closing the connection ends the session, so the script doesn't
+		// keep running after the job gave up on it.
+		conn.Close()
+		return &RunResult{Completed: false}, ctx.Err()
 	}
 }
 
-func (p *dockerProvider) Setup(ctx gocontext.Context) error { return nil }
-
-func (p *dockerProvider) checkoutCPUSets() (string, error) {
-	p.cpuSetsMutex.Lock()
-	defer p.cpuSetsMutex.Unlock()
-
-	cpuSets := []int{}
-
-	for i, checkedOut := range p.cpuSets {
-		if !checkedOut {
-			cpuSets = append(cpuSets, i)
-		}
+func (i *dockerInstance) Stop(ctx gocontext.Context) error {
+	i.stopMutex.Lock()
+	defer i.stopMutex.Unlock()
 
-		if len(cpuSets) == p.runCPUs {
-			break
-		}
+	if i.stopped {
+		return nil
 	}
 
-	if len(cpuSets) != p.runCPUs {
-		return "", fmt.Errorf("not enough free CPUsets")
+	if i.lifetimeTimer != nil {
+		i.lifetimeTimer.Stop()
 	}
 
-	cpuSetsString := []string{}
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
 
-	for _, cpuSet := range cpuSets {
-		p.cpuSets[cpuSet] = true
-		cpuSetsString = append(cpuSetsString, fmt.Sprintf("%d", cpuSet))
-	}
+	// The cleanup steps run in order: stopping the container, removing it
+	// and then releasing what the provider set aside for it. Each step runs
+	// even when an earlier one failed, so that a container that couldn't be
+	// stopped is still force-removed and its cpu set doesn't leak. The
+	// instance only counts as stopped once the container is gone, so that
+	// calling Stop again retries what failed.
+	var errs dockerStopErrors
 
-	return strings.Join(cpuSetsString, ","), nil
-}
+	if !i.halted {
+		// A paused container can neither exec, be stopped nor be killed, so
+		// it is unpaused first, or else only force-removed.
+		running := true
+		if i.paused {
+			err := i.client.UnpauseContainer(i.container.ID)
+			if err != nil {
+				logger.WithField("err", err).Warn("couldn't unpause container; removing it")
+				running = false
+			} else {
+				i.paused = false
+			}
+		}
 
-func (p *dockerProvider) checkinCPUSets(sets string) {
-	p.cpuSetsMutex.Lock()
-	defer p.cpuSetsMutex.Unlock()
+		if running {
+			if len(i.provider.postExecCmd) > 0 {
+				i.postExec(ctx)
+			}
 
-	for _, cpuString := range strings.Split(sets, ",") {
-		cpu, err := strconv.ParseUint(cpuString, 10, 64)
-		if err != nil {
-			continue
+			err := i.stopContainer()
+			if err != nil {
+				logger.WithField("err", err).Error("couldn't stop container; removing it")
+				errs = append(errs, err)
+			} else if i.provider.stopWait > 0 {
+				i.waitForExit(ctx, i.provider.stopWait)
+			}
 		}
-		p.cpuSets[int(cpu)] = false
+		i.halted = len(errs) == 0
 	}
-}
 
-func (i *dockerInstance) sshConnection() (ssh.Connection, error) {
-	var err error
-	i.container, err = i.client.InspectContainer(i.container.ID)
+	err := i.removeContainer(ctx)
 	if err != nil {
-		return nil, err
+		errs = append(errs, err)
 	}
 
-	time.Sleep(2 * time.Second)
+	// The cpu sets are checked in before the instance is deregistered, so
+	// that the cpu set sweep never sees them owned by nobody and reclaims
+	// them after they were handed out again.
+	if !i.released {
+		i.provider.releaseMemory(i.client, i.memory)
+		i.provider.checkinCPUSets(i.client, i.CPUSet())
+		i.provider.deregisterInstance(i)
+		i.released = true
+	}
 
-	return i.provider.sshDialer.Dial(fmt.Sprintf("%s:22", i.container.NetworkSettings.IPAddress), "travis", i.provider.sshDialTimeout)
+	err = errs.err()
+	i.stopped = err == nil
+	i.provider.audit(i, "stop", err)
+	return err
 }
 
-func (i *dockerInstance) UploadScript(ctx gocontext.Context, script []byte) error {
-	if i.runNative {
-		return i.uploadScriptNative(ctx, script)
+// stopContainer stops or, with STOP_MODE "kill", kills the container. A
+// container that is already gone counts as stopped.
+func (i *dockerInstance) stopContainer() error {
+	var err error
+	if i.provider.stopKill {
+		err = i.client.KillContainer(docker.KillContainerOptions{
+			ID:     i.container.ID,
+			Signal: i.provider.stopSignal,
+		})
+	} else {
+		err = i.client.StopContainer(i.container.ID, 30)
+	}
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return nil
 	}
-	return i.uploadScriptSCP(ctx, script)
+	return err
 }
 
-func (i *dockerInstance) uploadScriptNative(ctx gocontext.Context, script []byte) error {
-	tarBuf := &bytes.Buffer{}
-	tw := tar.NewWriter(tarBuf)
-	err := tw.WriteHeader(&tar.Header{
-		Name: "/home/travis/build.sh",
-		Mode: 0755,
-		Size: int64(len(script)),
-	})
-	if err != nil {
-		return err
-	}
-	_, err = tw.Write(script)
-	if err != nil {
-		return err
-	}
-	err = tw.Close()
-	if err != nil {
-		return err
-	}
+// dockerStopErrors collects the errors of the cleanup steps of Stop.
+type dockerStopErrors []error
 
-	uploadOpts := docker.UploadToContainerOptions{
-		InputStream: bytes.NewReader(tarBuf.Bytes()),
-		Path:        "/",
+func (e dockerStopErrors) Error() string {
+	msgs := make([]string, len(e))
+	for n, err := range e {
+		msgs[n] = err.Error()
 	}
-
-	return i.client.UploadToContainer(i.container.ID, uploadOpts)
+	return strings.Join(msgs, "; ")
 }
 
-func (i *dockerInstance) uploadScriptSCP(ctx gocontext.Context, script []byte) error {
-	conn, err := i.sshConnection()
-	if err != nil {
-		return err
+// err returns nil without errors and a single error as is.
+func (e dockerStopErrors) err() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	default:
+		return e
 	}
-	defer conn.Close()
+}
 
-	existed, err := conn.UploadFile("build.sh", script)
-	if existed {
-		return ErrStaleVM
+// Pause freezes all processes of the container, e.g. to throttle it or to
+// inspect it while debugging, until Unpause is called.
+func (i *dockerInstance) Pause(ctx gocontext.Context) error {
+	i.stopMutex.Lock()
+	defer i.stopMutex.Unlock()
+
+	if i.released {
+		return fmt.Errorf("can't pause stopped container")
 	}
+
+	err := i.client.PauseContainer(i.container.ID)
 	if err != nil {
-		return errors.Wrap(err, "couldn't upload build script")
+		return errors.Wrap(err, "couldn't pause container")
 	}
 
+	i.paused = true
 	return nil
 }
 
-func (i *dockerInstance) RunScript(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
-	if i.runNative {
-		return i.runScriptExec(ctx, output)
-	}
-	return i.runScriptSSH(ctx, output)
-}
+// Unpause resumes the processes of a container paused with Pause.
+func (i *dockerInstance) Unpause(ctx gocontext.Context) error {
+	i.stopMutex.Lock()
+	defer i.stopMutex.Unlock()
 
-func (i *dockerInstance) runScriptExec(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
-	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
-	createExecOpts := docker.CreateExecOptions{
-		AttachStdin:  false,
-		AttachStdout: true,
-		AttachStderr: true,
-		Tty:          true,
-		Cmd:          i.provider.execCmd,
-		User:         "travis",
-		Container:    i.container.ID,
+	if i.released {
+		return fmt.Errorf("can't unpause stopped container")
 	}
-	exec, err := i.client.CreateExec(createExecOpts)
+
+	err := i.client.UnpauseContainer(i.container.ID)
 	if err != nil {
-		return &RunResult{Completed: false}, err
+		return errors.Wrap(err, "couldn't unpause container")
 	}
 
-	successChan := make(chan struct{})
+	i.paused = false
+	return nil
+}
 
-	startExecOpts := docker.StartExecOptions{
-		Detach:       false,
-		Success:      successChan,
-		Tty:          true,
-		OutputStream: output,
-		ErrorStream:  output,
+// removeContainer removes the container, retrying with backoff while the
+// daemon is busy, e.g. with "removal already in progress" or "device or
+// resource busy" errors. A container that is already gone counts as removed.
+func (i *dockerInstance) removeContainer(ctx gocontext.Context) error {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
 
-		// IMPORTANT!  If this is false, then
-		// github.com/docker/docker/pkg/stdcopy.StdCopy is used instead of io.Copy,
-		// which will result in busted behavior.
-		RawTerminal: true,
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = defaultDockerRemoveRetrySleep
+
+	for attempt := uint64(0); ; attempt++ {
+		err := i.client.RemoveContainer(docker.RemoveContainerOptions{
+			ID:            i.container.ID,
+			RemoveVolumes: i.provider.removeVolumes,
+			Force:         true,
+		})
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			return nil
+		}
+		if err == nil || !isBusyDockerError(err) || attempt >= i.provider.removeRetries {
+			return err
+		}
+
+		logger.WithFields(logrus.Fields{
+			"err":     err,
+			"attempt": attempt + 1,
+		}).Warn("couldn't remove container; retrying")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(b.NextBackOff()):
+		}
 	}
+}
+
+// postExec runs the POST_EXEC_CMD cleanup command, logging rather than
+// returning errors and giving up after a short timeout so that it never
+// blocks teardown.
+func (i *dockerInstance) postExec(ctx gocontext.Context) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
 
+	errChan := make(chan error, 1)
 	go func() {
-		err := i.client.StartExec(exec.ID, startExecOpts)
-		if err != nil {
-			// not much to be done about it, though...
-			logger.WithField("err", err).Error("start exec error")
+		res, err := i.runExec(ctx, i.provider.postExecCmd, nil, nil, ioutil.Discard)
+		if err == nil && res.ExitCode != 0 {
+			err = fmt.Errorf("exited with code %d", res.ExitCode)
 		}
+		errChan <- err
 	}()
 
-	<-successChan
-	logger.Debug("exec success; returning control to hijacked streams")
-	successChan <- struct{}{}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			logger.WithField("err", err).Warn("post exec cleanup failed")
+		}
+	case <-time.After(defaultDockerPostExecTimeout):
+		logger.WithField("timeout", defaultDockerPostExecTimeout).Warn("timed out waiting for post exec cleanup")
+	}
+}
+
+// waitForExit polls the container until it is no longer running, giving up
+// after the given timeout or once ctx is done so that removal can be forced.
+func (i *dockerInstance) waitForExit(ctx gocontext.Context, timeout time.Duration) {
+	logger := context.LoggerFromContext(ctx).WithField("self", "backend/docker_instance")
+	deadline := time.Now().Add(timeout)
 
 	for {
-		inspect, err := i.client.InspectExec(exec.ID)
+		container, err := i.client.InspectContainer(i.container.ID)
 		if err != nil {
-			return &RunResult{Completed: false}, err
+			logger.WithField("err", err).Warn("couldn't inspect container while waiting for exit")
+			return
 		}
 
-		if !inspect.Running {
-			return &RunResult{Completed: true, ExitCode: uint8(inspect.ExitCode)}, nil
+		if !container.State.Running {
+			return
 		}
 
-		time.Sleep(500 * time.Millisecond)
-	}
-}
+		if time.Now().After(deadline) {
+			logger.WithField("timeout", timeout).Warn("timed out waiting for container to exit")
+			return
+		}
 
-func (i *dockerInstance) runScriptSSH(ctx gocontext.Context, output io.Writer) (*RunResult, error) {
-	conn, err := i.sshConnection()
-	if err != nil {
-		return &RunResult{Completed: false}, errors.Wrap(err, "couldn't connect to SSH server")
+		select {
+		case <-ctx.Done():
+			logger.WithField("err", ctx.Err()).Warn("gave up waiting for container to exit")
+			return
+		case <-time.After(defaultDockerStopPollSleep):
+		}
 	}
-	defer conn.Close()
-
-	exitStatus, err := conn.RunCommand(strings.Join(i.provider.execCmd, " "), output)
-
-	return &RunResult{Completed: err != nil, ExitCode: exitStatus}, errors.Wrap(err, "error running script")
 }
 
-func (i *dockerInstance) Stop(ctx gocontext.Context) error {
-	defer i.provider.checkinCPUSets(i.container.Config.CPUSet)
-
-	err := i.client.StopContainer(i.container.ID, 30)
+// WaitExit blocks until the container has exited or ctx is done, returning
+// its exit code. A container that is already gone, e.g. removed by Stop, has
+// exit code -1.
+func (i *dockerInstance) WaitExit(ctx gocontext.Context) (int, error) {
+	exitCode, err := i.client.WaitContainerWithContext(i.container.ID, ctx)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return -1, nil
+	}
 	if err != nil {
-		return err
+		return 0, errors.Wrap(err, "couldn't wait for container to exit")
 	}
 
-	return i.client.RemoveContainer(docker.RemoveContainerOptions{
-		ID:            i.container.ID,
-		RemoveVolumes: true,
-		Force:         true,
-	})
+	return exitCode, nil
 }
 
 func (i *dockerInstance) ID() string {
@@ -630,6 +6095,12 @@ func (i *dockerInstance) ID() string {
 	return fmt.Sprintf("%s:%s", i.container.ID[0:7], i.imageName)
 }
 
+// CPUSet returns the cpus allocated to the container, which are checked in
+// again on Stop, or an empty string if CPUS is 0.
+func (i *dockerInstance) CPUSet() string {
+	return i.cpuSet
+}
+
 func (i *dockerInstance) StartupDuration() time.Duration {
 	if i.container == nil {
 		return zeroDuration
@@ -637,10 +6108,42 @@ func (i *dockerInstance) StartupDuration() time.Duration {
 	return i.startBooting.Sub(i.container.Created)
 }
 
+// AvailableLanguages returns the languages this host has "travis:<lang>"
+// images for, i.e. the languages the tag image selector can serve without
+// falling back to the default image, on the first endpoint that answers. It
+// returns nil if images can't be listed.
+func (p *dockerProvider) AvailableLanguages() []string {
+	images, err := listDockerImages(p.clients)
+	if err != nil {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	languages := []string{}
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if !strings.HasPrefix(tag, "travis:") {
+				continue
+			}
+
+			language := strings.TrimPrefix(tag, "travis:")
+			if language == "" || language == "default" || seen[language] {
+				continue
+			}
+
+			seen[language] = true
+			languages = append(languages, language)
+		}
+	}
+
+	sort.Strings(languages)
+	return languages
+}
+
 func (s *dockerTagImageSelector) Select(params *image.Params) (string, error) {
-	images, err := s.client.ListImages(docker.ListImagesOptions{All: true})
+	images, err := listDockerImages(s.clients)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to list docker images")
+		return "", err
 	}
 
 	_, imageName, err := findDockerImageByTag([]string{
@@ -653,6 +6156,31 @@ func (s *dockerTagImageSelector) Select(params *image.Params) (string, error) {
 	return imageName, err
 }
 
+var dockerSignals = map[string]docker.Signal{
+	"HUP":  docker.SIGHUP,
+	"INT":  docker.SIGINT,
+	"QUIT": docker.SIGQUIT,
+	"KILL": docker.SIGKILL,
+	"USR1": docker.SIGUSR1,
+	"USR2": docker.SIGUSR2,
+	"TERM": docker.SIGTERM,
+}
+
+// parseDockerSignal parses a signal given by name, with or without the "SIG"
+// prefix, or by number.
+func parseDockerSignal(s string) (docker.Signal, error) {
+	name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "SIG")
+	if signal, ok := dockerSignals[name]; ok {
+		return signal, nil
+	}
+
+	n, err := strconv.ParseUint(name, 10, 8)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("unknown signal %q", s)
+	}
+	return docker.Signal(n), nil
+}
+
 func findDockerImageByTag(searchTags []string, images []docker.APIImages) (string, string, error) {
 	for _, searchTag := range searchTags {
 		for _, image := range images {
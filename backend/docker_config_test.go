@@ -0,0 +1,487 @@
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/worker/config"
+)
+
+func TestNewDockerProvider_WithInvalidPrivileged(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"PRIVILEGED": "fafafaf",
+	})
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithMissingEndpoint(t *testing.T) {
+	provider, err := newDockerProvider(config.ProviderConfigFromMap(map[string]string{}))
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithDockerHost(t *testing.T) {
+	provider, err := newDockerProvider(config.ProviderConfigFromMap(map[string]string{
+		"HOST": "tcp://fleeflahflew.example.com:8080",
+	}))
+	assert.Nil(t, err)
+	assert.NotNil(t, provider)
+}
+
+func TestNewDockerProvider_WithRequiredConfig(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(nil)
+
+	assert.Nil(t, err)
+	assert.NotNil(t, provider)
+	assert.NotNil(t, provider.client)
+	assert.False(t, provider.runNative)
+	assert.False(t, provider.runPrivileged)
+	assert.Equal(t, uint64(1024*1024*1024*4), provider.runMemory)
+	assert.Equal(t, 3, provider.cpuSetSize)
+	assert.Equal(t, []string{"/sbin/init"}, provider.runCmd)
+	assert.Equal(t, 2, provider.runCPUs)
+}
+
+func TestNewDockerProvider_WithNative(t *testing.T) {
+	provider, err := newDockerProvider(config.ProviderConfigFromMap(map[string]string{
+		"HOST":   "tcp://fleeflahflew.example.com:8080",
+		"NATIVE": "1",
+	}))
+	assert.Nil(t, err)
+	assert.NotNil(t, provider)
+	assert.True(t, provider.(*dockerProvider).runNative)
+
+	provider, err = newDockerProvider(config.ProviderConfigFromMap(map[string]string{
+		"HOST":   "tcp://fleeflahflew.example.com:8080",
+		"NATIVE": "wat",
+	}))
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithCMD(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CMD": "/bin/bash /fancy-docker-init-thing",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/bin/bash", "/fancy-docker-init-thing"}, provider.runCmd)
+}
+
+func TestNewDockerProvider_WithMemory(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"MEMORY": "99MB",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0x5e69ec0), provider.runMemory)
+}
+
+func TestNewDockerProvider_WithInvalidResources(t *testing.T) {
+	for key, value := range map[string]string{
+		"MEMORY": "4 gigs",
+		"SHM":    "64MiBB",
+		"CPUS":   "two",
+	} {
+		provider, _, err := dockerTestNewProvider(map[string]string{
+			key: value,
+		})
+
+		assert.NotNil(t, err, key)
+		assert.Contains(t, err.Error(), "invalid "+key)
+		assert.Nil(t, provider, key)
+	}
+}
+
+func TestNewDockerProvider_WithPlatform(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"PLATFORM": "linux/arm64",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "linux/arm64", provider.runPlatform)
+}
+
+func TestNewDockerProvider_WithTmpfsMap(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"TMPFS_MAP": "/run:rw,nosuid,size=65536k /var/tmp/:noexec,mode=1777",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"/run":     "rw,nosuid,size=65536k",
+		"/var/tmp": "noexec,mode=1777",
+		"/tmp":     "rw,nosuid,nodev,exec,mode=1777,size=524288k",
+	}, provider.tmpFs)
+}
+
+func TestNewDockerProvider_WithInvalidTmpfsMap(t *testing.T) {
+	for _, tmpfsMap := range []string{
+		"run:rw",
+		"/run:rw,bogus",
+		"/run:size",
+		"/run:noexec=1",
+	} {
+		provider, _, err := dockerTestNewProvider(map[string]string{
+			"TMPFS_MAP": tmpfsMap,
+		})
+
+		assert.NotNil(t, err, tmpfsMap)
+		assert.Nil(t, provider, tmpfsMap)
+	}
+}
+
+func TestNewDockerProvider_WithInvalidAnnotations(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"ANNOTATIONS": "io.kubernetes.cri.sandbox-id=abc nope",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithInvalidMountDockerSockMode(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"MOUNT_DOCKER_SOCK":      "true",
+		"MOUNT_DOCKER_SOCK_MODE": "rwx",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithEndpoints(t *testing.T) {
+	provider, err := newDockerProvider(config.ProviderConfigFromMap(map[string]string{
+		"ENDPOINTS": "tcp://one.example.com:2375, tcp://two.example.com:2375,",
+	}))
+	assert.Nil(t, err)
+	assert.Len(t, provider.(*dockerProvider).clients, 2)
+	assert.Equal(t, "tcp://one.example.com:2375", provider.(*dockerProvider).client.Endpoint())
+}
+
+func TestNewDockerProvider_WithInvalidDNSOptions(t *testing.T) {
+	for _, opts := range []string{"ndots", "ndots:two", "rotate:1", "bogus"} {
+		provider, _, err := dockerTestNewProvider(map[string]string{
+			"DNS_OPTIONS": opts,
+		})
+
+		assert.NotNil(t, err, opts)
+		assert.Nil(t, provider, opts)
+	}
+}
+
+func TestNewDockerProvider_WithInvalidSecretsOwner(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"SECRETS_OWNER": "travis",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithNetworkMTUWithoutNetwork(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"NETWORK_MTU": "1400",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithInvalidNetworkMTU(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"NETWORK":     "travis",
+		"NETWORK_MTU": "-1",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithTmpTmpfsSize(t *testing.T) {
+	for _, tc := range []struct {
+		cfg      map[string]string
+		expected map[string]string
+	}{
+		{
+			cfg: map[string]string{"TMP_TMPFS_SIZE": "1GiB"},
+			expected: map[string]string{
+				"/run": "rw,nosuid,nodev,exec,noatime,size=65536k",
+				"/tmp": "rw,nosuid,nodev,exec,mode=1777,size=1048576k",
+			},
+		},
+		{
+			cfg: map[string]string{"TMP_TMPFS_SIZE": "0"},
+			expected: map[string]string{
+				"/run": "rw,nosuid,nodev,exec,noatime,size=65536k",
+			},
+		},
+		{
+			cfg: map[string]string{"TMP_TMPFS_SIZE": "100", "TMPFS_MAP": "/var/tmp:rw"},
+			expected: map[string]string{
+				"/var/tmp": "rw",
+				"/tmp":     "rw,nosuid,nodev,exec,mode=1777,size=1k",
+			},
+		},
+		{
+			cfg: map[string]string{"TMPFS_MAP": "/tmp:rw,size=64m"},
+			expected: map[string]string{
+				"/tmp": "rw,size=64m",
+			},
+		},
+	} {
+		provider, _, err := dockerTestNewProvider(tc.cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, provider.tmpFs)
+	}
+
+	assert.Equal(t, map[string]string{"/run": "rw,nosuid,nodev,exec,noatime,size=65536k"}, defaultTmpfsMap)
+}
+
+func TestNewDockerProvider_WithInvalidTmpTmpfsSize(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"TMP_TMPFS_SIZE": "lots",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithInvalidCMDMode(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CMD_MODE": "prepend",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestDockerConfigList(t *testing.T) {
+	cfg := config.ProviderConfigFromMap(map[string]string{
+		"SSH_CIPHERS": "aes256-ctr, aes192-ctr,,aes128-ctr",
+	})
+
+	assert.Equal(t, []string{"aes256-ctr", "aes192-ctr", "aes128-ctr"}, dockerConfigList(cfg, "SSH_CIPHERS"))
+	assert.Nil(t, dockerConfigList(cfg, "SSH_MACS"))
+}
+
+func TestNewDockerProvider_WithInvalidKernelMemory(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"KERNEL_MEMORY": "lots",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestParseDockerEnvFile(t *testing.T) {
+	env, err := parseDockerEnvFile(`# build settings
+LANG=en_US.UTF-8
+export CI=true
+
+GREETING="hello \"travis\"\nbye"
+LITERAL='no $expansion # here'
+PLAIN=value # trailing comment
+  SPACED = padded
+EMPTY=
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"LANG":     "en_US.UTF-8",
+		"CI":       "true",
+		"GREETING": "hello \"travis\"\nbye",
+		"LITERAL":  "no $expansion # here",
+		"PLAIN":    "value",
+		"SPACED":   "padded",
+		"EMPTY":    "",
+	}, env)
+}
+
+func TestParseDockerEnvFile_WithMalformedLines(t *testing.T) {
+	for _, s := range []string{
+		"NOVALUE",
+		"1ABC=foo",
+		"BAD KEY=foo",
+		`OPEN="unterminated`,
+		"OPEN='unterminated",
+		`TRAILING="quoted" garbage`,
+	} {
+		_, err := parseDockerEnvFile(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestNewDockerProvider_WithInvalidEnvFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "worker-env")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "NOT A VARIABLE\n")
+	f.Close()
+
+	for _, cfg := range []map[string]string{
+		{"ENV_FILE": f.Name()},
+		{"ENV_FILE": f.Name() + ".missing"},
+		{"CONTAINER_ENV": "FOO"},
+	} {
+		provider, _, err := dockerTestNewProvider(cfg)
+		assert.NotNil(t, err, fmt.Sprintf("%v", cfg))
+		assert.Nil(t, provider)
+	}
+}
+
+func TestNewDockerProvider_WithInvalidHugePages(t *testing.T) {
+	for _, cfg := range []map[string]string{
+		{"SHM_HUGE": "sometimes"},
+		{"SHM_HUGE": "always", "SHM": "0"},
+		{"SHM_HUGE": "always", "TMPFS_MAP": "/dev/shm:rw,size=64m"},
+		{"HUGETLBFS_BIND": "/dev/hugepages"},
+		{"HUGETLBFS_BIND": "hugepages:/dev/hugepages"},
+	} {
+		provider, _, err := dockerTestNewProvider(cfg)
+		assert.NotNil(t, err, fmt.Sprintf("%v", cfg))
+		assert.Nil(t, provider)
+	}
+}
+
+func TestNewDockerProvider_WithTmpfsHarden(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"TMPFS_HARDEN": "true",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"/run": "rw,noatime,size=65536k,nosuid,nodev,noexec",
+		"/tmp": "rw,mode=1777,size=524288k,nosuid,nodev,exec",
+	}, provider.tmpFs)
+}
+
+func TestHardenDockerTmpfsOpts(t *testing.T) {
+	assert.Equal(t, "rw,noatime,size=65536k,nosuid,nodev,noexec", hardenDockerTmpfsOpts("rw,nosuid,nodev,exec,noatime,size=65536k", false))
+	assert.Equal(t, "mode=1777,nosuid,nodev,exec", hardenDockerTmpfsOpts("suid,mode=1777,noexec", true))
+	assert.Equal(t, "nosuid,nodev,noexec", hardenDockerTmpfsOpts("", false))
+}
+
+func TestParseDockerTmpfsSize(t *testing.T) {
+	for s, expected := range map[string]uint64{
+		"512":  512,
+		"64k":  64 * 1024,
+		"128M": 128 * 1024 * 1024,
+		"2g":   2 * 1024 * 1024 * 1024,
+	} {
+		size, err := parseDockerTmpfsSize(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, size, s)
+	}
+
+	for _, s := range []string{"", "k", "50%", "0", "-1m", "1t"} {
+		_, err := parseDockerTmpfsSize(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestDockerProvider_WithBuildHome(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":             "true",
+		"BUILD_HOME":         "/Users/builder/",
+		"BUILD_HOME_WORKDIR": "true",
+	})
+
+	assert.Equal(t, "/Users/builder", provider.buildHome)
+	assert.Equal(t, []string{"bash", "/Users/builder/build.sh"}, provider.execCmd)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "/Users/builder", client.created[0].Config.WorkingDir)
+
+	err = instance.UploadScript(context.TODO(), []byte("echo hello\n"))
+	assert.Nil(t, err)
+
+	tr := tar.NewReader(bytes.NewReader(client.uploaded))
+	hdr, err := tr.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "/Users/builder/build.sh", hdr.Name)
+
+	assert.Equal(t, []string{
+		"bash", "-c",
+		`cat >/Users/builder/build.sh && chmod 0755 /Users/builder/build.sh && exec bash /Users/builder/build.sh </dev/null`,
+	}, dockerScriptStdinCmd(provider.buildScriptPath(), provider.execCmd))
+}
+
+func TestDockerProvider_WithoutBuildHome(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	assert.Equal(t, "/home/travis/build.sh", provider.buildScriptPath())
+	assert.Equal(t, strings.Split(defaultExecCmd, " "), provider.execCmd)
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", client.created[0].Config.WorkingDir)
+}
+
+func TestNewDockerProvider_WithInvalidBuildHome(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"BUILD_HOME": "home/travis",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithInvalidResourceProfiles(t *testing.T) {
+	for _, profiles := range []string{
+		"jvm",
+		"jvm:memory",
+		"jvm:memory=",
+		"jvm:memory=lots",
+		"jvm:memory=0",
+		"jvm:cpus=-1",
+		"jvm:cpus=64",
+		"jvm:disk=10GiB",
+	} {
+		provider, _, err := dockerTestNewProvider(map[string]string{
+			"CPU_SET_SIZE":      "8",
+			"RESOURCE_PROFILES": profiles,
+		})
+
+		assert.NotNil(t, err, profiles)
+		assert.Nil(t, provider, profiles)
+	}
+
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"SHM_HUGE":          "within_size",
+		"RESOURCE_PROFILES": "jvm:shm=128MiB",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithInvalidMemoryOvercommitRatio(t *testing.T) {
+	for _, cfg := range []map[string]string{
+		{"HOST_MEMORY_BUDGET": "2GiB", "MEMORY_OVERCOMMIT_RATIO": "lots"},
+		{"HOST_MEMORY_BUDGET": "2GiB", "MEMORY_OVERCOMMIT_RATIO": "0"},
+		{"MEMORY_OVERCOMMIT_RATIO": "1.5"},
+	} {
+		provider, _, err := dockerTestNewProvider(cfg)
+		assert.NotNil(t, err)
+		assert.Nil(t, provider)
+	}
+}
+
+func TestDockerProvider_WithMissingBootstrapScript(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"BOOTSTRAP_SCRIPT": "@/nonexistent/worker-bootstrap",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
@@ -0,0 +1,623 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	workerctx "github.com/travis-ci/worker/context"
+)
+
+type fakeDockerCPUTopology struct {
+	siblings map[int][]int
+	isolated []int
+	nodes    map[int]int
+}
+
+func (t *fakeDockerCPUTopology) ThreadSiblings(cpu int) ([]int, error) {
+	return t.siblings[cpu], nil
+}
+
+func (t *fakeDockerCPUTopology) IsolatedCPUs() ([]int, error) {
+	return t.isolated, nil
+}
+
+func (t *fakeDockerCPUTopology) NUMANode(cpu int) (int, error) {
+	return t.nodes[cpu], nil
+}
+
+func TestNewDockerProvider_WithCPUSetSize(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":       "1",
+		"CPU_SET_SIZE": "16",
+	})
+
+	assert.Equal(t, 16, provider.cpuSetSize)
+}
+
+func TestNewDockerProvider_WithInvalidCPUSetSize(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"NATIVE":       "1",
+		"CPU_SET_SIZE": "fafafaf",
+	})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "strconv.ParseInt: parsing \"fafafaf\": invalid syntax", err.Error())
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithCPUSetSizeLessThan2(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"NATIVE":       "1",
+		"CPU_SET_SIZE": "1",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, provider.cpuSetSize)
+}
+
+func TestNewDockerProvider_WithCPUs(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPUS": "4",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 4, provider.runCPUs)
+}
+
+func TestNewDockerProvider_WithInvalidCPUShares(t *testing.T) {
+	for _, shares := range []string{"fafafaf", "0", "-512"} {
+		provider, _, err := dockerTestNewProvider(map[string]string{
+			"CPU_SHARES": shares,
+		})
+
+		assert.NotNil(t, err, shares)
+		assert.Nil(t, provider, shares)
+	}
+}
+
+func TestDockerProvider_Start_WithCPUShares(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CPU_SHARES": "512",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(512), client.created[0].HostConfig.CPUShares)
+	assert.Equal(t, "0,1", client.created[0].HostConfig.CPUSet)
+}
+
+type fakePanickingDockerClient struct {
+	*fakeDockerClient
+}
+
+func (c *fakePanickingDockerClient) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	panic("create container")
+}
+
+func TestDockerProvider_Start_WithPanicChecksInCPUSets(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	// the client panics when creating the container after the cpu sets have
+	// been checked out
+	provider.clients = []dockerClient{&fakePanickingDockerClient{client}}
+
+	assert.Panics(t, func() {
+		provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	})
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[client.Endpoint()])
+}
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := parseCPUList("0,4")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 4}, cpus)
+
+	cpus, err = parseCPUList("2-3,8")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2, 3, 8}, cpus)
+
+	_, err = parseCPUList("a-b")
+	assert.NotNil(t, err)
+
+	_, err = parseCPUList("3-1")
+	assert.NotNil(t, err)
+}
+
+func TestDockerProvider_CheckoutCPUSets_WithCoreGranularity(t *testing.T) {
+	defaultDockerCPUTopology = &fakeDockerCPUTopology{siblings: map[int][]int{
+		0: {0, 2}, 1: {1, 3}, 2: {0, 2}, 3: {1, 3},
+	}}
+	defer func() { defaultDockerCPUTopology = &sysfsCPUTopology{} }()
+
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPU_SET_GRANULARITY": "core",
+		"CPU_SET_SIZE":        "4",
+		"CPUS":                "1",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{0, 2}, {1, 3}}, provider.cpuCores)
+
+	cpuSets, err := provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, "0,2", cpuSets)
+
+	cpuSets, err = provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, "1,3", cpuSets)
+
+	_, err = provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+	assert.NotNil(t, err)
+
+	provider.checkinCPUSets(provider.client, "0,2")
+	cpuSets, err = provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, "0,2", cpuSets)
+}
+
+func TestNewDockerProvider_WithInvalidCPUSetGranularity(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPU_SET_GRANULARITY": "socket",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestBuildDockerCPUAllowed(t *testing.T) {
+	allowed, err := buildDockerCPUAllowed(" 2-4,6 ", 8)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false, false, true, true, true, false, true, false}, allowed)
+
+	_, err = buildDockerCPUAllowed("2-8", 8)
+	assert.NotNil(t, err)
+
+	_, err = buildDockerCPUAllowed("2,x", 8)
+	assert.NotNil(t, err)
+}
+
+func TestNewDockerProvider_WithInvalidCPUSetAllowed(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPU_SET_SIZE":    "4",
+		"CPU_SET_ALLOWED": "2-7",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestNewDockerProvider_WithReversedCPUSetAllowedRange(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPU_SET_SIZE":    "4",
+		"CPU_SET_ALLOWED": "3-1",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestDockerProvider_CheckoutCPUSets_WithCPUSetAllowed(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPU_SET_SIZE":    "8",
+		"CPU_SET_ALLOWED": "2-3,6",
+		"CPUS":            "1",
+	})
+
+	assert.Nil(t, err)
+
+	for _, expected := range []string{"2", "3", "6"} {
+		cpuSets, err := provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, cpuSets)
+	}
+
+	_, err = provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+	assert.NotNil(t, err)
+
+	provider.checkinCPUSets(provider.client, "3")
+	cpuSets, err := provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, "3", cpuSets)
+}
+
+func TestDockerProvider_CheckoutCPUSets_WithCPUSetIsolatedOnly(t *testing.T) {
+	defaultDockerCPUTopology = &fakeDockerCPUTopology{isolated: []int{2, 3, 5, 9}}
+	defer func() { defaultDockerCPUTopology = &sysfsCPUTopology{} }()
+
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPU_SET_SIZE":          "8",
+		"CPU_SET_ALLOWED":       "3-7",
+		"CPU_SET_ISOLATED_ONLY": "true",
+		"CPUS":                  "1",
+	})
+
+	assert.Nil(t, err)
+
+	for _, expected := range []string{"3", "5"} {
+		cpuSets, err := provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, cpuSets)
+	}
+
+	_, err = provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+	assert.NotNil(t, err)
+}
+
+func TestDockerProvider_CheckoutCPUSets_WithCPUSetIsolatedOnlyWithoutIsolatedCPUs(t *testing.T) {
+	defaultDockerCPUTopology = &fakeDockerCPUTopology{isolated: []int{}}
+	defer func() { defaultDockerCPUTopology = &sysfsCPUTopology{} }()
+
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPU_SET_SIZE":          "4",
+		"CPU_SET_ISOLATED_ONLY": "true",
+		"CPUS":                  "1",
+	})
+
+	assert.Nil(t, err)
+	assert.Nil(t, provider.cpuAllowed)
+
+	for _, expected := range []string{"0", "1", "2", "3"} {
+		cpuSets, err := provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, cpuSets)
+	}
+}
+
+func TestDockerProvider_Start_WithNUMAAwareCPUSetStrategy(t *testing.T) {
+	defaultDockerCPUTopology = &fakeDockerCPUTopology{nodes: map[int]int{0: 0, 1: 0, 2: 1, 3: 1}}
+	defer func() { defaultDockerCPUTopology = &sysfsCPUTopology{} }()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CPU_SET_STRATEGY": "numa-aware",
+		"CPU_SET_SIZE":     "4",
+		"CPUS":             "1",
+	})
+	assert.Equal(t, []int{0, 0, 1, 1}, provider.cpuNodes)
+
+	for _, expected := range []string{"0", "0", "1"} {
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, client.created[len(client.created)-1].HostConfig.CPUSetMEMs)
+	}
+
+	provider.checkinCPUSets(provider.client, "0,1,2")
+	assert.Equal(t, "0,1", provider.cpuSetMems("1,2"))
+	assert.Equal(t, "1", provider.cpuSetMems("3,2"))
+}
+
+func TestDockerProvider_Start_WithDefaultCPUSetStrategy(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+	assert.Nil(t, provider.cpuNodes)
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", client.created[0].HostConfig.CPUSetMEMs)
+
+	provider, _, err = dockerTestNewProvider(map[string]string{
+		"CPU_SET_STRATEGY": "bogus",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestParseIsolatedCPUsFromCmdline(t *testing.T) {
+	cpus, err := parseIsolatedCPUsFromCmdline("BOOT_IMAGE=/vmlinuz root=/dev/sda1 isolcpus=domain,managed_irq,2-3 nohz_full=6,7 quiet\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2, 3, 6, 7}, cpus)
+
+	cpus, err = parseIsolatedCPUsFromCmdline("root=/dev/sda1 quiet")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{}, cpus)
+
+	_, err = parseIsolatedCPUsFromCmdline("isolcpus=2-x")
+	assert.NotNil(t, err)
+}
+
+func TestDockerProvider_CheckoutCPUSets_WithCPUSetAllowedAndCoreGranularity(t *testing.T) {
+	defaultDockerCPUTopology = &fakeDockerCPUTopology{siblings: map[int][]int{
+		0: {0, 2}, 1: {1, 3}, 2: {0, 2}, 3: {1, 3},
+	}}
+	defer func() { defaultDockerCPUTopology = &sysfsCPUTopology{} }()
+
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPU_SET_GRANULARITY": "core",
+		"CPU_SET_SIZE":        "4",
+		"CPU_SET_ALLOWED":     "1-3",
+		"CPUS":                "1",
+	})
+
+	assert.Nil(t, err)
+
+	cpuSets, err := provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, "1,3", cpuSets)
+
+	_, err = provider.checkoutCPUSets(provider.client, provider.runCPUs, time.Time{})
+	assert.NotNil(t, err)
+}
+
+func TestDockerProvider_Start_WithCreateConflictOnTakenCPUSets(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CPUS":         "1",
+		"CPU_SET_SIZE": "4",
+	})
+
+	staleID := "f2e475c0ee1825418a3d4661d39d28bee478f4190d46e1a3984b73ea175c20c3"
+	client.containers[staleID] = &docker.Container{
+		ID:         staleID,
+		Name:       "/travis-job-42",
+		State:      docker.State{Running: true},
+		HostConfig: &docker.HostConfig{CPUSetCPUs: "2"},
+	}
+
+	// cpu 2 of the earlier attempt was handed out to another container
+	taken, err := provider.checkoutCPUSets(client, 3, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, "0,1,2", taken)
+
+	ctx := workerctx.FromJobID(context.TODO(), 42)
+	instance, err := provider.Start(ctx, &StartAttributes{ImageName: "travis:jvm"})
+	assert.Nil(t, err)
+	assert.Len(t, client.removed, 1)
+	assert.Equal(t, staleID, client.removed[0].ID)
+	assert.Len(t, client.created, 1)
+	assert.Equal(t, "travis-job-42", client.created[0].Name)
+	assert.Equal(t, "fake0001", instance.(*dockerInstance).container.ID)
+	assert.Equal(t, "3", instance.(*dockerInstance).CPUSet())
+	assert.Equal(t, []bool{true, true, true, true}, provider.cpuSets[client.Endpoint()])
+}
+
+func TestDockerProvider_Start_AccountsCPUSetsPerEndpoint(t *testing.T) {
+	provider, one := dockerTestFakeSetup(t, nil)
+	two := newFakeDockerClient()
+	two.endpoint = "fake://two"
+	provider.clients = []dockerClient{one, two}
+
+	first, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	second, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, one, first.(*dockerInstance).client)
+	assert.Equal(t, two, second.(*dockerInstance).client)
+	assert.Equal(t, "0,1", one.created[0].HostConfig.CPUSet)
+	assert.Equal(t, "0,1", two.created[0].HostConfig.CPUSet)
+
+	// the first endpoint has no room left, so the next start fails over to
+	// the second one once that has room again
+	assert.Nil(t, second.Stop(context.TODO()))
+	assert.Equal(t, []bool{true, true, false}, provider.cpuSets[one.Endpoint()])
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[two.Endpoint()])
+
+	third, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, two, third.(*dockerInstance).client)
+	assert.Len(t, one.created, 1)
+}
+
+func TestNewDockerProvider_WithInvalidCPURealtime(t *testing.T) {
+	for _, cfg := range []map[string]string{
+		{"CPU_RT_RUNTIME": "lots"},
+		{"CPU_RT_RUNTIME": "0"},
+		{"CPU_RT_PERIOD": "1000000"},
+		{"CPU_RT_RUNTIME": "950000", "CPU_RT_PERIOD": "500000"},
+	} {
+		provider, _, err := dockerTestNewProvider(cfg)
+		assert.NotNil(t, err, fmt.Sprintf("%v", cfg))
+		assert.Nil(t, provider)
+	}
+}
+
+func TestDockerProvider_Start_WithCPURealtime(t *testing.T) {
+	for _, tc := range []struct {
+		cfg             map[string]string
+		runtime, period int64
+	}{
+		{map[string]string{}, 0, 0},
+		{map[string]string{"CPU_RT_RUNTIME": "95000"}, 95000, 0},
+		{map[string]string{"CPU_RT_RUNTIME": "95000", "CPU_RT_PERIOD": "100000"}, 95000, 100000},
+	} {
+		provider, client := dockerTestFakeSetup(t, tc.cfg)
+		client.info = &docker.DockerInfo{}
+
+		assert.Nil(t, provider.Setup(context.TODO()))
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		assert.Equal(t, tc.runtime, client.created[0].HostConfig.CPURealtimeRuntime, fmt.Sprintf("%v", tc.cfg))
+		assert.Equal(t, tc.period, client.created[0].HostConfig.CPURealtimePeriod, fmt.Sprintf("%v", tc.cfg))
+	}
+}
+
+func TestDockerProvider_Setup_WithCPURealtimeOnCgroupV2(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CPU_RT_RUNTIME": "95000",
+	})
+	client.info = &docker.DockerInfo{SecurityOptions: []string{"name=cgroupns"}}
+
+	assert.NotNil(t, provider.Setup(context.TODO()))
+}
+
+func TestDockerProvider_Setup_WithCPURealtimeWithoutKernelMemory(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CPU_RT_RUNTIME": "95000",
+	})
+	client.info = &docker.DockerInfo{KernelMemory: false}
+
+	assert.Nil(t, provider.Setup(context.TODO()))
+}
+
+func TestDockerInstance_CPUSet(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CPUS": "1",
+	})
+
+	for _, expected := range []string{"0", "1"} {
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, instance.(*dockerInstance).CPUSet())
+		assert.Equal(t, expected, client.created[len(client.created)-1].HostConfig.CPUSet)
+	}
+}
+
+func TestDockerInstance_CPUSet_WithoutCPUs(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CPUS": "0",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", instance.(*dockerInstance).CPUSet())
+	assert.Equal(t, "", client.created[0].HostConfig.CPUSet)
+
+	err = instance.Stop(context.TODO())
+	assert.Nil(t, err)
+	for _, checkedOut := range provider.cpuSets[provider.client.Endpoint()] {
+		assert.False(t, checkedOut)
+	}
+}
+
+func TestDockerProvider_ReclaimCPUSetLeases(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"CPU_SET_LEASE_GRACE": "10m",
+		"CPUS":                "1",
+	})
+	assert.Equal(t, 10*time.Minute, provider.cpuLeaseGrace)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "0", instance.(*dockerInstance).CPUSet())
+
+	// a checkout that neither boots nor any instance owns, e.g. leaked by
+	// an error path
+	leaked, err := provider.checkoutCPUSets(provider.client, 1, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, "1", leaked)
+	provider.finishBootingCPUSets(provider.client, leaked)
+
+	// within the grace period nothing is reclaimed
+	assert.Empty(t, provider.reclaimCPUSetLeases(context.TODO(), time.Now()))
+
+	reclaimed := provider.reclaimCPUSetLeases(context.TODO(), time.Now().Add(11*time.Minute))
+	assert.Equal(t, []int{1}, reclaimed)
+	assert.Equal(t, []bool{true, false, false}, provider.cpuSets[provider.client.Endpoint()])
+
+	cpuSets, err := provider.checkoutCPUSets(provider.client, 1, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, "1", cpuSets)
+}
+
+func TestDockerProvider_ReclaimCPUSetLeases_WhileBooting(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"CPU_SET_LEASE_GRACE": "10m",
+		"CPUS":                "1",
+	})
+
+	// a boot that outlasts the grace period still owns its cpus until its
+	// boot timeout plus the grace
+	now := time.Now()
+	booting, err := provider.checkoutCPUSets(provider.client, 1, now.Add(30*time.Minute))
+	assert.Nil(t, err)
+	assert.Empty(t, provider.reclaimCPUSetLeases(context.TODO(), now.Add(20*time.Minute)))
+
+	adopted := "2"
+	assert.True(t, provider.swapCPUSets(provider.client, booting, adopted))
+	assert.Empty(t, provider.reclaimCPUSetLeases(context.TODO(), now.Add(39*time.Minute)))
+
+	finished, err := provider.checkoutCPUSets(provider.client, 1, now.Add(30*time.Minute))
+	assert.Nil(t, err)
+	provider.finishBootingCPUSets(provider.client, finished)
+	assert.Equal(t, []int{0}, provider.reclaimCPUSetLeases(context.TODO(), now.Add(20*time.Minute)))
+
+	// a boot hanging past its deadline leaked its cpus
+	assert.Equal(t, []int{2}, provider.reclaimCPUSetLeases(context.TODO(), now.Add(41*time.Minute)))
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+}
+
+func TestDockerProvider_ReclaimCPUSetLeases_WithoutBootDeadline(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"CPU_SET_LEASE_GRACE": "1m",
+	})
+
+	// without a deadline, boots count as booting for the warm pool boot
+	// timeout, which may be longer than the grace
+	now := time.Now()
+	_, err := provider.checkoutCPUSets(provider.client, 1, time.Time{})
+	assert.Nil(t, err)
+	assert.Empty(t, provider.reclaimCPUSetLeases(context.TODO(), now.Add(defaultDockerWarmPoolBootTimeout)))
+	assert.Equal(t, []int{0}, provider.reclaimCPUSetLeases(context.TODO(), now.Add(defaultDockerWarmPoolBootTimeout+2*time.Minute)))
+}
+
+func TestDockerProvider_ReclaimCPUSetLeases_WhileRefreshing(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"CPU_SET_LEASE_GRACE": "10m",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, instance.(*dockerInstance).Refresh(context.TODO()))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		assert.Empty(t, provider.reclaimCPUSetLeases(context.TODO(), time.Now().Add(time.Hour)))
+	}
+	<-done
+
+	assert.Equal(t, "0,1", instance.(*dockerInstance).CPUSet())
+}
+
+func TestDockerProvider_Setup_WithCPUSetLeaseGrace(t *testing.T) {
+	defaultDockerCPUSetSweepInterval = time.Millisecond
+	defer func() { defaultDockerCPUSetSweepInterval = time.Minute }()
+
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"CPU_SET_LEASE_GRACE": "10m",
+		"CPUS":                "1",
+	})
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	leaked, err := provider.checkoutCPUSets(provider.client, 1, time.Time{})
+	assert.Nil(t, err)
+	provider.finishBootingCPUSets(provider.client, leaked)
+
+	provider.cpuSetsMutex.Lock()
+	provider.cpuLeases[provider.client.Endpoint()][0] = time.Now().Add(-time.Hour)
+	provider.cpuSetsMutex.Unlock()
+
+	err = provider.Setup(ctx)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		provider.cpuSetsMutex.Lock()
+		checkedOut := provider.cpuSets[provider.client.Endpoint()][0]
+		provider.cpuSetsMutex.Unlock()
+
+		if !checkedOut {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("leaked cpu set wasn't reclaimed")
+}
+
+func TestNewDockerProvider_WithInvalidCPUSetLeaseGrace(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"CPU_SET_LEASE_GRACE": "forever",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
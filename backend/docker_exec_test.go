@@ -0,0 +1,721 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/worker/config"
+)
+
+func TestDockerInstance_RunScript_WithNative(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE": "true",
+	})
+	client.execOutput = "hello from the build\n"
+	client.execExitCode = 3
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	output := &bytes.Buffer{}
+	res, err := instance.RunScript(context.TODO(), output)
+	assert.Nil(t, err)
+	assert.True(t, res.Completed)
+	assert.Equal(t, uint8(3), res.ExitCode)
+	assert.Equal(t, "hello from the build\n", output.String())
+	assert.Equal(t, [][]string{provider.execCmd}, client.execCmds)
+	assert.Equal(t, int64(len("hello from the build\n")), res.Summary.BytesStreamed)
+}
+
+func TestDockerInstance_RunScript_WithOutputViaLogs(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":          "true",
+		"OUTPUT_VIA_LOGS": "true",
+	})
+	assert.True(t, provider.outputViaLogs)
+	dockerTestOutputViaLogs(client, "hello from the logs\n")
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	writer := &bytes.Buffer{}
+	res, err := instance.RunScript(context.TODO(), writer)
+	assert.Nil(t, err)
+	assert.True(t, res.Completed)
+	assert.Equal(t, "hello from the logs\n", writer.String())
+	assert.Contains(t, client.execCmds, []string{"bash", "-c", "bash /home/travis/build.sh >/tmp/travis-build-output 2>&1"})
+}
+
+// dockerTestOutputViaLogs sets the container logs of client to the relayed
+// build output logs, with a single timestamp so that fetching them again
+// doesn't repeat them.
+func dockerTestOutputViaLogs(client *fakeDockerClient, logs string) {
+	ts := time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano)
+	client.logs = ts + " " + dockerOutputLogsLabel + logs
+}
+
+func TestDockerLogsWriter(t *testing.T) {
+	output := &bytes.Buffer{}
+	start := time.Date(2017, 9, 12, 10, 0, 0, 0, time.UTC)
+	lw := &dockerLogsWriter{w: output, last: start}
+
+	ts := func(d time.Duration) string {
+		return start.Add(d).Format(time.RFC3339Nano)
+	}
+
+	// reconnecting repeats the lines since the start of the second
+	fmt.Fprintf(lw, "%s before\n%s one\n%s tw", ts(-time.Millisecond), ts(time.Millisecond), ts(2*time.Millisecond))
+	fmt.Fprintf(lw, "o\n")
+	fmt.Fprintf(lw, "%s one\n%s two\n%s three", ts(time.Millisecond), ts(2*time.Millisecond), ts(3*time.Millisecond))
+	assert.Nil(t, lw.flush())
+
+	assert.Equal(t, "one\ntwo\nthree", output.String())
+}
+
+func TestDockerLogsWriter_WithLabel(t *testing.T) {
+	output := &bytes.Buffer{}
+	start := time.Date(2017, 9, 12, 10, 0, 0, 0, time.UTC)
+	lw := &dockerLogsWriter{w: output, last: start, label: []byte("build: ")}
+
+	ts := func(d time.Duration) string {
+		return start.Add(d).Format(time.RFC3339Nano)
+	}
+
+	// only the labelled lines are written, and a line cut off by a dropped
+	// stream is written once it's fetched again
+	fmt.Fprintf(lw, "%s build: one\n%s init\n%s build: tw", ts(time.Millisecond), ts(2*time.Millisecond), ts(3*time.Millisecond))
+	lw.reset()
+	fmt.Fprintf(lw, "%s build: two\n%s build: three", ts(3*time.Millisecond), ts(4*time.Millisecond))
+	assert.Nil(t, lw.flush())
+
+	assert.Equal(t, "one\ntwo\nthree", output.String())
+}
+
+func TestDockerInstance_RunScript_WithTransientInspectExecError(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE": "true",
+	})
+	assert.Equal(t, uint64(3), provider.inspectExecRetries)
+
+	defaultDockerInspectExecRetrySleep = time.Millisecond
+	defer func() { defaultDockerInspectExecRetrySleep = 500 * time.Millisecond }()
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	client.execExitCode = 3
+	client.inspectExecErrs = []error{&docker.Error{Status: http.StatusServiceUnavailable}}
+
+	res, err := instance.RunScript(context.TODO(), &bytes.Buffer{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, client.inspectExecs)
+	assert.True(t, res.Completed)
+	assert.Equal(t, uint8(3), res.ExitCode)
+}
+
+func TestDockerInstance_RunScript_WithRunSummary(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":            "true",
+		"OUTPUT_VIA_LOGS":   "true",
+		"RUN_SUMMARY_STATS": "true",
+	})
+	dockerTestOutputViaLogs(client, "0123456789")
+	client.execUserExitCodes = map[string]int{"travis": 1}
+	client.stats.MemoryStats.MaxUsage = 123456789
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	client.onInspect = func(container *docker.Container) {
+		container.State.Running = false
+		container.State.OOMKilled = true
+	}
+
+	before := time.Now()
+	res, err := instance.RunScript(context.TODO(), &bytes.Buffer{})
+	assert.Nil(t, err)
+	assert.NotNil(t, res.Summary)
+	assert.False(t, res.Summary.StartedAt.Before(before))
+	assert.False(t, res.Summary.FinishedAt.Before(res.Summary.StartedAt))
+	assert.Equal(t, uint8(1), res.Summary.ExitCode)
+	assert.True(t, res.Summary.OOMKilled)
+	assert.Equal(t, int64(10), res.Summary.BytesStreamed)
+	assert.Equal(t, uint64(123456789), res.Summary.PeakMemoryBytes)
+	assert.Equal(t, []bool{false}, client.statsStreams)
+
+	summaryJSON, err := json.Marshal(res.Summary)
+	assert.Nil(t, err)
+	assert.Contains(t, string(summaryJSON), `"peak_memory_bytes":123456789`)
+}
+
+func TestDockerInstance_PeakMemory(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	dockerInstance := instance.(*dockerInstance)
+
+	client.stats.MemoryStats.MaxUsage = 123456789
+	peak, err := dockerInstance.peakMemory(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(123456789), peak)
+	assert.Empty(t, client.execCmds)
+
+	// cgroup v1 without a recorded peak leaves it unknown
+	client.stats.MemoryStats.MaxUsage = 0
+	peak, err = dockerInstance.peakMemory(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), peak)
+	assert.Empty(t, client.execCmds)
+}
+
+func TestDockerInstance_PeakMemory_WithCgroupV2(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+	provider.cgroupVersions[client.Endpoint()] = 2
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	client.execOutput = "987654\n"
+	peak, err := instance.(*dockerInstance).peakMemory(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(987654), peak)
+	assert.Equal(t, [][]string{{"cat", "/sys/fs/cgroup/memory.peak"}}, client.execCmds)
+	assert.Equal(t, []string{"root"}, client.execUsers)
+
+	// an older kernel without memory.peak leaves it unknown
+	client.execExitCode = 1
+	client.execOutput = "cat: /sys/fs/cgroup/memory.peak: No such file or directory\n"
+	peak, err = instance.(*dockerInstance).peakMemory(context.TODO())
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(0), peak)
+}
+
+func TestDockerInstance_RunScript_WithExecRawTerminal(t *testing.T) {
+	for _, rawTerminal := range []bool{true, false} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"NATIVE":            "true",
+			"EXEC_RAW_TERMINAL": strconv.FormatBool(rawTerminal),
+		})
+		client.execOutput = "hai\n"
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		writer := &bytes.Buffer{}
+		res, err := instance.RunScript(context.TODO(), writer)
+		assert.Nil(t, err)
+		assert.True(t, res.Completed)
+		assert.Equal(t, []bool{rawTerminal}, client.execTtys)
+		assert.Equal(t, "hai\n", writer.String())
+	}
+}
+
+func TestDockerInstance_Exec(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+	client.execOutput = "/dev/sda1 20G\n"
+	client.execExitCode = 2
+	client.execQuiet = 100 * time.Millisecond
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	writer := &bytes.Buffer{}
+	res, err := instance.(*dockerInstance).Exec(context.TODO(), []string{"df", "-h"}, writer)
+	assert.Nil(t, err)
+	assert.True(t, res.Completed)
+	assert.Equal(t, uint8(2), res.ExitCode)
+	assert.Equal(t, [][]string{{"df", "-h"}}, client.execCmds)
+	assert.Equal(t, "/dev/sda1 20G\n", writer.String())
+}
+
+func TestNewDockerProvider_WithInvalidExecKeepaliveInterval(t *testing.T) {
+	_, _, err := dockerTestNewProvider(map[string]string{
+		"EXEC_KEEPALIVE_INTERVAL": "often",
+	})
+
+	assert.NotNil(t, err)
+}
+
+func TestNewDockerProvider_WithExecKeepaliveInterval(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, `{"Id":"beabebabafabafaba0000","State":{"Running":true}}`)
+	}))
+	defer server.Close()
+
+	provider, err := newDockerProvider(config.ProviderConfigFromMap(map[string]string{
+		"ENDPOINT":                server.URL,
+		"EXEC_KEEPALIVE_INTERVAL": "10s",
+	}))
+	assert.Nil(t, err)
+
+	// the connections are kept alive rather than the build output
+	client := provider.(*dockerProvider).client.(*docker.Client)
+	assert.Equal(t, 10*time.Second, client.Dialer.(*net.Dialer).KeepAlive)
+
+	container, err := client.InspectContainer("beabebabafabafaba0000")
+	assert.Nil(t, err)
+	assert.Equal(t, "beabebabafabafaba0000", container.ID)
+}
+
+func TestDockerTimestampWriter(t *testing.T) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	tw := &dockerTimestampWriter{
+		w: buf,
+		now: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+	}
+
+	for _, chunk := range []string{"hello ", "world\nsecond", " line\n", "", "\n", "a\nb\n", "partial"} {
+		n, err := tw.Write([]byte(chunk))
+		assert.Nil(t, err)
+		assert.Equal(t, len(chunk), n)
+	}
+
+	assert.Equal(t, strings.Join([]string{
+		"2017-10-01T12:00:01Z hello world",
+		"2017-10-01T12:00:02Z second line",
+		"2017-10-01T12:00:03Z ",
+		"2017-10-01T12:00:04Z a",
+		"2017-10-01T12:00:05Z b",
+		"2017-10-01T12:00:06Z partial",
+	}, "\n"), buf.String())
+}
+
+type dockerFailingWriter struct {
+	limit int
+	buf   bytes.Buffer
+}
+
+func (fw *dockerFailingWriter) Write(p []byte) (int, error) {
+	if fw.buf.Len()+len(p) > fw.limit {
+		return 0, errors.New("sink disconnected")
+	}
+	return fw.buf.Write(p)
+}
+
+func TestDockerInstance_RunScript_WithFailingOutput(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":            "true",
+		"EXEC_RAW_TERMINAL": "true",
+	})
+	client.execOutput = strings.Repeat("hai\r\n", 10)
+
+	// The script never finishes on its own, so RunScript only returns once
+	// it notices the failed output.
+	client.execRunning = true
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	writer := &dockerFailingWriter{limit: 12}
+	done := make(chan struct{})
+	var res *RunResult
+	go func() {
+		res, err = instance.RunScript(context.TODO(), writer)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunScript didn't return after the output failed")
+	}
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "output sink failed")
+	assert.Contains(t, err.Error(), "sink disconnected")
+	assert.False(t, res.Completed)
+	assert.True(t, writer.buf.Len() <= 12)
+}
+
+// dockerKeepaliveRecorder records the build output and counts the empty
+// writes of keepalives.
+type dockerKeepaliveRecorder struct {
+	mutex      sync.Mutex
+	buf        bytes.Buffer
+	keepalives int
+}
+
+func (r *dockerKeepaliveRecorder) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(p) == 0 {
+		r.keepalives++
+	}
+	return r.buf.Write(p)
+}
+
+func TestDockerInstance_Exec_WithStartExecError(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	client.startExecErr = docker.ErrConnectionRefused
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		res, err := instance.(*dockerInstance).Exec(context.TODO(), []string{"true"}, ioutil.Discard)
+		assert.Equal(t, docker.ErrConnectionRefused, errors.Cause(err))
+		assert.False(t, res.Completed)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exec hung after StartExec failed")
+	}
+}
+
+func TestDockerInstance_Exec_WithCancelledContextBeforeHijack(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	client.startExecWait = make(chan struct{})
+	defer close(client.startExecWait)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	res, err := instance.(*dockerInstance).Exec(ctx, []string{"true"}, ioutil.Discard)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.False(t, res.Completed)
+}
+
+func TestDockerInstance_RunScript_WithExecKeepaliveInterval(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":                  "true",
+		"EXEC_KEEPALIVE_INTERVAL": "10ms",
+	})
+	client.execOutput = "done\n"
+	client.execQuiet = 100 * time.Millisecond
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	output := &dockerKeepaliveRecorder{}
+	res, err := instance.RunScript(context.TODO(), output)
+	assert.Nil(t, err)
+	assert.True(t, res.Completed)
+
+	// the quiet exec got keepalives, which leave the build output as is
+	output.mutex.Lock()
+	defer output.mutex.Unlock()
+	assert.True(t, output.keepalives > 0, "no keepalives during a quiet exec")
+	assert.Equal(t, "done\n", output.buf.String())
+}
+
+func TestDockerShellJoin(t *testing.T) {
+	for expected, args := range map[string][]string{
+		"bash /home/travis/build.sh":              {"bash", "/home/travis/build.sh"},
+		"bash -lc 'bash /home/travis/build.sh'":   {"bash", "-lc", "bash /home/travis/build.sh"},
+		`sh -c 'echo '"'"'hai'"'"' && exit 1' ''`: {"sh", "-c", "echo 'hai' && exit 1", ""},
+		`echo '$HOME' '*'`:                        {"echo", "$HOME", "*"},
+	} {
+		assert.Equal(t, expected, dockerShellJoin(args))
+	}
+}
+
+func TestDockerProvider_ExecArgs_WithExecShell(t *testing.T) {
+	for _, tc := range []struct {
+		cfg      map[string]string
+		expected []string
+	}{
+		{map[string]string{}, []string{"bash", "/home/travis/build.sh"}},
+		{map[string]string{"EXEC_SHELL": "bash -lc"}, []string{"bash", "-lc", "bash /home/travis/build.sh"}},
+		{map[string]string{"EXEC_SHELL": "sh -c", "EXEC_CMD": "/home/travis/build.sh --verbose"}, []string{"sh", "-c", "/home/travis/build.sh --verbose"}},
+	} {
+		provider, _, err := dockerTestNewProvider(tc.cfg)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, provider.execArgs(), fmt.Sprintf("%v", tc.cfg))
+	}
+}
+
+func TestDockerInstance_RunScript_WithExecShell(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":         "true",
+		"EXEC_SHELL":     "bash -lc",
+		"SCRIPT_VIA_ENV": "true",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	err = instance.UploadScript(context.TODO(), []byte("#!/bin/bash\necho hai\n"))
+	assert.Nil(t, err)
+
+	_, err = instance.RunScript(context.TODO(), ioutil.Discard)
+	assert.Nil(t, err)
+
+	assert.Len(t, client.execCmds, 1)
+	assert.Equal(t, []string{"bash", "-c"}, client.execCmds[0][:2])
+	assert.True(t, strings.HasSuffix(client.execCmds[0][2], "&& exec bash -lc 'bash /home/travis/build.sh'"), client.execCmds[0][2])
+}
+
+func TestDockerInstance_RunScript_WithLogExecCommand(t *testing.T) {
+	for _, logExecCommand := range []bool{true, false} {
+		provider, _ := dockerTestFakeSetup(t, map[string]string{
+			"NATIVE":           "true",
+			"EXEC_CMD":         "env GITHUB_TOKEN=hunter2 --password='s3cr3t' bash /home/travis/build.sh",
+			"LOG_EXEC_COMMAND": fmt.Sprintf("%v", logExecCommand),
+		})
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		logs := &bytes.Buffer{}
+		logrus.SetOutput(logs)
+		_, err = instance.RunScript(context.TODO(), &bytes.Buffer{})
+		logrus.SetOutput(os.Stderr)
+		assert.Nil(t, err)
+
+		assert.NotContains(t, logs.String(), "hunter2")
+		assert.NotContains(t, logs.String(), "s3cr3t")
+		if logExecCommand {
+			assert.Contains(t, logs.String(), "running script via exec")
+			assert.Contains(t, logs.String(), "GITHUB_TOKEN=[REDACTED]")
+			assert.Contains(t, logs.String(), "--password=[REDACTED]")
+		} else {
+			assert.NotContains(t, logs.String(), "running script via exec")
+		}
+	}
+}
+
+func TestRedactDockerCommand(t *testing.T) {
+	assert.Equal(t, []string{
+		"bash",
+		"-c",
+		`API_KEY=[REDACTED] ./run --auth-token=[REDACTED] --user=travis`,
+		"GREETING=hello",
+	}, redactDockerCommand([]string{
+		"bash",
+		"-c",
+		`API_KEY="a b c" ./run --auth-token=xyz --user=travis`,
+		"GREETING=hello",
+	}))
+}
+
+func TestParseDockerExecCgroupLimits(t *testing.T) {
+	limits, err := parseDockerExecCgroupLimits("memory=3GiB, cpus=1.5,pids=512")
+	assert.Nil(t, err)
+	assert.Equal(t, dockerExecCgroupLimits{memory: 3 * 1024 * 1024 * 1024, cpus: 1.5, pids: 512}, limits)
+	assert.Equal(t, [][2]string{
+		{"memory.max", "3221225472"},
+		{"cpu.max", "150000 100000"},
+		{"pids.max", "512"},
+	}, limits.files())
+
+	limits, err = parseDockerExecCgroupLimits("")
+	assert.Nil(t, err)
+	assert.Empty(t, limits.files())
+
+	for _, s := range []string{"memory", "memory=lots", "cpus=-1", "pids=many", "swap=1GiB"} {
+		_, err := parseDockerExecCgroupLimits(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestDockerInstance_RunScript_WithExecCgroupLimits(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":             "true",
+		"EXEC_CGROUP_LIMITS": "memory=3GiB,cpus=1.5",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	_, err = instance.RunScript(context.TODO(), ioutil.Discard)
+	assert.Nil(t, err)
+
+	assert.Len(t, client.execCmds, 2)
+	assert.Equal(t, []string{"root", "travis"}, client.execUsers)
+	assert.Equal(t, dockerExecCgroupSetupCmd(dockerCgroupRoot, provider.execCgroup, "travis"), client.execCmds[0])
+	assert.Equal(t, dockerExecCgroupCmd(dockerCgroupRoot, []string{"bash", "/home/travis/build.sh"}), client.execCmds[1])
+}
+
+func TestDockerInstance_RunScript_WithFailedExecCgroupSetup(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":             "true",
+		"EXEC_CGROUP_LIMITS": "memory=3GiB",
+	})
+	client.execExitCodes = []int{1}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	res, err := instance.RunScript(context.TODO(), ioutil.Discard)
+	assert.Nil(t, err)
+	assert.True(t, res.Completed)
+
+	assert.Len(t, client.execCmds, 2)
+	assert.Equal(t, "root", client.execUsers[0])
+	assert.Equal(t, []string{"bash", "/home/travis/build.sh"}, client.execCmds[1])
+}
+
+func TestDockerExecCgroupCmds(t *testing.T) {
+	for _, shell := range []string{"sh", "bash"} {
+		if _, err := exec.LookPath(shell); err != nil {
+			t.Skipf("no %s to run the commands with", shell)
+		}
+	}
+
+	// a stand-in for the cgroup filesystem, where the writes are plain files
+	root, err := ioutil.TempDir("", "worker-exec-cgroup")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "cgroup.procs"),
+		[]byte(fmt.Sprintf("%d\n", os.Getpid())), 0644))
+	// mkdir creates cgroup.procs in a cgroup filesystem
+	assert.Nil(t, os.Mkdir(filepath.Join(root, "travis-build"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "travis-build", "cgroup.procs"), nil, 0644))
+
+	limits, err := parseDockerExecCgroupLimits("memory=3GiB,cpus=1.5")
+	assert.Nil(t, err)
+
+	setup := dockerExecCgroupSetupCmd(root, limits, strconv.Itoa(os.Getuid()))
+	out, err := exec.Command(setup[0], setup[1:]...).CombinedOutput()
+	assert.Nil(t, err, string(out))
+
+	for file, content := range map[string]string{
+		"init/cgroup.procs":         fmt.Sprintf("%d\n", os.Getpid()),
+		"cgroup.subtree_control":    "+cpu +memory +pids\n",
+		"travis-build/memory.max":   "3221225472\n",
+		"travis-build/cpu.max":      "150000 100000\n",
+		"travis-build/cgroup.procs": "",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(root, file))
+		if assert.Nil(t, err, file) {
+			assert.Equal(t, content, string(b), file)
+		}
+	}
+
+	build := dockerExecCgroupCmd(root, []string{"sh", "-c", "echo $$"})
+	out, err = exec.Command(build[0], build[1:]...).CombinedOutput()
+	assert.Nil(t, err, string(out))
+	b, err := ioutil.ReadFile(filepath.Join(root, "travis-build", "cgroup.procs"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(out), string(b))
+
+	// without the sub-cgroup the build still runs, but says why it's unlimited
+	build = dockerExecCgroupCmd(filepath.Join(root, "missing"), []string{"echo", "built"})
+	out, err = exec.Command(build[0], build[1:]...).CombinedOutput()
+	assert.Nil(t, err, string(out))
+	assert.Contains(t, string(out), "running it without EXEC_CGROUP_LIMITS")
+	assert.True(t, strings.HasSuffix(string(out), "built\n"), string(out))
+}
+
+func TestDockerProvider_WithInvalidExecCgroupLimits(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"EXEC_CGROUP_LIMITS": "memory=lots",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestDockerInstance_RunScript_WithOutputViaLogsRelay(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":          "true",
+		"OUTPUT_VIA_LOGS": "true",
+	})
+	ts := time.Now().Add(time.Minute).UTC()
+	client.logs = fmt.Sprintf("%s %shello\n%s starting sshd\n%s %sfrom the logs\n",
+		ts.Format(time.RFC3339Nano), dockerOutputLogsLabel,
+		ts.Add(time.Millisecond).Format(time.RFC3339Nano),
+		ts.Add(2*time.Millisecond).Format(time.RFC3339Nano), dockerOutputLogsLabel)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	output := &bytes.Buffer{}
+	started := time.Now()
+	res, err := instance.RunScript(context.TODO(), output)
+	assert.Nil(t, err)
+	assert.True(t, res.Completed)
+	assert.True(t, time.Since(started) < defaultDockerLogsDrainTimeout, "waited for the drain timeout")
+
+	// both the followed and the remaining logs have the lines, but they are
+	// only written once, without the output of PID 1
+	assert.Equal(t, "hello\nfrom the logs\n", output.String())
+
+	// the relay and the build run at the same time
+	users := map[string]string{}
+	for idx, cmd := range client.execCmds {
+		users[strings.Join(cmd, " ")] = client.execUsers[idx]
+	}
+	assert.Equal(t, map[string]string{
+		"sh -c rm -f /tmp/travis-build-output && mkfifo -m 0622 /tmp/travis-build-output":                        "root",
+		`sh -c exec awk '{ print "travis-build-output: " $0; fflush() }' /tmp/travis-build-output >/proc/1/fd/1`: "root",
+		"bash -c bash /home/travis/build.sh >/tmp/travis-build-output 2>&1":                                      "travis",
+	}, users)
+	assert.Equal(t, "sh -c rm -f /tmp/travis-build-output && mkfifo -m 0622 /tmp/travis-build-output", strings.Join(client.execCmds[0], " "))
+}
+
+func TestDockerInstance_RunScript_WithOutputViaLogsAndScriptViaEnv(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":          "true",
+		"OUTPUT_VIA_LOGS": "true",
+		"SCRIPT_VIA_ENV":  "true",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	err = instance.UploadScript(context.TODO(), []byte("#!/bin/bash\necho hai\n"))
+	assert.Nil(t, err)
+
+	_, err = instance.RunScript(context.TODO(), ioutil.Discard)
+	assert.Nil(t, err)
+
+	// the script command is quoted as a whole when redirected, instead of
+	// being split into separate words
+	expected := []string{"bash", "-c",
+		`bash -c 'echo "$TRAVIS_WORKER_BUILD_SCRIPT" | base64 -d >/home/travis/build.sh && chmod 0755 /home/travis/build.sh && exec bash /home/travis/build.sh' >/tmp/travis-build-output 2>&1`}
+	assert.Contains(t, client.execCmds, expected)
+}
+
+func TestDockerInstance_InspectExec_WithCancelledContext(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"INSPECT_EXEC_RETRIES": "100",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	client.inspectExecErr = &docker.Error{Status: http.StatusServiceUnavailable}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	_, err = instance.(*dockerInstance).inspectExec(ctx, "exec0001")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(started) < 5*time.Second)
+}
@@ -0,0 +1,461 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerProvider_Start_WithImageTags(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{
+		Language:  "jvm",
+		ImageTags: []string{"travis:nope", "travis:ruby", "travis:jvm"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "fc24f3225c15", client.created[0].Config.Image)
+	assert.Equal(t, "fake000:travis:ruby", instance.ID())
+}
+
+func TestDockerProvider_Start_WithUnmatchedImageTags(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{
+		Language:  "jvm",
+		ImageTags: []string{"travis:nope"},
+	})
+	assert.NotNil(t, err)
+	assert.Nil(t, instance)
+	assert.Empty(t, client.created)
+}
+
+func TestDockerProvider_Start_WithEmptyImageTags(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{
+		Language:  "jvm",
+		ImageTags: []string{},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "fake000:travis:jvm", instance.ID())
+}
+
+func TestDockerProvider_Start_WithRespectImageLabels(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"RESPECT_IMAGE_LABELS": "true",
+		"CPU_SET_SIZE":         "8",
+		"MAX_MEMORY":           "6GiB",
+		"MAX_CPUS":             "3",
+	})
+	client.imageConfigs = map[string]*docker.Config{
+		"570c738990e5": {Labels: map[string]string{"travis.memory": "8GiB", "travis.cpus": "1"}},
+	}
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{
+		Language:  "jvm",
+		ImageTags: []string{"travis:jvm"},
+	})
+	assert.Nil(t, err)
+
+	// memory is capped by MAX_MEMORY, cpus are taken as-is
+	assert.Equal(t, int64(6*1024*1024*1024), client.created[0].Config.Memory)
+	assert.Equal(t, int64(6*1024*1024*1024), client.created[0].HostConfig.Memory)
+	assert.Equal(t, "0", client.created[0].HostConfig.CPUSet)
+}
+
+func TestDockerProvider_Start_WithEmptyImageSelection(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+	provider.imageSelector = &fakeDockerImageSelector{selection: " "}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, instance)
+	assert.Equal(t, ErrImageNotFound, errors.Cause(err))
+	assert.Equal(t, FailureFail, err.(*StartError).Class)
+	assert.Contains(t, err.Error(), `language "jvm"`)
+	assert.Empty(t, client.created)
+}
+
+func TestDockerProvider_DockerImageIDFromName_WithImageCacheTTL(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"IMAGE_CACHE_TTL": "1m",
+	})
+
+	assert.Equal(t, "570c738990e5", provider.dockerImageIDFromName(client, "travis:jvm"))
+	assert.Equal(t, "570c738990e5", provider.dockerImageIDFromName(client, "travis:jvm"))
+	assert.Equal(t, 1, client.listImages)
+
+	assert.Equal(t, "travis:go", provider.dockerImageIDFromName(client, "travis:go"))
+	assert.Equal(t, "travis:go", provider.dockerImageIDFromName(client, "travis:go"))
+	assert.Equal(t, 3, client.listImages)
+
+	provider.invalidateImageCache(client, "travis:jvm")
+	assert.Equal(t, "570c738990e5", provider.dockerImageIDFromName(client, "travis:jvm"))
+	assert.Equal(t, 4, client.listImages)
+
+	provider.imageCache[client.Endpoint()+" travis:jvm"] = dockerImageCacheEntry{
+		id:      "570c738990e5",
+		expires: time.Now().Add(-time.Second),
+	}
+	assert.Equal(t, "570c738990e5", provider.dockerImageIDFromName(client, "travis:jvm"))
+	assert.Equal(t, 5, client.listImages)
+}
+
+func TestDockerProvider_DockerImageIDFromName_WithoutImageCacheTTL(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	provider.dockerImageIDFromName(client, "travis:jvm")
+	provider.dockerImageIDFromName(client, "travis:jvm")
+	assert.Equal(t, 2, client.listImages)
+}
+
+func TestDockerProvider_Start_WithImageSelectorInfra(t *testing.T) {
+	for cfgValue, expected := range map[string]string{"": "docker", "docker-arm": "docker-arm"} {
+		cfg := map[string]string{}
+		if cfgValue != "" {
+			cfg["IMAGE_SELECTOR_INFRA"] = cfgValue
+		}
+		provider, _ := dockerTestFakeSetup(t, cfg)
+
+		selector := &fakeDockerImageSelector{selection: "travis:jvm"}
+		provider.imageSelector = selector
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, selector.params.Infra)
+		assert.Equal(t, "jvm", selector.params.Language)
+	}
+}
+
+func TestDockerProvider_Setup_WithPreloadImage(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"PRELOAD_IMAGE": "travis:jvm",
+	})
+	client.images = []docker.APIImages{{ID: "570c738990e5", RepoTags: []string{"travis:jvm"}}}
+
+	err := provider.Setup(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, client.listImages)
+
+	for i := 0; i < 2; i++ {
+		id, err := provider.preloadedImageID(provider.client)
+		assert.Nil(t, err)
+		assert.Equal(t, "570c738990e5", id)
+	}
+	assert.Equal(t, 1, client.listImages)
+
+	client.images[0].ID = "fc24f3225c15"
+	id, err := provider.refreshPreloadedImage(provider.client)
+	assert.Nil(t, err)
+	assert.Equal(t, "fc24f3225c15", id)
+	assert.Equal(t, 2, client.listImages)
+
+	id, err = provider.preloadedImageID(provider.client)
+	assert.Nil(t, err)
+	assert.Equal(t, "fc24f3225c15", id)
+	assert.Equal(t, 2, client.listImages)
+
+	client.images[0].ID = "b0b0b0b0b0b0"
+	provider.invalidateImageCache(provider.client, "travis:jvm")
+	id, err = provider.preloadedImageID(provider.client)
+	assert.Nil(t, err)
+	assert.Equal(t, "b0b0b0b0b0b0", id)
+	assert.Equal(t, 3, client.listImages)
+}
+
+func TestDockerProvider_Setup_WithMissingPreloadImage(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"PRELOAD_IMAGE": "travis:go",
+	})
+
+	err := provider.Setup(context.TODO())
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrImageNotFound, errors.Cause(err))
+}
+
+func TestDockerProvider_AvailableLanguages(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+	client.images = []docker.APIImages{
+		{ID: "fc24f3225c15", RepoTags: []string{"quay.io/travisci/travis-ruby:latest", "travis:ruby", "travis:default"}},
+		{ID: "570c738990e5", RepoTags: []string{"quay.io/travisci/travis-jvm:latest", "travis:java", "travis:jvm", "travis:scala"}},
+		{ID: "8fa3b7c1d2e4", RepoTags: []string{"travis:ruby", "ubuntu:xenial"}},
+		{ID: "3b1c0a9e7d6f"},
+	}
+
+	assert.Equal(t, []string{"java", "jvm", "ruby", "scala"}, provider.AvailableLanguages())
+}
+
+func TestDockerProvider_AvailableLanguages_WithListImagesError(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+	client.listImagesErr = &docker.Error{Status: http.StatusInternalServerError}
+
+	assert.Nil(t, provider.AvailableLanguages())
+}
+
+func TestNewDockerProvider_WithInvalidCMDByImage(t *testing.T) {
+	for _, cmdByImage := range []string{
+		"travis:jvm",
+		"=/sbin/init",
+		"travis:jvm=",
+	} {
+		provider, _, err := dockerTestNewProvider(map[string]string{
+			"CMD_BY_IMAGE": cmdByImage,
+		})
+		assert.NotNil(t, err, cmdByImage)
+		assert.Nil(t, provider, cmdByImage)
+	}
+}
+
+func TestDockerProvider_Start_WithCMDByImage(t *testing.T) {
+	for imageName, expected := range map[string][]string{
+		"travis:jvm":                  {"/lib/systemd/systemd", "--log-level=info"},
+		"travis:ruby":                 {"/sbin/init"},
+		"quay.io/travisci/travis-jvm": {"/usr/bin/tini", "--", "sleep", "infinity"},
+		"travis:default":              {"/bin/sleep", "infinity"},
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"CMD":          "/bin/sleep infinity",
+			"CMD_BY_IMAGE": "travis:jvm=/lib/systemd/systemd --log-level=info; travis:r*=/sbin/init; quay.io/*/*=/usr/bin/tini -- sleep infinity",
+		})
+		client.images = append(client.images, docker.APIImages{ID: "a2f1c0b9e8d7", RepoTags: []string{"quay.io/travisci/travis-jvm"}})
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{ImageName: imageName})
+		assert.Nil(t, err, imageName)
+		assert.Len(t, client.created, 1)
+		assert.Equal(t, expected, client.created[0].Config.Cmd, imageName)
+	}
+}
+
+func TestDockerImageIDNameFromSelection(t *testing.T) {
+	for _, tc := range []struct {
+		selection string
+		nameFirst bool
+		id, name  string
+	}{
+		{"570c738990e5;travis:jvm", false, "570c738990e5", "travis:jvm"},
+		{"travis:jvm;570c738990e5", true, "570c738990e5", "travis:jvm"},
+		{" travis:jvm ", false, "travis:jvm", "travis:jvm"},
+		{"travis:jvm", true, "travis:jvm", "travis:jvm"},
+	} {
+		id, name := dockerImageIDNameFromSelection(tc.selection, tc.nameFirst)
+		assert.Equal(t, tc.id, id, tc.selection)
+		assert.Equal(t, tc.name, name, tc.selection)
+	}
+}
+
+func TestNewDockerProvider_WithInvalidImageSelectionFormat(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"IMAGE_SELECTION_FORMAT": "id;name",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestDockerProvider_Start_WithImageSelectionFormat(t *testing.T) {
+	for format, selection := range map[string]string{
+		"":        "570c738990e5;travis:jvm",
+		"id-name": "570c738990e5;travis:jvm",
+		"name-id": "travis:jvm;570c738990e5",
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"IMAGE_SELECTION_FORMAT": format,
+		})
+		provider.imageSelector = &fakeDockerImageSelector{selection: selection}
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err, format)
+		assert.Len(t, client.created, 1)
+		assert.Equal(t, "570c738990e5", client.created[0].Config.Image, format)
+		assert.Equal(t, "travis:jvm", instance.(*dockerInstance).imageName, format)
+	}
+}
+
+func TestDockerProvider_Setup_WithValidateSelectorURL(t *testing.T) {
+	requests := 0
+	selector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer selector.Close()
+
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"IMAGE_SELECTOR_TYPE":   "api",
+		"IMAGE_SELECTOR_URL":    selector.URL,
+		"VALIDATE_SELECTOR_URL": "true",
+	})
+
+	assert.Nil(t, err)
+	assert.Nil(t, provider.Setup(context.TODO()))
+	assert.Equal(t, 1, requests)
+}
+
+func TestDockerProvider_Setup_WithValidateSelectorURLUnreachable(t *testing.T) {
+	selector := httptest.NewServer(http.NotFoundHandler())
+	selectorURL := selector.URL
+	selector.Close()
+
+	for validate, expectErr := range map[string]bool{"true": true, "false": false} {
+		provider, _, err := dockerTestNewProvider(map[string]string{
+			"IMAGE_SELECTOR_TYPE":   "api",
+			"IMAGE_SELECTOR_URL":    selectorURL,
+			"VALIDATE_SELECTOR_URL": validate,
+		})
+		assert.Nil(t, err)
+
+		err = provider.Setup(context.TODO())
+		assert.Equal(t, expectErr, err != nil, validate)
+
+	}
+}
+
+func TestDockerProvider_Start_WithImageSelectorMissTTL(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"IMAGE_SELECTOR_MISS_TTL": "50ms",
+	})
+	selector := &fakeDockerImageSelector{selection: ""}
+	provider.imageSelector = selector
+
+	for i := 0; i < 3; i++ {
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "cobol"})
+		assert.Equal(t, ErrImageNotFound, errors.Cause(err))
+	}
+	assert.Equal(t, 1, selector.calls)
+
+	// misses are kept per language
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "fortran"})
+	assert.Equal(t, ErrImageNotFound, errors.Cause(err))
+	assert.Equal(t, 2, selector.calls)
+
+	time.Sleep(60 * time.Millisecond)
+
+	_, err = provider.Start(context.TODO(), &StartAttributes{Language: "cobol"})
+	assert.Equal(t, ErrImageNotFound, errors.Cause(err))
+	assert.Equal(t, 3, selector.calls)
+}
+
+func TestDockerProvider_Start_WithoutImageSelectorMissTTL(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{})
+	selector := &fakeDockerImageSelector{selection: ""}
+	provider.imageSelector = selector
+
+	for i := 0; i < 3; i++ {
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "cobol"})
+		assert.Equal(t, ErrImageNotFound, errors.Cause(err))
+	}
+	assert.Equal(t, 3, selector.calls)
+}
+
+func TestDockerProvider_Start_WithFullImageRef(t *testing.T) {
+	for _, imageName := range []string{
+		"quay.io/travisci/ci-garnet:packer-1503972846",
+		"travisci/ci-garnet:packer-1503972846",
+		"ci-garnet@sha256:8a8f4e6f4b5b3d4c2c1f8b5f3c1e3b5f0f7a4b2f6e1c7d2e9a3b4c5d6e7f8a9b",
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{
+			Language:  "jvm",
+			ImageName: imageName,
+		})
+		assert.Nil(t, err)
+
+		assert.Equal(t, imageName, client.created[0].Config.Image)
+		assert.Equal(t, 0, client.listImages, imageName)
+	}
+}
+
+func TestDockerProvider_Start_WithBareImageName(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{
+		Language:  "jvm",
+		ImageName: "travis:ruby",
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "fc24f3225c15", client.created[0].Config.Image)
+	assert.Equal(t, 1, client.listImages)
+}
+
+func TestDockerProvider_Start_WithMissingImagePull(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"PULL_MISSING_IMAGES": "true",
+	})
+	client.createErrs = []error{docker.ErrNoSuchImage}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{ImageName: "travis:jvm"})
+	assert.Nil(t, err)
+	assert.NotNil(t, instance)
+	assert.Equal(t, []string{"travis:jvm"}, client.pulled)
+	assert.Len(t, client.created, 1)
+}
+
+func TestDockerProvider_Start_WithPullRateLimited(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"PULL_MISSING_IMAGES":      "true",
+		"PULL_RATE_LIMIT_COOLDOWN": "1h",
+	})
+	client.createErrs = []error{docker.ErrNoSuchImage, docker.ErrNoSuchImage}
+	client.pullErrs = []error{fmt.Errorf("toomanyrequests: You have reached your pull rate limit. You may increase the limit by authenticating and upgrading")}
+
+	gometrics.DefaultRegistry.UnregisterAll()
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{ImageName: "travis:jvm"})
+	assert.Equal(t, ErrPullRateLimited, errors.Cause(err))
+	assert.Equal(t, FailureReschedule, ClassifyStartError(err))
+	assert.Len(t, client.pulled, 1)
+
+	// during the cooldown, the registry isn't asked again
+	_, err = provider.Start(context.TODO(), &StartAttributes{ImageName: "travis:jvm"})
+	assert.Equal(t, ErrPullRateLimited, errors.Cause(err))
+	assert.Len(t, client.pulled, 1)
+	assert.Empty(t, client.created)
+
+	// another registry has a limit of its own
+	client.createErrs = []error{docker.ErrNoSuchImage}
+	_, err = provider.Start(context.TODO(), &StartAttributes{ImageName: "quay.io/travisci/ci-garnet:latest"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"travis:jvm", "quay.io/travisci/ci-garnet:latest"}, client.pulled)
+
+	meter, ok := gometrics.DefaultRegistry.Get("worker.vm.provider.docker.pull.ratelimited").(gometrics.Meter)
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(1), meter.Count())
+	}
+}
+
+func TestIsDockerPullRateLimitError(t *testing.T) {
+	assert.False(t, isDockerPullRateLimitError(nil))
+	assert.False(t, isDockerPullRateLimitError(fmt.Errorf("manifest unknown")))
+	assert.True(t, isDockerPullRateLimitError(&docker.Error{Status: http.StatusTooManyRequests}))
+	assert.True(t, isDockerPullRateLimitError(fmt.Errorf("toomanyrequests: too many requests")))
+}
+
+func TestDockerImageRegistry(t *testing.T) {
+	for imageName, registry := range map[string]string{
+		"travis:jvm":                        "docker.io",
+		"travisci/ci-garnet:latest":         "docker.io",
+		"quay.io/travisci/ci-garnet:latest": "quay.io",
+		"localhost/ci-garnet":               "localhost",
+		"registry:5000/ci-garnet":           "registry:5000",
+	} {
+		assert.Equal(t, registry, dockerImageRegistry(imageName), imageName)
+	}
+}
+
+func TestNewDockerProvider_WithInvalidPullRateLimitCooldown(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"PULL_RATE_LIMIT_COOLDOWN": "later",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
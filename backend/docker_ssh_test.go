@@ -0,0 +1,398 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/travis-ci/worker/ssh"
+)
+
+func TestDockerInstance_IPAddress_WithNetwork(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"NETWORK": "travis",
+	})
+
+	assert.Nil(t, err)
+
+	instance := &dockerInstance{
+		provider: provider,
+		container: &docker.Container{
+			ID: "beabebabafabafaba0000",
+			NetworkSettings: &docker.NetworkSettings{
+				Networks: map[string]docker.ContainerNetwork{
+					"travis": {IPAddress: "172.18.0.2"},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, "172.18.0.2", instance.ipAddress())
+}
+
+func TestNewDockerProvider_WithInvalidSSHDialAddressTemplate(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"SSH_DIAL_ADDRESS_TEMPLATE": "{{.IP",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestDockerInstance_SSHAddress(t *testing.T) {
+	for tmpl, expected := range map[string]string{
+		"":                            "172.17.0.4:22",
+		"{{.IP}}:2222":                "172.17.0.4:2222",
+		"ssh-proxy:{{.ID}}":           "ssh-proxy:beabebabafabafaba0000",
+		"127.0.0.1:{{printf \"22\"}}": "127.0.0.1:22",
+	} {
+		cfg := map[string]string{}
+		if tmpl != "" {
+			cfg["SSH_DIAL_ADDRESS_TEMPLATE"] = tmpl
+		}
+
+		provider, _ := dockerTestFakeSetup(t, cfg)
+
+		instance := &dockerInstance{
+			provider: provider,
+			container: &docker.Container{
+				ID:              "beabebabafabafaba0000",
+				NetworkSettings: &docker.NetworkSettings{IPAddress: "172.17.0.4"},
+			},
+		}
+
+		address, err := instance.sshAddress()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, address)
+
+	}
+}
+
+func TestDockerInstance_WaitForIPAddress(t *testing.T) {
+	defaultDockerIPRetrySleep = time.Millisecond
+	defer func() { defaultDockerIPRetrySleep = time.Second }()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	inspects := 0
+	client.onInspect = func(container *docker.Container) {
+		inspects++
+		if inspects == 3 {
+			container.NetworkSettings = &docker.NetworkSettings{IPAddress: "172.17.0.2"}
+		}
+	}
+
+	dockerInstance := instance.(*dockerInstance)
+	assert.Nil(t, dockerInstance.waitForIPAddress(context.TODO()))
+	assert.Equal(t, 3, inspects)
+
+	address, err := dockerInstance.sshAddress()
+	assert.Nil(t, err)
+	assert.Equal(t, "172.17.0.2:22", address)
+}
+
+func TestDockerInstance_WaitForIPAddress_WithoutIPAddress(t *testing.T) {
+	defaultDockerIPRetrySleep = time.Millisecond
+	defer func() { defaultDockerIPRetrySleep = time.Second }()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"SSH_IP_RETRIES": "2",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	inspects := 0
+	client.onInspect = func(container *docker.Container) {
+		inspects++
+		container.HostConfig.NetworkMode = "none"
+	}
+
+	err = instance.(*dockerInstance).waitForIPAddress(context.TODO())
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `network mode "none"`)
+	}
+	assert.Equal(t, 3, inspects)
+}
+
+func TestDockerInstance_WaitForIPAddress_WithAddressTemplateWithoutIP(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"SSH_DIAL_ADDRESS_TEMPLATE": "{{.ID}}.containers.example.com:22",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	inspects := 0
+	client.onInspect = func(container *docker.Container) {
+		inspects++
+	}
+
+	assert.Nil(t, instance.(*dockerInstance).waitForIPAddress(context.TODO()))
+	assert.Equal(t, 1, inspects)
+}
+
+type fakeDockerSSHDialer struct {
+	errs       []error
+	dials      int
+	uploadWait chan struct{}
+	runWait    chan struct{}
+	conns      []*fakeDockerSSHConnection
+
+	// runExitStatus and runErr are the result of commands run on the
+	// connections.
+	runExitStatus uint8
+	runErr        error
+}
+
+func (d *fakeDockerSSHDialer) Dial(address, username string, timeout time.Duration) (ssh.Connection, error) {
+	d.dials++
+	if len(d.errs) > 0 {
+		err := d.errs[0]
+		d.errs = d.errs[1:]
+		return nil, err
+	}
+	conn := &fakeDockerSSHConnection{
+		uploadWait:    d.uploadWait,
+		runWait:       d.runWait,
+		runExitStatus: d.runExitStatus,
+		runErr:        d.runErr,
+		closed:        make(chan struct{}),
+	}
+	d.conns = append(d.conns, conn)
+	return conn, nil
+}
+
+type fakeDockerSSHConnection struct {
+	ssh.Connection
+	uploadWait    chan struct{}
+	runWait       chan struct{}
+	runExitStatus uint8
+	runErr        error
+	closed        chan struct{}
+	closeOnce     sync.Once
+	files         map[string][]byte
+	commands      []string
+}
+
+// UploadFile refuses to overwrite files like the sftp upload does.
+func (c *fakeDockerSSHConnection) UploadFile(path string, data []byte) (bool, error) {
+	if c.uploadWait != nil {
+		select {
+		case <-c.uploadWait:
+		case <-c.closed:
+			return false, fmt.Errorf("connection closed")
+		}
+	}
+	if _, ok := c.files[path]; ok {
+		return true, fmt.Errorf("file already existed")
+	}
+	if c.files != nil {
+		c.files[path] = data
+	}
+	return false, nil
+}
+
+// RunCommand blocks on runWait like a long-running script, until the
+// connection is closed.
+func (c *fakeDockerSSHConnection) RunCommand(command string, output io.Writer) (uint8, error) {
+	if c.runWait != nil {
+		select {
+		case <-c.runWait:
+		case <-c.closed:
+			return 0, fmt.Errorf("connection closed")
+		}
+	}
+	c.commands = append(c.commands, command)
+	if strings.HasPrefix(command, "rm -f ") {
+		delete(c.files, strings.TrimPrefix(command, "rm -f "))
+	}
+	return c.runExitStatus, c.runErr
+}
+
+func (c *fakeDockerSSHConnection) Close() error {
+	if c.closed != nil {
+		c.closeOnce.Do(func() { close(c.closed) })
+	}
+	return nil
+}
+
+var errFakeDockerSSHAuth = errors.Wrap(fmt.Errorf("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain"), "couldn't connect to SSH server")
+
+func TestDockerInstance_DialSSH_WithEarlyBootAuthFailure(t *testing.T) {
+	defaultDockerSSHAuthRetrySleep = time.Millisecond
+	defer func() { defaultDockerSSHAuthRetrySleep = 2 * time.Second }()
+
+	provider, _ := dockerTestFakeSetup(t, map[string]string{})
+	dialer := &fakeDockerSSHDialer{errs: []error{errFakeDockerSSHAuth, errFakeDockerSSHAuth}}
+	provider.sshDialer = dialer
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	conn, err := instance.(*dockerInstance).dialSSH(context.TODO(), "172.17.0.2:22")
+	assert.Nil(t, err)
+	assert.NotNil(t, conn)
+	assert.Equal(t, 3, dialer.dials)
+}
+
+func TestDockerInstance_DialSSH_WithPersistentAuthFailure(t *testing.T) {
+	defaultDockerSSHAuthRetrySleep = time.Millisecond
+	defer func() { defaultDockerSSHAuthRetrySleep = 2 * time.Second }()
+
+	for _, tc := range []struct {
+		cfg      map[string]string
+		expected int
+	}{
+		// after the grace period, auth failures aren't retried
+		{map[string]string{"SSH_AUTH_GRACE": "1ns"}, 1},
+		// within the grace period, retries are bounded
+		{map[string]string{"SSH_AUTH_RETRIES": "2"}, 3},
+	} {
+		provider, _ := dockerTestFakeSetup(t, tc.cfg)
+		dialer := &fakeDockerSSHDialer{errs: []error{
+			errFakeDockerSSHAuth, errFakeDockerSSHAuth, errFakeDockerSSHAuth, errFakeDockerSSHAuth,
+		}}
+		provider.sshDialer = dialer
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		_, err = instance.(*dockerInstance).dialSSH(context.TODO(), "172.17.0.2:22")
+		assert.NotNil(t, err)
+		assert.Equal(t, tc.expected, dialer.dials, "%v", tc.cfg)
+	}
+}
+
+func TestDockerInstance_DialSSH_WithOtherError(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{})
+	dialer := &fakeDockerSSHDialer{errs: []error{fmt.Errorf("dial tcp 172.17.0.2:22: connection refused")}}
+	provider.sshDialer = dialer
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	_, err = instance.(*dockerInstance).dialSSH(context.TODO(), "172.17.0.2:22")
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, dialer.dials)
+}
+
+func TestDockerInstance_RunScriptSSH(t *testing.T) {
+	for _, tc := range []struct {
+		exitStatus uint8
+		err        error
+		completed  bool
+	}{
+		// a script that ran completed, whatever its exit code
+		{3, nil, true},
+		// one whose session failed didn't
+		{0, fmt.Errorf("session dropped"), false},
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{})
+		provider.sshDialer = &fakeDockerSSHDialer{runExitStatus: tc.exitStatus, runErr: tc.err}
+		client.onInspect = func(container *docker.Container) {
+			container.NetworkSettings = &docker.NetworkSettings{IPAddress: "172.17.0.2"}
+		}
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		res, err := instance.(*dockerInstance).runScriptSSH(context.TODO(), &bytes.Buffer{})
+		assert.Equal(t, tc.completed, res.Completed, "%v", tc.err)
+		assert.Equal(t, tc.exitStatus, res.ExitCode)
+		assert.Equal(t, tc.err, errors.Cause(err))
+	}
+}
+
+func TestDockerInstance_RunScriptSSH_WithCancel(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+	dialer := &fakeDockerSSHDialer{runWait: make(chan struct{})}
+	defer close(dialer.runWait)
+	provider.sshDialer = dialer
+	client.onInspect = func(container *docker.Container) {
+		container.NetworkSettings = &docker.NetworkSettings{IPAddress: "172.17.0.2"}
+	}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	res, err := instance.(*dockerInstance).runScriptSSH(ctx, &bytes.Buffer{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.False(t, res.Completed)
+
+	// the connection is closed rather than left running the script
+	assert.Len(t, dialer.conns, 1)
+	select {
+	case <-dialer.conns[0].closed:
+	case <-time.After(time.Second):
+		t.Error("connection wasn't closed")
+	}
+}
+
+var errFakeDockerSSHRefused = errors.Wrap(fmt.Errorf("dial tcp 172.17.0.2:22: connect: connection refused"), "couldn't connect to SSH server")
+
+func TestDockerInstance_DialSSHWithRestart(t *testing.T) {
+	defaultDockerSSHDRestartSleep = time.Millisecond
+	defer func() { defaultDockerSSHDRestartSleep = time.Second }()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"SSHD_RESTART_CMD": "sudo service ssh restart",
+	})
+	dialer := &fakeDockerSSHDialer{errs: []error{errFakeDockerSSHRefused, errFakeDockerSSHRefused}}
+	provider.sshDialer = dialer
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	conn, err := instance.(*dockerInstance).dialSSHWithRestart(context.TODO(), "172.17.0.2:22")
+	assert.Nil(t, err)
+	assert.NotNil(t, conn)
+	assert.Equal(t, 3, dialer.dials)
+	assert.Equal(t, [][]string{
+		{"sudo", "service", "ssh", "restart"},
+		{"sudo", "service", "ssh", "restart"},
+	}, client.execCmds)
+}
+
+func TestDockerInstance_DialSSHWithRestart_WithPersistentRefusal(t *testing.T) {
+	defaultDockerSSHDRestartSleep = time.Millisecond
+	defer func() { defaultDockerSSHDRestartSleep = time.Second }()
+
+	for _, tc := range []struct {
+		cfg      map[string]string
+		dials    int
+		restarts int
+	}{
+		{cfg: map[string]string{}, dials: 1, restarts: 0},
+		{cfg: map[string]string{"SSHD_RESTART_CMD": "sudo service ssh restart"}, dials: 3, restarts: 2},
+		{cfg: map[string]string{"SSHD_RESTART_CMD": "sudo service ssh restart", "SSHD_RESTART_RETRIES": "0"}, dials: 1, restarts: 0},
+	} {
+		provider, client := dockerTestFakeSetup(t, tc.cfg)
+		dialer := &fakeDockerSSHDialer{errs: []error{
+			errFakeDockerSSHRefused, errFakeDockerSSHRefused, errFakeDockerSSHRefused, errFakeDockerSSHRefused,
+		}}
+		provider.sshDialer = dialer
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		_, err = instance.(*dockerInstance).dialSSHWithRestart(context.TODO(), "172.17.0.2:22")
+		assert.NotNil(t, err)
+		assert.Equal(t, tc.dials, dialer.dials)
+		assert.Len(t, client.execCmds, tc.restarts)
+	}
+}
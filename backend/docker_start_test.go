@@ -0,0 +1,1236 @@
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	workerctx "github.com/travis-ci/worker/context"
+)
+
+func TestDockerProvider_Start(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{
+		Language: "jvm",
+		Group:    "",
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, instance)
+
+	assert.Equal(t, "fake000:travis:jvm", instance.ID())
+	assert.Len(t, client.created, 1)
+	assert.Equal(t, "570c738990e5", client.created[0].Config.Image)
+	assert.Equal(t, "0,1", client.created[0].HostConfig.CPUSet)
+	assert.Equal(t, []bool{true, true, false}, provider.cpuSets[provider.client.Endpoint()])
+	assert.Equal(t, []Instance{instance}, provider.Instances())
+}
+
+func TestDockerProvider_Start_WithPrivileged(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"PRIVILEGED": "true",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm", Group: ""})
+	assert.Nil(t, err)
+	assert.Equal(t, "fake000:travis:jvm", instance.ID())
+	assert.True(t, client.created[0].HostConfig.Privileged)
+}
+
+func TestDockerProvider_Start_WithPlatform(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"PLATFORM": "linux/amd64",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{
+		Language: "jvm",
+		Platform: "linux/arm64",
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "linux/arm64", client.created[0].Platform)
+}
+
+func TestDockerProvider_Start_WithMaxInstanceLifetime(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"MAX_INSTANCE_LIFETIME": "50ms",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.NotNil(t, instance)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(provider.Instances()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(provider.Instances()) > 0 {
+		t.Fatal("instance was not stopped after exceeding its max lifetime")
+	}
+
+	client.mutex.Lock()
+	assert.Len(t, client.removed, 1)
+	client.mutex.Unlock()
+
+	// a subsequent Stop must not check in the cpu sets a second time
+	assert.Nil(t, instance.Stop(context.TODO()))
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[client.Endpoint()])
+}
+
+func TestDockerProvider_Instances(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, nil)
+
+	assert.Len(t, provider.Instances(), 0)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, []Instance{instance}, provider.Instances())
+
+	assert.Nil(t, instance.Stop(context.TODO()))
+	assert.Len(t, provider.Instances(), 0)
+}
+
+func TestDockerProvider_Start_WithAnnotations(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"ANNOTATIONS": "io.kubernetes.cri.untrusted-workload=true com.example.team=builds",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	labels := client.created[0].Config.Labels
+	assert.Equal(t, "true", labels["io.kubernetes.cri.untrusted-workload"])
+	assert.Equal(t, "builds", labels["com.example.team"])
+}
+
+func TestDockerProvider_Start_WithBootTimeout(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+	client.onInspect = func(container *docker.Container) {
+		container.State = docker.State{Running: false, Status: "created", Error: "oci runtime error"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+
+	instance, err := provider.Start(ctx, &StartAttributes{Language: "jvm"})
+	assert.Nil(t, instance)
+	assert.NotNil(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Contains(t, err.Error(), "boot timed out")
+	assert.Contains(t, err.Error(), "state=created")
+	assert.Contains(t, err.Error(), "error=oci runtime error")
+	assert.Contains(t, client.logsTails, "20")
+}
+
+func TestDockerProvider_Start_WithMountDockerSock(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   map[string]string
+		binds []string
+	}{
+		{cfg: map[string]string{}},
+		{cfg: map[string]string{"MOUNT_DOCKER_SOCK": "false"}},
+		{cfg: map[string]string{"MOUNT_DOCKER_SOCK": "true"}, binds: []string{"/var/run/docker.sock:/var/run/docker.sock:ro"}},
+		{cfg: map[string]string{"MOUNT_DOCKER_SOCK": "true", "MOUNT_DOCKER_SOCK_MODE": "rw"}, binds: []string{"/var/run/docker.sock:/var/run/docker.sock:rw"}},
+	} {
+		provider, client := dockerTestFakeSetup(t, tc.cfg)
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		assert.Equal(t, tc.binds, client.created[0].HostConfig.Binds)
+	}
+}
+
+func TestDockerProvider_Start_WithEarlyExit(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CMD": "/sbin/init",
+	})
+	client.onInspect = func(container *docker.Container) {
+		now := time.Now()
+		container.State = docker.State{Running: false, Status: "exited", ExitCode: 127, StartedAt: now, FinishedAt: now}
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+
+	instance, err := provider.Start(ctx, &StartAttributes{Language: "jvm"})
+	assert.Nil(t, instance)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "container exited immediately with exit code 127")
+	assert.Contains(t, err.Error(), "/sbin/init")
+}
+
+func TestDockerProvider_Start_WithEndpoints(t *testing.T) {
+	provider, one := dockerTestFakeSetup(t, nil)
+	two := newFakeDockerClient()
+	two.endpoint = "fake://two"
+	provider.clients = []dockerClient{one, two}
+
+	for i := 0; i < 2; i++ {
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+	}
+
+	assert.Len(t, one.created, 1)
+	assert.Len(t, two.created, 1)
+}
+
+func TestDockerProvider_Start_WithEndpointsFailover(t *testing.T) {
+	provider, failing := dockerTestFakeSetup(t, nil)
+	failing.createErr = &docker.Error{Status: http.StatusInternalServerError}
+	client := newFakeDockerClient()
+	client.endpoint = "fake://two"
+	provider.clients = []dockerClient{failing, client}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm", ImageName: "travis:jvm"})
+	assert.Nil(t, err)
+	assert.Len(t, client.created, 1)
+	assert.Equal(t, "fake://two", instance.(*dockerInstance).client.Endpoint())
+}
+
+func TestDockerProvider_Start_WithWorkerVersionLabel(t *testing.T) {
+	origVersion := dockerWorkerVersion
+	dockerWorkerVersion = "v3.1.0-4-gfafafaf"
+	defer func() { dockerWorkerVersion = origVersion }()
+
+	for cfgValue, expected := range map[string]string{"": "v3.1.0-4-gfafafaf", "false": ""} {
+		cfg := map[string]string{}
+		if cfgValue != "" {
+			cfg["LABEL_WORKER_VERSION"] = cfgValue
+		}
+		provider, client := dockerTestFakeSetup(t, cfg)
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, client.created[0].Config.Labels["travis.worker_version"])
+	}
+}
+
+func TestDockerProvider_Start_WithDNSOptions(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"DNS_OPTIONS": "ndots:2 timeout:1 rotate",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ndots:2", "timeout:1", "rotate"}, client.created[0].HostConfig.DNSOptions)
+}
+
+func TestDockerProvider_Start_WithSecrets(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"SECRETS_OWNER": "2000:3000",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{
+		Language: "jvm",
+		Secrets: map[string]string{
+			"npmrc":   "//registry.npmjs.org/:_authToken=fafafaf",
+			"api-key": "s3cr3t",
+		},
+	})
+	assert.Nil(t, err)
+
+	// the secrets are on their own tmpfs, which goes away with the container
+	tmpFs := client.created[0].HostConfig.Tmpfs
+	assert.Equal(t, "rw,noexec,nosuid,nodev,mode=0700,uid=2000,gid=3000", tmpFs["/run/travis-secrets"])
+	assert.Equal(t, "rw,nosuid,nodev,exec,noatime,size=65536k", tmpFs["/run"])
+	assert.Len(t, provider.tmpFs, 2)
+
+	headers := []*tar.Header{}
+	contents := []string{}
+	tr := tar.NewReader(bytes.NewReader(client.uploaded))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		buf := &bytes.Buffer{}
+		buf.ReadFrom(tr)
+		headers = append(headers, hdr)
+		contents = append(contents, buf.String())
+	}
+
+	assert.Len(t, headers, 2)
+	for _, hdr := range headers {
+		assert.Equal(t, int64(0400), hdr.Mode)
+		assert.Equal(t, 2000, hdr.Uid)
+		assert.Equal(t, 3000, hdr.Gid)
+	}
+	assert.Equal(t, "/run/travis-secrets/api-key", headers[0].Name)
+	assert.Equal(t, "s3cr3t", contents[0])
+	assert.Equal(t, "/run/travis-secrets/npmrc", headers[1].Name)
+	assert.Equal(t, "//registry.npmjs.org/:_authToken=fafafaf", contents[1])
+
+	assert.Nil(t, instance.Stop(context.TODO()))
+}
+
+func TestDockerProvider_Start_WithInvalidSecretName(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{
+		Language: "jvm",
+		Secrets:  map[string]string{"../etc/passwd": "nope"},
+	})
+	assert.NotNil(t, err)
+	assert.Nil(t, instance)
+	assert.Len(t, client.removed, 1)
+	assert.Len(t, client.containers, 0)
+}
+
+func TestClassifyDockerStartError(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class FailureClass
+	}{
+		{errDockerNoFreeCPUSets, FailureReschedule},
+		{errors.Wrap(errDockerNoFreeCPUSets, "couldn't reserve 2 whole cores"), FailureReschedule},
+		{errors.Wrap(errDockerMemoryBudget, "4 GiB committed"), FailureReschedule},
+		{errors.Wrap(errDockerJobTmpfs, "tmpfs mount point \"/\" is not allowed"), FailureFail},
+		{errors.Wrap(errDockerMacAddress, "\"nope\" is not a 48-bit mac address"), FailureFail},
+		{docker.ErrNoSuchImage, FailureFail},
+		{fmt.Errorf("something else"), FailureUnknown},
+	} {
+		assert.Equal(t, tc.class, classifyDockerStartError(tc.err), fmt.Sprintf("%v", tc.err))
+	}
+}
+
+func TestDockerProvider_Setup_WithNetworkMTU(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NETWORK":     "travis",
+		"NETWORK_MTU": "1400",
+	})
+
+	err := provider.Setup(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, client.createdNetworks, 1)
+	created := client.createdNetworks[0]
+	assert.Equal(t, "travis", created.Name)
+	assert.Equal(t, "bridge", created.Driver)
+	assert.Equal(t, "1400", created.Options["com.docker.network.driver.mtu"])
+}
+
+func TestDockerProvider_Setup_WithExistingNetwork(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NETWORK":     "travis",
+		"NETWORK_MTU": "1400",
+	})
+	client.networks = map[string]*docker.Network{
+		"travis": {Name: "travis", ID: "ffbada", Driver: "bridge", Options: map[string]string{"com.docker.network.driver.mtu": "1500"}},
+	}
+
+	err := provider.Setup(context.TODO())
+	assert.Nil(t, err)
+	assert.Empty(t, client.createdNetworks)
+}
+
+func TestDockerProvider_Start_WithNetwork(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NETWORK": "travis",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "travis", client.created[0].HostConfig.NetworkMode)
+}
+
+func TestDockerProvider_Start_WithJobID(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	ctx := workerctx.FromJobID(context.TODO(), 42)
+	_, err := provider.Start(ctx, &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "travis-job-42", client.created[0].Name)
+}
+
+func TestDockerProvider_Start_WithCreateConflict(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CPUS":         "1",
+		"CPU_SET_SIZE": "4",
+	})
+
+	// the container of an earlier attempt to start the job
+	containerID := "beabebabafabafaba0000"
+	client.containers[containerID] = &docker.Container{
+		ID:         containerID,
+		Name:       "/travis-job-42",
+		State:      docker.State{Running: true},
+		HostConfig: &docker.HostConfig{CPUSetCPUs: "2"},
+	}
+
+	ctx := workerctx.FromJobID(context.TODO(), 42)
+	instance, err := provider.Start(ctx, &StartAttributes{ImageName: "travis:jvm"})
+	assert.Nil(t, err)
+	assert.NotNil(t, instance)
+	assert.Empty(t, client.created)
+	assert.Equal(t, containerID, instance.(*dockerInstance).container.ID)
+	assert.Equal(t, "2", instance.(*dockerInstance).CPUSet())
+	assert.Equal(t, "2", instance.(*dockerInstance).container.HostConfig.CPUSetCPUs)
+	assert.Equal(t, []bool{false, false, true, false}, provider.cpuSets[client.Endpoint()])
+
+	_, err = provider.Start(ctx, &StartAttributes{ImageName: "travis:jvm"})
+	assert.NotNil(t, err)
+}
+
+func TestDockerLabelValue(t *testing.T) {
+	assert.Equal(t, "travis:jvm", dockerLabelValue("travis:jvm"))
+	assert.Equal(t, "0,1", dockerLabelValue("0,1"))
+	assert.Equal(t, "quay.io/travisci/travis-jvm@sha256:fafafaf", dockerLabelValue("quay.io/travisci/travis-jvm@sha256:fafafaf"))
+	assert.Equal(t, "a_b_c_", dockerLabelValue("a b\"c\n"))
+}
+
+func TestDockerProvider_Start_WithMetricsLabels(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"METRICS_LABELS":        "true",
+		"METRICS_LABELS_MEMORY": "true",
+		"MEMORY":                "2GiB",
+		"CPUS":                  "1",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	labels := client.created[0].Config.Labels
+	startTime, err := time.Parse(time.RFC3339, labels["travis.start_time"])
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), startTime, time.Minute)
+	assert.Equal(t, "0", labels["travis.cpuset"])
+	assert.Equal(t, "travis:jvm", labels["travis.image"])
+	assert.Equal(t, "2147483648", labels["travis.memory_limit"])
+
+	for key, value := range labels {
+		assert.Equal(t, dockerLabelValue(value), value, "label %s", key)
+	}
+}
+
+func TestDockerProvider_Start_WithoutMetricsLabels(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	labels := client.created[0].Config.Labels
+	assert.NotContains(t, labels, "travis.start_time")
+	assert.NotContains(t, labels, "travis.memory_limit")
+}
+
+func TestDockerProvider_Start_WithWaitForHealthy(t *testing.T) {
+	for _, healthStatuses := range [][]string{
+		{"starting", "starting", "healthy"},
+		{""},
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"WAIT_FOR_HEALTHY": "true",
+		})
+
+		inspects := 0
+		client.onInspect = func(container *docker.Container) {
+			status := healthStatuses[len(healthStatuses)-1]
+			if inspects < len(healthStatuses) {
+				status = healthStatuses[inspects]
+			}
+			inspects++
+			container.State.Health.Status = status
+		}
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{ImageName: "travis:jvm"})
+		assert.Nil(t, err)
+		assert.NotNil(t, instance)
+		assert.Equal(t, len(healthStatuses), inspects)
+	}
+}
+
+func TestDockerProvider_Start_WithInspectError(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+	client.inspectErr = &docker.Error{Status: http.StatusInternalServerError}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{ImageName: "travis:jvm"})
+	assert.NotNil(t, err)
+	assert.Nil(t, instance)
+}
+
+func TestDockerProvider_Start_PollsInspectWhileBooting(t *testing.T) {
+	defaultDockerBootPollSleep = 20 * time.Millisecond
+	defer func() { defaultDockerBootPollSleep = 100 * time.Millisecond }()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"WAIT_FOR_HEALTHY": "true",
+	})
+
+	inspects := 0
+	client.onInspect = func(container *docker.Container) {
+		inspects++
+		container.State.Health.Status = "starting"
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+
+	instance, err := provider.Start(ctx, &StartAttributes{Language: "jvm"})
+	assert.NotNil(t, err)
+	assert.Nil(t, instance)
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	assert.True(t, inspects > 1)
+	assert.True(t, inspects <= 10)
+}
+
+func TestDockerProvider_Start_WithWaitForHealthyTimeout(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"WAIT_FOR_HEALTHY": "true",
+	})
+	client.onInspect = func(container *docker.Container) {
+		container.State.Health.Status = "unhealthy"
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 200*time.Millisecond)
+	defer cancel()
+
+	instance, err := provider.Start(ctx, &StartAttributes{ImageName: "travis:jvm"})
+	assert.Nil(t, instance)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+func TestDockerProvider_Start_WithMaxConcurrentStarts(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"MAX_CONCURRENT_STARTS": "2",
+		"CPU_SET_SIZE":          "12",
+		"CPUS":                  "1",
+	})
+
+	var (
+		mutex         sync.Mutex
+		active        int
+		maxActive     int
+		startAttempts = 6
+	)
+
+	client.onCreate = func(docker.CreateContainerOptions) {
+		mutex.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mutex.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < startAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, maxActive <= 2, "max active starts %d", maxActive)
+	assert.True(t, maxActive > 0)
+	assert.Len(t, provider.startSlots, 0)
+}
+
+func TestDockerProvider_Start_WithMaxConcurrentStartsTimeout(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"MAX_CONCURRENT_STARTS": "1",
+	})
+	provider.startSlots <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := provider.Start(ctx, &StartAttributes{Language: "jvm"})
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.Equal(t, FailureRetry, ClassifyStartError(err))
+}
+
+func TestDockerProvider_Start_WithCMDMode(t *testing.T) {
+	for _, tc := range []struct {
+		cfg      map[string]string
+		expected []string
+	}{
+		{map[string]string{}, []string{"/sbin/init"}},
+		{map[string]string{"CMD": "/lib/systemd/systemd --log-level=debug"}, []string{"/lib/systemd/systemd", "--log-level=debug"}},
+		{map[string]string{"CMD_MODE": "append"}, []string{"/sbin/init"}},
+		{map[string]string{"CMD_MODE": "append", "CMD": "--log-level=debug"}, []string{"/sbin/init", "--log-level=debug"}},
+	} {
+		provider, client := dockerTestFakeSetup(t, tc.cfg)
+		client.imageConfigs = map[string]*docker.Config{
+			"570c738990e5": {Cmd: []string{"/sbin/init"}},
+		}
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, client.created[0].Config.Cmd, fmt.Sprintf("%v", tc.cfg))
+	}
+}
+
+func TestDockerProvider_Start_WithKernelMemory(t *testing.T) {
+	for _, tc := range []struct {
+		info     *docker.DockerInfo
+		expected int64
+	}{
+		{&docker.DockerInfo{SecurityOptions: []string{"name=seccomp,profile=default"}, KernelMemory: true}, 64 * 1000 * 1000},
+		{&docker.DockerInfo{SecurityOptions: []string{"name=seccomp,profile=default"}}, 64 * 1000 * 1000},
+		{&docker.DockerInfo{}, 64 * 1000 * 1000},
+		{&docker.DockerInfo{SecurityOptions: []string{"name=seccomp,profile=default", "name=cgroupns"}}, 0},
+		{nil, 64 * 1000 * 1000},
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"KERNEL_MEMORY": "64MB",
+		})
+		client.info = tc.info
+
+		assert.Nil(t, provider.Setup(context.TODO()))
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, client.created[0].HostConfig.KernelMemory, fmt.Sprintf("%+v", tc.info))
+	}
+}
+
+func TestDockerProvider_Start_WithFirstEndpointRefusingConnections(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		cfg             map[string]string
+		startAttributes *StartAttributes
+	}{
+		{"tag selector", nil, &StartAttributes{Language: "jvm"}},
+		{"image tags", nil, &StartAttributes{ImageTags: []string{"travis:go", "travis:jvm"}}},
+		{"preloaded image", map[string]string{"PRELOAD_IMAGE": "travis:jvm"}, &StartAttributes{Language: "ruby"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, one := dockerTestFakeSetup(t, tc.cfg)
+			one.listImagesErr = docker.ErrConnectionRefused
+			one.createErr = docker.ErrConnectionRefused
+			two := newFakeDockerClient()
+			two.endpoint = "fake://two"
+			two.images = []docker.APIImages{{ID: "b0b0b0b0b0b0", RepoTags: []string{"travis:jvm"}}}
+			provider.clients = []dockerClient{one, two}
+			provider.imageSelector = &dockerTagImageSelector{clients: provider.clients}
+
+			instance, err := provider.Start(context.TODO(), tc.startAttributes)
+			assert.Nil(t, err)
+			if assert.NotNil(t, instance) {
+				assert.Equal(t, two, instance.(*dockerInstance).client)
+			}
+
+			// the image is resolved on the endpoint the container is
+			// created on rather than on the first one
+			if assert.Len(t, two.created, 1) {
+				assert.Equal(t, "b0b0b0b0b0b0", two.created[0].Config.Image)
+			}
+			assert.Equal(t, []string{"jvm"}, provider.AvailableLanguages())
+		})
+	}
+}
+
+func TestDockerProvider_Start_WithCreateError(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+	client.createErr = docker.ErrNoSuchImage
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, instance)
+	assert.NotNil(t, err)
+	assert.Equal(t, FailureFail, err.(*StartError).Class)
+	assert.Len(t, provider.Instances(), 0)
+}
+
+func TestDockerProvider_Start_WithEnvFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "worker-env")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "# shared settings\nLANG=en_US.UTF-8\nCI=\"false\"\n")
+	f.Close()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"ENV_FILE":      f.Name(),
+		"CONTAINER_ENV": "CI=true TRAVIS=true",
+	})
+
+	_, err = provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Len(t, client.created, 1)
+	assert.Equal(t, []string{"CI=true", "LANG=en_US.UTF-8", "TRAVIS=true"}, client.created[0].Config.Env)
+}
+
+func TestDockerProvider_Start_WithHugePages(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"SHM":            "128MiB",
+		"SHM_HUGE":       "within_size",
+		"HUGETLBFS_BIND": "/mnt/huge:/dev/hugepages",
+	})
+	client.info = &docker.DockerInfo{KernelVersion: "4.15.0-1044-aws"}
+
+	assert.Nil(t, provider.Setup(context.TODO()))
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	hostConfig := client.created[0].HostConfig
+	assert.Equal(t, "rw,nosuid,nodev,noexec,size=131072k,huge=within_size", hostConfig.Tmpfs["/dev/shm"])
+	assert.Equal(t, int64(0), hostConfig.ShmSize)
+	assert.Equal(t, []string{"/mnt/huge:/dev/hugepages:rw"}, hostConfig.Binds)
+}
+
+func TestDockerProvider_Setup_WithShmHugeOnOldKernel(t *testing.T) {
+	for _, info := range []*docker.DockerInfo{
+		{KernelVersion: "4.4.0-21-generic"},
+		{KernelVersion: "3.10.0-957.el7.x86_64"},
+		{KernelVersion: "unknown"},
+		nil,
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"SHM_HUGE": "always",
+		})
+		client.info = info
+
+		assert.NotNil(t, provider.Setup(context.TODO()))
+	}
+}
+
+func TestDockerProvider_Start_WithSourceLabels(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{
+		Language:   "jvm",
+		Repository: "travis-ci/worker",
+		Branch:     "feature/new thing",
+		Commit:     "6ab3f1c",
+	})
+	assert.Nil(t, err)
+
+	labels := client.created[0].Config.Labels
+	assert.Equal(t, "travis-ci/worker", labels[dockerRepositoryLabel])
+	assert.Equal(t, "feature/new_thing", labels[dockerBranchLabel])
+	assert.Equal(t, "6ab3f1c", labels[dockerCommitLabel])
+}
+
+func TestDockerProvider_Start_WithoutSourceLabels(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   map[string]string
+		attrs *StartAttributes
+	}{
+		{map[string]string{}, &StartAttributes{Language: "jvm"}},
+		{map[string]string{"LABEL_SOURCE": "false"}, &StartAttributes{Language: "jvm", Branch: "master", Commit: "6ab3f1c"}},
+	} {
+		provider, client := dockerTestFakeSetup(t, tc.cfg)
+
+		_, err := provider.Start(context.TODO(), tc.attrs)
+		assert.Nil(t, err)
+
+		labels := client.created[0].Config.Labels
+		for _, label := range []string{dockerRepositoryLabel, dockerBranchLabel, dockerCommitLabel} {
+			_, ok := labels[label]
+			assert.False(t, ok, label)
+		}
+	}
+}
+
+func TestDockerProvider_Start_WithJobTmpfs(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"TMPFS_MAP":           "/run:rw,size=65536k",
+		"TMP_TMPFS_SIZE":      "0",
+		"TMPFS_ALLOWED_PATHS": "/run /var/lib/*",
+		"TMPFS_MAX_SIZE":      "1GiB",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{
+		Language: "jvm",
+		Tmpfs: map[string]string{
+			"/run":            "rw,noexec,size=128m",
+			"/var/lib/mysql/": "rw,mode=0700",
+			"/var/lib/redis":  "rw,size=4g",
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]string{
+		"/run":           "rw,noexec,size=131072k",
+		"/var/lib/mysql": "rw,mode=0700,size=1048576k",
+		"/var/lib/redis": "rw,size=1048576k",
+	}, client.created[0].HostConfig.Tmpfs)
+
+	// the provider defaults are left alone
+	assert.Equal(t, map[string]string{"/run": "rw,size=65536k"}, provider.tmpFs)
+}
+
+func TestDockerProvider_Start_WithTmpfsHardenAndJobTmpfs(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"TMPFS_MAP":           "/run:rw,suid,dev,size=65536k /var/cache:rw,exec",
+		"TMP_TMPFS_SIZE":      "0",
+		"TMPFS_ALLOWED_PATHS": "/var/lib/*",
+		"TMPFS_HARDEN":        "true",
+		"TMPFS_EXEC_PATHS":    "/var/lib/tools",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{
+		Language: "jvm",
+		Tmpfs: map[string]string{
+			"/var/lib/mysql": "rw,exec,suid,size=64m",
+			"/var/lib/tools": "rw,noexec,size=64m",
+		},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]string{
+		"/run":           "rw,size=65536k,nosuid,nodev,noexec",
+		"/var/cache":     "rw,nosuid,nodev,noexec",
+		"/var/lib/mysql": "rw,size=65536k,nosuid,nodev,noexec",
+		"/var/lib/tools": "rw,size=65536k,nosuid,nodev,exec",
+	}, client.created[0].HostConfig.Tmpfs)
+}
+
+func TestDockerProvider_Start_WithInvalidJobTmpfs(t *testing.T) {
+	for _, tmpfs := range []map[string]string{
+		{"/var/lib/mysql": "rw"},
+		{"/opt": "rw"},
+		{"/run": "rw,bogus"},
+		{"/run": "size=50%"},
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"TMPFS_ALLOWED_PATHS": "/run",
+		})
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{
+			Language: "jvm",
+			Tmpfs:    tmpfs,
+		})
+		if assert.NotNil(t, err, "%v", tmpfs) {
+			assert.Equal(t, errDockerJobTmpfs, errors.Cause(err))
+			assert.Equal(t, FailureFail, err.(*StartError).Class)
+		}
+		assert.Len(t, client.created, 0)
+	}
+}
+
+func TestDockerProvider_Start_WithFDExhaustedDaemon(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CREATE_FD_COOLDOWN": "10ms",
+		"CREATE_FD_RETRIES":  "2",
+	})
+
+	fdErr := &docker.Error{
+		Status:  http.StatusInternalServerError,
+		Message: "open /var/lib/docker/containers: too many open files",
+	}
+	client.createErrs = []error{fdErr, fdErr}
+
+	gometrics.DefaultRegistry.UnregisterAll()
+
+	start := time.Now()
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.NotNil(t, instance)
+
+	// the cooldown doubles: 10ms, then 20ms
+	assert.True(t, time.Since(start) >= 30*time.Millisecond)
+	assert.Len(t, client.created, 1)
+
+	meter, ok := gometrics.DefaultRegistry.Get("worker.vm.provider.docker.fd_exhausted").(gometrics.Meter)
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(2), meter.Count())
+	}
+}
+
+func TestDockerProvider_Start_WithPersistentlyFDExhaustedDaemon(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CREATE_FD_COOLDOWN": "1ms",
+		"CREATE_FD_RETRIES":  "1",
+	})
+
+	fdErr := &docker.Error{
+		Status:  http.StatusInternalServerError,
+		Message: "too many open files",
+	}
+	client.createErrs = []error{fdErr, fdErr, fdErr}
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.NotNil(t, err)
+	assert.Len(t, client.createErrs, 1)
+	assert.Len(t, client.created, 0)
+}
+
+func TestDockerProvider_Start_WithPropagateProxyEnv(t *testing.T) {
+	for key, value := range map[string]string{
+		"HTTP_PROXY":  "http://proxy.example.com:3128",
+		"HTTPS_PROXY": "http://proxy.example.com:3128",
+		"NO_PROXY":    "localhost,.internal",
+		"http_proxy":  "",
+		"https_proxy": "",
+		"no_proxy":    "",
+	} {
+		oldValue, wasSet := os.LookupEnv(key)
+		os.Setenv(key, value)
+		if wasSet {
+			defer os.Setenv(key, oldValue)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"PROPAGATE_PROXY_ENV": "true",
+		"CONTAINER_ENV":       "NO_PROXY=localhost",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"HTTPS_PROXY=http://proxy.example.com:3128",
+		"HTTP_PROXY=http://proxy.example.com:3128",
+		"NO_PROXY=localhost",
+	}, client.created[0].Config.Env)
+
+	provider, client = dockerTestFakeSetup(t, map[string]string{})
+
+	_, err = provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Empty(t, client.created[0].Config.Env)
+}
+
+func TestDockerProvider_Start_WithMacAddress(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"MAC_ADDRESS":         "02:42:AC:11:00:02",
+		"MAC_ADDRESS_ALLOWED": "02:42:ac:11:00:03 02-42-AC-11-00-04",
+		"CPUS":                "1",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "02:42:ac:11:00:02", client.created[0].Config.MacAddress)
+
+	// the job's mac address takes precedence
+	_, err = provider.Start(context.TODO(), &StartAttributes{
+		Language:   "jvm",
+		MacAddress: "02-42-ac-11-00-03",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "02:42:ac:11:00:03", client.created[1].Config.MacAddress)
+
+	// jobs can't take over addresses that aren't allowed
+	_, err = provider.Start(context.TODO(), &StartAttributes{
+		Language:   "jvm",
+		MacAddress: "02:42:ac:11:00:02",
+	})
+	assert.Equal(t, errDockerMacAddress, errors.Cause(err))
+	assert.Equal(t, FailureFail, err.(*StartError).Class)
+	assert.Len(t, client.created, 2)
+}
+
+func TestDockerProvider_Start_WithMacAddressNotAllowed(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+	assert.Empty(t, provider.macAllowed)
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{
+		Language:   "jvm",
+		MacAddress: "02:42:ac:11:00:03",
+	})
+	assert.Equal(t, errDockerMacAddress, errors.Cause(err))
+	assert.Equal(t, FailureFail, err.(*StartError).Class)
+	assert.Len(t, client.created, 0)
+}
+
+func TestDockerProvider_Start_WithInvalidMacAddress(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{
+		Language:   "jvm",
+		MacAddress: "02:42:ac:11:00",
+	})
+	assert.Equal(t, errDockerMacAddress, errors.Cause(err))
+	assert.Equal(t, FailureFail, err.(*StartError).Class)
+	assert.Len(t, client.created, 0)
+
+	for _, macAddress := range []string{"bogus", "00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01"} {
+		for _, key := range []string{"MAC_ADDRESS", "MAC_ADDRESS_ALLOWED"} {
+			provider, _, err := dockerTestNewProvider(map[string]string{
+				key: macAddress,
+			})
+
+			assert.NotNil(t, err, key+"="+macAddress)
+			assert.Nil(t, provider, key+"="+macAddress)
+		}
+	}
+}
+
+func TestDockerProvider_Start_WithReadyProbeCmd(t *testing.T) {
+	defaultDockerReadyProbeSleep = time.Millisecond
+	defer func() { defaultDockerReadyProbeSleep = time.Second }()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"READY_PROBE_CMD": "systemctl is-system-running",
+	})
+	assert.Equal(t, []string{"systemctl", "is-system-running"}, provider.readyProbeCmd)
+	client.execExitCodes = []int{1, 1, 0}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.NotNil(t, instance)
+
+	assert.Equal(t, [][]string{
+		{"systemctl", "is-system-running"},
+		{"systemctl", "is-system-running"},
+		{"systemctl", "is-system-running"},
+	}, client.execCmds)
+}
+
+func TestDockerProvider_Start_WithFailingReadyProbeCmd(t *testing.T) {
+	defaultDockerReadyProbeSleep = time.Millisecond
+	defer func() { defaultDockerReadyProbeSleep = time.Second }()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"READY_PROBE_CMD": "false",
+	})
+	client.execExitCode = 1
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+
+	instance, err := provider.Start(ctx, &StartAttributes{Language: "jvm"})
+	assert.NotNil(t, err)
+	assert.Nil(t, instance)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	assert.NotEmpty(t, client.execCmds)
+	assert.Empty(t, client.containers)
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+}
+
+func TestDockerProvider_Start_CleansUpAfterStartFailure(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+	client.startErr = errors.New("oci runtime error")
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.NotNil(t, err)
+	assert.Nil(t, instance)
+	assert.Len(t, client.created, 1)
+	assert.Len(t, client.removed, 1)
+	assert.Empty(t, client.containers)
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+}
+
+func TestDockerProvider_Start_WithResourceProfiles(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"MEMORY":            "4GiB",
+		"CPUS":              "1",
+		"RESOURCE_PROFILES": "jvm:memory=6GiB,cpus=2,shm=128MiB ruby:memory=2GiB",
+	})
+	assert.Equal(t, map[string]dockerResourceProfile{
+		"jvm":  {memory: 6 * 1024 * 1024 * 1024, cpus: 2, shm: 128 * 1024 * 1024},
+		"ruby": {memory: 2 * 1024 * 1024 * 1024, cpus: 1, shm: 64 * 1024 * 1024},
+	}, provider.runProfiles)
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6*1024*1024*1024), client.created[0].HostConfig.Memory)
+	assert.Equal(t, int64(128*1024*1024), client.created[0].HostConfig.ShmSize)
+	assert.Equal(t, "0,1", client.created[0].HostConfig.CPUSet)
+
+	_, err = provider.Start(context.TODO(), &StartAttributes{Language: "ruby"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*1024*1024*1024), client.created[1].HostConfig.Memory)
+	assert.Equal(t, int64(64*1024*1024), client.created[1].HostConfig.ShmSize)
+	assert.Equal(t, "2", client.created[1].HostConfig.CPUSet)
+
+	// languages without a profile get the global defaults
+	provider.checkinCPUSets(provider.client, "0,1,2")
+	_, err = provider.Start(context.TODO(), &StartAttributes{Language: "go"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4*1024*1024*1024), client.created[2].HostConfig.Memory)
+	assert.Equal(t, int64(64*1024*1024), client.created[2].HostConfig.ShmSize)
+	assert.Equal(t, "0", client.created[2].HostConfig.CPUSet)
+}
+
+func TestDockerProvider_Start_WithCgroupnsMode(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CGROUPNS_MODE": "private",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "private", client.created[0].HostConfig.CgroupnsMode)
+
+	provider, client = dockerTestFakeSetup(t, map[string]string{})
+
+	_, err = provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", client.created[0].HostConfig.CgroupnsMode)
+
+	provider, _, err = dockerTestNewProvider(map[string]string{
+		"CGROUPNS_MODE": "shared",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestDockerProvider_Start_WithHostMemoryBudget(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"MEMORY":             "1GiB",
+		"CPUS":               "0",
+		"HOST_MEMORY_BUDGET": "3GiB",
+	})
+
+	var (
+		mutex     sync.Mutex
+		wg        sync.WaitGroup
+		instances []Instance
+		refused   []error
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err != nil {
+				refused = append(refused, err)
+				return
+			}
+			instances = append(instances, instance)
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, instances, 3)
+	assert.Len(t, refused, 5)
+	for _, err := range refused {
+		assert.Equal(t, errDockerMemoryBudget, errors.Cause(err))
+		assert.Equal(t, FailureReschedule, err.(*StartError).Class)
+	}
+	assert.Equal(t, uint64(3*1024*1024*1024), provider.memoryCommitted[provider.client.Endpoint()])
+
+	// stopping an instance makes room for another one
+	err := instances[0].Stop(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2*1024*1024*1024), provider.memoryCommitted[provider.client.Endpoint()])
+
+	_, err = provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3*1024*1024*1024), provider.memoryCommitted[provider.client.Endpoint()])
+}
+
+func TestDockerProvider_Start_WithMemoryOvercommitRatio(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"MEMORY":                  "1GiB",
+		"CPUS":                    "0",
+		"HOST_MEMORY_BUDGET":      "2GiB",
+		"MEMORY_OVERCOMMIT_RATIO": "1.5",
+	})
+	assert.Equal(t, uint64(3*1024*1024*1024), provider.memoryBudget)
+
+	for i := 0; i < 3; i++ {
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+	}
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Equal(t, errDockerMemoryBudget, errors.Cause(err))
+
+	// the containers are still limited to their own memory
+	for _, opts := range client.created {
+		assert.Equal(t, int64(1024*1024*1024), opts.HostConfig.Memory)
+	}
+}
+
+func TestDockerProvider_Start_WithHostMemoryBudgetAndFailedBoot(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"MEMORY":             "1GiB",
+		"CPUS":               "0",
+		"HOST_MEMORY_BUDGET": "1GiB",
+	})
+	client.createErr = docker.ErrNoSuchImage
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.NotNil(t, err)
+	assert.Equal(t, uint64(0), provider.memoryCommitted[provider.client.Endpoint()])
+}
+
+func TestDockerProvider_Start_WithBootstrapScript(t *testing.T) {
+	f, err := ioutil.TempFile("", "worker-bootstrap")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "#!/bin/sh\necho from file\n")
+	f.Close()
+
+	for value, expected := range map[string]string{
+		"#!/bin/sh\necho inline\n": "#!/bin/sh\necho inline\n",
+		"@" + f.Name():             "#!/bin/sh\necho from file\n",
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"BOOTSTRAP_SCRIPT": value,
+		})
+
+		_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		assert.Equal(t, []string{"/bin/sh", "-c", "/bin/sh /usr/local/bin/travis-bootstrap && exec /sbin/init"}, client.created[0].Config.Cmd)
+
+		tr := tar.NewReader(bytes.NewReader(client.uploaded))
+		hdr, err := tr.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, "/usr/local/bin/travis-bootstrap", hdr.Name)
+
+		content, err := ioutil.ReadAll(tr)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+}
+
+func TestDockerProvider_Start_WithBootstrapScriptAndCustomCmd(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"BOOTSTRAP_SCRIPT": "echo hai",
+		"CMD":              "/usr/local/bin/travis-bootstrap",
+	})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"/usr/local/bin/travis-bootstrap"}, client.created[0].Config.Cmd)
+	assert.NotEmpty(t, client.uploaded)
+}
+
+func TestIsTransientDockerError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{&docker.Error{Status: http.StatusServiceUnavailable}, true},
+		{&docker.Error{Status: http.StatusNotFound}, false},
+		{&docker.NoSuchExec{ID: "ffbada"}, false},
+		{&docker.NoSuchContainer{ID: "ffbada"}, false},
+		{io.ErrUnexpectedEOF, true},
+		{docker.ErrConnectionRefused, true},
+		{&url.Error{Op: "Get", URL: "http://docker/exec", Err: &net.OpError{Op: "read", Err: fmt.Errorf("connection reset by peer")}}, true},
+		{&url.Error{Op: "Get", URL: "http://docker/exec", Err: context.Canceled}, false},
+		{context.DeadlineExceeded, false},
+		{errors.Wrap(context.Canceled, "couldn't inspect exec"), false},
+		{fmt.Errorf("something unexpected"), false},
+	} {
+		assert.Equal(t, tc.transient, isTransientDockerError(tc.err), fmt.Sprintf("%#v", tc.err))
+	}
+}
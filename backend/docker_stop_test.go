@@ -0,0 +1,408 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerInstance_Stop(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "ruby"})
+	assert.Nil(t, err)
+
+	err = instance.Stop(context.TODO())
+	assert.Nil(t, err)
+
+	id := instance.(*dockerInstance).container.ID
+	assert.Equal(t, []string{id}, client.stopped)
+	assert.Len(t, client.removed, 1)
+	assert.Equal(t, id, client.removed[0].ID)
+	assert.True(t, client.removed[0].RemoveVolumes)
+	assert.Len(t, client.containers, 0)
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+	assert.Len(t, provider.Instances(), 0)
+
+	// stopping again is a no-op
+	assert.Nil(t, instance.Stop(context.TODO()))
+	assert.Len(t, client.stopped, 1)
+}
+
+func TestDockerInstance_WaitForExit_WithCancelledContext(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	// the container never exits
+	client.onInspect = func(container *docker.Container) {
+		container.State.Running = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	startedAt := time.Now()
+	instance.(*dockerInstance).waitForExit(ctx, time.Hour)
+	assert.True(t, time.Since(startedAt) < 5*time.Second, "waited past ctx")
+}
+
+func TestDockerInstance_Stop_WithStopRemoveWait(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"STOP_REMOVE_WAIT": "5s",
+	})
+	assert.Equal(t, 5*time.Second, provider.stopWait)
+
+	defaultDockerStopPollSleep = time.Millisecond
+	defer func() { defaultDockerStopPollSleep = 500 * time.Millisecond }()
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	// the container keeps running for one more inspection after the stop
+	inspections := 0
+	client.onInspect = func(container *docker.Container) {
+		if len(client.stopped) == 0 {
+			return
+		}
+		inspections++
+		container.State.Running = inspections < 2
+	}
+
+	err = instance.Stop(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, inspections)
+	assert.Len(t, client.removed, 1)
+}
+
+func TestDockerInstance_Stop_WithPostExecCmd(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"POST_EXEC_CMD": "umount -a",
+	})
+	assert.Equal(t, []string{"umount", "-a"}, provider.postExecCmd)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	err = instance.Stop(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"umount", "-a"}}, client.execCmds)
+	assert.Equal(t, []string{"exec", "stop", "remove"}, client.ops)
+}
+
+func TestDockerInstance_Stop_WithFailingPostExecCmd(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"POST_EXEC_CMD": "umount -a",
+	})
+	client.createExecErr = &docker.Error{Status: http.StatusInternalServerError}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	err = instance.Stop(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, client.removed, 1)
+}
+
+func TestDockerInstance_Stop_WithRemoveVolumes(t *testing.T) {
+	for cfgValue, expected := range map[string]bool{"": true, "true": true, "false": false} {
+		cfg := map[string]string{}
+		if cfgValue != "" {
+			cfg["REMOVE_VOLUMES"] = cfgValue
+		}
+
+		provider, client := dockerTestFakeSetup(t, cfg)
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		err = instance.Stop(context.TODO())
+		assert.Nil(t, err)
+		assert.Equal(t, expected, client.removed[0].RemoveVolumes, cfgValue)
+	}
+}
+
+func TestNewDockerProvider_WithInvalidStopMode(t *testing.T) {
+	for _, cfg := range []map[string]string{
+		{"STOP_MODE": "nuke"},
+		{"STOP_MODE": "kill", "STOP_SIGNAL": "SIGWHATEVER"},
+	} {
+		provider, _, err := dockerTestNewProvider(cfg)
+		assert.NotNil(t, err)
+		assert.Nil(t, provider)
+	}
+}
+
+func TestParseDockerSignal(t *testing.T) {
+	for s, expected := range map[string]docker.Signal{
+		"KILL":    docker.SIGKILL,
+		"SIGTERM": docker.SIGTERM,
+		"int":     docker.SIGINT,
+		"10":      docker.Signal(10),
+	} {
+		signal, err := parseDockerSignal(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, signal, s)
+	}
+
+	for _, s := range []string{"", "0", "SIGNOPE", "-9"} {
+		_, err := parseDockerSignal(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestDockerInstance_Stop_WithStopMode(t *testing.T) {
+	for _, tc := range []struct {
+		cfg    map[string]string
+		stop   bool
+		signal docker.Signal
+	}{
+		{map[string]string{}, true, 0},
+		{map[string]string{"STOP_MODE": "graceful"}, true, 0},
+		{map[string]string{"STOP_MODE": "kill"}, false, docker.SIGKILL},
+		{map[string]string{"STOP_MODE": "kill", "STOP_SIGNAL": "TERM"}, false, docker.SIGTERM},
+	} {
+		provider, client := dockerTestFakeSetup(t, tc.cfg)
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		err = instance.Stop(context.TODO())
+		assert.Nil(t, err)
+		assert.Equal(t, tc.stop, len(client.stopped) == 1, fmt.Sprintf("%v", tc.cfg))
+		assert.Equal(t, !tc.stop, len(client.killed) == 1, fmt.Sprintf("%v", tc.cfg))
+		if !tc.stop {
+			assert.Equal(t, tc.signal, client.killed[0].Signal, fmt.Sprintf("%v", tc.cfg))
+		}
+		assert.Len(t, client.removed, 1)
+	}
+}
+
+func TestDockerInstance_WaitExit(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	dockerInstance := instance.(*dockerInstance)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = dockerInstance.WaitExit(ctx)
+	assert.NotNil(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+
+		client.mutex.Lock()
+		defer client.mutex.Unlock()
+		container := client.containers[dockerInstance.container.ID]
+		container.State.Running = false
+		container.State.ExitCode = 137
+	}()
+
+	exitCode, err := dockerInstance.WaitExit(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 137, exitCode)
+
+	assert.Nil(t, instance.Stop(context.TODO()))
+
+	exitCode, err = dockerInstance.WaitExit(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, -1, exitCode)
+}
+
+func TestDockerInstance_Stop_WithBusyRemove(t *testing.T) {
+	defaultDockerRemoveRetrySleep = time.Millisecond
+	defer func() { defaultDockerRemoveRetrySleep = 500 * time.Millisecond }()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, true, false}, provider.cpuSets[provider.client.Endpoint()])
+
+	client.removeErrs = []error{
+		&docker.Error{Status: http.StatusConflict, Message: "removal of container is already in progress"},
+		&docker.Error{Status: http.StatusInternalServerError, Message: "device or resource busy"},
+	}
+
+	err = instance.Stop(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, client.removeErrs, 0)
+	assert.Len(t, client.removed, 1)
+	assert.Len(t, client.containers, 0)
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+}
+
+func TestDockerInstance_Stop_WithBusyRemoveExhaustingRetries(t *testing.T) {
+	defaultDockerRemoveRetrySleep = time.Millisecond
+	defer func() { defaultDockerRemoveRetrySleep = 500 * time.Millisecond }()
+
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"REMOVE_RETRIES": "1",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	busy := &docker.Error{Status: http.StatusConflict, Message: "removal of container is already in progress"}
+	client.removeErrs = []error{busy, busy, busy}
+
+	err = instance.Stop(context.TODO())
+	assert.Equal(t, busy, err)
+	assert.Len(t, client.removeErrs, 1)
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+}
+
+func TestDockerInstance_Stop_WithAlreadyRemovedContainer(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	client.removeErrs = []error{&docker.NoSuchContainer{ID: instance.(*dockerInstance).container.ID}}
+
+	assert.Nil(t, instance.Stop(context.TODO()))
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+}
+
+func TestDockerInstance_PauseAndUnpause(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	dockerInstance := instance.(*dockerInstance)
+	id := dockerInstance.container.ID
+
+	err = dockerInstance.Pause(context.TODO())
+	assert.Nil(t, err)
+	assert.True(t, client.containers[id].State.Paused)
+
+	err = dockerInstance.Unpause(context.TODO())
+	assert.Nil(t, err)
+	assert.False(t, client.containers[id].State.Paused)
+
+	err = instance.Stop(context.TODO())
+	assert.Nil(t, err)
+
+	err = dockerInstance.Pause(context.TODO())
+	assert.NotNil(t, err)
+}
+
+func TestDockerInstance_Stop_WhilePaused(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	id := instance.(*dockerInstance).container.ID
+
+	err = instance.(*dockerInstance).Pause(context.TODO())
+	assert.Nil(t, err)
+
+	err = instance.Stop(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{id}, client.stopped)
+	assert.Len(t, client.removed, 1)
+}
+
+func TestDockerInstance_Stop_WhilePausedWithUnpauseError(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+	client.unpauseErr = &docker.Error{Status: http.StatusInternalServerError}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	err = instance.(*dockerInstance).Pause(context.TODO())
+	assert.Nil(t, err)
+
+	err = instance.Stop(context.TODO())
+	assert.Nil(t, err)
+	assert.Empty(t, client.stopped)
+	assert.Len(t, client.removed, 1)
+	assert.True(t, client.removed[0].Force)
+
+	for _, checkedOut := range provider.cpuSets[provider.client.Endpoint()] {
+		assert.False(t, checkedOut)
+	}
+}
+
+func TestDockerInstance_Stop_WithStopError(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"HOST_MEMORY_BUDGET": "16GiB",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	stopErr := &docker.Error{Status: http.StatusInternalServerError, Message: "stop failed"}
+	client.stopErr = stopErr
+
+	err = instance.Stop(context.TODO())
+	assert.Equal(t, stopErr, err)
+	assert.Len(t, client.removed, 1)
+	assert.True(t, client.removed[0].Force)
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+	assert.Equal(t, uint64(0), provider.memoryCommitted[provider.client.Endpoint()])
+	assert.Empty(t, provider.instances)
+}
+
+func TestDockerInstance_Stop_WithStopAndRemoveErrors(t *testing.T) {
+	// a 500 is retried as busy otherwise
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"REMOVE_RETRIES": "0",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	stopErr := &docker.Error{Status: http.StatusInternalServerError, Message: "stop failed"}
+	removeErr := &docker.Error{Status: http.StatusInternalServerError, Message: "remove failed"}
+	client.stopErr = stopErr
+	client.removeErrs = []error{removeErr}
+
+	err = instance.Stop(context.TODO())
+	assert.Equal(t, dockerStopErrors{stopErr, removeErr}, err)
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+	assert.Empty(t, provider.instances)
+}
+
+func TestDockerInstance_Stop_RetriesAfterError(t *testing.T) {
+	// a 500 is retried as busy otherwise
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"REMOVE_RETRIES": "0",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	removeErr := &docker.Error{Status: http.StatusInternalServerError, Message: "remove failed"}
+	client.removeErrs = []error{removeErr}
+
+	assert.Equal(t, removeErr, instance.Stop(context.TODO()))
+	assert.Empty(t, client.removed)
+	assert.Equal(t, []bool{false, false, false}, provider.cpuSets[provider.client.Endpoint()])
+
+	// another instance gets the released cpu set, which the retry mustn't
+	// check in again
+	other, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, true, false}, provider.cpuSets[provider.client.Endpoint()])
+
+	assert.Nil(t, instance.Stop(context.TODO()))
+	assert.Len(t, client.removed, 1)
+	assert.Len(t, client.stopped, 1)
+	assert.Equal(t, []bool{true, true, false}, provider.cpuSets[provider.client.Endpoint()])
+
+	assert.Nil(t, instance.Stop(context.TODO()))
+	assert.Len(t, client.removed, 1)
+
+	assert.Nil(t, other.Stop(context.TODO()))
+}
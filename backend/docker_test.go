@@ -1,25 +1,24 @@
 package backend
 
 import (
-	"archive/tar"
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/travis-ci/worker/config"
-)
-
-var (
-	dockerTestMux      *http.ServeMux
-	dockerTestProvider *dockerProvider
-	dockerTestServer   *httptest.Server
+	"github.com/travis-ci/worker/image"
 )
 
 type fakeDockerNumCPUer struct{}
@@ -28,452 +27,672 @@ func (nc *fakeDockerNumCPUer) NumCPU() int {
 	return 3
 }
 
-func dockerTestSetup(t *testing.T, cfg *config.ProviderConfig) (*dockerProvider, error) {
-	if cfg == nil {
-		cfg = config.ProviderConfigFromMap(map[string]string{})
+type fakeDockerImageSelector struct {
+	selection string
+	params    *image.Params
+	calls     int
+}
+
+func (s *fakeDockerImageSelector) Select(params *image.Params) (string, error) {
+	s.params = params
+	s.calls++
+	return s.selection, nil
+}
+
+// fakeDockerClient is an in-memory dockerClient covering the container and
+// exec lifecycle. Methods it doesn't implement panic via the nil embedded
+// interface.
+type fakeDockerClient struct {
+	dockerClient
+
+	mutex      sync.Mutex
+	endpoint   string
+	images     []docker.APIImages
+	containers map[string]*docker.Container
+	created    []docker.CreateContainerOptions
+	stopped    []string
+	killed     []docker.KillContainerOptions
+	removed    []docker.RemoveContainerOptions
+	uploaded   []byte
+	uploadWait chan struct{}
+	existing   map[string]bool
+	info       *docker.DockerInfo
+	removeErrs []error
+	createErr  error
+	createErrs []error
+	renamed    map[string]string
+	renameErr  error
+	pulled     []string
+	pullErrs   []error
+	networks   map[string]*docker.Network
+
+	createdNetworks []docker.CreateNetworkOptions
+
+	// uploadsCancelled counts uploads whose context was done while waiting
+	// on uploadWait.
+	uploadsCancelled int
+
+	execOutput   string
+	execExitCode int
+	execCmds     [][]string
+	execUsers    []string
+	execEnvs     [][]string
+	execTtys     []bool
+	execStdins   [][]byte
+	execsDone    map[string]bool
+
+	// execQuiet is how long execs stay quiet before writing execOutput,
+	// and execRunning keeps them running after it, as if the script never
+	// finished on its own.
+	execQuiet   time.Duration
+	execRunning bool
+
+	// startExecErr fails StartExec before the connection is hijacked, and
+	// startExecWait holds up the hijack until it is closed.
+	startExecErr  error
+	startExecWait chan struct{}
+
+	// execExitCodes are the exit codes of the next execs, taking precedence
+	// over execExitCode.
+	execExitCodes []int
+	execExits     map[string]int
+
+	// execUserExitCodes are the exit codes of the execs run as the given
+	// user, taking precedence over execExitCode.
+	execUserExitCodes map[string]int
+
+	listImages    int
+	listImagesErr error
+
+	// imageConfigs are the configs of the images by id, e.g. with labels.
+	imageConfigs map[string]*docker.Config
+
+	version      string
+	versionCalls int
+
+	unpauseErr     error
+	stopErr        error
+	startErr       error
+	createExecErr  error
+	inspectErr     error
+	inspectExecErr error
+
+	// inspectExecErrs fail the next exec inspections, before inspectExecErr.
+	inspectExecErrs []error
+	inspectExecs    int
+
+	downloads    []string
+	logsTails    []string
+	statsStreams []bool
+
+	// logs are written on every Logs call, which blocks until its context
+	// is done when following.
+	logs string
+
+	// stats is the single sample of every Stats call.
+	stats docker.Stats
+
+	// events are sent to every event listener as it's added, which needs
+	// room for them, and listeners counts the listeners not yet removed.
+	events    []*docker.APIEvents
+	listeners int
+
+	// onCreate is called before every create, outside of the lock, e.g.
+	// to hold up creates.
+	onCreate func(opts docker.CreateContainerOptions)
+
+	// ops are the names of the container operations in the order they
+	// were made, e.g. to check the order of the cleanup steps of Stop.
+	ops []string
+
+	// onInspect is called with the stored container on every inspection,
+	// e.g. to change it over time.
+	onInspect func(container *docker.Container)
+}
+
+func newFakeDockerClient() *fakeDockerClient {
+	return &fakeDockerClient{
+		images: []docker.APIImages{
+			{ID: "570c738990e5", RepoTags: []string{"travis:jvm"}},
+			{ID: "fc24f3225c15", RepoTags: []string{"travis:ruby", "travis:default"}},
+		},
+		containers: map[string]*docker.Container{},
+		execsDone:  map[string]bool{},
+		execExits:  map[string]int{},
 	}
-	defaultDockerNumCPUer = &fakeDockerNumCPUer{}
-	dockerTestMux = http.NewServeMux()
-	dockerTestServer = httptest.NewServer(dockerTestMux)
-	cfg.Set("ENDPOINT", dockerTestServer.URL)
-	provider, err := newDockerProvider(cfg)
-	if err == nil {
-		dockerTestProvider = provider.(*dockerProvider)
+}
+
+func (c *fakeDockerClient) Endpoint() string {
+	if c.endpoint != "" {
+		return c.endpoint
 	}
-	return dockerTestProvider, err
+	return "fake://docker"
 }
 
-func dockerTestTeardown() {
-	defaultDockerNumCPUer = &stdlibNumCPUer{}
-	dockerTestServer.Close()
-	dockerTestMux = nil
-	dockerTestServer = nil
-	dockerTestProvider = nil
+func (c *fakeDockerClient) Info() (*docker.DockerInfo, error) {
+	if c.info == nil {
+		return nil, &docker.Error{Status: http.StatusInternalServerError}
+	}
+	return c.info, nil
 }
 
-type containerCreateRequest struct {
-	Image      string            `json:"Image"`
-	HostConfig docker.HostConfig `json:"HostConfig"`
+func (c *fakeDockerClient) Version() (*docker.Env, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.versionCalls++
+	if c.version == "" {
+		return nil, &docker.Error{Status: http.StatusInternalServerError}
+	}
+	return &docker.Env{"Version=" + c.version, "ApiVersion=1.32"}, nil
 }
 
-func TestDockerProvider_Start(t *testing.T) {
-	dockerTestSetup(t, nil)
-	defer dockerTestTeardown()
+func (c *fakeDockerClient) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	// The client expects this to be sufficiently long
-	containerID := "f2e475c0ee1825418a3d4661d39d28bee478f4190d46e1a3984b73ea175c20c3"
+	c.listImages++
+	if c.listImagesErr != nil {
+		return nil, c.listImagesErr
+	}
+	return c.images, nil
+}
 
-	imagesList := `[
-		{"Created":1423149832,"Id":"fc24f3225c15b08f8d9f70c1f7148d7fcbf4b41c3acce4b7da25af9371b90501","Labels":null,"ParentId":"2b412eda4314d97ff8a90d2f8c1b65677399723d6ecc4950f4e1247a5c2193c0","RepoDigests":[],"RepoTags":["quay.io/travisci/travis-ruby:latest","travis:ruby","travis:default"],"Size":729301088,"VirtualSize":4808391658},
-		{"Created":1423149832,"Id":"08a0d98600afe9d0ca4ca509b1829868cea39dcc75dea1f8dde0dc6325389b45","Labels":null,"ParentId":"2b412eda4314d97ff8a90d2f8c1b65677399723d6ecc4950f4e1247a5c2193c0","RepoDigests":[],"RepoTags":["quay.io/travisci/travis-go:latest","travis:go"],"Size":729301088,"VirtualSize":4808391658},
-		{"Created":1423150056,"Id":"570c738990e5859f3b78036f0fb6822fc54dc252f83cdd6d2127e3c1717bbbfd","Labels":null,"ParentId":"2b412eda4314d97ff8a90d2f8c1b65677399723d6ecc4950f4e1247a5c2193c0","RepoDigests":[],"RepoTags":["quay.io/travisci/travis-jvm:latest","travis:java","travis:jvm","travis:clojure","travis:groovy","travis:scala"],"Size":1092914295,"VirtualSize":5172004865}
-	]`
-	dockerTestMux.HandleFunc("/images/json", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, imagesList)
-	})
+func (c *fakeDockerClient) InspectImage(name string) (*docker.Image, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	containerCreated := fmt.Sprintf(`{"Id": "%s","Warnings":null}`, containerID)
-	dockerTestMux.HandleFunc("/containers/create", func(w http.ResponseWriter, r *http.Request) {
-		defer r.Body.Close()
-		var req containerCreateRequest
-		err := json.NewDecoder(r.Body).Decode(&req)
-		if err != nil {
-			t.Errorf("Error decoding docker client container create request: %s", err.Error())
-			w.WriteHeader(400)
-		} else {
-			fmt.Fprintf(w, containerCreated)
+	for _, img := range c.images {
+		if img.ID == name {
+			return &docker.Image{ID: img.ID, Config: c.imageConfigs[img.ID]}, nil
 		}
-	})
-
-	dockerTestMux.HandleFunc(fmt.Sprintf("/containers/%s/start", containerID), func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-	})
+		for _, tag := range img.RepoTags {
+			if tag == name {
+				return &docker.Image{ID: img.ID, Config: c.imageConfigs[img.ID]}, nil
+			}
+		}
+	}
+	return nil, docker.ErrNoSuchImage
+}
 
-	containerStatus := docker.Container{
-		ID: containerID,
-		State: docker.State{
-			Running: true,
-		},
+func (c *fakeDockerClient) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	if c.onCreate != nil {
+		c.onCreate(opts)
 	}
-	dockerTestMux.HandleFunc(fmt.Sprintf("/containers/%s/json", containerID), func(w http.ResponseWriter, r *http.Request) {
-		containerStatusBytes, _ := json.Marshal(containerStatus)
-		w.Write(containerStatusBytes)
-	})
 
-	dockerTestMux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"ApiVersion":"1.24"}`)
-	})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	dockerTestMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		t.Errorf("Unexpected URL %s", r.URL.String())
-		w.WriteHeader(400)
-	})
+	if c.createErr != nil {
+		return nil, c.createErr
+	}
+	if len(c.createErrs) > 0 {
+		err := c.createErrs[0]
+		c.createErrs = c.createErrs[1:]
+		return nil, err
+	}
+	if opts.Name != "" && c.findContainer(opts.Name) != nil {
+		return nil, docker.ErrContainerAlreadyExists
+	}
 
-	instance, err := dockerTestProvider.Start(context.TODO(), &StartAttributes{
-		Language: "jvm",
-		Group:    "",
-	})
+	c.created = append(c.created, opts)
+	container := &docker.Container{
+		ID:         fmt.Sprintf("fake%04d", len(c.created)),
+		Name:       opts.Name,
+		Config:     opts.Config,
+		HostConfig: opts.HostConfig,
+	}
+	c.containers[container.ID] = container
+	return container, nil
+}
 
-	if err != nil {
-		t.Errorf("provider.Start() returned error: %v", err)
+func (c *fakeDockerClient) StartContainer(id string, hostConfig *docker.HostConfig) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	container, ok := c.containers[id]
+	if !ok {
+		return &docker.NoSuchContainer{ID: id}
 	}
 
-	if instance.ID() != "f2e475c:travis:jvm" {
-		t.Errorf("Provider returned unexpected ID (\"%s\" != \"f2e475c:travis:jvm\"", instance.ID())
+	if c.startErr != nil {
+		return c.startErr
+	}
+	if container.State.Running {
+		return &docker.ContainerAlreadyRunning{ID: id}
 	}
-}
 
-func TestDockerProvider_Start_WithPrivileged(t *testing.T) {
-	dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"PRIVILEGED": "true",
-	}))
-	defer dockerTestTeardown()
-
-	// The client expects this to be sufficiently long
-	containerID := "f2e475c0ee1825418a3d4661d39d28bee478f4190d46e1a3984b73ea175c20c3"
-
-	imagesList := `[
-		{"Created":1423149832,"Id":"fc24f3225c15b08f8d9f70c1f7148d7fcbf4b41c3acce4b7da25af9371b90501","Labels":null,"ParentId":"2b412eda4314d97ff8a90d2f8c1b65677399723d6ecc4950f4e1247a5c2193c0","RepoDigests":[],"RepoTags":["quay.io/travisci/travis-ruby:latest","travis:ruby","travis:default"],"Size":729301088,"VirtualSize":4808391658},
-		{"Created":1423149832,"Id":"08a0d98600afe9d0ca4ca509b1829868cea39dcc75dea1f8dde0dc6325389b45","Labels":null,"ParentId":"2b412eda4314d97ff8a90d2f8c1b65677399723d6ecc4950f4e1247a5c2193c0","RepoDigests":[],"RepoTags":["quay.io/travisci/travis-go:latest","travis:go"],"Size":729301088,"VirtualSize":4808391658},
-		{"Created":1423150056,"Id":"570c738990e5859f3b78036f0fb6822fc54dc252f83cdd6d2127e3c1717bbbfd","Labels":null,"ParentId":"2b412eda4314d97ff8a90d2f8c1b65677399723d6ecc4950f4e1247a5c2193c0","RepoDigests":[],"RepoTags":["quay.io/travisci/travis-jvm:latest","travis:java","travis:jvm","travis:clojure","travis:groovy","travis:scala"],"Size":1092914295,"VirtualSize":5172004865}
-	]`
-	dockerTestMux.HandleFunc("/images/json", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, imagesList)
-	})
+	container.State.Running = true
+	container.State.StartedAt = time.Now()
+	return nil
+}
 
-	containerCreated := fmt.Sprintf(`{"Id": "%s","Warnings":null}`, containerID)
-	dockerTestMux.HandleFunc("/containers/create", func(w http.ResponseWriter, r *http.Request) {
-		defer r.Body.Close()
-		var req containerCreateRequest
-		err := json.NewDecoder(r.Body).Decode(&req)
-		if err != nil {
-			t.Errorf("Error decoding docker client container create request: %s", err.Error())
-			w.WriteHeader(400)
-		} else if !req.HostConfig.Privileged {
-			t.Errorf("Expected Privileged flag to be true, instead false")
-			w.WriteHeader(400)
-		} else {
-			fmt.Fprintf(w, containerCreated)
+// findContainer returns the container with the given id or name, if any.
+func (c *fakeDockerClient) findContainer(id string) *docker.Container {
+	if container, ok := c.containers[id]; ok {
+		return container
+	}
+	for _, container := range c.containers {
+		if strings.TrimPrefix(container.Name, "/") == strings.TrimPrefix(id, "/") {
+			return container
 		}
-	})
+	}
+	return nil
+}
 
-	dockerTestMux.HandleFunc(fmt.Sprintf("/containers/%s/start", containerID), func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-	})
+func (c *fakeDockerClient) InspectContainer(id string) (*docker.Container, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	containerStatus := docker.Container{
-		ID: containerID,
-		State: docker.State{
-			Running: true,
-		},
+	container := c.findContainer(id)
+	if container == nil {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	if c.inspectErr != nil {
+		return nil, c.inspectErr
 	}
-	dockerTestMux.HandleFunc(fmt.Sprintf("/containers/%s/json", containerID), func(w http.ResponseWriter, r *http.Request) {
-		containerStatusBytes, _ := json.Marshal(containerStatus)
-		w.Write(containerStatusBytes)
-	})
 
-	dockerTestMux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"ApiVersion":"1.24"}`)
-	})
+	if c.onInspect != nil {
+		c.onInspect(container)
+	}
 
-	dockerTestMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		t.Errorf("Unexpected URL %s", r.URL.String())
-		w.WriteHeader(400)
-	})
+	inspected := *container
+	return &inspected, nil
+}
 
-	instance, err := dockerTestProvider.Start(context.TODO(), &StartAttributes{Language: "jvm", Group: ""})
-	if err != nil {
-		t.Errorf("provider.Start() returned error: %v", err)
+func (c *fakeDockerClient) StopContainer(id string, timeout uint) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stopErr != nil {
+		return c.stopErr
+	}
+
+	container, ok := c.containers[id]
+	if !ok {
+		return &docker.NoSuchContainer{ID: id}
 	}
 
-	if instance.ID() != "f2e475c:travis:jvm" {
-		t.Errorf("Provider returned unexpected ID (\"%s\" != \"f2e475c:travis:jvm\"", instance.ID())
+	if container.State.Paused {
+		return &docker.Error{Status: http.StatusConflict, Message: "container is paused, unpause the container before stopping"}
 	}
+
+	container.State.Running = false
+	container.State.FinishedAt = time.Now()
+	c.stopped = append(c.stopped, id)
+	c.ops = append(c.ops, "stop")
+	return nil
 }
 
-func TestNewDockerProvider_WithInvalidPrivileged(t *testing.T) {
-	provider, err := dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"PRIVILEGED": "fafafaf",
-	}))
-	assert.NotNil(t, err)
-	assert.Nil(t, provider)
+func (c *fakeDockerClient) KillContainer(opts docker.KillContainerOptions) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	container, ok := c.containers[opts.ID]
+	if !ok {
+		return &docker.NoSuchContainer{ID: opts.ID}
+	}
+
+	container.State.Running = false
+	container.State.FinishedAt = time.Now()
+	c.killed = append(c.killed, opts)
+	c.ops = append(c.ops, "kill")
+	return nil
 }
 
-func TestNewDockerProvider_WithMissingEndpoint(t *testing.T) {
-	provider, err := newDockerProvider(config.ProviderConfigFromMap(map[string]string{}))
-	assert.NotNil(t, err)
-	assert.Nil(t, provider)
+func (c *fakeDockerClient) PauseContainer(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	container, ok := c.containers[id]
+	if !ok {
+		return &docker.NoSuchContainer{ID: id}
+	}
+
+	container.State.Paused = true
+	return nil
 }
 
-func TestNewDockerProvider_WithDockerHost(t *testing.T) {
-	provider, err := newDockerProvider(config.ProviderConfigFromMap(map[string]string{
-		"HOST": "tcp://fleeflahflew.example.com:8080",
-	}))
-	assert.Nil(t, err)
-	assert.NotNil(t, provider)
+func (c *fakeDockerClient) UnpauseContainer(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	container, ok := c.containers[id]
+	if !ok {
+		return &docker.NoSuchContainer{ID: id}
+	}
+	if c.unpauseErr != nil {
+		return c.unpauseErr
+	}
+
+	container.State.Paused = false
+	return nil
 }
 
-func TestNewDockerProvider_WithRequiredConfig(t *testing.T) {
-	provider, err := dockerTestSetup(t, nil)
+func (c *fakeDockerClient) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	assert.Nil(t, err)
-	assert.NotNil(t, provider)
-	assert.NotNil(t, provider.client)
-	assert.False(t, provider.runNative)
-	assert.False(t, provider.runPrivileged)
-	assert.Equal(t, uint64(1024*1024*1024*4), provider.runMemory)
-	assert.Equal(t, 3, len(provider.cpuSets))
-	assert.Equal(t, []string{"/sbin/init"}, provider.runCmd)
-	assert.Equal(t, 2, provider.runCPUs)
-}
-
-func TestNewDockerProvider_WithNative(t *testing.T) {
-	provider, err := newDockerProvider(config.ProviderConfigFromMap(map[string]string{
-		"HOST":   "tcp://fleeflahflew.example.com:8080",
-		"NATIVE": "1",
-	}))
-	assert.Nil(t, err)
-	assert.NotNil(t, provider)
-	assert.True(t, provider.(*dockerProvider).runNative)
+	if _, ok := c.containers[opts.ID]; !ok {
+		return &docker.NoSuchContainer{ID: opts.ID}
+	}
 
-	provider, err = newDockerProvider(config.ProviderConfigFromMap(map[string]string{
-		"HOST":   "tcp://fleeflahflew.example.com:8080",
-		"NATIVE": "wat",
-	}))
+	if len(c.removeErrs) > 0 {
+		err := c.removeErrs[0]
+		c.removeErrs = c.removeErrs[1:]
+		return err
+	}
 
-	assert.NotNil(t, err)
-	assert.Nil(t, provider)
+	delete(c.containers, opts.ID)
+	c.removed = append(c.removed, opts)
+	c.ops = append(c.ops, "remove")
+	return nil
 }
 
-func TestNewDockerProvider_WithCPUSetSize(t *testing.T) {
-	dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"NATIVE":       "1",
-		"CPU_SET_SIZE": "16",
-	}))
-	defer dockerTestTeardown()
+func (c *fakeDockerClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	assert.Equal(t, 16, len(dockerTestProvider.cpuSets))
+	c.pulled = append(c.pulled, opts.Repository)
+	if len(c.pullErrs) > 0 {
+		err := c.pullErrs[0]
+		c.pullErrs = c.pullErrs[1:]
+		return err
+	}
+	return nil
 }
 
-func TestNewDockerProvider_WithInvalidCPUSetSize(t *testing.T) {
-	provider, err := dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"NATIVE":       "1",
-		"CPU_SET_SIZE": "fafafaf",
-	}))
-	defer dockerTestTeardown()
+func (c *fakeDockerClient) RenameContainer(opts docker.RenameContainerOptions) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	assert.NotNil(t, err)
-	assert.Equal(t, "strconv.ParseInt: parsing \"fafafaf\": invalid syntax", err.Error())
-	assert.Nil(t, provider)
+	if _, ok := c.containers[opts.ID]; !ok {
+		return &docker.NoSuchContainer{ID: opts.ID}
+	}
+	if c.renameErr != nil {
+		return c.renameErr
+	}
+
+	if c.renamed == nil {
+		c.renamed = map[string]string{}
+	}
+	c.renamed[opts.ID] = opts.Name
+	return nil
 }
 
-func TestNewDockerProvider_WithCPUSetSizeLessThan2(t *testing.T) {
-	provider, err := dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"NATIVE":       "1",
-		"CPU_SET_SIZE": "1",
-	}))
-	defer dockerTestTeardown()
+func (c *fakeDockerClient) NetworkInfo(id string) (*docker.Network, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	assert.Nil(t, err)
-	assert.Equal(t, 2, len(provider.cpuSets))
+	network, ok := c.networks[id]
+	if !ok {
+		return nil, &docker.NoSuchNetwork{ID: id}
+	}
+	return network, nil
 }
 
-func TestNewDockerProvider_WithCMD(t *testing.T) {
-	provider, err := dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"CMD": "/bin/bash /fancy-docker-init-thing",
-	}))
-	defer dockerTestTeardown()
+func (c *fakeDockerClient) CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	assert.Nil(t, err)
-	assert.Equal(t, []string{"/bin/bash", "/fancy-docker-init-thing"}, provider.runCmd)
+	c.createdNetworks = append(c.createdNetworks, opts)
+	network := &docker.Network{Name: opts.Name, ID: opts.Name, Driver: opts.Driver}
+	if c.networks == nil {
+		c.networks = map[string]*docker.Network{}
+	}
+	c.networks[opts.Name] = network
+	return network, nil
 }
 
-func TestNewDockerProvider_WithMemory(t *testing.T) {
-	provider, err := dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"MEMORY": "99MB",
-	}))
-	defer dockerTestTeardown()
+func (c *fakeDockerClient) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	assert.Nil(t, err)
-	assert.Equal(t, uint64(0x5e69ec0), provider.runMemory)
+	if _, ok := c.containers[opts.Container]; !ok {
+		return nil, &docker.NoSuchContainer{ID: opts.Container}
+	}
+	if c.createExecErr != nil {
+		return nil, c.createExecErr
+	}
+	c.ops = append(c.ops, "exec")
+
+	c.execCmds = append(c.execCmds, opts.Cmd)
+	c.execUsers = append(c.execUsers, opts.User)
+	c.execEnvs = append(c.execEnvs, opts.Env)
+	c.execTtys = append(c.execTtys, opts.Tty)
+	id := fmt.Sprintf("exec%04d", len(c.execCmds))
+	if len(c.execExitCodes) > 0 {
+		c.execExits[id] = c.execExitCodes[0]
+		c.execExitCodes = c.execExitCodes[1:]
+	} else if exitCode, ok := c.execUserExitCodes[opts.User]; ok {
+		c.execExits[id] = exitCode
+	}
+
+	return &docker.Exec{ID: id}, nil
 }
 
-func TestNewDockerProvider_WithCPUs(t *testing.T) {
-	provider, err := dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"CPUS": "4",
-	}))
-	defer dockerTestTeardown()
+func (c *fakeDockerClient) StartExec(id string, opts docker.StartExecOptions) error {
+	if c.startExecWait != nil {
+		<-c.startExecWait
+	}
+	if c.startExecErr != nil {
+		return c.startExecErr
+	}
 
-	assert.Nil(t, err)
-	assert.Equal(t, 4, provider.runCPUs)
-}
+	// the same handshake as the hijacked connection of the real client
+	if opts.Success != nil {
+		opts.Success <- struct{}{}
+		<-opts.Success
+	}
 
-func TestDockerProvider_Setup(t *testing.T) {
-	provider, _ := dockerTestSetup(t, nil)
-	provider.Setup(nil)
-}
+	var stdin []byte
+	if opts.InputStream != nil {
+		var err error
+		stdin, err = ioutil.ReadAll(opts.InputStream)
+		if err != nil {
+			return err
+		}
+	}
 
-func TestDockerInstance_UploadScript_WithNative(t *testing.T) {
-	provider, err := dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"NATIVE": "true",
-	}))
+	time.Sleep(c.execQuiet)
+	_, err := io.WriteString(opts.OutputStream, c.execOutput)
 
-	assert.Nil(t, err)
-	assert.NotNil(t, provider)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	instance := &dockerInstance{
-		client:       provider.client,
-		provider:     provider,
-		runNative:    provider.runNative,
-		container:    &docker.Container{ID: "beabebabafabafaba0000"},
-		imageName:    "fafafaf",
-		startBooting: time.Now(),
+	if opts.InputStream != nil {
+		c.execStdins = append(c.execStdins, stdin)
 	}
 
-	script := []byte("#!/bin/bash\necho hai\n")
-	scriptUploaded := false
+	c.execsDone[id] = true
+	return err
+}
 
-	dockerTestMux.HandleFunc(fmt.Sprintf("/containers/%s/archive", instance.container.ID),
-		func(w http.ResponseWriter, req *http.Request) {
-			assert.Nil(t, err)
-			assert.Equal(t, "PUT", req.Method)
+func (c *fakeDockerClient) AddEventListener(listener chan<- *docker.APIEvents) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-			tr := tar.NewReader(req.Body)
-			hdr, err := tr.Next()
+	c.listeners++
+	for _, event := range c.events {
+		listener <- event
+	}
+	return nil
+}
 
-			assert.Nil(t, err)
-			assert.Equal(t, "/home/travis/build.sh", hdr.Name)
-			assert.Equal(t, int64(len(script)), hdr.Size)
-			assert.Equal(t, int64(0755), hdr.Mode)
+func (c *fakeDockerClient) RemoveEventListener(listener chan *docker.APIEvents) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-			buf := make([]byte, hdr.Size)
-			_, err = tr.Read(buf)
-			assert.Nil(t, err)
-			assert.Equal(t, buf, script)
+	c.listeners--
+	return nil
+}
 
-			scriptUploaded = true
-		})
+func (c *fakeDockerClient) Logs(opts docker.LogsOptions) error {
+	c.mutex.Lock()
+	c.logsTails = append(c.logsTails, opts.Tail)
+	logs := c.logs
+	c.mutex.Unlock()
 
-	err = instance.UploadScript(context.TODO(), script)
-	assert.Nil(t, err)
-	assert.True(t, scriptUploaded)
+	_, err := io.WriteString(opts.OutputStream, logs)
+	if err != nil || !opts.Follow {
+		return err
+	}
+
+	<-opts.Context.Done()
+	return opts.Context.Err()
 }
 
-func TestDockerInstance_RunScript_WithNative(t *testing.T) {
-	provider, err := dockerTestSetup(t, config.ProviderConfigFromMap(map[string]string{
-		"NATIVE": "true",
-	}))
+func (c *fakeDockerClient) Stats(opts docker.StatsOptions) error {
+	c.mutex.Lock()
+	c.statsStreams = append(c.statsStreams, opts.Stream)
+	stats := c.stats
+	c.mutex.Unlock()
 
-	assert.Nil(t, err)
-	assert.NotNil(t, provider)
+	opts.Stats <- &stats
+	close(opts.Stats)
+	return nil
+}
 
-	containerID := "beabebabafabafaba0000"
-	instance := &dockerInstance{
-		client:       provider.client,
-		provider:     provider,
-		runNative:    provider.runNative,
-		container:    &docker.Container{ID: containerID},
-		imageName:    "fafafaf",
-		startBooting: time.Now(),
-	}
+func (c *fakeDockerClient) DownloadFromContainer(id string, opts docker.DownloadFromContainerOptions) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	scriptRun := false
-	writer := &bytes.Buffer{}
+	c.downloads = append(c.downloads, opts.Path)
+	if c.existing[opts.Path] {
+		return nil
+	}
+	return &docker.Error{Status: http.StatusNotFound}
+}
 
-	dockerTestMux.HandleFunc("/containers/"+containerID+"/exec", func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "POST" {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+// UploadToContainer reads the upload in small chunks, as a slow connection
+// to a remote daemon would.
+func (c *fakeDockerClient) UploadToContainer(id string, opts docker.UploadToContainerOptions) error {
+	if c.uploadWait != nil && opts.Context != nil {
+		select {
+		case <-c.uploadWait:
+		case <-opts.Context.Done():
+			c.mutex.Lock()
+			c.uploadsCancelled++
+			c.mutex.Unlock()
+			return opts.Context.Err()
 		}
+	} else if c.uploadWait != nil {
+		<-c.uploadWait
+	}
 
-		w.WriteHeader(http.StatusCreated)
-		fmt.Fprintf(w, `{"ID":"ffbada"}`)
-	})
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	dockerTestMux.HandleFunc("/exec/ffbada/start", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	buf := make([]byte, 512)
+	for {
+		n, err := opts.InputStream.Read(buf)
+		c.uploaded = append(c.uploaded, buf[:n]...)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
 
-	dockerTestMux.HandleFunc("/exec/ffbada/json", func(w http.ResponseWriter, req *http.Request) {
-		scriptRun = true
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"ExitCode":0,"Running":false}`)
-	})
+func (c *fakeDockerClient) WaitContainerWithContext(id string, ctx context.Context) (int, error) {
+	for {
+		c.mutex.Lock()
+		container, ok := c.containers[id]
+		var state docker.State
+		if ok {
+			state = container.State
+		}
+		c.mutex.Unlock()
 
-	dockerTestMux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		t.Logf("got: %s %s", req.Method, req.URL.Path)
-	})
+		if !ok {
+			return 0, &docker.NoSuchContainer{ID: id}
+		}
+		if !state.Running {
+			return state.ExitCode, nil
+		}
 
-	res, err := instance.RunScript(context.TODO(), writer)
-	assert.NotNil(t, res)
-	assert.Nil(t, err)
-	assert.True(t, scriptRun)
-	assert.True(t, res.Completed)
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
 }
 
-func TestDockerInstance_Stop(t *testing.T) {
-	provider, err := dockerTestSetup(t, nil)
+func (c *fakeDockerClient) InspectExec(id string) (*docker.ExecInspect, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	assert.Nil(t, err)
-	assert.NotNil(t, provider)
+	c.inspectExecs++
+	if len(c.inspectExecErrs) > 0 {
+		err := c.inspectExecErrs[0]
+		c.inspectExecErrs = c.inspectExecErrs[1:]
+		return nil, err
+	}
+	if c.inspectExecErr != nil {
+		return nil, c.inspectExecErr
+	}
 
-	containerID := "beabebabafabafaba0000"
-	instance := &dockerInstance{
-		client:    provider.client,
-		provider:  provider,
-		runNative: provider.runNative,
-		container: &docker.Container{ID: containerID,
-			Config: &docker.Config{
-				CPUSet: "0,1",
-			},
-		},
-		imageName:    "fafafaf",
-		startBooting: time.Now(),
+	done := c.execsDone[id]
+	exitCode, ok := c.execExits[id]
+	if !ok {
+		exitCode = c.execExitCode
 	}
 
-	wasDeleted := false
+	return &docker.ExecInspect{ID: id, Running: !done || c.execRunning, ExitCode: exitCode}, nil
+}
 
-	dockerTestMux.HandleFunc("/containers/"+containerID+"/stop", func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "POST" {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+// dockerTestNewProvider creates a provider from cfg whose endpoint is served
+// by a fake client.
+func dockerTestNewProvider(cfg map[string]string) (*dockerProvider, *fakeDockerClient, error) {
+	if cfg == nil {
+		cfg = map[string]string{}
+	}
+	defaultDockerNumCPUer = &fakeDockerNumCPUer{}
+	defer func() { defaultDockerNumCPUer = &stdlibNumCPUer{} }()
 
-		w.WriteHeader(http.StatusOK)
-	})
+	providerConfig := config.ProviderConfigFromMap(cfg)
+	providerConfig.Set("ENDPOINT", "tcp://fake.example.com:2375")
 
-	dockerTestMux.HandleFunc("/containers/"+containerID, func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "DELETE" {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
+	p, err := newDockerProvider(providerConfig)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		wasDeleted = true
-		w.WriteHeader(http.StatusNoContent)
-	})
+	client := newFakeDockerClient()
+	provider := p.(*dockerProvider)
+	provider.client = client
+	provider.clients = []dockerClient{client}
+	if _, ok := provider.imageSelector.(*dockerTagImageSelector); ok {
+		provider.imageSelector = &dockerTagImageSelector{clients: []dockerClient{client}}
+	}
 
-	dockerTestMux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		t.Logf("got: %s %s", req.Method, req.URL.Path)
-	})
+	return provider, client, nil
+}
 
-	err = instance.Stop(context.TODO())
-	assert.Nil(t, err)
-	assert.True(t, wasDeleted)
+func dockerTestFakeSetup(t *testing.T, cfg map[string]string) (*dockerProvider, *fakeDockerClient) {
+	provider, client, err := dockerTestNewProvider(cfg)
+	if err != nil {
+		t.Fatalf("couldn't create provider: %v", err)
+	}
+	return provider, client
 }
 
-func TestDockerInstance_StartupDuration(t *testing.T) {
-	provider, err := dockerTestSetup(t, nil)
+func TestDockerProvider_Setup(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, nil)
+	provider.Setup(context.TODO())
+}
 
-	assert.Nil(t, err)
-	assert.NotNil(t, provider)
+func TestDockerInstance_StartupDuration(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
 
 	now := time.Now()
 	containerID := "beabebabafabafaba0000"
 
 	instance := &dockerInstance{
-		client:    provider.client,
+		client:    client,
 		provider:  provider,
 		runNative: provider.runNative,
 		container: &docker.Container{
@@ -491,16 +710,13 @@ func TestDockerInstance_StartupDuration(t *testing.T) {
 }
 
 func TestDockerInstance_ID(t *testing.T) {
-	provider, err := dockerTestSetup(t, nil)
-
-	assert.Nil(t, err)
-	assert.NotNil(t, provider)
+	provider, client := dockerTestFakeSetup(t, nil)
 
 	now := time.Now()
 	containerID := "beabebabafabafaba0000"
 
 	instance := &dockerInstance{
-		client:       provider.client,
+		client:       client,
 		provider:     provider,
 		runNative:    provider.runNative,
 		container:    &docker.Container{ID: containerID},
@@ -513,3 +729,320 @@ func TestDockerInstance_ID(t *testing.T) {
 	instance.container = nil
 	assert.Equal(t, "{unidentified}", instance.ID())
 }
+
+func TestDockerInstance_Refresh(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	i, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	instance := i.(*dockerInstance)
+
+	// the inspection doesn't have the cpu set of the container
+	client.onInspect = func(container *docker.Container) {
+		container.NetworkSettings = &docker.NetworkSettings{IPAddress: "172.17.0.4"}
+		container.Config = &docker.Config{}
+		container.HostConfig = &docker.HostConfig{}
+	}
+
+	container := instance.container
+
+	err = instance.Refresh(context.TODO())
+	assert.Nil(t, err)
+	assert.True(t, container == instance.container)
+	assert.True(t, instance.container.State.Running)
+	assert.Equal(t, "172.17.0.4", instance.container.NetworkSettings.IPAddress)
+	assert.Equal(t, "0,1", instance.container.Config.CPUSet)
+	assert.Equal(t, "0,1", instance.container.HostConfig.CPUSet)
+}
+
+func TestDockerInstance_Refresh_WhileInUse(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+	client.onInspect = func(container *docker.Container) {
+		container.NetworkSettings = &docker.NetworkSettings{IPAddress: "172.17.0.2"}
+	}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, instance.(*dockerInstance).Refresh(context.TODO()))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, "172.17.0.2", instance.(*dockerInstance).ipAddress())
+		assert.NotEmpty(t, instance.(*dockerInstance).DebugInfo()["container_id"])
+	}
+	<-done
+
+	assert.Nil(t, instance.Stop(context.TODO()))
+}
+
+func TestDockerInstance_DebugInfo(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	i, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	instance := i.(*dockerInstance)
+
+	client.onInspect = func(container *docker.Container) {
+		container.NetworkSettings = &docker.NetworkSettings{IPAddress: "172.17.0.4"}
+		container.HostConfig.NetworkMode = "bridge"
+	}
+
+	info := instance.DebugInfo()
+	for _, key := range []string{"container_id", "image", "cpuset", "daemon_version", "state", "ip_address", "network_mode", "created", "started_at", "finished_at", "startup_duration", "exit_code", "oom_killed"} {
+		assert.Contains(t, info, key)
+	}
+	assert.NotContains(t, info, "inspect_error")
+	assert.Equal(t, instance.container.ID, info["container_id"])
+	assert.Equal(t, "travis:jvm", info["image"])
+	assert.Equal(t, "0,1", info["cpuset"])
+	assert.Equal(t, "running", info["state"])
+	assert.Equal(t, "172.17.0.4", info["ip_address"])
+	assert.Equal(t, "bridge", info["network_mode"])
+}
+
+func TestDockerInstance_DebugInfo_WithInspectError(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	i, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	instance := i.(*dockerInstance)
+
+	// the container is gone from the daemon
+	id := instance.container.ID
+	delete(client.containers, id)
+
+	info := instance.DebugInfo()
+	assert.Contains(t, info, "inspect_error")
+	assert.Equal(t, id, info["container_id"])
+	assert.Equal(t, "unknown", info["state"])
+}
+
+func TestDockerInstance_WatchEvents(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	containerID := instance.(*dockerInstance).container.ID
+
+	client.events = []*docker.APIEvents{
+		{Status: "die", ID: "cafecafecafe", Type: "container", Action: "die", Actor: docker.APIActor{ID: "cafecafecafe"}, Time: 1507000000},
+		{Status: "oom", ID: containerID, Type: "container", Action: "oom", Actor: docker.APIActor{ID: containerID}, Time: 1507000001},
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	events, err := instance.(*dockerInstance).WatchEvents(ctx)
+	assert.Nil(t, err)
+
+	select {
+	case event := <-events:
+		assert.Equal(t, "oom", event.Action)
+		assert.Equal(t, containerID, event.Actor.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for container event")
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for events to be closed")
+	}
+
+	client.mutex.Lock()
+	assert.Equal(t, 0, client.listeners)
+	client.mutex.Unlock()
+}
+
+func TestDockerProvider_ActiveGauge(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, nil)
+	client.stopErr = &docker.Error{Status: http.StatusInternalServerError}
+
+	gauge := gometrics.GetOrRegisterGauge("worker.vm.provider.docker.active", gometrics.DefaultRegistry)
+	gauge.Update(0)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), gauge.Value())
+
+	err = instance.Stop(context.TODO())
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(0), gauge.Value())
+}
+
+func TestDockerProvider_WithAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "worker-audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	auditLogPath := dir + "/audit.log"
+
+	provider, _ := dockerTestFakeSetup(t, map[string]string{
+		"AUDIT_LOG_PATH": auditLogPath,
+		"CONTAINER_ENV":  "GREETING=hello GITHUB_TOKEN=hunter2",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Nil(t, instance.Stop(context.TODO()))
+
+	// the audit log is written in the background
+	var records []dockerAuditRecord
+	deadline := time.Now().Add(time.Second)
+	for len(records) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+
+		content, err := ioutil.ReadFile(auditLogPath)
+		assert.Nil(t, err)
+
+		records = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			if line == "" {
+				continue
+			}
+			var record dockerAuditRecord
+			assert.Nil(t, json.Unmarshal([]byte(line), &record))
+			records = append(records, record)
+		}
+	}
+
+	if assert.Len(t, records, 2) {
+		for i, event := range []string{"start", "stop"} {
+			record := records[i]
+			assert.Equal(t, event, record.Event)
+			assert.Equal(t, "fake0001", record.Container)
+			assert.Equal(t, "travis:jvm", record.Image)
+			assert.Equal(t, "570c738990e5", record.ImageID)
+			assert.Equal(t, "0,1", record.CPUSet)
+			assert.Equal(t, "fake://docker", record.Endpoint)
+			assert.Contains(t, record.Env, "GREETING=hello")
+			assert.Contains(t, record.Env, "GITHUB_TOKEN=[REDACTED]")
+			assert.False(t, record.Time.IsZero())
+			assert.Empty(t, record.Error)
+		}
+	}
+}
+
+func TestDockerAuditLog_Record_WithFullBuffer(t *testing.T) {
+	l := &dockerAuditLog{records: make(chan *dockerAuditRecord, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		l.Record(&dockerAuditRecord{Event: "start"})
+		l.Record(&dockerAuditRecord{Event: "stop"})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Record blocked on a full buffer")
+	}
+	assert.Len(t, l.records, 1)
+}
+
+func TestRedactDockerEnv(t *testing.T) {
+	assert.Equal(t, []string{
+		"PATH=/usr/bin",
+		"AWS_SECRET_ACCESS_KEY=[REDACTED]",
+		"DB_PASSWORD=[REDACTED]",
+		"NPM_AUTH=[REDACTED]",
+		"EMPTY",
+	}, redactDockerEnv([]string{
+		"PATH=/usr/bin",
+		"AWS_SECRET_ACCESS_KEY=abc",
+		"DB_PASSWORD=abc",
+		"NPM_AUTH=abc",
+		"EMPTY",
+	}))
+}
+
+func TestDockerProvider_Drain(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- provider.Drain(context.TODO())
+	}()
+
+	// new instances are refused while draining
+	for !provider.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Equal(t, ErrProviderDraining, errors.Cause(err))
+	assert.Equal(t, FailureReschedule, err.(*StartError).Class)
+
+	select {
+	case <-drained:
+		t.Fatal("Drain returned with an active instance")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	assert.Nil(t, instance.Stop(context.TODO()))
+
+	select {
+	case err := <-drained:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Drain didn't return after the instance stopped")
+	}
+}
+
+func TestDockerProvider_Drain_WithoutInstances(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{})
+
+	assert.Nil(t, provider.Drain(context.TODO()))
+}
+
+func TestDockerProvider_Drain_WithTimeout(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{})
+
+	_, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+
+	err = provider.Drain(ctx)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+}
+
+func TestDockerProvider_Setup_DetectsDaemonVersion(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"CPUS": "1",
+	})
+	client.version = "17.09.0-ce"
+
+	err := provider.Setup(context.TODO())
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		assert.Equal(t, "17.09.0-ce", instance.(*dockerInstance).DebugInfo()["daemon_version"])
+	}
+
+	assert.Equal(t, 1, client.versionCalls)
+}
+
+func TestDockerProvider_Setup_WithDaemonVersionError(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{})
+
+	err := provider.Setup(context.TODO())
+	assert.Nil(t, err)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", instance.(*dockerInstance).DebugInfo()["daemon_version"])
+	assert.Equal(t, 1, client.versionCalls)
+}
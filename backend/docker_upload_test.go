@@ -0,0 +1,362 @@
+package backend
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDockerInstance_UploadScript_WithNative(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE": "true",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	script := []byte("#!/bin/bash\necho hai\n")
+	err = instance.UploadScript(context.TODO(), script)
+	assert.Nil(t, err)
+
+	tr := tar.NewReader(bytes.NewReader(client.uploaded))
+	hdr, err := tr.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "/home/travis/build.sh", hdr.Name)
+	assert.Equal(t, int64(len(script)), hdr.Size)
+	assert.Equal(t, int64(0755), hdr.Mode)
+
+	buf, err := ioutil.ReadAll(tr)
+	assert.Nil(t, err)
+	assert.Equal(t, script, buf)
+}
+
+func TestDockerScriptEnvCmd(t *testing.T) {
+	assert.Equal(t, []string{
+		"bash", "-c",
+		`echo "$TRAVIS_WORKER_BUILD_SCRIPT" | base64 -d >/home/travis/build.sh && chmod 0755 /home/travis/build.sh && exec bash /home/travis/build.sh`,
+	}, dockerScriptEnvCmd("/home/travis/build.sh", []string{"bash", "/home/travis/build.sh"}))
+}
+
+func TestDockerInstance_UploadScript_WithScriptViaEnv(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":                  "true",
+		"SCRIPT_VIA_ENV":          "true",
+		"SCRIPT_VIA_ENV_MAX_SIZE": "32B",
+	})
+	assert.Equal(t, uint64(32), provider.scriptViaEnvMaxSize)
+
+	i, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	instance := i.(*dockerInstance)
+
+	script := []byte("#!/bin/bash\necho hai\n")
+	err = instance.UploadScript(context.TODO(), script)
+	assert.Nil(t, err)
+	assert.Empty(t, client.uploaded)
+	assert.Empty(t, client.downloads)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(script), instance.scriptEnv)
+
+	_, err = instance.RunScript(context.TODO(), &bytes.Buffer{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"TRAVIS_WORKER_BUILD_SCRIPT=" + instance.scriptEnv}, client.execEnvs[len(client.execEnvs)-1])
+	assert.Equal(t, dockerScriptEnvCmd("/home/travis/build.sh", provider.execCmd), client.execCmds[len(client.execCmds)-1])
+
+	// scripts over the size cap are uploaded as usual
+	instance.scriptEnv = ""
+	err = instance.UploadScript(context.TODO(), bytes.Repeat([]byte("#"), 33))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, client.downloads)
+	assert.NotEmpty(t, client.uploaded)
+	assert.Equal(t, "", instance.scriptEnv)
+}
+
+func TestDockerInstance_UploadScript_WithUploadCompress(t *testing.T) {
+	script := []byte("#!/bin/bash\n" + strings.Repeat("echo hai\n", 1000))
+	uploads := map[string][]byte{}
+
+	for _, compress := range []string{"false", "true"} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"NATIVE":          "true",
+			"UPLOAD_COMPRESS": compress,
+		})
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		err = instance.UploadScript(context.TODO(), script)
+		assert.Nil(t, err)
+		if compress == "true" {
+			assert.True(t, len(client.uploaded) < len(script))
+		}
+
+		var r io.Reader = bytes.NewReader(client.uploaded)
+		if compress == "true" {
+			r, err = gzip.NewReader(r)
+			assert.Nil(t, err)
+		}
+
+		tr := tar.NewReader(r)
+		hdr, err := tr.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, "/home/travis/build.sh", hdr.Name)
+		assert.Equal(t, int64(0755), hdr.Mode)
+
+		uploads[compress], err = ioutil.ReadAll(tr)
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, script, uploads["false"])
+	assert.Equal(t, uploads["false"], uploads["true"])
+}
+
+func TestDockerInstance_RunScript_WithScriptViaStdin(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":           "true",
+		"SCRIPT_VIA_STDIN": "true",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	script := []byte("#!/bin/bash\necho hai\n")
+	err = instance.UploadScript(context.TODO(), script)
+	assert.Nil(t, err)
+
+	// the script is neither checked for nor uploaded
+	assert.Empty(t, client.downloads)
+	assert.Empty(t, client.uploaded)
+
+	res, err := instance.RunScript(context.TODO(), &bytes.Buffer{})
+	assert.Nil(t, err)
+	assert.True(t, res.Completed)
+
+	assert.Equal(t, []bool{false}, client.execTtys)
+	assert.Equal(t, [][]string{dockerScriptStdinCmd("/home/travis/build.sh", provider.execCmd)}, client.execCmds)
+	assert.Equal(t, [][]byte{script}, client.execStdins)
+}
+
+func TestDockerProgressReader(t *testing.T) {
+	reports := []int64{}
+	pr := &dockerProgressReader{
+		r:           bytes.NewReader(make([]byte, 2500)),
+		reportEvery: 1000,
+		report: func(n int64) {
+			reports = append(reports, n)
+		},
+	}
+
+	buf := make([]byte, 300)
+	total := 0
+	for {
+		n, err := pr.Read(buf)
+		total += n
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 2500, total)
+	assert.Equal(t, []int64{1200, 2400, 2500}, reports)
+}
+
+func TestDockerInstance_UploadScript_WithUploadProgressInterval(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":                   "true",
+		"UPLOAD_PROGRESS_INTERVAL": "1KiB",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	gauge := gometrics.GetOrRegisterGauge("worker.vm.provider.docker.upload.bytes", gometrics.DefaultRegistry)
+	gauge.Update(0)
+
+	script := []byte("#!/bin/bash\n" + strings.Repeat("echo hai\n", 1000))
+	err = instance.UploadScript(context.TODO(), script)
+	assert.Nil(t, err)
+
+	assert.True(t, len(client.uploaded) > len(script))
+	assert.Equal(t, int64(len(client.uploaded)), gauge.Value())
+
+	tr := tar.NewReader(bytes.NewReader(client.uploaded))
+	hdr, err := tr.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "/home/travis/build.sh", hdr.Name)
+}
+
+func TestWriteDockerScriptTar(t *testing.T) {
+	script := []byte("echo hello\n")
+
+	buf := &bytes.Buffer{}
+	err := writeDockerScriptTar(tar.NewWriter(buf), "/home/travis/build.sh", int64(len(script)), script)
+	assert.Nil(t, err)
+
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "/home/travis/build.sh", hdr.Name)
+	content, err := ioutil.ReadAll(tr)
+	assert.Nil(t, err)
+	assert.Equal(t, script, content)
+}
+
+func TestWriteDockerScriptTar_WithMismatchedSize(t *testing.T) {
+	script := []byte("echo hello\n")
+
+	for _, size := range []int64{int64(len(script)) - 1, int64(len(script)) + 1} {
+		err := writeDockerScriptTar(tar.NewWriter(ioutil.Discard), "/home/travis/build.sh", size, script)
+		if assert.NotNil(t, err, "size %d", size) {
+			assert.Contains(t, err.Error(), fmt.Sprintf("header size %d", size))
+		}
+	}
+}
+
+func TestDockerInstance_UploadScript_WithUploadTimeoutNative(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"NATIVE":         "true",
+		"UPLOAD_TIMEOUT": "50ms",
+	})
+	assert.Equal(t, 50*time.Millisecond, provider.uploadTimeout)
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	client.uploadWait = make(chan struct{})
+	defer close(client.uploadWait)
+
+	err = instance.UploadScript(context.TODO(), []byte("#!/bin/bash\necho hai\n"))
+	assert.Equal(t, errDockerUploadTimeout, errors.Cause(err))
+
+	// the timed out upload is cancelled rather than left running
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		client.mutex.Lock()
+		cancelled := client.uploadsCancelled
+		client.mutex.Unlock()
+		if cancelled > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	client.mutex.Lock()
+	assert.Equal(t, 1, client.uploadsCancelled)
+	assert.Empty(t, client.uploaded)
+	client.mutex.Unlock()
+
+	// the worker's own deadline isn't reported as an upload timeout
+	provider.uploadTimeout = time.Hour
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Millisecond)
+	defer cancel()
+
+	err = instance.UploadScript(ctx, []byte("#!/bin/bash\necho hai\n"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestDockerInstance_UploadScript_WithUploadTimeoutSSH(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"UPLOAD_TIMEOUT": "50ms",
+	})
+	dialer := &fakeDockerSSHDialer{uploadWait: make(chan struct{})}
+	defer close(dialer.uploadWait)
+	provider.sshDialer = dialer
+	client.onInspect = func(container *docker.Container) {
+		container.NetworkSettings = &docker.NetworkSettings{IPAddress: "172.17.0.2"}
+	}
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	err = instance.UploadScript(context.TODO(), []byte("#!/bin/bash\necho hai\n"))
+	assert.Equal(t, errDockerUploadTimeout, errors.Cause(err))
+}
+
+func TestDockerInstance_UploadScriptViaConn_WithCancel(t *testing.T) {
+	provider, _ := dockerTestFakeSetup(t, map[string]string{})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+
+	uploadWait := make(chan struct{})
+	defer close(uploadWait)
+	conn := &fakeDockerSSHConnection{uploadWait: uploadWait, closed: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	// the stuck upload is stopped by closing its connection
+	err = instance.(*dockerInstance).uploadScriptViaConn(ctx, conn, []byte("#!/bin/bash\necho hai\n"))
+	assert.NotNil(t, err)
+	select {
+	case <-conn.closed:
+	default:
+		t.Error("connection wasn't closed")
+	}
+}
+
+func TestDockerProvider_WithInvalidUploadTimeout(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"UPLOAD_TIMEOUT": "soon",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestDockerInstance_UploadScriptViaConn_WithExistingScript(t *testing.T) {
+	for _, tc := range []struct {
+		cfg      map[string]string
+		err      error
+		script   string
+		commands []string
+	}{
+		{cfg: map[string]string{}, err: ErrStaleVM, script: "old"},
+		{cfg: map[string]string{"ALLOW_SCRIPT_OVERWRITE": "true"}, script: "new", commands: []string{"rm -f build.sh"}},
+	} {
+		provider, _ := dockerTestFakeSetup(t, tc.cfg)
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+
+		conn := &fakeDockerSSHConnection{files: map[string][]byte{"build.sh": []byte("old")}}
+		err = instance.(*dockerInstance).uploadScriptViaConn(context.TODO(), conn, []byte("new"))
+		assert.Equal(t, tc.err, errors.Cause(err))
+		assert.Equal(t, tc.script, string(conn.files["build.sh"]))
+		assert.Equal(t, tc.commands, conn.commands)
+	}
+}
+
+func TestDockerInstance_UploadScript_WithExistingScriptNative(t *testing.T) {
+	for _, tc := range []struct {
+		cfg      map[string]string
+		err      error
+		uploaded bool
+	}{
+		{cfg: map[string]string{"NATIVE": "true"}, err: ErrStaleVM},
+		{cfg: map[string]string{"NATIVE": "true", "ALLOW_SCRIPT_OVERWRITE": "true"}, uploaded: true},
+	} {
+		provider, client := dockerTestFakeSetup(t, tc.cfg)
+		client.existing = map[string]bool{"/home/travis/build.sh": true}
+
+		instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+		assert.Nil(t, err)
+		client.uploaded = nil
+
+		err = instance.UploadScript(context.TODO(), []byte("#!/bin/bash\necho hai\n"))
+		assert.Equal(t, tc.err, err)
+		assert.Equal(t, tc.uploaded, len(client.uploaded) > 0)
+	}
+}
@@ -0,0 +1,272 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	workerctx "github.com/travis-ci/worker/context"
+)
+
+func TestNewDockerProvider_WithWarmPoolSizeWithoutImage(t *testing.T) {
+	provider, _, err := dockerTestNewProvider(map[string]string{
+		"WARM_POOL_SIZE": "2",
+	})
+
+	assert.NotNil(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestDockerProvider_Start_WithWarmPool(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"WARM_POOL_SIZE":  "1",
+		"WARM_POOL_IMAGE": "travis:jvm",
+		"CPU_SET_SIZE":    "8",
+		"CPUS":            "1",
+	})
+
+	createdCount := func() int {
+		client.mutex.Lock()
+		defer client.mutex.Unlock()
+		return len(client.created)
+	}
+
+	poolSize := func() int {
+		provider.warmPoolMutex.Lock()
+		defer provider.warmPoolMutex.Unlock()
+		return len(provider.warmPool)
+	}
+
+	// the pool fills in the background
+	err := provider.Setup(context.TODO())
+	assert.Nil(t, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for poolSize() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, createdCount())
+	assert.Equal(t, 1, poolSize())
+	assert.Len(t, provider.Instances(), 0)
+
+	// pool hit
+	instance, err := provider.Start(context.TODO(), &StartAttributes{ImageName: "travis:jvm"})
+	assert.Nil(t, err)
+	assert.NotNil(t, instance)
+	assert.Len(t, provider.Instances(), 1)
+
+	// replenishment
+	deadline = time.Now().Add(5 * time.Second)
+	for createdCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2, createdCount())
+
+	for poolSize() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, poolSize())
+
+	// pool miss for a different image
+	_, err = provider.Start(context.TODO(), &StartAttributes{ImageName: "travis:ruby"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, createdCount())
+	assert.Equal(t, 1, poolSize())
+
+	// pool miss when empty
+	assert.NotNil(t, provider.takeWarmInstance(logrus.NewEntry(logrus.StandardLogger())))
+	assert.Nil(t, provider.takeWarmInstance(logrus.NewEntry(logrus.StandardLogger())))
+
+	_, err = provider.Start(context.TODO(), &StartAttributes{ImageName: "travis:jvm"})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, createdCount())
+}
+
+func TestDockerProvider_FillWarmPool_WithMaxConcurrentStarts(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"MAX_CONCURRENT_STARTS": "1",
+		"WARM_POOL_SIZE":        "1",
+		"WARM_POOL_IMAGE":       "travis:jvm",
+	})
+	provider.startSlots <- struct{}{}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+
+	provider.fillWarmPool(ctx)
+	assert.Empty(t, client.created)
+	assert.Empty(t, provider.warmPool)
+
+	<-provider.startSlots
+	provider.fillWarmPool(context.TODO())
+	assert.Len(t, client.created, 1)
+	assert.Len(t, provider.warmPool, 1)
+	assert.Len(t, provider.startSlots, 0)
+}
+
+func TestDockerProvider_Start_WithWarmPoolForJob(t *testing.T) {
+	for _, tc := range []struct {
+		attrs     StartAttributes
+		renameErr error
+		warm      bool
+	}{
+		{StartAttributes{ImageName: "travis:jvm"}, nil, true},
+		// labels can't be added to the warm container
+		{StartAttributes{ImageName: "travis:jvm", Repository: "travis-ci/worker"}, nil, false},
+		// the name is held by a container of an earlier attempt
+		{StartAttributes{ImageName: "travis:jvm"}, &docker.Error{Status: http.StatusConflict}, false},
+	} {
+		provider, client := dockerTestFakeSetup(t, map[string]string{
+			"WARM_POOL_SIZE":  "1",
+			"WARM_POOL_IMAGE": "travis:jvm",
+			"CPUS":            "1",
+		})
+		client.renameErr = tc.renameErr
+
+		provider.fillWarmPool(context.TODO())
+		assert.Len(t, provider.warmPool, 1)
+		warmID := provider.warmPool[0].container.ID
+
+		ctx := workerctx.FromJobID(context.TODO(), 42)
+		instance, err := provider.Start(ctx, &tc.attrs)
+		assert.Nil(t, err)
+
+		id := instance.(*dockerInstance).container.ID
+		assert.Equal(t, tc.warm, id == warmID, "%+v", tc)
+
+		client.mutex.Lock()
+		if tc.warm {
+			assert.Equal(t, "travis-job-42", client.renamed[id])
+			assert.Equal(t, "/travis-job-42", instance.(*dockerInstance).container.Name)
+		} else {
+			assert.Empty(t, client.renamed)
+			names := []string{}
+			for _, opts := range client.created {
+				names = append(names, opts.Name)
+			}
+			assert.Contains(t, names, "travis-job-42")
+		}
+		client.mutex.Unlock()
+	}
+}
+
+func TestDockerProvider_Drain_WaitsForWarmBoot(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"WARM_POOL_SIZE":  "1",
+		"WARM_POOL_IMAGE": "travis:jvm",
+	})
+
+	booting := make(chan struct{})
+	client.onInspect = func(container *docker.Container) {
+		<-booting
+	}
+
+	go provider.fillWarmPool(context.TODO())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		provider.instancesMutex.Lock()
+		starting := provider.starting
+		provider.instancesMutex.Unlock()
+		if starting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	drained := make(chan error, 1)
+	go func() { drained <- provider.Drain(context.TODO()) }()
+
+	select {
+	case <-drained:
+		t.Fatal("drained while a warm container was booting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(booting)
+	assert.Nil(t, <-drained)
+
+	provider.warmPoolMutex.Lock()
+	defer provider.warmPoolMutex.Unlock()
+	assert.Empty(t, provider.warmPool)
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	assert.Empty(t, client.containers)
+}
+
+func TestDockerProvider_TakeWarmInstance_WithMaxInstanceLifetime(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"MAX_INSTANCE_LIFETIME": "1h",
+		"CPUS":                  "1",
+	})
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	instance.(*dockerInstance).lifetimeTimer.Stop()
+
+	instance.(*dockerInstance).startBooting = time.Now().Add(-20 * time.Minute)
+	provider.warmPool = []*dockerInstance{instance.(*dockerInstance)}
+	assert.Equal(t, instance, provider.takeWarmInstance(logger))
+
+	// with less than half of its lifetime left, a warm instance isn't handed
+	// out, let alone one that outlived it
+	instance.(*dockerInstance).startBooting = time.Now().Add(-40 * time.Minute)
+	provider.warmPool = []*dockerInstance{instance.(*dockerInstance)}
+	assert.Nil(t, provider.takeWarmInstance(logger))
+
+	other, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	other.(*dockerInstance).lifetimeTimer.Stop()
+
+	other.(*dockerInstance).startBooting = time.Now().Add(-2 * time.Hour)
+	provider.warmPool = []*dockerInstance{other.(*dockerInstance)}
+	assert.Nil(t, provider.takeWarmInstance(logger))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		client.mutex.Lock()
+		removed := len(client.removed)
+		client.mutex.Unlock()
+		if removed == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.mutex.Lock()
+	assert.Len(t, client.removed, 2)
+	client.mutex.Unlock()
+}
+
+func TestDockerProvider_ActivateInstance_StartsLifetimeAtBoot(t *testing.T) {
+	provider, client := dockerTestFakeSetup(t, map[string]string{
+		"MAX_INSTANCE_LIFETIME": "1h",
+	})
+
+	instance, err := provider.Start(context.TODO(), &StartAttributes{Language: "jvm"})
+	assert.Nil(t, err)
+	instance.(*dockerInstance).lifetimeTimer.Stop()
+
+	// an instance that booted almost an hour ago only has a moment left
+	instance.(*dockerInstance).startBooting = time.Now().Add(-time.Hour + 50*time.Millisecond)
+	provider.activateInstance(logrus.NewEntry(logrus.StandardLogger()), instance.(*dockerInstance))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		client.mutex.Lock()
+		removed := len(client.removed)
+		client.mutex.Unlock()
+		if removed == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.mutex.Lock()
+	assert.Len(t, client.removed, 1)
+	client.mutex.Unlock()
+}
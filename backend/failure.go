@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+)
+
+// FailureClass tells the scheduler how to react to an instance failing to
+// start.
+type FailureClass int
+
+const (
+	// FailureUnknown is used for errors that aren't recognized.
+	FailureUnknown FailureClass = iota
+
+	// FailureRetry means the error is likely transient, so starting the
+	// instance again on the same host may succeed.
+	FailureRetry
+
+	// FailureReschedule means the host is unable to start the instance, e.g.
+	// because it ran out of resources, so the job should go to another host.
+	FailureReschedule
+
+	// FailureFail means the job can't be started anywhere as requested,
+	// e.g. because its image doesn't exist.
+	FailureFail
+)
+
+func (c FailureClass) String() string {
+	switch c {
+	case FailureRetry:
+		return "retry"
+	case FailureReschedule:
+		return "reschedule"
+	case FailureFail:
+		return "fail"
+	default:
+		return "unknown"
+	}
+}
+
+// StartError is returned from Provider.Start with the class of the
+// underlying error.
+type StartError struct {
+	Class FailureClass
+	Err   error
+}
+
+func (e *StartError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error, so that errors.Cause sees through the
+// StartError.
+func (e *StartError) Cause() error {
+	return e.Err
+}
+
+// ClassifyStartError maps common errors from starting an instance to a
+// FailureClass.
+func ClassifyStartError(err error) FailureClass {
+	if err == nil {
+		return FailureUnknown
+	}
+
+	if startErr, ok := err.(*StartError); ok {
+		return startErr.Class
+	}
+
+	cause := errors.Cause(err)
+	switch cause {
+	case ErrImageNotFound, docker.ErrNoSuchImage:
+		return FailureFail
+	case ErrProviderDraining:
+		return FailureReschedule
+	case docker.ErrConnectionRefused, context.DeadlineExceeded:
+		return FailureRetry
+	}
+
+	if netErr, ok := cause.(net.Error); ok && netErr.Timeout() {
+		return FailureRetry
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "no space left on device"):
+		return FailureReschedule
+	case strings.Contains(msg, "connection refused"):
+		return FailureRetry
+	}
+
+	return FailureUnknown
+}
@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func TestClassifyStartError(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class FailureClass
+	}{
+		{nil, FailureUnknown},
+		{fmt.Errorf("something else"), FailureUnknown},
+		{ErrImageNotFound, FailureFail},
+		{errors.Wrap(ErrImageNotFound, "image selector returned no image"), FailureFail},
+		{docker.ErrNoSuchImage, FailureFail},
+		{fmt.Errorf("write /var/lib/docker/tmp: no space left on device"), FailureReschedule},
+		{ErrProviderDraining, FailureReschedule},
+		{docker.ErrConnectionRefused, FailureRetry},
+		{fmt.Errorf("dial unix /var/run/docker.sock: connect: connection refused"), FailureRetry},
+		{context.DeadlineExceeded, FailureRetry},
+		{errors.Wrap(context.DeadlineExceeded, "boot timed out"), FailureRetry},
+		{&timeoutError{}, FailureRetry},
+		{&StartError{Class: FailureReschedule, Err: fmt.Errorf("busy")}, FailureReschedule},
+	} {
+		assert.Equal(t, tc.class, ClassifyStartError(tc.err), fmt.Sprintf("%v", tc.err))
+	}
+}
+
+func TestStartError(t *testing.T) {
+	err := &StartError{Class: FailureFail, Err: errors.Wrap(ErrImageNotFound, "no image for language \"jvm\"")}
+	assert.Equal(t, "no image for language \"jvm\": no image found", err.Error())
+	assert.Equal(t, ErrImageNotFound, errors.Cause(err))
+	assert.Equal(t, "fail", err.Class.String())
+}
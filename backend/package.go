@@ -46,6 +46,14 @@ var (
 	// an 'ENDPOINT' configuration, but one is required.
 	ErrMissingEndpointConfig = fmt.Errorf("expected config key endpoint")
 
+	// ErrImageNotFound is returned from Provider.Start if no image could be
+	// selected for the given start attributes.
+	ErrImageNotFound = fmt.Errorf("no image found")
+
+	// ErrProviderDraining is returned from Provider.Start if the provider is
+	// being drained before shutdown.
+	ErrProviderDraining = fmt.Errorf("provider is draining")
+
 	zeroDuration time.Duration
 )
 
@@ -90,6 +98,22 @@ type RunResult struct {
 	// Whether the script finished running or not. Can be false if there was a
 	// connection error in the middle of the script run.
 	Completed bool
+
+	// Summary of the script run, if the backend provides one.
+	Summary *RunSummary
+}
+
+// RunSummary contains timing and resource information about a script run,
+// meant to be serialized to JSON for build records.
+type RunSummary struct {
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	ExitCode      uint8     `json:"exit_code"`
+	OOMKilled     bool      `json:"oom_killed"`
+	BytesStreamed int64     `json:"bytes_streamed"`
+
+	// PeakMemoryBytes is only set if the backend sampled resource usage.
+	PeakMemoryBytes uint64 `json:"peak_memory_bytes,omitempty"`
 }
 
 func asBool(s string) bool {
@@ -5,12 +5,22 @@ import "time"
 // StartAttributes contains some parts of the config which can be used to
 // determine the type of instance to boot up (for example, what image to use)
 type StartAttributes struct {
-	Language  string `json:"language"`
-	OsxImage  string `json:"osx_image"`
-	Dist      string `json:"dist"`
-	Group     string `json:"group"`
-	OS        string `json:"os"`
-	ImageName string `json:"image_name"`
+	Language  string   `json:"language"`
+	OsxImage  string   `json:"osx_image"`
+	Dist      string   `json:"dist"`
+	Group     string   `json:"group"`
+	OS        string   `json:"os"`
+	ImageName string   `json:"image_name"`
+	ImageTags []string `json:"image_tags"`
+	Platform  string   `json:"platform"`
+
+	// MacAddress is the mac address requested by the job, e.g. for test
+	// suites licensed to it, which providers may restrict or ignore.
+	MacAddress string `json:"mac_address"`
+
+	// Tmpfs maps mount points to tmpfs mount options of extra tmpfs mounts
+	// requested by the job, which providers may restrict or ignore.
+	Tmpfs map[string]string `json:"tmpfs"`
 
 	// The VMType isn't stored in the config directly, but in the top level of
 	// the job payload, see the worker.JobPayload struct.
@@ -19,6 +29,17 @@ type StartAttributes struct {
 	// HardTimeout isn't stored in the config directly, but is injected
 	// from the processor
 	HardTimeout time.Duration `json:"-"`
+
+	// Repository, Branch and Commit aren't stored in the config directly, but
+	// in the job payload, and are empty if the payload doesn't include them.
+	Repository string `json:"-"`
+	Branch     string `json:"-"`
+	Commit     string `json:"-"`
+
+	// Secrets maps file names to contents of secrets that are made available
+	// to the build without being part of the image or environment. They are
+	// never read from or written to the config.
+	Secrets map[string]string `json:"-"`
 }
 
 // SetDefaults sets any missing required attributes to the default values provided
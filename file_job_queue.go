@@ -141,6 +141,9 @@ func (f *FileJobQueue) pollInDirTick(ctx gocontext.Context) {
 
 		buildJob.startAttributes = startAttrs.Config
 		buildJob.startAttributes.VMType = buildJob.payload.VMType
+		buildJob.startAttributes.Repository = buildJob.payload.Repository.Slug
+		buildJob.startAttributes.Branch = buildJob.payload.Job.Branch
+		buildJob.startAttributes.Commit = buildJob.payload.Job.Commit
 		buildJob.startAttributes.SetDefaults(f.DefaultLanguage, f.DefaultDist, f.DefaultGroup, f.DefaultOS, VMTypeDefault)
 		buildJob.receivedFile = filepath.Join(f.receivedDir, entry.Name())
 		buildJob.startedFile = filepath.Join(f.startedDir, entry.Name())
@@ -348,6 +348,9 @@ func (q *HTTPJobQueue) fetchJob(ctx gocontext.Context, jobID uint64) (Job, <-cha
 
 	buildJob.startAttributes = startAttrs.Data.Config
 	buildJob.startAttributes.VMType = buildJob.payload.Data.VMType
+	buildJob.startAttributes.Repository = buildJob.payload.Data.Repository.Slug
+	buildJob.startAttributes.Branch = buildJob.payload.Data.Job.Branch
+	buildJob.startAttributes.Commit = buildJob.payload.Data.Job.Commit
 	buildJob.startAttributes.SetDefaults(q.DefaultLanguage, q.DefaultDist, q.DefaultGroup, q.DefaultOS, VMTypeDefault)
 
 	return buildJob, readyChan, nil
@@ -55,6 +55,11 @@ func (w *httpLogWriter) Write(p []byte) (int, error) {
 		return 0, fmt.Errorf("attempted write to closed log")
 	}
 
+	// Empty writes, e.g. keepalives of quiet execs, aren't log activity.
+	if len(p) == 0 {
+		return 0, nil
+	}
+
 	logger := context.LoggerFromContext(w.ctx).WithFields(logrus.Fields{
 		"self": "http_log_writer",
 		"inst": fmt.Sprintf("%p", w),
@@ -42,6 +42,20 @@ func TestHTTPLogWriter_Write(t *testing.T) {
 	assert.True(t, n > 0)
 }
 
+func TestHTTPLogWriter_Write_Empty(t *testing.T) {
+	cancel, hlw, err := buildTestHTTPLogWriter()
+	defer cancel()
+
+	assert.NotNil(t, hlw)
+
+	// empty writes aren't log activity, so they don't add a log part
+	number := hlw.logPartNumber
+	n, err := hlw.Write([]byte{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, number, hlw.logPartNumber)
+}
+
 func TestHTTPLogWriter_Write_HitsMaxLogLength(t *testing.T) {
 	cancel, hlw, err := buildTestHTTPLogWriter()
 	defer cancel()
@@ -44,6 +44,8 @@ type JobMetaPayload struct {
 type JobJobPayload struct {
 	ID       uint64     `json:"id"`
 	Number   string     `json:"number"`
+	Branch   string     `json:"branch"`
+	Commit   string     `json:"commit"`
 	QueuedAt *time.Time `json:"queued_at"`
 }
 
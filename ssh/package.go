@@ -34,6 +34,15 @@ func FormatPublicKey(key interface{}) ([]byte, error) {
 
 type AuthDialer struct {
 	authMethods []ssh.AuthMethod
+	config      ssh.Config
+}
+
+// Algorithms restricts the algorithms offered when negotiating an SSH
+// connection. Empty lists use the library defaults.
+type Algorithms struct {
+	Ciphers      []string
+	KeyExchanges []string
+	MACs         []string
 }
 
 func NewDialerWithKey(key crypto.Signer) (*AuthDialer, error) {
@@ -53,6 +62,17 @@ func NewDialerWithPassword(password string) (*AuthDialer, error) {
 	}, nil
 }
 
+func NewDialerWithPasswordAndAlgorithms(password string, algorithms Algorithms) (*AuthDialer, error) {
+	return &AuthDialer{
+		authMethods: []ssh.AuthMethod{ssh.Password(password)},
+		config: ssh.Config{
+			Ciphers:      algorithms.Ciphers,
+			KeyExchanges: algorithms.KeyExchanges,
+			MACs:         algorithms.MACs,
+		},
+	}, nil
+}
+
 func NewDialerWithKeyWithoutPassPhrase(pemBytes []byte) (*AuthDialer, error) {
 	signer, err := ssh.ParsePrivateKey(pemBytes)
 	if err != nil {
@@ -93,6 +113,7 @@ func NewDialer(keyPath, keyPassphrase string) (*AuthDialer, error) {
 
 func (d *AuthDialer) Dial(address, username string, timeout time.Duration) (Connection, error) {
 	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		Config:  d.config,
 		User:    username,
 		Auth:    d.authMethods,
 		Timeout: timeout,
@@ -0,0 +1,30 @@
+package ssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDialerWithPasswordAndAlgorithms(t *testing.T) {
+	dialer, err := NewDialerWithPasswordAndAlgorithms("travis", Algorithms{
+		Ciphers:      []string{"aes256-ctr"},
+		KeyExchanges: []string{"curve25519-sha256@libssh.org"},
+		MACs:         []string{"hmac-sha2-256"},
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, dialer.authMethods, 1)
+	assert.Equal(t, []string{"aes256-ctr"}, dialer.config.Ciphers)
+	assert.Equal(t, []string{"curve25519-sha256@libssh.org"}, dialer.config.KeyExchanges)
+	assert.Equal(t, []string{"hmac-sha2-256"}, dialer.config.MACs)
+}
+
+func TestNewDialerWithPasswordAndAlgorithms_WithDefaults(t *testing.T) {
+	dialer, err := NewDialerWithPasswordAndAlgorithms("travis", Algorithms{})
+
+	assert.Nil(t, err)
+	assert.Nil(t, dialer.config.Ciphers)
+	assert.Nil(t, dialer.config.KeyExchanges)
+	assert.Nil(t, dialer.config.MACs)
+}
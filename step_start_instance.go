@@ -32,7 +32,10 @@ func (s *stepStartInstance) Run(state multistep.StateBag) multistep.StepAction {
 
 	instance, err := s.provider.Start(ctx, buildJob.StartAttributes())
 	if err != nil {
-		logger.WithField("err", err).Error("couldn't start instance")
+		logger.WithFields(logrus.Fields{
+			"err":           err,
+			"failure_class": backend.ClassifyStartError(err),
+		}).Error("couldn't start instance")
 		context.CaptureError(ctx, err)
 
 		jobAbortErr, ok := errors.Cause(err).(workererrors.JobAbortError)